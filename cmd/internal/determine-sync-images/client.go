@@ -0,0 +1,39 @@
+package synclister
+
+import (
+	metalgo "github.com/metal-stack/metal-go"
+	"github.com/metal-stack/metal-go/api/client/image"
+	"github.com/metal-stack/metal-go/api/client/partition"
+	"github.com/metal-stack/metal-go/api/models"
+)
+
+// MetalClient lists the images and partitions to determine the entities to sync.
+type MetalClient interface {
+	ListImages() ([]*models.V1ImageResponse, error)
+	ListPartitions() ([]*models.V1PartitionResponse, error)
+}
+
+type metalAPIClient struct {
+	client metalgo.Client
+}
+
+// NewMetalAPIClient returns a client listing images and partitions from the metal-api.
+func NewMetalAPIClient(client metalgo.Client) MetalClient {
+	return &metalAPIClient{client: client}
+}
+
+func (m *metalAPIClient) ListImages() ([]*models.V1ImageResponse, error) {
+	resp, err := m.client.Image().ListImages(image.NewListImagesParams(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (m *metalAPIClient) ListPartitions() ([]*models.V1PartitionResponse, error) {
+	resp, err := m.client.Partition().ListPartitions(partition.NewListPartitionsParams(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
@@ -0,0 +1,99 @@
+package synclister
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headCache caches the results of HEAD requests against the origin in order to avoid re-probing unchanged artifacts.
+type headCache struct {
+	mu         sync.Mutex
+	defaultTTL time.Duration
+	entries    map[string]headCacheEntry
+	now        func() time.Time
+}
+
+// headResult contains the information about an artifact retrieved by a HEAD request against the origin.
+type headResult struct {
+	size         int64
+	lastModified time.Time
+	etag         string
+}
+
+type headCacheEntry struct {
+	headResult
+	expires time.Time
+}
+
+func newHeadCache(defaultTTL time.Duration) *headCache {
+	return &headCache{
+		defaultTTL: defaultTTL,
+		entries:    map[string]headCacheEntry{},
+		now:        time.Now,
+	}
+}
+
+func (h *headCache) get(url string) (headResult, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.entries[url]
+	if !ok {
+		return headResult{}, false
+	}
+
+	if !h.now().Before(e.expires) {
+		delete(h.entries, url)
+		return headResult{}, false
+	}
+
+	return e.headResult, true
+}
+
+func (h *headCache) put(url string, result headResult, header http.Header) {
+	ttl := h.ttl(header)
+	if ttl <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[url] = headCacheEntry{
+		headResult: result,
+		expires:    h.now().Add(ttl),
+	}
+}
+
+// ttl determines how long a response may be cached, preferring the cache headers sent by the origin over the default ttl.
+func (h *headCache) ttl(header http.Header) time.Duration {
+	if cc := header.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+
+			switch {
+			case directive == "no-store", directive == "no-cache":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+				if err != nil {
+					continue
+				}
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(h.now())
+	}
+
+	return h.defaultTTL
+}
@@ -0,0 +1,136 @@
+package synclister
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncLister_contentLength(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     map[string]string
+		defaultTTL time.Duration
+		wantHits   int32
+	}{
+		{
+			name:     "no cache headers and no default ttl probes every time",
+			wantHits: 2,
+		},
+		{
+			name:       "no cache headers uses default ttl",
+			defaultTTL: time.Minute,
+			wantHits:   1,
+		},
+		{
+			name:     "max-age from origin is respected",
+			header:   map[string]string{"Cache-Control": "public, max-age=60"},
+			wantHits: 1,
+		},
+		{
+			name:       "no-cache from origin overrides default ttl",
+			header:     map[string]string{"Cache-Control": "no-cache"},
+			defaultTTL: time.Minute,
+			wantHits:   2,
+		},
+		{
+			name:     "expires from origin is respected",
+			header:   map[string]string{"Expires": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+			wantHits: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.Header().Set("Content-Length", "4")
+			}))
+			defer ts.Close()
+
+			s := &SyncLister{
+				stop:       context.TODO(),
+				httpClient: http.DefaultClient,
+				headCache:  newHeadCache(tt.defaultTTL),
+			}
+
+			for i := 0; i < 2; i++ {
+				size, err := s.contentLength(ts.URL + "/kernel")
+				require.NoError(t, err)
+				assert.Equal(t, int64(4), size)
+			}
+
+			assert.Equal(t, tt.wantHits, hits.Load())
+		})
+	}
+}
+
+func TestSyncLister_headLastModified(t *testing.T) {
+	lastModified := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/kernel" {
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		w.Header().Set("Content-Length", "4")
+	}))
+	defer ts.Close()
+
+	s := &SyncLister{
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+		headCache:  newHeadCache(time.Minute),
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := s.head(ts.URL + "/kernel")
+		require.NoError(t, err)
+		assert.Equal(t, headResult{size: 4, lastModified: lastModified}, got)
+	}
+
+	got, err := s.head(ts.URL + "/boot-image")
+	require.NoError(t, err)
+	assert.True(t, got.lastModified.IsZero())
+}
+
+func TestSyncLister_headETag(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/kernel":
+			w.Header().Set("ETag", `"0cbc6611f5540bd0809a388dc95a615b"`)
+		case "/weak":
+			w.Header().Set("ETag", `W/"0cbc6611f5540bd0809a388dc95a615b"`)
+		}
+		w.Header().Set("Content-Length", "4")
+	}))
+	defer ts.Close()
+
+	s := &SyncLister{
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+		headCache:  newHeadCache(time.Minute),
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := s.head(ts.URL + "/kernel")
+		require.NoError(t, err)
+		assert.Equal(t, "0cbc6611f5540bd0809a388dc95a615b", got.etag)
+	}
+	assert.Equal(t, int32(1), hits.Load())
+
+	got, err := s.head(ts.URL + "/weak")
+	require.NoError(t, err)
+	assert.Empty(t, got.etag)
+}
@@ -2,35 +2,42 @@ package synclister
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
-	metalgo "github.com/metal-stack/metal-go"
-	"github.com/metal-stack/metal-go/api/client/image"
-	"github.com/metal-stack/metal-go/api/client/partition"
 	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
 	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
 	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
 )
 
+// errImageChecksumMissing is returned if neither a md5 nor a sha256 checksum exists for an image
+var errImageChecksumMissing = errors.New("image checksum does not exist")
+
 type SyncLister struct {
 	logger         *slog.Logger
-	client         metalgo.Client
+	client         MetalClient
 	config         *api.Config
 	s3             *s3.S3
 	stop           context.Context
 	imageCollector *metrics.ImageCollector
 	httpClient     *http.Client
+	headCache      *headCache
 }
 
-func NewSyncLister(logger *slog.Logger, client metalgo.Client, s3 *s3.S3, imageCollector *metrics.ImageCollector, config *api.Config, stop context.Context) *SyncLister {
+func NewSyncLister(logger *slog.Logger, client MetalClient, s3 *s3.S3, httpClient *http.Client, imageCollector *metrics.ImageCollector, config *api.Config, stop context.Context) *SyncLister {
 	return &SyncLister{
 		logger:         logger,
 		client:         client,
@@ -38,35 +45,53 @@ func NewSyncLister(logger *slog.Logger, client metalgo.Client, s3 *s3.S3, imageC
 		s3:             s3,
 		stop:           stop,
 		imageCollector: imageCollector,
-		httpClient:     http.DefaultClient,
+		httpClient:     httpClient,
+		headCache:      newHeadCache(config.HeadCacheTTL),
 	}
 }
 
 func (s *SyncLister) DetermineImageSyncList() ([]api.OS, error) {
+	storeAvailable := true
 	s3Images, err := s.retrieveImagesFromS3()
 	if err != nil {
-		return nil, fmt.Errorf("error listing images in s3:%w", err)
+		if !s.config.ImageStoreHTTPFallback {
+			return nil, fmt.Errorf("error listing images in s3:%w", err)
+		}
+
+		s.logger.Warn("cannot list images in s3, syncing images over http from their url", "error", err)
+		storeAvailable = false
 	}
 
-	resp, err := s.client.Image().ListImages(image.NewListImagesParams(), nil)
+	apiImages, err := s.client.ListImages()
 	if err != nil {
 		return nil, fmt.Errorf("error listing images:%w", err)
 	}
 
-	s.imageCollector.SetMetalAPIImageCount(len(resp.Payload))
+	s.imageCollector.SetMetalAPIImageCount(len(apiImages))
 
 	expirationGraceDays := 24 * time.Hour * time.Duration(s.config.ExpirationGraceDays)
 
 	images := api.OSImagesByOS{}
-	for _, img := range resp.Payload {
-		if s.isExcluded(img.URL) {
+	var (
+		fallback *api.OS
+		// origin-absent images are not downloaded, they do not take the place of syncable images in the limits
+		originAbsent []api.OS
+		// probes of images in the image store while it can only be reached over http
+		storeProbes, storeProbesFailed int
+	)
+	for _, img := range apiImages {
+		if s.isExcluded(img.URL, s.excludes(s.config.ImageExcludes)) {
 			s.logger.Debug("skipping image with exclude URL", "id", *img.ID)
+			s.skipped(metrics.SkipReasonExcluded, 1)
 			continue
 		}
 
-		if img.ExpirationDate != nil {
+		isFallback := s.config.FallbackImage != "" && *img.ID == s.config.FallbackImage
+
+		if img.ExpirationDate != nil && !isFallback {
 			if time.Since(time.Time(*img.ExpirationDate)) > expirationGraceDays {
 				s.logger.Debug("not considering expired image, skipping", "id", *img.ID)
+				s.skipped(metrics.SkipReasonExpired, 1)
 				continue
 			}
 		}
@@ -77,6 +102,12 @@ func (s *SyncLister) DetermineImageSyncList() ([]api.OS, error) {
 			continue
 		}
 
+		if !s.isIncludedOS(os) {
+			s.logger.Debug("skipping image of os that is not included", "id", *img.ID)
+			s.skipped(metrics.SkipReasonExcluded, 1)
+			continue
+		}
+
 		versions, ok := images[os]
 		if !ok {
 			versions = api.OSImagesByVersion{}
@@ -91,49 +122,155 @@ func (s *SyncLister) DetermineImageSyncList() ([]api.OS, error) {
 			continue
 		}
 
-		bucketKey := u.Path[1:]
+		var o api.OS
+		if storeAvailable && s.isImageStoreHost(u) {
+			bucketName, bucketKey := s.bucketOf(u, s3Images)
+			bucketImages := s3Images[bucketName]
+
+			s3Image, ok := bucketImages[bucketKey]
+			if !ok {
+				if s.config.OriginAbsentPolicy == api.OriginAbsentPolicyRemove {
+					s.logger.Error("image is not contained in global image store, skipping", "path", u.Path, "id", *img.ID)
+					s.skipped(metrics.SkipReasonMissingInStore, 1)
+					continue
+				}
 
-		s3Image, ok := s3Images[bucketKey]
-		if !ok {
-			s.logger.Error("image is not contained in global image store, skipping", "path", u.Path, "id", *img.ID)
-			continue
+				// the syncer decides whether a cached copy of this image should be kept
+				originAbsent = append(originAbsent, api.OS{
+					Name:         os,
+					Version:      ver,
+					ApiRef:       *img,
+					BucketKey:    bucketKey,
+					BucketName:   bucketName,
+					OriginAbsent: true,
+				})
+				continue
+			}
+
+			s3MD5, hasMD5 := bucketImages[bucketKey+".md5"]
+			s3SHA256, hasSHA256 := bucketImages[bucketKey+".sha256"]
+			if !hasMD5 && !hasSHA256 {
+				s.logger.Error("image checksum is not contained in global image store, skipping", "path", u.Path, "id", *img.ID)
+				s.skipped(metrics.SkipReasonMissingMD5, 1)
+				continue
+			}
+
+			var deltas []api.Delta
+			if s.config.EnableDeltas {
+				deltas = findDeltas(bucketImages, bucketKey)
+			}
+
+			o = api.OS{
+				Name:       os,
+				Version:    ver,
+				ApiRef:     *img,
+				BucketKey:  bucketKey,
+				BucketName: bucketName,
+				ImageRef:   s3Image,
+				MD5Ref:     s3MD5,
+				SHA256Ref:  s3SHA256,
+				Deltas:     deltas,
+			}
+		} else {
+			// images served by another host than the image store are synced over http from their url
+			probesStore := !storeAvailable && s.isImageStoreHost(u)
+			if probesStore {
+				storeProbes++
+			}
+
+			o, err = s.httpImage(u)
+			if errors.Is(err, errImageChecksumMissing) {
+				s.logger.Error("image checksum is not available over http, skipping", "url", img.URL, "id", *img.ID)
+				s.skipped(metrics.SkipReasonMissingMD5, 1)
+				continue
+			}
+			if err != nil {
+				if probesStore {
+					storeProbesFailed++
+				}
+
+				if s.config.OriginAbsentPolicy == api.OriginAbsentPolicyRemove {
+					s.logger.Error("image is not available over http, skipping", "url", img.URL, "id", *img.ID, "error", err)
+					s.skipped(metrics.SkipReasonMissingInStore, 1)
+					continue
+				}
+
+				// the syncer decides whether a cached copy of this image should be kept
+				s.logger.Warn("image is not available over http", "url", img.URL, "id", *img.ID, "error", err)
+				originAbsent = append(originAbsent, api.OS{
+					Name:         os,
+					Version:      ver,
+					ApiRef:       *img,
+					BucketKey:    strings.TrimPrefix(u.Path, "/"),
+					ViaHTTP:      true,
+					OriginAbsent: true,
+				})
+				continue
+			}
+
+			o.Name = os
+			o.Version = ver
+			o.ApiRef = *img
 		}
 
-		s3MD5, ok := s3Images[bucketKey+".md5"]
-		if !ok {
-			s.logger.Error("image md5 is not contained in global image store, skipping", "path", u.Path, "id", *img.ID)
+		if isFallback {
+			fallback = &o
 			continue
 		}
 
-		imageVersions = append(imageVersions, api.OS{
-			Name:       os,
-			Version:    ver,
-			ApiRef:     *img,
-			BucketKey:  bucketKey,
-			BucketName: s.config.ImageBucket,
-			ImageRef:   s3Image,
-			MD5Ref:     s3MD5,
-		})
+		imageVersions = append(imageVersions, o)
 
 		versions[majorMinor] = imageVersions
 		images[os] = versions
 	}
 
+	// an empty sync list would wipe the cache while the image store is down
+	if storeProbes > 0 && storeProbesFailed == storeProbes {
+		return nil, fmt.Errorf("image store is neither reachable over s3 nor over http, %d image probes failed", storeProbesFailed)
+	}
+
+	if s.config.FallbackImage != "" && fallback == nil {
+		s.logger.Error("fallback image is not available for sync", "id", s.config.FallbackImage)
+	}
+
+	s.dropAgedImages(images)
+
+	syncImages := s.selectImages(images, fallback)
+
+	if len(originAbsent) > 0 {
+		syncImages = append(syncImages, originAbsent...)
+		api.SortOSImagesByName(syncImages)
+	}
+
+	s.imageCollector.SetUnsyncedImageCount(len(apiImages) - len(syncImages))
+
+	return syncImages, nil
+}
+
+// selectImages selects the images to sync with respect to the retention and cache size settings,
+// the fallback image is always contained and never reduced.
+func (s *SyncLister) selectImages(images api.OSImagesByOS, fallback *api.OS) []api.OS {
 	var sizeCount int64
+	if fallback != nil {
+		sizeCount += fallback.GetSize()
+	}
+
 	var syncImages []api.OS
-	for _, versions := range images {
+	for os, versions := range images {
+		maxImages := s.config.ImageLimitsFor(os).Max
 		for _, versionedImages := range versions {
 			versionedImages := versionedImages
 			sort.Slice(versionedImages, func(i, j int) bool {
-				return versionedImages[i].Version.GreaterThan(versionedImages[j].Version)
+				return versionedImages[i].NewerThan(versionedImages[j])
 			})
 			amount := 0
 			for _, img := range versionedImages {
-				if s.config.MaxImagesPerName > 0 && amount >= s.config.MaxImagesPerName {
+				if maxImages > 0 && amount >= maxImages {
+					s.skipped(metrics.SkipReasonOverMax, len(versionedImages)-amount)
 					break
 				}
 				amount += 1
-				sizeCount += *img.ImageRef.Size
+				sizeCount += img.GetSize()
 				syncImages = append(syncImages, img)
 			}
 		}
@@ -142,53 +279,178 @@ func (s *SyncLister) DetermineImageSyncList() ([]api.OS, error) {
 	api.SortOSImagesByName(syncImages)
 
 	for {
-		if sizeCount < s.config.MaxCacheSize {
+		if sizeCount <= s.config.MaxCacheSize {
 			break
 		}
 
+		var err error
 		syncImages, sizeCount, err = s.reduce(syncImages, sizeCount)
 		if err != nil {
 			s.logger.Warn("cannot reduce anymore images (all at minimum size), exceeding maximum cache size")
 			break
 		}
+		s.skipped(metrics.SkipReasonReduced, 1)
 	}
 
-	s.imageCollector.SetUnsyncedImageCount(len(resp.Payload) - len(syncImages))
+	if fallback != nil {
+		syncImages = append(syncImages, *fallback)
+		api.SortOSImagesByName(syncImages)
+	}
 
-	return syncImages, nil
+	return syncImages
+}
+
+// skipped counts images that are not synced for the given reason.
+func (s *SyncLister) skipped(reason string, count int) {
+	if s.imageCollector == nil {
+		return
+	}
+	s.imageCollector.AddSkippedImages(reason, count)
 }
 
-func (s *SyncLister) isExcluded(url string) bool {
-	for _, exclude := range s.config.ExcludePaths {
+// dropAgedImages removes images whose version datestamp exceeds the max image age, the newest images of an image
+// variant are kept up to the minimum images per name if the age respects the minimum. images without datestamp are kept.
+func (s *SyncLister) dropAgedImages(images api.OSImagesByOS) {
+	if s.config.MaxImageAgeDays == 0 {
+		return
+	}
+
+	maxAge := 24 * time.Hour * time.Duration(s.config.MaxImageAgeDays)
+
+	for os, versions := range images {
+		keep := 0
+		if s.config.AgeRespectsMin {
+			keep = s.config.ImageLimitsFor(os).Min
+		}
+
+		for majorMinor, versionedImages := range versions {
+			sorted := append([]api.OS{}, versionedImages...)
+			sort.Slice(sorted, func(i, j int) bool {
+				return sorted[i].NewerThan(sorted[j])
+			})
+
+			var result []api.OS
+			for i, img := range sorted {
+				date, ok := imageDate(img)
+				if ok && time.Since(date) > maxAge && i >= keep {
+					s.logger.Debug("not considering image exceeding the max image age, skipping", "id", img.GetName(), "date", date.Format(time.DateOnly))
+					s.skipped(metrics.SkipReasonAged, 1)
+					continue
+				}
+				result = append(result, img)
+			}
+
+			if len(result) == 0 {
+				delete(versions, majorMinor)
+				continue
+			}
+			versions[majorMinor] = result
+		}
+
+		if len(versions) == 0 {
+			delete(images, os)
+		}
+	}
+}
+
+// imageDate returns the datestamp of an image, which is the patch portion of its version (e.g. 20200408).
+func imageDate(img api.OS) (time.Time, bool) {
+	if img.Version == nil {
+		return time.Time{}, false
+	}
+
+	date, err := time.Parse("20060102", strconv.FormatUint(img.Version.Patch(), 10))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return date, true
+}
+
+// findDeltas returns the deltas published for an image, they are expected to be stored next to the image
+// with the name of the base version's directory as an infix, e.g. ubuntu/20.04/20201026/img.tar.lz4.from-20201025.bsdiff
+func findDeltas(s3Images map[string]s3.Object, bucketKey string) []api.Delta {
+	prefix := bucketKey + ".from-"
+
+	var result []api.Delta
+	for key, o := range s3Images {
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".bsdiff") {
+			continue
+		}
+
+		base := strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".bsdiff")
+
+		result = append(result, api.Delta{
+			BaseSubPath: path.Join(path.Dir(path.Dir(bucketKey)), base, path.Base(bucketKey)),
+			Ref:         o,
+		})
+	}
+
+	// prefer the most recent base version
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].BaseSubPath > result[j].BaseSubPath
+	})
+
+	return result
+}
+
+// isIncludedOS returns true if images of the given os should be synced, all are included if no os is configured.
+func (s *SyncLister) isIncludedOS(os string) bool {
+	if len(s.config.IncludeOS) == 0 {
+		return true
+	}
+	return slices.Contains(s.config.IncludeOS, os)
+}
+
+// excludes returns the exclude paths of a kind of entity, the global exclude paths apply if none are set for it.
+func (s *SyncLister) excludes(kindExcludes []string) []string {
+	if len(kindExcludes) > 0 {
+		return kindExcludes
+	}
+	return s.config.ExcludePaths
+}
+
+func (s *SyncLister) isExcluded(url string, excludePaths []string) bool {
+	for _, exclude := range excludePaths {
 		if strings.Contains(url, exclude) {
 			return true
 		}
 	}
 
+	for _, exclude := range s.config.ExcludeRegexps {
+		if exclude.MatchString(url) {
+			return true
+		}
+	}
+
 	return false
 }
 
 func (s *SyncLister) DetermineKernelSyncList() ([]api.Kernel, error) {
-	resp, err := s.client.Partition().ListPartitions(partition.NewListPartitionsParams(), nil)
+	partitions, err := s.client.ListPartitions()
 	if err != nil {
 		return nil, fmt.Errorf("error listing partitions:%w", err)
 	}
 
 	var result []api.Kernel
-	urls := map[string]bool{}
+	// index of the kernel url in the result, the url is recorded as skipped if it is not synced
+	urls := map[string]int{}
 
-	for _, p := range resp.Payload {
+	for _, p := range partitions {
 		if p.Bootconfig == nil {
 			continue
 		}
 
 		kernelURL := p.Bootconfig.Kernelurl
 
-		if urls[kernelURL] {
+		if i, ok := urls[kernelURL]; ok {
+			if i >= 0 {
+				result[i].References++
+			}
 			continue
 		}
 
-		if s.isExcluded(kernelURL) {
+		if s.isExcluded(kernelURL, s.excludes(s.config.KernelExcludes)) {
 			s.logger.Debug("skipping kernel with exclude URL", "url", kernelURL)
 			continue
 		}
@@ -199,43 +461,50 @@ func (s *SyncLister) DetermineKernelSyncList() ([]api.Kernel, error) {
 			continue
 		}
 
-		size, err := retrieveContentLength(s.stop, s.httpClient, u.String())
-		if err != nil {
-			s.logger.Warn("unable to determine kernel download size", "error", err)
-		}
+		probe := s.probeArtifact(u, "kernel", false)
 
+		urls[kernelURL] = len(result)
+
+		// older kernels are published without md5 checksum and are synced without verification
 		result = append(result, api.Kernel{
-			SubPath: strings.TrimPrefix(u.Path, "/"),
-			URL:     kernelURL,
-			Size:    size,
+			SubPath:      s.subPath(u),
+			URL:          kernelURL,
+			Size:         probe.head.size,
+			LastModified: probe.head.lastModified,
+			ETag:         probe.head.etag,
+			MD5Available: probe.md5Err == nil,
+			References:   1,
 		})
-		urls[kernelURL] = true
 	}
 
 	return result, nil
 }
 
 func (s *SyncLister) DetermineBootImageSyncList() ([]api.BootImage, error) {
-	resp, err := s.client.Partition().ListPartitions(partition.NewListPartitionsParams(), nil)
+	partitions, err := s.client.ListPartitions()
 	if err != nil {
 		return nil, fmt.Errorf("error listing partitions:%w", err)
 	}
 
 	var result []api.BootImage
-	urls := map[string]bool{}
+	// index of the boot image url in the result, the url is recorded as skipped if it is not synced
+	urls := map[string]int{}
 
-	for _, p := range resp.Payload {
+	for _, p := range partitions {
 		if p.Bootconfig == nil {
 			continue
 		}
 
 		bootImageURL := p.Bootconfig.Imageurl
 
-		if urls[bootImageURL] {
+		if i, ok := urls[bootImageURL]; ok {
+			if i >= 0 {
+				result[i].References++
+			}
 			continue
 		}
 
-		if s.isExcluded(bootImageURL) {
+		if s.isExcluded(bootImageURL, s.excludes(s.config.BootImageExcludes)) {
 			s.logger.Debug("skipping boot image with exclude URL", "url", bootImageURL)
 			continue
 		}
@@ -246,59 +515,190 @@ func (s *SyncLister) DetermineBootImageSyncList() ([]api.BootImage, error) {
 			continue
 		}
 
-		size, err := retrieveContentLength(s.stop, s.httpClient, u.String())
-		if err != nil {
-			s.logger.Warn("unable to determine boot image download size", "error", err)
-		}
+		probe := s.probeArtifact(u, "boot image", true)
 
-		md5URL := u.String() + ".md5"
-		_, err = retrieveContentLength(s.stop, s.httpClient, md5URL)
-		if err != nil {
-			s.logger.Error("boot image md5 does not exist, skipping", "url", md5URL, "error", err)
-			continue
+		md5Missing := false
+		if probe.md5Err != nil && probe.sha256Available {
+			md5Missing = true
+		} else if probe.md5Err != nil {
+			if s.config.RequireBootImageMD5 {
+				s.logger.Error("boot image md5 does not exist, skipping", "url", bootImageURL+".md5", "error", probe.md5Err)
+				urls[bootImageURL] = -1
+				continue
+			}
+
+			s.logger.Warn("boot image md5 does not exist, syncing without checksum verification", "url", bootImageURL+".md5", "error", probe.md5Err)
+			md5Missing = true
 		}
 
+		urls[bootImageURL] = len(result)
+
 		result = append(result, api.BootImage{
-			SubPath: strings.TrimPrefix(u.Path, "/"),
-			URL:     bootImageURL,
-			Size:    size,
+			SubPath:         s.subPath(u),
+			URL:             bootImageURL,
+			Size:            probe.head.size,
+			MD5Missing:      md5Missing,
+			SHA256Available: probe.sha256Available,
+			LastModified:    probe.head.lastModified,
+			ETag:            probe.head.etag,
+			References:      1,
 		})
-		urls[bootImageURL] = true
 	}
 
 	return result, nil
 }
 
-func retrieveContentLength(ctx context.Context, c *http.Client, url string) (int64, error) {
+// DeterminePartitionBootArtifacts returns the kernel and boot image sub paths of every partition.
+func (s *SyncLister) DeterminePartitionBootArtifacts() ([]api.PartitionBootArtifacts, error) {
+	partitions, err := s.client.ListPartitions()
+	if err != nil {
+		return nil, fmt.Errorf("error listing partitions:%w", err)
+	}
+
+	var result []api.PartitionBootArtifacts
+	for _, p := range partitions {
+		if p.ID == nil || p.Bootconfig == nil {
+			continue
+		}
+
+		artifacts := api.PartitionBootArtifacts{
+			ID: *p.ID,
+		}
+
+		if u, err := url.Parse(p.Bootconfig.Kernelurl); err == nil && p.Bootconfig.Kernelurl != "" {
+			artifacts.KernelSubPath = s.subPath(u)
+		}
+		if u, err := url.Parse(p.Bootconfig.Imageurl); err == nil && p.Bootconfig.Imageurl != "" {
+			artifacts.BootImageSubPath = s.subPath(u)
+		}
+
+		result = append(result, artifacts)
+	}
+
+	return result, nil
+}
+
+// subPath returns the path in the cache for a kernel or boot image url according to the configured naming.
+func (s *SyncLister) subPath(u *url.URL) string {
+	p := strings.TrimPrefix(u.Path, "/")
+
+	switch s.config.SubPathNaming {
+	case api.SubPathNamingHost:
+		return path.Join(u.Host, p)
+	case api.SubPathNamingHash:
+		sum := sha256.Sum256([]byte(u.String()))
+		return path.Join(hex.EncodeToString(sum[:])[:16], path.Base(p))
+	default:
+		return p
+	}
+}
+
+// artifactProbe is the result of probing a kernel or boot image and its checksum files at the origin.
+type artifactProbe struct {
+	head            headResult
+	md5Err          error
+	sha256Available bool
+}
+
+// probeArtifact determines the size of a kernel or boot image along with the existence of its checksum files,
+// the sha256 checksum is only probed if requested. A failing size lookup is only logged as the download
+// determines the size as well.
+func (s *SyncLister) probeArtifact(u *url.URL, kind string, sha256 bool) artifactProbe {
+	var (
+		result artifactProbe
+		err    error
+	)
+
+	result.head, err = s.head(u.String())
+	if err != nil {
+		s.logger.Warn("unable to determine "+kind+" download size", "error", err)
+	}
+
+	_, result.md5Err = s.head(u.String() + ".md5")
+
+	if sha256 {
+		_, err = s.head(u.String() + ".sha256")
+		result.sha256Available = err == nil
+	}
+
+	return result
+}
+
+func (s *SyncLister) contentLength(url string) (int64, error) {
+	result, err := s.head(url)
+	if err != nil {
+		return 0, err
+	}
+	return result.size, nil
+}
+
+// head returns the size and the modification time of an artifact of the origin, the modification time is zero
+// if the origin does not send a Last-Modified header.
+func (s *SyncLister) head(url string) (headResult, error) {
+	if result, ok := s.headCache.get(url); ok {
+		return result, nil
+	}
+
+	size, header, err := retrieveContentLength(s.stop, s.httpClient, url)
+	if err != nil {
+		return headResult{}, err
+	}
+
+	result := headResult{
+		size: size,
+		etag: strongETag(header.Get("ETag")),
+	}
+	if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		result.lastModified = lm
+	}
+
+	s.headCache.put(url, result, header)
+
+	return result, nil
+}
+
+// strongETag returns the given etag without quotes, weak etags do not guarantee identical content and are dropped.
+func strongETag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return strings.Trim(etag, `"`)
+}
+
+func retrieveContentLength(ctx context.Context, c *http.Client, url string) (int64, http.Header, error) {
 	req, err := http.NewRequest(http.MethodHead, url, nil)
 	if err != nil {
-		return 0, fmt.Errorf("unable to create head request:%w", err)
+		return 0, nil, fmt.Errorf("unable to create head request:%w", err)
 	}
 
 	req = req.WithContext(ctx)
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("head request to url did not return OK: %s", url)
+		return 0, nil, fmt.Errorf("head request to url did not return OK: %s", url)
 	}
 
 	size, err := strconv.Atoi(resp.Header.Get("Content-Length"))
 	if err != nil {
-		return 0, fmt.Errorf("content-length header value could not be converted to integer:%w", err)
+		return 0, nil, fmt.Errorf("content-length header value could not be converted to integer:%w", err)
 	}
 
-	return int64(size), nil
+	return int64(size), resp.Header, nil
 }
 
 func (s *SyncLister) reduce(images []api.OS, sizeCount int64) ([]api.OS, int64, error) {
+	if s.config.EvictionStrategy == api.EvictionStrategyLargestFirst {
+		return s.reduceLargestFirst(images, sizeCount)
+	}
+
 	groups := map[string][]api.OS{}
 	for _, img := range images {
-		key := fmt.Sprintf("%s-%d.%d", img.Name, img.Version.Major(), img.Version.Minor())
+		key := groupKey(img)
 		groups[key] = append(groups[key], img)
 	}
 
@@ -311,7 +711,7 @@ func (s *SyncLister) reduce(images []api.OS, sizeCount int64) ([]api.OS, int64,
 	sort.Strings(groupNames)
 	for _, name := range groupNames {
 		amount := len(groups[name])
-		if amount > s.config.MinImagesPerName && amount > currentBiggest {
+		if amount > s.config.ImageLimitsFor(groups[name][0].Name).Min && amount > currentBiggest {
 			currentBiggest = amount
 			biggestGroup = name
 		}
@@ -321,10 +721,15 @@ func (s *SyncLister) reduce(images []api.OS, sizeCount int64) ([]api.OS, int64,
 		return images, sizeCount, fmt.Errorf("can not reduce any further")
 	}
 
-	groupImages := groups[biggestGroup]
-	groups[biggestGroup] = append([]api.OS{}, groupImages[1:]...)
+	// evict the oldest version of the group
+	groupImages := append([]api.OS{}, groups[biggestGroup]...)
+	sort.Slice(groupImages, func(i, j int) bool {
+		return groupImages[i].NewerThan(groupImages[j])
+	})
+	oldest := groupImages[len(groupImages)-1]
+	groups[biggestGroup] = groupImages[:len(groupImages)-1]
 
-	newSize := sizeCount - *groupImages[0].ImageRef.Size
+	newSize := sizeCount - oldest.GetSize()
 
 	var result []api.OS
 	for _, imgs := range groups {
@@ -336,20 +741,140 @@ func (s *SyncLister) reduce(images []api.OS, sizeCount int64) ([]api.OS, int64,
 	return result, newSize, nil
 }
 
-func (s *SyncLister) retrieveImagesFromS3() (map[string]s3.Object, error) {
-	res := map[string]s3.Object{}
+// reduceLargestFirst evicts the largest image of all image variants that contain more than the minimum amount of images,
+// the oldest version is evicted if images have the same size.
+func (s *SyncLister) reduceLargestFirst(images []api.OS, sizeCount int64) ([]api.OS, int64, error) {
+	groupSizes := map[string]int{}
+	for _, img := range images {
+		groupSizes[groupKey(img)]++
+	}
 
-	err := s.s3.ListObjectsPages(&s3.ListObjectsInput{
-		Bucket: &s.config.ImageBucket,
-	}, func(objects *s3.ListObjectsOutput, lastPage bool) bool {
-		for _, o := range objects.Contents {
-			res[*o.Key] = *o
+	evict := -1
+	for i, img := range images {
+		if groupSizes[groupKey(img)] <= s.config.ImageLimitsFor(img.Name).Min {
+			continue
 		}
-		return true
-	})
+
+		if evict < 0 {
+			evict = i
+			continue
+		}
+
+		current := images[evict]
+		if img.GetSize() > current.GetSize() || (img.GetSize() == current.GetSize() && current.NewerThan(img)) {
+			evict = i
+		}
+	}
+
+	if evict < 0 {
+		return images, sizeCount, fmt.Errorf("can not reduce any further")
+	}
+
+	newSize := sizeCount - images[evict].GetSize()
+
+	result := append([]api.OS{}, images[:evict]...)
+	result = append(result, images[evict+1:]...)
+
+	return result, newSize, nil
+}
+
+// groupKey returns the image variant of an image, which is the os name and its major and minor version.
+// images without version form a separate variant.
+func groupKey(img api.OS) string {
+	if img.Version == nil {
+		return img.Name + "-unversioned"
+	}
+	return fmt.Sprintf("%s-%d.%d", img.Name, img.Version.Major(), img.Version.Minor())
+}
+
+// isImageStoreHost returns true if the url points to the image store, either directly or through a virtual-hosted bucket.
+func (s *SyncLister) isImageStoreHost(u *url.URL) bool {
+	storeHost := s.config.ImageStore
+	if su, err := url.Parse(storeHost); err == nil && su.Host != "" {
+		storeHost = su.Hostname()
+	} else if h, _, err := net.SplitHostPort(storeHost); err == nil {
+		storeHost = h
+	}
+
+	host := u.Hostname()
+
+	return host == storeHost || strings.HasSuffix(host, "."+storeHost)
+}
+
+// httpImage returns an image that is synced over http from the given url, it requires a checksum to be published next to the image.
+func (s *SyncLister) httpImage(u *url.URL) (api.OS, error) {
+	head, err := s.head(u.String())
 	if err != nil {
-		return nil, fmt.Errorf("cannot list s3 objects:%w", err)
+		return api.OS{}, err
+	}
+
+	_, err = s.contentLength(u.String() + ".sha256")
+	sha256Available := err == nil
+
+	_, err = s.contentLength(u.String() + ".md5")
+	md5Missing := err != nil
+
+	if md5Missing && !sha256Available {
+		return api.OS{}, errImageChecksumMissing
+	}
+
+	return api.OS{
+		ViaHTTP:         true,
+		BucketKey:       strings.TrimPrefix(u.Path, "/"),
+		Size:            head.size,
+		MD5Missing:      md5Missing,
+		SHA256Available: sha256Available,
+		LastModified:    head.lastModified,
+	}, nil
+}
+
+// retrieveImagesFromS3 lists the objects of all configured buckets by bucket name and key.
+func (s *SyncLister) retrieveImagesFromS3() (map[string]map[string]s3.Object, error) {
+	res := map[string]map[string]s3.Object{}
+
+	for _, bucket := range s.config.ImageBuckets {
+		bucket := bucket
+		objects := map[string]s3.Object{}
+
+		err := s.s3.ListObjectsPages(&s3.ListObjectsInput{
+			Bucket: &bucket,
+		}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, o := range page.Contents {
+				objects[*o.Key] = *o
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot list s3 objects of bucket %s:%w", bucket, err)
+		}
+
+		res[bucket] = objects
 	}
 
 	return res, nil
 }
+
+// bucketOf returns the bucket and the key of an image url. the bucket is taken from the url if it is addressed
+// in virtual host or path style, otherwise the first bucket containing the url path is used. if no bucket
+// contains the image, the first configured bucket is returned.
+func (s *SyncLister) bucketOf(u *url.URL, s3Images map[string]map[string]s3.Object) (string, string) {
+	key := strings.TrimPrefix(u.Path, "/")
+
+	host, _, _ := strings.Cut(u.Hostname(), ".")
+	if _, ok := s3Images[host][key]; ok {
+		return host, key
+	}
+
+	bucket, bucketKey, _ := strings.Cut(key, "/")
+	if _, ok := s3Images[bucket][bucketKey]; ok {
+		return bucket, bucketKey
+	}
+
+	for _, bucket := range s.config.ImageBuckets {
+		if _, ok := s3Images[bucket][key]; ok {
+			return bucket, key
+		}
+	}
+
+	return s.config.ImageBuckets[0], key
+}
@@ -0,0 +1,1236 @@
+package synclister
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/go-openapi/strfmt"
+	"github.com/metal-stack/metal-go/api/client/image"
+	"github.com/metal-stack/metal-go/api/client/partition"
+	"github.com/metal-stack/metal-go/api/models"
+	metaltestclient "github.com/metal-stack/metal-go/test/client"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func testImage(name, version string, size int64) api.OS {
+	return api.OS{
+		Name:      name,
+		Version:   semver.MustParse(version),
+		BucketKey: "metal-os/" + name + "/" + version + "/img.tar.lz4",
+		ImageRef:  s3.Object{Size: &size},
+	}
+}
+
+func TestSyncLister_selectImagesFallback(t *testing.T) {
+	images := api.OSImagesByOS{
+		"ubuntu": api.OSImagesByVersion{
+			"20.4": []api.OS{
+				testImage("ubuntu", "20.04.20201024", 100),
+				testImage("ubuntu", "20.04.20201025", 100),
+				testImage("ubuntu", "20.04.20201026", 100),
+			},
+		},
+	}
+	fallback := testImage("ubuntu", "20.04.20201001", 100)
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		config: &api.Config{
+			MinImagesPerName: 1,
+			MaxImagesPerName: -1,
+			MaxCacheSize:     1,
+		},
+	}
+
+	got := s.selectImages(images, &fallback)
+	require.Len(t, got, 2)
+	assert.Equal(t, fallback.BucketKey, got[0].BucketKey)
+	assert.Equal(t, "metal-os/ubuntu/20.04.20201026/img.tar.lz4", got[1].BucketKey)
+
+	got = s.selectImages(images, nil)
+	require.Len(t, got, 1)
+	assert.Equal(t, "metal-os/ubuntu/20.04.20201026/img.tar.lz4", got[0].BucketKey)
+}
+
+func TestSyncLister_selectImagesPerOSLimits(t *testing.T) {
+	images := api.OSImagesByOS{
+		"ubuntu": api.OSImagesByVersion{
+			"20.4": []api.OS{
+				testImage("ubuntu", "20.04.20201024", 100),
+				testImage("ubuntu", "20.04.20201025", 100),
+				testImage("ubuntu", "20.04.20201026", 100),
+			},
+		},
+		"firewall": api.OSImagesByVersion{
+			"2.0": []api.OS{
+				testImage("firewall", "2.0.20210301", 100),
+				testImage("firewall", "2.0.20210302", 100),
+				testImage("firewall", "2.0.20210303", 100),
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		maxCacheSize int64
+		want         []string
+	}{
+		{
+			name:         "max images per os",
+			maxCacheSize: 1000,
+			want: []string{
+				"metal-os/firewall/2.0.20210301/img.tar.lz4",
+				"metal-os/firewall/2.0.20210302/img.tar.lz4",
+				"metal-os/firewall/2.0.20210303/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201026/img.tar.lz4",
+			},
+		},
+		{
+			name:         "min images per os when reducing",
+			maxCacheSize: 1,
+			want: []string{
+				"metal-os/firewall/2.0.20210302/img.tar.lz4",
+				"metal-os/firewall/2.0.20210303/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201026/img.tar.lz4",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SyncLister{
+				logger: slog.Default(),
+				config: &api.Config{
+					MinImagesPerName: 1,
+					MaxImagesPerName: -1,
+					MaxCacheSize:     tt.maxCacheSize,
+					PerOSLimits: map[string]api.ImageLimits{
+						"firewall": {Min: 2},
+						"ubuntu":   {Max: 1},
+					},
+				},
+			}
+
+			var got []string
+			for _, img := range s.selectImages(images, nil) {
+				got = append(got, img.BucketKey)
+			}
+			assert.ElementsMatch(t, tt.want, got)
+		})
+	}
+}
+
+func TestSyncLister_reduceEvictsOldest(t *testing.T) {
+	images := []api.OS{
+		testImage("ubuntu", "20.04.20201025", 100),
+		testImage("ubuntu", "20.04.20201027", 100),
+		testImage("ubuntu", "20.04.20201024", 100),
+		testImage("ubuntu", "20.04.20201026", 100),
+	}
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		config: &api.Config{MinImagesPerName: 1},
+	}
+
+	got, size, err := s.reduce(images, 400)
+	require.NoError(t, err)
+	assert.Equal(t, int64(300), size)
+
+	var versions []string
+	for _, img := range got {
+		versions = append(versions, img.Version.String())
+	}
+	assert.Equal(t, []string{"20.4.20201025", "20.4.20201026", "20.4.20201027"}, versions)
+}
+
+func TestSyncLister_reduceNilVersion(t *testing.T) {
+	unversioned := testImage("ubuntu", "20.04.20201023", 100)
+	unversioned.Version = nil
+	unversioned.BucketKey = "metal-os/ubuntu/unversioned/img.tar.lz4"
+
+	for _, strategy := range []string{api.EvictionStrategyBalanced, api.EvictionStrategyLargestFirst} {
+		strategy := strategy
+		t.Run(strategy, func(t *testing.T) {
+			images := []api.OS{
+				testImage("ubuntu", "20.04.20201025", 100),
+				unversioned,
+				testImage("ubuntu", "20.04.20201024", 100),
+				testImage("ubuntu", "20.04.20201026", 100),
+			}
+
+			s := &SyncLister{
+				logger: slog.Default(),
+				config: &api.Config{MinImagesPerName: 1, EvictionStrategy: strategy},
+			}
+
+			got, size, err := s.reduce(images, 400)
+			require.NoError(t, err)
+			assert.Equal(t, int64(300), size)
+
+			// the unversioned image forms its own variant, which is already at the minimum
+			var keys []string
+			for _, img := range got {
+				keys = append(keys, img.BucketKey)
+			}
+			assert.ElementsMatch(t, []string{
+				"metal-os/ubuntu/20.04.20201025/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201026/img.tar.lz4",
+				"metal-os/ubuntu/unversioned/img.tar.lz4",
+			}, keys)
+		})
+	}
+}
+
+func TestSyncLister_dropAgedImages(t *testing.T) {
+	daysAgo := func(days int) string {
+		return "20.04." + time.Now().AddDate(0, 0, -days).Format("20060102")
+	}
+
+	tests := []struct {
+		name           string
+		maxAgeDays     uint
+		ageRespectsMin bool
+		want           []string
+	}{
+		{
+			name: "disabled",
+			want: []string{daysAgo(1), daysAgo(40), daysAgo(50), "20.04.1"},
+		},
+		{
+			name:       "aged images are dropped",
+			maxAgeDays: 30,
+			want:       []string{daysAgo(1), "20.04.1"},
+		},
+		{
+			name:           "min images are kept",
+			maxAgeDays:     30,
+			ageRespectsMin: true,
+			want:           []string{daysAgo(1), daysAgo(40), "20.04.1"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			images := api.OSImagesByOS{
+				"ubuntu": api.OSImagesByVersion{
+					"20.4": []api.OS{
+						testImage("ubuntu", daysAgo(50), 100),
+						testImage("ubuntu", daysAgo(1), 100),
+						testImage("ubuntu", daysAgo(40), 100),
+						// versions without datestamp have no age
+						testImage("ubuntu", "20.04.1", 100),
+					},
+				},
+			}
+
+			s := &SyncLister{
+				logger: slog.Default(),
+				config: &api.Config{MinImagesPerName: 2, MaxImageAgeDays: tt.maxAgeDays, AgeRespectsMin: tt.ageRespectsMin},
+			}
+
+			s.dropAgedImages(images)
+
+			var got []string
+			for _, img := range images["ubuntu"]["20.4"] {
+				got = append(got, img.BucketKey)
+			}
+
+			var want []string
+			for _, v := range tt.want {
+				want = append(want, testImage("ubuntu", v, 100).BucketKey)
+			}
+			assert.ElementsMatch(t, want, got)
+		})
+	}
+}
+
+func TestSyncLister_selectImagesMaxCacheSize(t *testing.T) {
+	images := api.OSImagesByOS{
+		"ubuntu": api.OSImagesByVersion{
+			"20.4": []api.OS{
+				testImage("ubuntu", "20.04.20201024", 100),
+				testImage("ubuntu", "20.04.20201025", 100),
+				testImage("ubuntu", "20.04.20201026", 100),
+				testImage("ubuntu", "20.04.20201027", 100),
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		maxCacheSize int64
+		want         int
+	}{
+		{
+			name:         "below the limit",
+			maxCacheSize: 1000,
+			want:         4,
+		},
+		{
+			name:         "exactly at the limit",
+			maxCacheSize: 400,
+			want:         4,
+		},
+		{
+			name:         "exceeding the limit",
+			maxCacheSize: 250,
+			want:         2,
+		},
+		{
+			name:         "exceeding the limit down to the minimum",
+			maxCacheSize: 1,
+			want:         1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SyncLister{
+				logger: slog.Default(),
+				config: &api.Config{
+					MinImagesPerName: 1,
+					MaxImagesPerName: -1,
+					MaxCacheSize:     tt.maxCacheSize,
+				},
+			}
+
+			got := s.selectImages(images, nil)
+			require.Len(t, got, tt.want)
+			assert.Equal(t, "metal-os/ubuntu/20.04.20201027/img.tar.lz4", got[len(got)-1].BucketKey)
+		})
+	}
+}
+
+func TestSyncLister_selectImagesEvictionStrategy(t *testing.T) {
+	images := api.OSImagesByOS{
+		"ubuntu": api.OSImagesByVersion{
+			"20.4": []api.OS{
+				testImage("ubuntu", "20.04.20201024", 100),
+				testImage("ubuntu", "20.04.20201025", 100),
+				testImage("ubuntu", "20.04.20201026", 100),
+			},
+		},
+		"firewall": api.OSImagesByVersion{
+			"2.0": []api.OS{
+				testImage("firewall", "2.0.20210301", 500),
+				testImage("firewall", "2.0.20210302", 500),
+			},
+		},
+	}
+
+	tests := []struct {
+		strategy string
+		want     []string
+	}{
+		{
+			strategy: api.EvictionStrategyBalanced,
+			want: []string{
+				"metal-os/firewall/2.0.20210302/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201025/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201026/img.tar.lz4",
+			},
+		},
+		{
+			strategy: api.EvictionStrategyLargestFirst,
+			want: []string{
+				"metal-os/firewall/2.0.20210302/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201024/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201025/img.tar.lz4",
+				"metal-os/ubuntu/20.04.20201026/img.tar.lz4",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.strategy, func(t *testing.T) {
+			s := &SyncLister{
+				logger: slog.Default(),
+				config: &api.Config{
+					MinImagesPerName: 1,
+					MaxImagesPerName: -1,
+					MaxCacheSize:     900,
+					EvictionStrategy: tt.strategy,
+				},
+			}
+
+			var got []string
+			for _, img := range s.selectImages(images, nil) {
+				got = append(got, img.BucketKey)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSyncLister_subPath(t *testing.T) {
+	first, err := url.Parse("https://first.example.com/releases/v1/kernel")
+	require.NoError(t, err)
+	second, err := url.Parse("https://second.example.com/releases/v1/kernel")
+	require.NoError(t, err)
+
+	tests := []struct {
+		naming       string
+		wantFirst    string
+		wantDistinct bool
+	}{
+		{
+			naming:       api.SubPathNamingPath,
+			wantFirst:    "releases/v1/kernel",
+			wantDistinct: false,
+		},
+		{
+			naming:       api.SubPathNamingHost,
+			wantFirst:    "first.example.com/releases/v1/kernel",
+			wantDistinct: true,
+		},
+		{
+			naming:       api.SubPathNamingHash,
+			wantDistinct: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.naming, func(t *testing.T) {
+			s := &SyncLister{config: &api.Config{SubPathNaming: tt.naming}}
+
+			gotFirst := s.subPath(first)
+			gotSecond := s.subPath(second)
+
+			if tt.wantFirst != "" {
+				assert.Equal(t, tt.wantFirst, gotFirst)
+			}
+			assert.Equal(t, tt.wantDistinct, gotFirst != gotSecond)
+			assert.Equal(t, "kernel", path.Base(gotFirst))
+		})
+	}
+}
+
+func TestSyncLister_isExcluded(t *testing.T) {
+	s := &SyncLister{
+		config: &api.Config{
+			ExcludePaths: []string{"/master/"},
+			// pull request builds are prefixed with their number, tagged release candidates are kept
+			ExcludeRegexps: []*regexp.Regexp{regexp.MustCompile(`/pull_requests/[0-9]+-[^/]*/`)},
+		},
+	}
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "https://images.metal-stack.io/metal-os/stable/ubuntu/20.04/20201026/img.tar.lz4", want: false},
+		{url: "https://images.metal-stack.io/metal-os/master/ubuntu/20.04/20201026/img.tar.lz4", want: true},
+		{url: "https://images.metal-stack.io/metal-os/pull_requests/42-add-firmware/ubuntu/20.04/20201026/img.tar.lz4", want: true},
+		{url: "https://images.metal-stack.io/metal-os/pull_requests/v0.2.0-rc.1/ubuntu/20.04/20201026/img.tar.lz4", want: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equal(t, tt.want, s.isExcluded(tt.url, s.config.ExcludePaths))
+		})
+	}
+}
+
+func TestSyncLister_DetermineBootImageSyncListWithoutMD5(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/boot/initrd.img.lz4":
+			w.Header().Set("Content-Length", "4")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		requireMD5 bool
+		want       []api.BootImage
+	}{
+		{
+			name:       "boot image without md5 is skipped",
+			requireMD5: true,
+			want:       nil,
+		},
+		{
+			name:       "boot image without md5 is synced unverified",
+			requireMD5: false,
+			want: []api.BootImage{
+				{
+					SubPath:    "boot/initrd.img.lz4",
+					URL:        ts.URL + "/boot/initrd.img.lz4",
+					Size:       4,
+					MD5Missing: true,
+					References: 1,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := metaltestclient.NewMetalMockClient(t, &metaltestclient.MetalMockFns{
+				Partition: func(m *mock.Mock) {
+					m.On("ListPartitions", mock.Anything, nil).Return(&partition.ListPartitionsOK{
+						Payload: []*models.V1PartitionResponse{
+							{
+								Bootconfig: &models.V1PartitionBootConfiguration{
+									Imageurl: ts.URL + "/boot/initrd.img.lz4",
+								},
+							},
+						},
+					}, nil)
+				},
+			})
+
+			s := &SyncLister{
+				logger:     slog.Default(),
+				client:     NewMetalAPIClient(client),
+				stop:       context.TODO(),
+				config:     &api.Config{RequireBootImageMD5: tt.requireMD5},
+				httpClient: http.DefaultClient,
+				headCache:  newHeadCache(0),
+			}
+
+			got, err := s.DetermineBootImageSyncList()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			if len(got) > 0 {
+				assert.False(t, got[0].HasMD5())
+			}
+		})
+	}
+}
+
+func TestSyncLister_DetermineBootImageSyncListProbesOnce(t *testing.T) {
+	var heads atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heads.Add(1)
+		switch r.URL.Path {
+		case "/boot/initrd.img.lz4":
+			w.Header().Set("Content-Length", "4")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	var partitions []*models.V1PartitionResponse
+	for i := 0; i < 3; i++ {
+		partitions = append(partitions, &models.V1PartitionResponse{
+			Bootconfig: &models.V1PartitionBootConfiguration{
+				Imageurl: ts.URL + "/boot/initrd.img.lz4",
+			},
+		})
+	}
+
+	s := &SyncLister{
+		logger:     slog.Default(),
+		client:     &fakeMetalClient{partitions: partitions},
+		stop:       context.TODO(),
+		config:     &api.Config{RequireBootImageMD5: true},
+		httpClient: http.DefaultClient,
+		headCache:  newHeadCache(0),
+	}
+
+	got, err := s.DetermineBootImageSyncList()
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// image, md5 and sha256 are probed once although the skipped boot image is used by every partition
+	assert.Equal(t, int32(3), heads.Load())
+}
+
+func TestSyncLister_retrieveImagesFromS3Paginated(t *testing.T) {
+	pages := []*s3.ListObjectsOutput{
+		{
+			IsTruncated: aws.Bool(true),
+			Contents: []*s3.Object{
+				{Key: aws.String("metal-os/ubuntu/20.04/img.tar.lz4")},
+				{Key: aws.String("metal-os/ubuntu/20.04/img.tar.lz4.md5")},
+			},
+		},
+		{
+			IsTruncated: aws.Bool(false),
+			Contents: []*s3.Object{
+				{Key: aws.String("metal-os/debian/10/img.tar.lz4")},
+			},
+		},
+	}
+
+	var markers []string
+	svc := s3.New(unit.Session)
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Unmarshal.Clear()
+	svc.Handlers.UnmarshalMeta.Clear()
+	svc.Handlers.ValidateResponse.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		markers = append(markers, aws.StringValue(r.Params.(*s3.ListObjectsInput).Marker))
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}
+	})
+	svc.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+		*r.Data.(*s3.ListObjectsOutput) = *pages[len(markers)-1]
+	})
+
+	s := &SyncLister{
+		s3:     svc,
+		config: &api.Config{ImageBuckets: []string{"images"}},
+	}
+
+	got, err := s.retrieveImagesFromS3()
+	require.NoError(t, err)
+	assert.Len(t, got["images"], 3)
+	assert.Contains(t, got["images"], "metal-os/debian/10/img.tar.lz4")
+	assert.Equal(t, []string{"", "metal-os/ubuntu/20.04/img.tar.lz4.md5"}, markers)
+}
+
+func TestSyncLister_DetermineImageSyncListIncludeOS(t *testing.T) {
+	var objects []*s3.Object
+	var images []*models.V1ImageResponse
+	for _, id := range []string{"ubuntu-20.04.20201026", "debian-10.0.20201026", "firewall-2.0.20210304"} {
+		key := "metal-os/" + id + "/img.tar.lz4"
+		objects = append(objects,
+			&s3.Object{Key: aws.String(key), Size: aws.Int64(1)},
+			&s3.Object{Key: aws.String(key + ".md5"), Size: aws.Int64(1)},
+		)
+		images = append(images, &models.V1ImageResponse{
+			ID:  aws.String(id),
+			URL: "https://images.metal-stack.io/" + key,
+		})
+	}
+	images = append(images, &models.V1ImageResponse{
+		ID:  aws.String("ubuntu-20.04.20201027"),
+		URL: "https://images.metal-stack.io/pull_requests/ubuntu-20.04.20201027/img.tar.lz4",
+	})
+
+	tests := []struct {
+		name      string
+		includeOS []string
+		want      []string
+	}{
+		{
+			name:      "empty include list syncs everything",
+			includeOS: nil,
+			want:      []string{"debian-10.0.20201026", "firewall-2.0.20210304", "ubuntu-20.04.20201026"},
+		},
+		{
+			name:      "restrictive include list",
+			includeOS: []string{"ubuntu", "firewall"},
+			want:      []string{"firewall-2.0.20210304", "ubuntu-20.04.20201026"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := metaltestclient.NewMetalMockClient(t, &metaltestclient.MetalMockFns{
+				Image: func(m *mock.Mock) {
+					m.On("ListImages", mock.Anything, nil).Return(&image.ListImagesOK{Payload: images}, nil)
+				},
+			})
+
+			s := &SyncLister{
+				logger: slog.Default(),
+				client: NewMetalAPIClient(client),
+				s3:     newS3Mock(map[string][]*s3.Object{"images": objects}),
+				config: &api.Config{
+					ImageStore:   "metal-stack.io",
+					ImageBuckets: []string{"images"},
+					MaxCacheSize: 1024,
+					ExcludePaths: []string{"/pull_requests/"},
+					IncludeOS:    tt.includeOS,
+				},
+				imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+			}
+
+			got, err := s.DetermineImageSyncList()
+			require.NoError(t, err)
+
+			var ids []string
+			for _, img := range got {
+				ids = append(ids, *img.ApiRef.ID)
+			}
+			assert.ElementsMatch(t, tt.want, ids)
+		})
+	}
+}
+
+func TestSyncLister_DetermineImageSyncListMultipleBuckets(t *testing.T) {
+	objects := func(key string) []*s3.Object {
+		return []*s3.Object{
+			{Key: aws.String(key), Size: aws.Int64(1)},
+			{Key: aws.String(key + ".md5"), Size: aws.Int64(1)},
+		}
+	}
+
+	svc := newS3Mock(map[string][]*s3.Object{
+		"images":          objects("metal-os/ubuntu/20.04/20201026/img.tar.lz4"),
+		"firewall-images": append(objects("metal-os/firewall/2.0/20210304/img.tar.lz4"), objects("metal-os/debian/10/20201026/img.tar.lz4")...),
+	})
+
+	_, client := metaltestclient.NewMetalMockClient(t, &metaltestclient.MetalMockFns{
+		Image: func(m *mock.Mock) {
+			m.On("ListImages", mock.Anything, nil).Return(&image.ListImagesOK{Payload: []*models.V1ImageResponse{
+				{
+					ID:  aws.String("ubuntu-20.04.20201026"),
+					URL: "https://images.metal-stack.io/metal-os/ubuntu/20.04/20201026/img.tar.lz4",
+				},
+				{
+					ID:  aws.String("firewall-2.0.20210304"),
+					URL: "https://s3.metal-stack.io/firewall-images/metal-os/firewall/2.0/20210304/img.tar.lz4",
+				},
+				{
+					ID:  aws.String("debian-10.0.20201026"),
+					URL: "https://cdn.metal-stack.io/metal-os/debian/10/20201026/img.tar.lz4",
+				},
+			}}, nil)
+		},
+	})
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: NewMetalAPIClient(client),
+		s3:     svc,
+		config: &api.Config{
+			ImageStore:   "https://metal-stack.io",
+			ImageBuckets: []string{"images", "firewall-images"},
+			MaxCacheSize: 1024,
+		},
+		imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+	}
+
+	got, err := s.DetermineImageSyncList()
+	require.NoError(t, err)
+
+	buckets := map[string]string{}
+	for _, img := range got {
+		buckets[*img.ApiRef.ID] = img.BucketName + ":" + img.BucketKey
+	}
+	assert.Equal(t, map[string]string{
+		"ubuntu-20.04.20201026": "images:metal-os/ubuntu/20.04/20201026/img.tar.lz4",
+		"firewall-2.0.20210304": "firewall-images:metal-os/firewall/2.0/20210304/img.tar.lz4",
+		"debian-10.0.20201026":  "firewall-images:metal-os/debian/10/20201026/img.tar.lz4",
+	}, buckets)
+}
+
+// newS3Mock returns an s3 client that lists the given objects by bucket in a single page.
+func newS3Mock(buckets map[string][]*s3.Object) *s3.S3 {
+	svc := s3.New(unit.Session)
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Unmarshal.Clear()
+	svc.Handlers.UnmarshalMeta.Clear()
+	svc.Handlers.ValidateResponse.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}
+	})
+	svc.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+		bucket := aws.StringValue(r.Params.(*s3.ListObjectsInput).Bucket)
+		*r.Data.(*s3.ListObjectsOutput) = s3.ListObjectsOutput{IsTruncated: aws.Bool(false), Contents: buckets[bucket]}
+	})
+	return svc
+}
+
+type fakeMetalClient struct {
+	images     []*models.V1ImageResponse
+	partitions []*models.V1PartitionResponse
+}
+
+func (f *fakeMetalClient) ListImages() ([]*models.V1ImageResponse, error) {
+	return f.images, nil
+}
+
+func (f *fakeMetalClient) ListPartitions() ([]*models.V1PartitionResponse, error) {
+	return f.partitions, nil
+}
+
+func TestSyncLister_DetermineImageSyncList(t *testing.T) {
+	expired := strfmt.DateTime(time.Now().Add(-10 * 24 * time.Hour))
+	expiring := strfmt.DateTime(time.Now().Add(24 * time.Hour))
+
+	var objects []*s3.Object
+	var images []*models.V1ImageResponse
+	addImage := func(id string, size int64, expiration *strfmt.DateTime) {
+		key := "metal-os/" + id + "/img.tar.lz4"
+		objects = append(objects,
+			&s3.Object{Key: aws.String(key), Size: aws.Int64(size)},
+			&s3.Object{Key: aws.String(key + ".md5"), Size: aws.Int64(1)},
+		)
+		images = append(images, &models.V1ImageResponse{
+			ID:             aws.String(id),
+			URL:            "https://images.metal-stack.io/" + key,
+			ExpirationDate: expiration,
+		})
+	}
+	addImage("ubuntu-20.04.20201024", 100, &expired)
+	addImage("ubuntu-20.04.20201025", 100, nil)
+	addImage("ubuntu-20.04.20201026", 100, &expiring)
+	addImage("ubuntu-20.04.20201027", 100, nil)
+	addImage("firewall-2.0.20210301", 300, nil)
+	addImage("firewall-2.0.20210302", 300, nil)
+
+	tests := []struct {
+		name   string
+		config api.Config
+		want   []string
+	}{
+		{
+			name: "everything fits",
+			config: api.Config{
+				MinImagesPerName: 1,
+				MaxImagesPerName: -1,
+				MaxCacheSize:     10000,
+			},
+			want: []string{"firewall-2.0.20210301", "firewall-2.0.20210302", "ubuntu-20.04.20201025", "ubuntu-20.04.20201026", "ubuntu-20.04.20201027"},
+		},
+		{
+			name: "expired images within grace period",
+			config: api.Config{
+				MinImagesPerName:    1,
+				MaxImagesPerName:    -1,
+				MaxCacheSize:        10000,
+				ExpirationGraceDays: 30,
+			},
+			want: []string{"firewall-2.0.20210301", "firewall-2.0.20210302", "ubuntu-20.04.20201024", "ubuntu-20.04.20201025", "ubuntu-20.04.20201026", "ubuntu-20.04.20201027"},
+		},
+		{
+			name: "max images per name",
+			config: api.Config{
+				MinImagesPerName: 1,
+				MaxImagesPerName: 2,
+				MaxCacheSize:     10000,
+			},
+			want: []string{"firewall-2.0.20210301", "firewall-2.0.20210302", "ubuntu-20.04.20201026", "ubuntu-20.04.20201027"},
+		},
+		{
+			name: "reduced to cache size",
+			config: api.Config{
+				MinImagesPerName: 1,
+				MaxImagesPerName: -1,
+				MaxCacheSize:     600,
+			},
+			want: []string{"firewall-2.0.20210302", "ubuntu-20.04.20201026", "ubuntu-20.04.20201027"},
+		},
+		{
+			name: "cache size cannot go below min images per name",
+			config: api.Config{
+				MinImagesPerName: 2,
+				MaxImagesPerName: -1,
+				MaxCacheSize:     1,
+			},
+			want: []string{"firewall-2.0.20210301", "firewall-2.0.20210302", "ubuntu-20.04.20201026", "ubuntu-20.04.20201027"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.ImageStore = "metal-stack.io"
+			config.ImageBuckets = []string{"images"}
+
+			s := &SyncLister{
+				logger:         slog.Default(),
+				client:         &fakeMetalClient{images: images},
+				s3:             newS3Mock(map[string][]*s3.Object{"images": objects}),
+				config:         &config,
+				imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+			}
+
+			got, err := s.DetermineImageSyncList()
+			require.NoError(t, err)
+
+			var ids []string
+			for _, img := range got {
+				ids = append(ids, img.GetName())
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func TestSyncLister_DetermineImageSyncListSkippedImages(t *testing.T) {
+	expired := strfmt.DateTime(time.Now().Add(-10 * 24 * time.Hour))
+
+	var objects []*s3.Object
+	var images []*models.V1ImageResponse
+	addImage := func(id string, size int64, expiration *strfmt.DateTime) {
+		key := "metal-os/" + id + "/img.tar.lz4"
+		objects = append(objects,
+			&s3.Object{Key: aws.String(key), Size: aws.Int64(size)},
+			&s3.Object{Key: aws.String(key + ".md5"), Size: aws.Int64(1)},
+		)
+		images = append(images, &models.V1ImageResponse{
+			ID:             aws.String(id),
+			URL:            "https://images.metal-stack.io/" + key,
+			ExpirationDate: expiration,
+		})
+	}
+	addImage("ubuntu-20.04.20201024", 100, &expired)
+	addImage("ubuntu-20.04.20201025", 100, nil)
+	addImage("ubuntu-20.04.20201026", 100, nil)
+	addImage("ubuntu-20.04.20201027", 100, nil)
+	addImage("firewall-2.0.20210301", 300, nil)
+	addImage("firewall-2.0.20210302", 300, nil)
+
+	images = append(images,
+		&models.V1ImageResponse{
+			ID:  aws.String("debian-10.0.20210101"),
+			URL: "https://images.metal-stack.io/metal-os/pull_requests/debian-10.0.20210101/img.tar.lz4",
+		},
+		&models.V1ImageResponse{
+			ID:  aws.String("centos-7.0.20210101"),
+			URL: "https://images.metal-stack.io/metal-os/centos-7.0.20210101/img.tar.lz4",
+		},
+	)
+	objects = append(objects, &s3.Object{Key: aws.String("metal-os/almalinux-9.0.20210101/img.tar.lz4"), Size: aws.Int64(100)})
+	images = append(images, &models.V1ImageResponse{
+		ID:  aws.String("almalinux-9.0.20210101"),
+		URL: "https://images.metal-stack.io/metal-os/almalinux-9.0.20210101/img.tar.lz4",
+	})
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: &fakeMetalClient{images: images},
+		s3:     newS3Mock(map[string][]*s3.Object{"images": objects}),
+		config: &api.Config{
+			ImageStore:         "metal-stack.io",
+			ImageBuckets:       []string{"images"},
+			ExcludePaths:       []string{"/pull_requests/"},
+			OriginAbsentPolicy: api.OriginAbsentPolicyRemove,
+			MinImagesPerName:   1,
+			MaxImagesPerName:   2,
+			MaxCacheSize:       400,
+		},
+		imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+	}
+
+	got, err := s.DetermineImageSyncList()
+	require.NoError(t, err)
+
+	var ids []string
+	for _, img := range got {
+		ids = append(ids, img.GetName())
+	}
+	assert.Equal(t, []string{"firewall-2.0.20210302", "ubuntu-20.04.20201027"}, ids)
+
+	families, err := s.imageCollector.GetGatherer().Gather()
+	require.NoError(t, err)
+
+	skipped := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "images_skipped_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			skipped[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+
+	assert.Equal(t, map[string]float64{
+		metrics.SkipReasonExpired:        1,
+		metrics.SkipReasonExcluded:       1,
+		metrics.SkipReasonMissingInStore: 1,
+		metrics.SkipReasonMissingMD5:     1,
+		metrics.SkipReasonOverMax:        1,
+		metrics.SkipReasonReduced:        2,
+	}, skipped)
+}
+
+func TestSyncLister_DetermineImageSyncListOriginAbsent(t *testing.T) {
+	objects := []*s3.Object{
+		{Key: aws.String("metal-os/ubuntu-20.04.20201026/img.tar.lz4"), Size: aws.Int64(100)},
+		{Key: aws.String("metal-os/ubuntu-20.04.20201026/img.tar.lz4.md5"), Size: aws.Int64(32)},
+	}
+	images := []*models.V1ImageResponse{
+		{ID: aws.String("ubuntu-20.04.20201026"), URL: "https://images.metal-stack.io/metal-os/ubuntu-20.04.20201026/img.tar.lz4"},
+		{ID: aws.String("ubuntu-20.04.20201027"), URL: "https://images.metal-stack.io/metal-os/ubuntu-20.04.20201027/img.tar.lz4"},
+	}
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: &fakeMetalClient{images: images},
+		s3:     newS3Mock(map[string][]*s3.Object{"images": objects}),
+		config: &api.Config{
+			ImageStore:         "metal-stack.io",
+			ImageBuckets:       []string{"images"},
+			OriginAbsentPolicy: api.OriginAbsentPolicyKeep,
+			MinImagesPerName:   1,
+			MaxImagesPerName:   1,
+			MaxCacheSize:       100,
+		},
+		imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+	}
+
+	got, err := s.DetermineImageSyncList()
+	require.NoError(t, err)
+
+	// the newer origin-absent image does not push the available image out of the limits
+	require.Len(t, got, 2)
+	assert.Equal(t, "ubuntu-20.04.20201026", got[0].GetName())
+	assert.False(t, got[0].OriginAbsent)
+	assert.Equal(t, "ubuntu-20.04.20201027", got[1].GetName())
+	assert.True(t, got[1].OriginAbsent)
+}
+
+func TestSyncLister_DetermineImageSyncListHTTPOrigin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metal-os/debian/10/20201026/img.tar.lz4":
+			w.Header().Set("Content-Length", "42")
+		case "/metal-os/debian/10/20201026/img.tar.lz4.md5":
+			w.Header().Set("Content-Length", "1")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	key := "metal-os/ubuntu/20.04/20201026/img.tar.lz4"
+	svc := newS3Mock(map[string][]*s3.Object{
+		"images": {
+			{Key: aws.String(key), Size: aws.Int64(1)},
+			{Key: aws.String(key + ".md5"), Size: aws.Int64(1)},
+		},
+	})
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: &fakeMetalClient{images: []*models.V1ImageResponse{
+			{
+				ID:  aws.String("ubuntu-20.04.20201026"),
+				URL: "https://images.metal-stack.io/" + key,
+			},
+			{
+				ID:  aws.String("debian-10.0.20201026"),
+				URL: ts.URL + "/metal-os/debian/10/20201026/img.tar.lz4",
+			},
+			{
+				ID:  aws.String("centos-7.0.20201026"),
+				URL: ts.URL + "/metal-os/centos/7/20201026/img.tar.lz4",
+			},
+		}},
+		s3:   svc,
+		stop: context.TODO(),
+		config: &api.Config{
+			ImageStore:         "metal-stack.io",
+			ImageBuckets:       []string{"images"},
+			OriginAbsentPolicy: api.OriginAbsentPolicyKeep,
+			MaxCacheSize:       1024,
+		},
+		imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+		httpClient:     http.DefaultClient,
+		headCache:      newHeadCache(0),
+	}
+
+	got, err := s.DetermineImageSyncList()
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+
+	// an image that is not available over http is handed to the origin absent policy of the syncer
+	centos := got[0]
+	assert.Equal(t, "centos-7.0.20201026", centos.GetName())
+	assert.True(t, centos.OriginAbsent)
+	assert.Equal(t, "metal-os/centos/7/20201026/img.tar.lz4", centos.GetSubPath())
+	assert.False(t, centos.HasMD5())
+
+	debian := got[1]
+	assert.Equal(t, "debian-10.0.20201026", debian.GetName())
+	assert.True(t, debian.ViaHTTP)
+	assert.Equal(t, "metal-os/debian/10/20201026/img.tar.lz4", debian.GetSubPath())
+	assert.Equal(t, int64(42), debian.GetSize())
+	assert.True(t, debian.HasMD5())
+	assert.False(t, debian.HasSHA256())
+
+	ubuntu := got[2]
+	assert.Equal(t, "ubuntu-20.04.20201026", ubuntu.GetName())
+	assert.False(t, ubuntu.ViaHTTP)
+	assert.Equal(t, "images", ubuntu.BucketName)
+}
+
+func TestSyncLister_DetermineImageSyncListHTTPFallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metal-os/ubuntu/20.04/20201026/img.tar.lz4":
+			w.Header().Set("Content-Length", "42")
+		case "/metal-os/ubuntu/20.04/20201026/img.tar.lz4.sha256":
+			w.Header().Set("Content-Length", "1")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		fallback bool
+		path     string
+		wantErr  bool
+	}{
+		{
+			name:     "listing error without fallback",
+			fallback: false,
+			path:     "/metal-os/ubuntu/20.04/20201026/img.tar.lz4",
+			wantErr:  true,
+		},
+		{
+			name:     "listing error with fallback",
+			fallback: true,
+			path:     "/metal-os/ubuntu/20.04/20201026/img.tar.lz4",
+		},
+		{
+			name:     "image store not reachable over http either",
+			fallback: true,
+			path:     "/metal-os/ubuntu/20.04/20201027/img.tar.lz4",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			svc := s3.New(unit.Session)
+			svc.Handlers.Send.Clear()
+			svc.Handlers.Send.PushBack(func(r *request.Request) {
+				r.Error = fmt.Errorf("s3 api not available")
+			})
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			s := &SyncLister{
+				logger: slog.Default(),
+				client: &fakeMetalClient{images: []*models.V1ImageResponse{
+					{
+						ID:  aws.String("ubuntu-20.04.20201026"),
+						URL: ts.URL + tt.path,
+					},
+				}},
+				s3:   svc,
+				stop: context.TODO(),
+				config: &api.Config{
+					ImageStore:             u.Host,
+					ImageBuckets:           []string{"images"},
+					ImageStoreHTTPFallback: tt.fallback,
+					MaxCacheSize:           1024,
+				},
+				imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+				httpClient:     http.DefaultClient,
+				headCache:      newHeadCache(0),
+			}
+
+			got, err := s.DetermineImageSyncList()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, got, 1)
+			assert.True(t, got[0].ViaHTTP)
+			assert.Equal(t, int64(42), got[0].GetSize())
+			assert.False(t, got[0].HasMD5())
+			assert.True(t, got[0].HasSHA256())
+		})
+	}
+}
+
+func TestSyncLister_DetermineKernelSyncListMD5(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/metal-kernel", "/v2/metal-kernel", "/v2/metal-kernel.md5":
+			w.Header().Set("Content-Length", "4")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: &fakeMetalClient{partitions: []*models.V1PartitionResponse{
+			{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v1/metal-kernel"}},
+			{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v2/metal-kernel"}},
+		}},
+		stop:       context.TODO(),
+		config:     &api.Config{},
+		httpClient: http.DefaultClient,
+		headCache:  newHeadCache(0),
+	}
+
+	got, err := s.DetermineKernelSyncList()
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.False(t, got[0].HasMD5(), "kernel without md5 must be synced unverified")
+	assert.True(t, got[1].HasMD5())
+}
+
+func TestSyncLister_DetermineKernelSyncListExcludes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		config api.Config
+		want   []string
+	}{
+		{
+			name:   "image excludes do not apply to kernels",
+			config: api.Config{ImageExcludes: []string{"/v1/"}},
+			want:   []string{ts.URL + "/v1/metal-kernel", ts.URL + "/v2/metal-kernel"},
+		},
+		{
+			name:   "global excludes apply to kernels",
+			config: api.Config{ExcludePaths: []string{"/v1/"}, ImageExcludes: []string{"/v2/"}},
+			want:   []string{ts.URL + "/v2/metal-kernel"},
+		},
+		{
+			name:   "kernel excludes replace global excludes",
+			config: api.Config{ExcludePaths: []string{"/v1/"}, KernelExcludes: []string{"/v2/"}},
+			want:   []string{ts.URL + "/v1/metal-kernel"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			s := &SyncLister{
+				logger: slog.Default(),
+				client: &fakeMetalClient{partitions: []*models.V1PartitionResponse{
+					{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v1/metal-kernel"}},
+					{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v2/metal-kernel"}},
+				}},
+				stop:       context.TODO(),
+				config:     &config,
+				httpClient: http.DefaultClient,
+				headCache:  newHeadCache(0),
+			}
+
+			got, err := s.DetermineKernelSyncList()
+			require.NoError(t, err)
+
+			var urls []string
+			for _, k := range got {
+				urls = append(urls, k.URL)
+			}
+			assert.Equal(t, tt.want, urls)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package synclister
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+)
+
+// DeterminePeerSyncList returns the files served by a peer cache, base url points to the peer's cache server.
+func (s *SyncLister) DeterminePeerSyncList(baseURL string) ([]api.PeerFile, error) {
+	manifestURL, err := url.JoinPath(baseURL, "manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("peer url is invalid:%w", err)
+	}
+
+	req, err := http.NewRequestWithContext(s.stop, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create get request:%w", err)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading peer manifest:%w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get request to peer manifest did not return OK: %s", manifestURL)
+	}
+
+	var manifest []api.ManifestEntry
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding peer manifest:%w", err)
+	}
+
+	var result []api.PeerFile
+	for _, e := range manifest {
+		if !isRelativeSubPath(e.SubPath) {
+			s.logger.Error("peer file path is not relative to the cache root, skipping", "path", e.SubPath)
+			continue
+		}
+
+		if s.isExcluded(e.SubPath, s.config.ExcludePaths) {
+			s.logger.Debug("skipping peer file with exclude path", "path", e.SubPath)
+			continue
+		}
+
+		fileURL, err := url.JoinPath(baseURL, e.SubPath)
+		if err != nil {
+			s.logger.Error("peer file url is invalid, skipping", "error", err)
+			continue
+		}
+
+		result = append(result, api.PeerFile{
+			SubPath: e.SubPath,
+			URL:     fileURL,
+			Size:    e.Size,
+			MD5:     e.MD5,
+		})
+	}
+
+	return result, nil
+}
+
+// isRelativeSubPath returns false for sub paths of a peer manifest that are absolute or point outside of the cache root.
+func isRelativeSubPath(subPath string) bool {
+	if subPath == "" || path.IsAbs(subPath) || filepath.IsAbs(subPath) {
+		return false
+	}
+
+	for _, segment := range strings.FieldsFunc(subPath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
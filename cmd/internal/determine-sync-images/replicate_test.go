@@ -0,0 +1,97 @@
+package synclister
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncLister_DeterminePeerSyncList(t *testing.T) {
+	files := map[string]string{
+		"/metal-os/master/ubuntu/20.04/20201026/img.tar.lz4": "ubuntu",
+		"/metal-os/pull_requests/ubuntu/img.tar.lz4":         "excluded",
+	}
+
+	manifest := []api.ManifestEntry{
+		{
+			Name:    "metal-os/master/ubuntu/20.04/20201026/img.tar.lz4",
+			SubPath: "metal-os/master/ubuntu/20.04/20201026/img.tar.lz4",
+			Size:    6,
+			MD5:     "1d41c853af58d3a7ae54990ce29417d8",
+		},
+		{
+			Name:    "metal-os/pull_requests/ubuntu/img.tar.lz4",
+			SubPath: "metal-os/pull_requests/ubuntu/img.tar.lz4",
+			Size:    8,
+		},
+		{
+			Name:    "escaping",
+			SubPath: "metal-os/../../../etc/cron.d/evil",
+			Size:    4,
+		},
+		{
+			Name:    "absolute",
+			SubPath: "/etc/cron.d/evil",
+			Size:    4,
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.json" {
+			_ = json.NewEncoder(w).Encode(manifest)
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer ts.Close()
+
+	s := &SyncLister{
+		logger:     slog.Default(),
+		stop:       context.TODO(),
+		config:     &api.Config{ExcludePaths: []string{"/pull_requests/"}},
+		httpClient: http.DefaultClient,
+	}
+
+	got, err := s.DeterminePeerSyncList(ts.URL)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, api.PeerFile{
+		SubPath: "metal-os/master/ubuntu/20.04/20201026/img.tar.lz4",
+		URL:     ts.URL + "/metal-os/master/ubuntu/20.04/20201026/img.tar.lz4",
+		Size:    6,
+		MD5:     "1d41c853af58d3a7ae54990ce29417d8",
+	}, got[0])
+
+	fs := afero.NewMemMapFs()
+
+	target, err := fs.Create("/tmp/img.tar.lz4")
+	require.NoError(t, err)
+	defer target.Close()
+
+	n, err := got[0].Download(context.TODO(), target, http.DefaultClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), n)
+
+	// a file altered on the peer must not be replicated
+	files["/metal-os/master/ubuntu/20.04/20201026/img.tar.lz4"] = "tamper"
+
+	tampered, err := fs.Create("/tmp/tampered.tar.lz4")
+	require.NoError(t, err)
+	defer tampered.Close()
+
+	_, err = got[0].Download(context.TODO(), tampered, http.DefaultClient, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package synclister
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+)
+
+// SyncLists contains the entities to sync into the image, kernel and boot image caches.
+type SyncLists struct {
+	Images     []api.OS
+	Kernels    []api.Kernel
+	BootImages []api.BootImage
+
+	// ImagesErr, KernelsErr and BootImagesErr are set if the respective list could not be determined,
+	// such that the sync of the other caches is not prevented by a single failing list
+	ImagesErr     error
+	KernelsErr    error
+	BootImagesErr error
+}
+
+func (l *SyncLists) size() int64 {
+	var size int64
+	for _, img := range l.Images {
+		size += img.GetSize()
+	}
+	for _, k := range l.Kernels {
+		size += k.GetSize()
+	}
+	for _, b := range l.BootImages {
+		size += b.GetSize()
+	}
+	return size
+}
+
+// DetermineSyncLists determines the entities of all caches and reduces them to the maximum total cache size.
+// lists that cannot be determined are left empty and do not count against the maximum total cache size.
+func (s *SyncLister) DetermineSyncLists() *SyncLists {
+	lists := &SyncLists{}
+
+	var err error
+	lists.Images, err = s.DetermineImageSyncList()
+	if err != nil {
+		lists.ImagesErr = fmt.Errorf("cannot gather images:%w", err)
+	}
+
+	lists.Kernels, err = s.DetermineKernelSyncList()
+	if err != nil {
+		lists.KernelsErr = fmt.Errorf("cannot gather kernels:%w", err)
+	}
+
+	lists.BootImages, err = s.DetermineBootImageSyncList()
+	if err != nil {
+		lists.BootImagesErr = fmt.Errorf("cannot gather boot images:%w", err)
+	}
+
+	if lists.ImagesErr != nil || lists.KernelsErr != nil || lists.BootImagesErr != nil {
+		s.logger.Warn("not all sync lists could be determined, the maximum total cache size is only applied to the determined ones")
+	}
+
+	s.reduceToTotalCacheSize(lists)
+
+	return lists
+}
+
+// reduceToTotalCacheSize evicts entities until the caches fit into the maximum total cache size. images are evicted
+// first as they are not referenced by partitions, the minimum images per name and the fallback image are kept.
+// afterwards the kernels and boot images referenced by the least partitions are evicted, the oldest first.
+func (s *SyncLister) reduceToTotalCacheSize(lists *SyncLists) {
+	if s.config.MaxTotalCacheSize <= 0 {
+		return
+	}
+
+	sizeCount := lists.size()
+	if sizeCount <= s.config.MaxTotalCacheSize {
+		return
+	}
+
+	var (
+		images []api.OS
+		// the fallback image is never evicted, origin-absent images are not downloaded and do not count against the limit
+		retained []api.OS
+	)
+	for _, img := range lists.Images {
+		if img.OriginAbsent || (s.config.FallbackImage != "" && img.ApiRef.ID != nil && *img.ApiRef.ID == s.config.FallbackImage) {
+			retained = append(retained, img)
+			continue
+		}
+		images = append(images, img)
+	}
+
+	for sizeCount > s.config.MaxTotalCacheSize {
+		var err error
+		images, sizeCount, err = s.reduce(images, sizeCount)
+		if err != nil {
+			break
+		}
+		s.skipped(metrics.SkipReasonReduced, 1)
+	}
+
+	lists.Images = append(images, retained...)
+	api.SortOSImagesByName(lists.Images)
+
+	type bootArtifact struct {
+		kind         string
+		url          string
+		size         int64
+		references   int
+		lastModified time.Time
+	}
+
+	var artifacts []bootArtifact
+	for _, k := range lists.Kernels {
+		artifacts = append(artifacts, bootArtifact{kind: "kernel", url: k.URL, size: k.GetSize(), references: k.References, lastModified: k.LastModified})
+	}
+	for _, b := range lists.BootImages {
+		artifacts = append(artifacts, bootArtifact{kind: "boot image", url: b.URL, size: b.GetSize(), references: b.References, lastModified: b.LastModified})
+	}
+
+	sort.SliceStable(artifacts, func(i, j int) bool {
+		if artifacts[i].references != artifacts[j].references {
+			return artifacts[i].references < artifacts[j].references
+		}
+		return artifacts[i].lastModified.Before(artifacts[j].lastModified)
+	})
+
+	evicted := map[string]bool{}
+	for _, a := range artifacts {
+		if sizeCount <= s.config.MaxTotalCacheSize {
+			break
+		}
+
+		s.logger.Warn("evicting boot artifact to respect the maximum total cache size", "kind", a.kind, "url", a.url, "references", a.references)
+
+		evicted[a.kind+a.url] = true
+		sizeCount -= a.size
+	}
+
+	var kernels []api.Kernel
+	for _, k := range lists.Kernels {
+		if !evicted["kernel"+k.URL] {
+			kernels = append(kernels, k)
+		}
+	}
+	lists.Kernels = kernels
+
+	var bootImages []api.BootImage
+	for _, b := range lists.BootImages {
+		if !evicted["boot image"+b.URL] {
+			bootImages = append(bootImages, b)
+		}
+	}
+	lists.BootImages = bootImages
+
+	if sizeCount > s.config.MaxTotalCacheSize {
+		s.logger.Warn("cannot reduce the caches any further, exceeding maximum total cache size")
+	}
+}
@@ -0,0 +1,182 @@
+package synclister
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/metal-stack/metal-go/api/models"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncLister_reduceToTotalCacheSize(t *testing.T) {
+	now := time.Now()
+
+	lists := func() *SyncLists {
+		return &SyncLists{
+			Images: []api.OS{
+				testImage("ubuntu", "20.04.20201026", 100),
+				testImage("ubuntu", "20.04.20201027", 100),
+			},
+			Kernels: []api.Kernel{
+				{URL: "https://images.metal-stack.io/metal-kernel-shared", Size: 50, References: 2, LastModified: now.Add(-48 * time.Hour)},
+				{URL: "https://images.metal-stack.io/metal-kernel-single", Size: 50, References: 1, LastModified: now},
+			},
+			BootImages: []api.BootImage{
+				{URL: "https://images.metal-stack.io/metal-hammer-shared", Size: 50, References: 2, LastModified: now},
+			},
+		}
+	}
+
+	tests := []struct {
+		name              string
+		maxTotalCacheSize int64
+		wantImages        int
+		wantKernels       []string
+		wantBootImages    int
+	}{
+		{
+			name:              "disabled",
+			maxTotalCacheSize: 0,
+			wantImages:        2,
+			wantKernels:       []string{"https://images.metal-stack.io/metal-kernel-shared", "https://images.metal-stack.io/metal-kernel-single"},
+			wantBootImages:    1,
+		},
+		{
+			name:              "exactly at the limit",
+			maxTotalCacheSize: 350,
+			wantImages:        2,
+			wantKernels:       []string{"https://images.metal-stack.io/metal-kernel-shared", "https://images.metal-stack.io/metal-kernel-single"},
+			wantBootImages:    1,
+		},
+		{
+			name:              "images are evicted first",
+			maxTotalCacheSize: 250,
+			wantImages:        1,
+			wantKernels:       []string{"https://images.metal-stack.io/metal-kernel-shared", "https://images.metal-stack.io/metal-kernel-single"},
+			wantBootImages:    1,
+		},
+		{
+			name:              "least referenced boot artifacts are evicted after the images",
+			maxTotalCacheSize: 200,
+			wantImages:        1,
+			wantKernels:       []string{"https://images.metal-stack.io/metal-kernel-shared"},
+			wantBootImages:    1,
+		},
+		{
+			name:              "oldest boot artifacts are evicted on equal references",
+			maxTotalCacheSize: 150,
+			wantImages:        1,
+			wantKernels:       nil,
+			wantBootImages:    1,
+		},
+		{
+			name:              "minimum images are kept",
+			maxTotalCacheSize: 1,
+			wantImages:        1,
+			wantKernels:       nil,
+			wantBootImages:    0,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SyncLister{
+				logger: slog.Default(),
+				config: &api.Config{
+					MinImagesPerName:  1,
+					MaxTotalCacheSize: tt.maxTotalCacheSize,
+				},
+			}
+
+			got := lists()
+			s.reduceToTotalCacheSize(got)
+
+			require.Len(t, got.Images, tt.wantImages)
+			assert.Equal(t, "metal-os/ubuntu/20.04.20201027/img.tar.lz4", got.Images[len(got.Images)-1].BucketKey)
+
+			var kernels []string
+			for _, k := range got.Kernels {
+				kernels = append(kernels, k.URL)
+			}
+			assert.Equal(t, tt.wantKernels, kernels)
+			assert.Len(t, got.BootImages, tt.wantBootImages)
+		})
+	}
+}
+
+func TestSyncLister_DetermineKernelSyncListReferences(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4")
+	}))
+	defer ts.Close()
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: &fakeMetalClient{partitions: []*models.V1PartitionResponse{
+			{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v1/metal-kernel", Imageurl: ts.URL + "/v1/metal-hammer"}},
+			{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v2/metal-kernel", Imageurl: ts.URL + "/v1/metal-hammer"}},
+			{Bootconfig: &models.V1PartitionBootConfiguration{Kernelurl: ts.URL + "/v1/metal-kernel", Imageurl: ts.URL + "/v1/metal-hammer"}},
+		}},
+		stop:       context.TODO(),
+		config:     &api.Config{},
+		httpClient: http.DefaultClient,
+		headCache:  newHeadCache(0),
+	}
+
+	kernels, err := s.DetermineKernelSyncList()
+	require.NoError(t, err)
+	require.Len(t, kernels, 2)
+	assert.Equal(t, 2, kernels[0].References)
+	assert.Equal(t, 1, kernels[1].References)
+
+	bootImages, err := s.DetermineBootImageSyncList()
+	require.NoError(t, err)
+	require.Len(t, bootImages, 1)
+	assert.Equal(t, 3, bootImages[0].References)
+}
+
+func TestSyncLister_DetermineSyncListsPartialFailure(t *testing.T) {
+	svc := s3.New(unit.Session)
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = fmt.Errorf("s3 api not available")
+	})
+
+	s := &SyncLister{
+		logger: slog.Default(),
+		client: &fakeMetalClient{images: []*models.V1ImageResponse{
+			{ID: aws.String("ubuntu-20.04.20201026"), URL: "https://images.metal-stack.io/metal-os/ubuntu/20.04/20201026/img.tar.lz4"},
+		}},
+		s3:   svc,
+		stop: context.TODO(),
+		config: &api.Config{
+			ImageStore:        "metal-stack.io",
+			ImageBuckets:      []string{"images"},
+			MaxTotalCacheSize: 100,
+		},
+		imageCollector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir()),
+		httpClient:     http.DefaultClient,
+		headCache:      newHeadCache(0),
+	}
+
+	// a failing image list does not prevent the other lists from being determined
+	lists := s.DetermineSyncLists()
+	require.Error(t, lists.ImagesErr)
+	assert.Contains(t, lists.ImagesErr.Error(), "cannot gather images")
+	assert.Empty(t, lists.Images)
+	assert.NoError(t, lists.KernelsErr)
+	assert.NoError(t, lists.BootImagesErr)
+}
@@ -0,0 +1,250 @@
+package layout
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+const (
+	// Mirror stores entities in the same directory structure as the origin
+	Mirror = "mirror"
+	// Flat stores all entities in a single directory, the sub path is escaped into the file name
+	Flat = "flat"
+)
+
+// Layout maps the sub path of a cached entity to its location relative to the cache root and back.
+type Layout interface {
+	Path(subPath string) string
+	SubPath(p string) (string, error)
+}
+
+type mirrorLayout struct{}
+
+func (mirrorLayout) Path(subPath string) string {
+	return subPath
+}
+
+func (mirrorLayout) SubPath(p string) (string, error) {
+	return p, nil
+}
+
+type flatLayout struct{}
+
+func (flatLayout) Path(subPath string) string {
+	return url.PathEscape(subPath)
+}
+
+func (flatLayout) SubPath(p string) (string, error) {
+	if strings.Contains(p, "/") {
+		return "", fmt.Errorf("path %s is not part of a flat layout", p)
+	}
+	return url.PathUnescape(p)
+}
+
+func New(name string) (Layout, error) {
+	switch name {
+	case Mirror:
+		return mirrorLayout{}, nil
+	case Flat:
+		return flatLayout{}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache layout %q, must be one of %s or %s", name, Mirror, Flat)
+	}
+}
+
+// stagingSuffix is appended to the target root to get the directory files are migrated into before they are swapped in
+const stagingSuffix = ".migrating"
+
+type migration struct {
+	from     string
+	to       string
+	checksum string
+	staged   bool
+}
+
+// Migrate moves all files in sourceRoot from one layout to another into targetRoot, which may be the same as sourceRoot.
+// the files are migrated into a staging directory next to the target root, which only replaces the target root after the
+// checksums of all files were verified. if the migration fails, all files are moved back to the source root.
+func Migrate(logger *slog.Logger, fs afero.Fs, sourceRoot, targetRoot string, from, to Layout) error {
+	inPlace := sourceRoot == targetRoot
+	if !inPlace {
+		exists, err := afero.Exists(fs, targetRoot)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("migration target %s already exists", targetRoot)
+		}
+	}
+
+	stagingRoot := targetRoot + stagingSuffix
+	exists, err := afero.Exists(fs, stagingRoot)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("staging directory %s of a previous migration already exists", stagingRoot)
+	}
+
+	var migrations []migration
+	err = afero.Walk(fs, sourceRoot, func(p string, info os.FileInfo, innerErr error) error {
+		if innerErr != nil {
+			return fmt.Errorf("error while walking through root path %s error:%w", sourceRoot, innerErr)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		subPath, err := from.SubPath(p[len(sourceRoot)+1:])
+		if err != nil {
+			return err
+		}
+
+		checksum, err := utils.FileMD5(fs, p)
+		if err != nil {
+			return fmt.Errorf("error calculating hash sum of %s:%w", p, err)
+		}
+
+		migrations = append(migrations, migration{
+			from:     p,
+			to:       path.Join(stagingRoot, to.Path(subPath)),
+			checksum: checksum,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range migrations {
+		m := &migrations[i]
+
+		exists, err := afero.Exists(fs, m.to)
+		if err != nil {
+			return rollback(fs, stagingRoot, migrations, inPlace, err)
+		}
+		if exists {
+			return rollback(fs, stagingRoot, migrations, inPlace, fmt.Errorf("migration target %s already exists", m.to))
+		}
+
+		err = fs.MkdirAll(path.Dir(m.to), 0755)
+		if err != nil {
+			return rollback(fs, stagingRoot, migrations, inPlace, fmt.Errorf("error creating directory for %s:%w", m.to, err))
+		}
+
+		logger.Info("migrating file", "from", m.from, "to", m.to)
+
+		if inPlace {
+			err = fs.Rename(m.from, m.to)
+		} else {
+			err = copyFile(fs, m.from, m.to)
+		}
+		if err != nil {
+			return rollback(fs, stagingRoot, migrations, inPlace, fmt.Errorf("error migrating %s:%w", m.from, err))
+		}
+		m.staged = true
+	}
+
+	var errs []error
+	for _, m := range migrations {
+		checksum, err := utils.FileMD5(fs, m.to)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error calculating hash sum of %s:%w", m.to, err))
+			continue
+		}
+
+		if checksum != m.checksum {
+			errs = append(errs, fmt.Errorf("checksum of %s changed during migration", m.to))
+		}
+	}
+	if len(errs) > 0 {
+		return rollback(fs, stagingRoot, migrations, inPlace, fmt.Errorf("errors occurred verifying migration: %v", errs))
+	}
+
+	if !inPlace {
+		err = fs.Rename(stagingRoot, targetRoot)
+		if err != nil {
+			return rollback(fs, stagingRoot, migrations, inPlace, fmt.Errorf("error moving %s to %s:%w", stagingRoot, targetRoot, err))
+		}
+		return nil
+	}
+
+	// the source root only contains the empty directories of the old layout by now
+	oldRoot := sourceRoot + ".old"
+	err = fs.Rename(sourceRoot, oldRoot)
+	if err != nil {
+		return rollback(fs, stagingRoot, migrations, inPlace, fmt.Errorf("error moving %s to %s:%w", sourceRoot, oldRoot, err))
+	}
+
+	err = fs.Rename(stagingRoot, targetRoot)
+	if err != nil {
+		cause := fmt.Errorf("error moving %s to %s:%w", stagingRoot, targetRoot, err)
+		err = fs.Rename(oldRoot, sourceRoot)
+		if err != nil {
+			return fmt.Errorf("%w, restoring %s failed:%w", cause, sourceRoot, err)
+		}
+		return rollback(fs, stagingRoot, migrations, inPlace, cause)
+	}
+
+	err = fs.RemoveAll(oldRoot)
+	if err != nil {
+		logger.Warn("unable to remove directories of the previous layout", "path", oldRoot, "error", err)
+	}
+
+	return nil
+}
+
+// rollback moves the staged files back to the source root and removes the staging directory.
+func rollback(fs afero.Fs, stagingRoot string, migrations []migration, inPlace bool, cause error) error {
+	if inPlace {
+		for _, m := range migrations {
+			if !m.staged {
+				continue
+			}
+
+			err := fs.MkdirAll(path.Dir(m.from), 0755)
+			if err != nil {
+				return fmt.Errorf("%w, rolling back %s failed:%w", cause, m.from, err)
+			}
+
+			err = fs.Rename(m.to, m.from)
+			if err != nil {
+				return fmt.Errorf("%w, rolling back %s failed:%w", cause, m.from, err)
+			}
+		}
+	}
+
+	err := fs.RemoveAll(stagingRoot)
+	if err != nil {
+		return fmt.Errorf("%w, removing staging directory %s failed:%w", cause, stagingRoot, err)
+	}
+
+	return cause
+}
+
+func copyFile(fs afero.Fs, from, to string) error {
+	src, err := fs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.Create(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
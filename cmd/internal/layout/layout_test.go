@@ -0,0 +1,130 @@
+package layout
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	cacheRoot = "/tmp/test-path"
+)
+
+var mirrorFiles = map[string]string{
+	"/metal-os/master/ubuntu/20.04/20201026/img.tar.lz4":     "ubuntu",
+	"/metal-os/master/ubuntu/20.04/20201026/img.tar.lz4.md5": "d41d8cd98f00b204e9800998ecf8427e  img.tar.lz4",
+	"/metal-os/master/firewall/2.0/20210304/img.tar.lz4":     "firewall",
+}
+
+var flatFiles = map[string]string{
+	"/metal-os%2Fmaster%2Fubuntu%2F20.04%2F20201026%2Fimg.tar.lz4":     "ubuntu",
+	"/metal-os%2Fmaster%2Fubuntu%2F20.04%2F20201026%2Fimg.tar.lz4.md5": "d41d8cd98f00b204e9800998ecf8427e  img.tar.lz4",
+	"/metal-os%2Fmaster%2Ffirewall%2F2.0%2F20210304%2Fimg.tar.lz4":     "firewall",
+}
+
+func TestMigrate(t *testing.T) {
+	mirror, err := New(Mirror)
+	require.NoError(t, err)
+	flat, err := New(Flat)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		targetRoot string
+	}{
+		{
+			name:       "in place",
+			targetRoot: cacheRoot,
+		},
+		{
+			name:       "to new root",
+			targetRoot: "/tmp/new-path",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+			for p, content := range mirrorFiles {
+				require.NoError(t, afero.WriteFile(fs, cacheRoot+p, []byte(content), 0644))
+			}
+
+			err := Migrate(slog.Default(), fs, cacheRoot, tt.targetRoot, mirror, flat)
+			require.NoError(t, err)
+			assertFiles(t, fs, tt.targetRoot, flatFiles)
+
+			err = Migrate(slog.Default(), fs, tt.targetRoot, cacheRoot+"-back", flat, mirror)
+			require.NoError(t, err)
+			assertFiles(t, fs, cacheRoot+"-back", mirrorFiles)
+		})
+	}
+}
+
+func TestMigrate_targetExists(t *testing.T) {
+	mirror, err := New(Mirror)
+	require.NoError(t, err)
+	flat, err := New(Flat)
+	require.NoError(t, err)
+
+	fs := afero.NewMemMapFs()
+	for p, content := range mirrorFiles {
+		require.NoError(t, afero.WriteFile(fs, cacheRoot+p, []byte(content), 0644))
+	}
+	require.NoError(t, afero.WriteFile(fs, "/tmp/new-path/metal-os%2Fmaster%2Ffirewall%2F2.0%2F20210304%2Fimg.tar.lz4", []byte("other"), 0644))
+
+	err = Migrate(slog.Default(), fs, cacheRoot, "/tmp/new-path", mirror, flat)
+	require.Error(t, err)
+}
+
+// failingRenameFs fails to rename files containing the given pattern.
+type failingRenameFs struct {
+	afero.Fs
+	pattern string
+}
+
+func (f *failingRenameFs) Rename(oldname, newname string) error {
+	if strings.Contains(oldname, f.pattern) {
+		return fmt.Errorf("rename of %s failed", oldname)
+	}
+	return f.Fs.Rename(oldname, newname)
+}
+
+func TestMigrate_rollback(t *testing.T) {
+	mirror, err := New(Mirror)
+	require.NoError(t, err)
+	flat, err := New(Flat)
+	require.NoError(t, err)
+
+	fs := afero.NewMemMapFs()
+	for p, content := range mirrorFiles {
+		require.NoError(t, afero.WriteFile(fs, cacheRoot+p, []byte(content), 0644))
+	}
+
+	err = Migrate(slog.Default(), &failingRenameFs{Fs: fs, pattern: "firewall"}, cacheRoot, cacheRoot, mirror, flat)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rename of")
+
+	assertFiles(t, fs, cacheRoot, mirrorFiles)
+	for p := range flatFiles {
+		exists, err := afero.Exists(fs, cacheRoot+p)
+		require.NoError(t, err)
+		assert.False(t, exists, "file %s of the new layout must not exist", p)
+	}
+	exists, err := afero.Exists(fs, cacheRoot+stagingSuffix)
+	require.NoError(t, err)
+	assert.False(t, exists, "staging directory must be removed")
+}
+
+func assertFiles(t *testing.T, fs afero.Fs, root string, want map[string]string) {
+	for p, content := range want {
+		got, err := afero.ReadFile(fs, root+p)
+		require.NoError(t, err, "file %s does not exist", p)
+		assert.Equal(t, content, string(got))
+	}
+}
@@ -5,21 +5,30 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/spf13/afero"
 )
 
 type BootImageCollector struct {
-	logger         *slog.Logger
-	reg            *prometheus.Registry
-	rootPath       string
-	cacheMissInc   func()
-	cacheDownloads func()
+	bandwidth
+	syncStatus
+	*dirStats
+
+	logger             *slog.Logger
+	reg                *prometheus.Registry
+	rootPath           string
+	cacheOrphanedFiles func(float64)
+	cacheOrphanedBytes func(float64)
+	cacheMissInc       func()
+	cacheDownloads     func()
 }
 
-func MustBootImageMetrics(logger *slog.Logger, rootPath string) *BootImageCollector {
+func MustBootImageMetrics(logger *slog.Logger, fs afero.Fs, rootPath string) *BootImageCollector {
 	c := &BootImageCollector{
-		logger:   logger,
-		rootPath: rootPath,
-		reg:      prometheus.NewRegistry(),
+		logger:     logger,
+		rootPath:   rootPath,
+		dirStats:   sharedDirStats(fs, rootPath),
+		reg:        prometheus.NewRegistry(),
+		syncStatus: newSyncStatus(),
 	}
 
 	cacheSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
@@ -32,6 +41,18 @@ func MustBootImageMetrics(logger *slog.Logger, rootPath string) *BootImageCollec
 		Help: "Current amount of bootimages in the cache (amount of files in cache directory excluding checksums)",
 	}, c.cacheImageCount)
 
+	cacheOrphanedFiles := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_orphaned_files",
+		Help: "Amount of files in the cache that are not referenced by the want-list of the last sync",
+	})
+	c.cacheOrphanedFiles = cacheOrphanedFiles.Set
+
+	cacheOrphanedBytes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_orphaned_bytes",
+		Help: "Size of the files in the cache that are not referenced by the want-list of the last sync in bytes",
+	})
+	c.cacheOrphanedBytes = cacheOrphanedBytes.Set
+
 	cacheMisses := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "cache_misses",
 		Help: "Amount of cache misses during instance lifetime",
@@ -49,13 +70,17 @@ func MustBootImageMetrics(logger *slog.Logger, rootPath string) *BootImageCollec
 	c.reg.MustRegister(cacheSize)
 	c.reg.MustRegister(cacheImageCount)
 	c.reg.MustRegister(cacheMisses)
+	c.reg.MustRegister(cacheOrphanedFiles)
+	c.reg.MustRegister(cacheOrphanedBytes)
+	c.reg.MustRegister(c.bandwidthCollectors()...)
+	c.reg.MustRegister(c.syncStatusCollectors()...)
 	c.reg.MustRegister(cacheDownloads)
 
 	return c
 }
 
 func (c *BootImageCollector) cacheDirSize() float64 {
-	size, err := dirSize(c.rootPath)
+	size, _, err := c.dirStats.get()
 
 	if err != nil {
 		c.logger.Error("error collecting cache dir size metric", "error", err)
@@ -65,7 +90,7 @@ func (c *BootImageCollector) cacheDirSize() float64 {
 }
 
 func (c *BootImageCollector) cacheImageCount() float64 {
-	count, err := fileCount(c.rootPath)
+	_, count, err := c.dirStats.get()
 
 	if err != nil {
 		c.logger.Error("error collecting image cache count metric", "error", err)
@@ -74,6 +99,11 @@ func (c *BootImageCollector) cacheImageCount() float64 {
 	return float64(count)
 }
 
+func (c *BootImageCollector) SetOrphans(count int, bytes int64) {
+	c.cacheOrphanedFiles(float64(count))
+	c.cacheOrphanedBytes(float64(bytes))
+}
+
 func (c *BootImageCollector) IncrementCacheMiss() {
 	c.cacheMissInc()
 }
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// dirStatsTTL is the duration after which the size and file count of a cache directory are computed from scratch,
+// in between they are kept up to date by the sync, walking a large cache on every scrape is expensive.
+const dirStatsTTL = 10 * time.Minute
+
+// errDirUnreadable is returned if the cache directory itself cannot be walked, in contrast to single unreadable entries.
+var errDirUnreadable = errors.New("cache directory cannot be walked")
+
+var (
+	dirStatsMutex sync.Mutex
+	dirStatsByDir = map[dirStatsKey]*dirStats{}
+)
+
+type dirStatsKey struct {
+	fs   afero.Fs
+	path string
+}
+
+// dirStats caches the size, the file count and the image count by os of a directory.
+type dirStats struct {
+	fs   afero.Fs
+	path string
+	ttl  time.Duration
+
+	mutex      sync.Mutex
+	size       int64
+	count      int64
+	byOS       map[osVersion]int
+	err        error
+	updated    time.Time
+	refreshing bool
+}
+
+// sharedDirStats returns the stats of the given directory, collectors of the same directory share them such that
+// the directory is only walked once per ttl.
+func sharedDirStats(fs afero.Fs, path string) *dirStats {
+	dirStatsMutex.Lock()
+	defer dirStatsMutex.Unlock()
+
+	key := dirStatsKey{fs: fs, path: path}
+	d, ok := dirStatsByDir[key]
+	if !ok {
+		d = &dirStats{fs: fs, path: path, ttl: dirStatsTTL}
+		dirStatsByDir[key] = d
+	}
+
+	return d
+}
+
+// get returns the size and the file count of the directory. the directory is only walked on the first call,
+// afterwards the cached values are returned and a single refresh is started in the background once they are stale.
+func (d *dirStats) get() (int64, int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.updated.IsZero() {
+		d.size, d.count, d.byOS, d.err = walkDir(d.fs, d.path)
+		d.updated = time.Now()
+	} else if !d.refreshing && time.Since(d.updated) > d.ttl {
+		d.refreshing = true
+		go func() {
+			_, _, _ = d.update()
+		}()
+	}
+
+	return d.size, d.count, d.err
+}
+
+// imagesByOS returns the image count by os of the directory, cached like the size and the file count.
+func (d *dirStats) imagesByOS() (map[osVersion]int, error) {
+	_, _, err := d.get()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return maps.Clone(d.byOS), err
+}
+
+// UpdateCacheStats applies the changes of the sync to the stats of the directory, the sub path is the file that
+// was added or removed. sidecar files are not accounted, the deviation is corrected by the periodic walk of the directory.
+func (d *dirStats) UpdateCacheStats(subPath string, deltaBytes, deltaCount int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// not walked yet, the first scrape computes the stats anyway
+	if d.updated.IsZero() {
+		return
+	}
+
+	d.size = max(d.size+deltaBytes, 0)
+	d.count = max(d.count+deltaCount, 0)
+
+	if key, ok := osVersionOf(subPath); ok && deltaCount != 0 {
+		if d.byOS == nil {
+			d.byOS = map[osVersion]int{}
+		}
+		d.byOS[key] += int(deltaCount)
+		if d.byOS[key] <= 0 {
+			delete(d.byOS, key)
+		}
+	}
+}
+
+// CacheStats returns the size and the file count of the directory, zero if the directory cannot be walked.
+func (d *dirStats) CacheStats() CacheStats {
+	size, count, _ := d.get()
+	return CacheStats{Size: size, Files: count}
+}
+
+// update walks the directory right away, e.g. after a sync changed the directory. the previous stats are kept if
+// the directory cannot be walked at all, an unreadable cache directory does not look like an empty one.
+func (d *dirStats) update() (int64, int64, error) {
+	size, count, byOS, err := walkDir(d.fs, d.path)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.refreshing = false
+	d.err = err
+
+	if errors.Is(err, errDirUnreadable) && !d.updated.IsZero() {
+		return d.size, d.count, err
+	}
+
+	d.size, d.count, d.byOS = size, count, byOS
+	d.updated = time.Now()
+
+	return size, count, err
+}
+
+// walkDir sums up the size of the files in the given path and counts them without sidecar files, in total and by os.
+// entries that cannot be read are skipped and returned as joined error.
+func walkDir(fs afero.Fs, path string) (int64, int64, map[osVersion]int, error) {
+	var (
+		size    int64
+		count   int64
+		byOS    = map[osVersion]int{}
+		skipped []error
+	)
+	err := afero.Walk(fs, path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == path {
+				return fmt.Errorf("%w:%w", errDirUnreadable, err)
+			}
+			skipped = append(skipped, err)
+			return nil
+		}
+		if isLatestLink(path, p, info) {
+			return skipLatestLink(info)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		size += info.Size()
+		if isSidecar(info.Name()) {
+			return nil
+		}
+		count += 1
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		// images in a flat cache layout carry their escaped sub path in the file name
+		subPath, err := url.PathUnescape(filepath.ToSlash(rel))
+		if err != nil {
+			return nil
+		}
+		if key, ok := osVersionOf(subPath); ok {
+			byOS[key]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return size, count, byOS, errors.Join(skipped...)
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirStats(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/cache/ubuntu/img.tar.lz4", make([]byte, 100), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/cache/ubuntu/img.tar.lz4.md5", make([]byte, 10), 0644))
+	// copy of the newest version on filesystems without symlink support
+	require.NoError(t, afero.WriteFile(fs, "/cache/ubuntu/latest/img.tar.lz4", make([]byte, 100), 0644))
+
+	d := &dirStats{fs: fs, path: "/cache", ttl: time.Hour}
+
+	// checksum files take space but are not counted, latest links are skipped
+	size, count, err := d.get()
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), size)
+	assert.Equal(t, int64(1), count)
+
+	// served from memory within the ttl
+	require.NoError(t, afero.WriteFile(fs, "/cache/ubuntu/kernel", make([]byte, 50), 0644))
+	size, count, err = d.get()
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), size)
+	assert.Equal(t, int64(1), count)
+
+	// stale values are returned while they are refreshed in the background
+	d.mutex.Lock()
+	d.ttl = 0
+	d.mutex.Unlock()
+
+	size, _, err = d.get()
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), size)
+
+	assert.Eventually(t, func() bool {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return !d.refreshing && d.size == 160 && d.count == 2
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Same(t, sharedDirStats(fs, "/cache"), sharedDirStats(fs, "/cache"))
+	assert.NotSame(t, sharedDirStats(fs, "/cache"), sharedDirStats(afero.NewMemMapFs(), "/cache"))
+}
+
+func TestDirStats_UpdateCacheStats(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/cache/kernel", make([]byte, 100), 0644))
+
+	d := &dirStats{fs: fs, path: "/cache", ttl: time.Hour}
+
+	// ignored until the directory was walked once
+	d.UpdateCacheStats("kernel", 50, 1)
+
+	size, count, err := d.get()
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), size)
+	assert.Equal(t, int64(1), count)
+
+	d.UpdateCacheStats("kernel", 50, 1)
+	size, count, err = d.get()
+	require.NoError(t, err)
+	assert.Equal(t, int64(150), size)
+	assert.Equal(t, int64(2), count)
+
+	d.UpdateCacheStats("kernel", -500, -5)
+	size, count, err = d.get()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestBootImageCollector_cacheStats(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/cache/boot/initrd.img.lz4", make([]byte, 100), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/cache/boot/initrd.img.lz4.md5", make([]byte, 40), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/cache/boot/initrd.img.lz4.sha256", make([]byte, 70), 0644))
+
+	c := MustBootImageMetrics(slog.Default(), fs, "/cache")
+
+	families, err := c.GetGatherer().Gather()
+	require.NoError(t, err)
+
+	got := map[string]float64{}
+	for _, f := range families {
+		switch f.GetName() {
+		case "current_cache_size", "cache_boot_images_count":
+			got[f.GetName()] = f.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+
+	assert.Equal(t, map[string]float64{
+		"current_cache_size":      210,
+		"cache_boot_images_count": 1,
+	}, got)
+}
+
+func BenchmarkDirStats(b *testing.B) {
+	fs := afero.NewOsFs()
+	root := b.TempDir()
+	for i := 0; i < 100; i++ {
+		require.NoError(b, fs.MkdirAll(filepath.Join(root, fmt.Sprintf("dir-%d", i)), 0755))
+		for j := 0; j < 100; j++ {
+			require.NoError(b, afero.WriteFile(fs, filepath.Join(root, fmt.Sprintf("dir-%d", i), fmt.Sprintf("file-%d", j)), nil, 0644))
+		}
+	}
+
+	b.Run("walk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, _, _ = walkDir(fs, root)
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		d := &dirStats{fs: fs, path: root, ttl: time.Hour}
+		for i := 0; i < b.N; i++ {
+			_, _, _ = d.get()
+		}
+	})
+}
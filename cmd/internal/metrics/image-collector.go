@@ -1,29 +1,56 @@
 package metrics
 
 import (
+	"errors"
 	"log/slog"
+	"strings"
 
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/spf13/afero"
+)
+
+// reasons for images of the metal-api not being synced into the cache
+const (
+	SkipReasonExpired        = "expired"
+	SkipReasonExcluded       = "excluded"
+	SkipReasonAged           = "aged"
+	SkipReasonOverMax        = "over_max"
+	SkipReasonReduced        = "reduced"
+	SkipReasonMissingMD5     = "missing_md5"
+	SkipReasonMissingInStore = "missing_in_store"
 )
 
 type ImageCollector struct {
+	bandwidth
+	syncStatus
+	*dirStats
+
 	logger                    *slog.Logger
 	reg                       *prometheus.Registry
 	rootPath                  string
+	cacheSizeUtilization      func(float64)
+	cacheOrphanedFiles        func(float64)
+	cacheOrphanedBytes        func(float64)
 	cacheMissInc              func()
 	cacheSyncDownloadBytesAdd func(float64)
 	cacheSyncDownloadInc      func()
 	cacheDownloadsInc         func()
 	cacheUnsyncedImageCount   func(float64)
 	metalAPIImageCount        func(float64)
+	missingFreeSpace          *prometheus.GaugeVec
+	imagesByOS                *prometheus.Desc
+	imagesSkipped             *prometheus.CounterVec
 }
 
-func MustImageMetrics(logger *slog.Logger, rootPath string) *ImageCollector {
+func MustImageMetrics(logger *slog.Logger, fs afero.Fs, rootPath string) *ImageCollector {
 	c := &ImageCollector{
-		logger:   logger,
-		rootPath: rootPath,
-		reg:      prometheus.NewRegistry(),
+		logger:     logger,
+		rootPath:   rootPath,
+		dirStats:   sharedDirStats(fs, rootPath),
+		reg:        prometheus.NewRegistry(),
+		syncStatus: newSyncStatus(),
 	}
 
 	cacheSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
@@ -48,6 +75,24 @@ func MustImageMetrics(logger *slog.Logger, rootPath string) *ImageCollector {
 	})
 	c.metalAPIImageCount = metalImageCount.Set
 
+	cacheSizeUtilization := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_size_utilization_ratio",
+		Help: "Ratio of the cache directory size to the configured maximum cache size after the last sync",
+	})
+	c.cacheSizeUtilization = cacheSizeUtilization.Set
+
+	cacheOrphanedFiles := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_orphaned_files",
+		Help: "Amount of files in the cache that are not referenced by the want-list of the last sync",
+	})
+	c.cacheOrphanedFiles = cacheOrphanedFiles.Set
+
+	cacheOrphanedBytes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_orphaned_bytes",
+		Help: "Size of the files in the cache that are not referenced by the want-list of the last sync in bytes",
+	})
+	c.cacheOrphanedBytes = cacheOrphanedBytes.Set
+
 	cacheMisses := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "cache_misses",
 		Help: "Amount of cache misses during instance lifetime",
@@ -72,22 +117,46 @@ func MustImageMetrics(logger *slog.Logger, rootPath string) *ImageCollector {
 	})
 	c.cacheDownloadsInc = cacheDownloadsInc.Inc
 
+	c.missingFreeSpace = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cache_sync_missing_free_space_bytes",
+		Help: "Amount of bytes missing on the cache filesystem to download all entities planned by the last sync, zero if there was enough space",
+	}, []string{"root"})
+
+	c.imagesByOS = prometheus.NewDesc(
+		"cache_images_by_os",
+		"Current amount of images in the cache per operating system and major.minor version",
+		[]string{"os", "major_minor"}, nil,
+	)
+
+	c.imagesSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "images_skipped_total",
+		Help: "Amount of images from the metal-api not synced into the cache by reason (expired|excluded|aged|over_max|reduced|missing_md5|missing_in_store)",
+	}, []string{"reason"})
+
 	c.reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	c.reg.MustRegister(collectors.NewGoCollector())
 	c.reg.MustRegister(cacheSize)
 	c.reg.MustRegister(cacheImageCount)
 	c.reg.MustRegister(cacheUnsyncedImageCount)
 	c.reg.MustRegister(cacheMisses)
+	c.reg.MustRegister(cacheSizeUtilization)
+	c.reg.MustRegister(cacheOrphanedFiles)
+	c.reg.MustRegister(cacheOrphanedBytes)
+	c.reg.MustRegister(c.bandwidthCollectors()...)
+	c.reg.MustRegister(c.syncStatusCollectors()...)
 	c.reg.MustRegister(cacheSyncDownloadBytes)
 	c.reg.MustRegister(cacheSyncDownloadCount)
 	c.reg.MustRegister(cacheDownloadsInc)
 	c.reg.MustRegister(metalImageCount)
+	c.reg.MustRegister(c.missingFreeSpace)
+	c.reg.MustRegister(&imagesByOSCollector{c: c})
+	c.reg.MustRegister(c.imagesSkipped)
 
 	return c
 }
 
 func (c *ImageCollector) cacheDirSize() float64 {
-	size, err := dirSize(c.rootPath)
+	size, _, err := c.dirStats.get()
 
 	if err != nil {
 		c.logger.Error("error collecting cache dir size metric", "error", err)
@@ -97,7 +166,7 @@ func (c *ImageCollector) cacheDirSize() float64 {
 }
 
 func (c *ImageCollector) cacheImageCount() float64 {
-	count, err := fileCount(c.rootPath)
+	_, count, err := c.dirStats.get()
 
 	if err != nil {
 		c.logger.Error("error collecting image cache count metric", "error", err)
@@ -106,6 +175,32 @@ func (c *ImageCollector) cacheImageCount() float64 {
 	return float64(count)
 }
 
+// UpdateCacheSizeUtilization sets the ratio of the current cache size to the given maximum cache size,
+// the ratio is zero if no maximum is configured.
+func (c *ImageCollector) UpdateCacheSizeUtilization(maxCacheSize int64) {
+	if maxCacheSize <= 0 {
+		c.cacheSizeUtilization(0)
+		return
+	}
+
+	// the cache just changed by the sync, so the directory is walked right away
+	size, _, err := c.dirStats.update()
+	if err != nil {
+		c.logger.Error("error collecting cache size utilization metric", "error", err)
+	}
+	if errors.Is(err, errDirUnreadable) {
+		// the last value is kept, a zero utilization would look like an empty cache
+		return
+	}
+
+	c.cacheSizeUtilization(float64(size) / float64(maxCacheSize))
+}
+
+func (c *ImageCollector) SetOrphans(count int, bytes int64) {
+	c.cacheOrphanedFiles(float64(count))
+	c.cacheOrphanedBytes(float64(bytes))
+}
+
 func (c *ImageCollector) IncrementCacheMiss() {
 	c.cacheMissInc()
 }
@@ -122,6 +217,11 @@ func (c *ImageCollector) SetUnsyncedImageCount(b int) {
 	c.cacheUnsyncedImageCount(float64(b))
 }
 
+// AddSkippedImages counts images of the metal-api that were not synced for the given reason.
+func (c *ImageCollector) AddSkippedImages(reason string, count int) {
+	c.imagesSkipped.WithLabelValues(reason).Add(float64(count))
+}
+
 func (c *ImageCollector) IncrementDownloads() {
 	c.cacheDownloadsInc()
 }
@@ -130,6 +230,53 @@ func (c *ImageCollector) SetMetalAPIImageCount(b int) {
 	c.metalAPIImageCount(float64(b))
 }
 
+func (c *ImageCollector) SetMissingFreeSpace(root string, b int64) {
+	c.missingFreeSpace.WithLabelValues(root).Set(float64(b))
+}
+
+// imagesByOSCollector reports the image count by os of the cached directory stats, the metrics are created per scrape
+// such that concurrent scrapes do not interfere and operating systems that disappeared from the cache are dropped.
+type imagesByOSCollector struct {
+	c *ImageCollector
+}
+
+func (i *imagesByOSCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- i.c.imagesByOS
+}
+
+func (i *imagesByOSCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := i.c.dirStats.imagesByOS()
+	if err != nil {
+		i.c.logger.Error("error collecting images by os metric", "error", err)
+	}
+
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(i.c.imagesByOS, prometheus.GaugeValue, float64(count), key.os, key.majorMinor)
+	}
+}
+
+type osVersion struct {
+	os         string
+	majorMinor string
+}
+
+// osVersionOf returns the operating system and major.minor version of an image by its sub path. images are expected
+// to be stored under <os>/<major.minor>/<date>/<file> like in the image store, other paths are not images.
+func osVersionOf(subPath string) (osVersion, bool) {
+	parts := strings.Split(subPath, "/")
+	if len(parts) < 4 {
+		return osVersion{}, false
+	}
+
+	majorMinor := parts[len(parts)-3]
+	name, _, err := utils.GetOsAndSemver(parts[len(parts)-4] + "-" + majorMinor)
+	if err != nil {
+		return osVersion{}, false
+	}
+
+	return osVersion{os: name, majorMinor: majorMinor}, true
+}
+
 func (c *ImageCollector) GetGatherer() prometheus.Gatherer {
 	return c.reg
 }
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageCollector_UpdateCacheSizeUtilization(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxCacheSize int64
+		want         float64
+	}{
+		{
+			name:         "ratio of cache size to max cache size",
+			maxCacheSize: 400,
+			want:         0.25,
+		},
+		{
+			name:         "exceeding max cache size",
+			maxCacheSize: 50,
+			want:         2,
+		},
+		{
+			name:         "zero max cache size",
+			maxCacheSize: 0,
+			want:         0,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, "/cache/ubuntu/img.tar.lz4", make([]byte, 100), 0644))
+
+			c := MustImageMetrics(slog.Default(), fs, "/cache")
+			c.UpdateCacheSizeUtilization(tt.maxCacheSize)
+
+			families, err := c.GetGatherer().Gather()
+			require.NoError(t, err)
+
+			found := false
+			for _, f := range families {
+				if f.GetName() == "cache_size_utilization_ratio" {
+					found = true
+					assert.InDelta(t, tt.want, f.GetMetric()[0].GetGauge().GetValue(), 0.0001)
+				}
+			}
+			assert.True(t, found, "utilization metric was not gathered")
+		})
+	}
+}
+
+// unreadableRootFs fails to stat the given path once unreadable is set.
+type unreadableRootFs struct {
+	afero.Fs
+	path       string
+	unreadable bool
+}
+
+func (u *unreadableRootFs) Stat(name string) (os.FileInfo, error) {
+	if u.unreadable && name == u.path {
+		return nil, os.ErrPermission
+	}
+	return u.Fs.Stat(name)
+}
+
+func TestImageCollector_UpdateCacheSizeUtilizationUnreadable(t *testing.T) {
+	fs := &unreadableRootFs{Fs: afero.NewMemMapFs(), path: "/cache"}
+	require.NoError(t, afero.WriteFile(fs, "/cache/ubuntu/img.tar.lz4", make([]byte, 100), 0644))
+
+	c := MustImageMetrics(slog.Default(), fs, "/cache")
+
+	utilization := func() float64 {
+		families, err := c.GetGatherer().Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() == "cache_size_utilization_ratio" {
+				return f.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+
+	c.UpdateCacheSizeUtilization(400)
+	assert.InDelta(t, 0.25, utilization(), 0.0001)
+
+	// an unreadable cache directory does not look like an empty cache
+	fs.unreadable = true
+	c.UpdateCacheSizeUtilization(400)
+	assert.InDelta(t, 0.25, utilization(), 0.0001)
+	assert.Equal(t, CacheStats{Size: 100, Files: 1}, c.CacheStats())
+}
+
+func TestImageCollector_imagesByOS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	files := []string{
+		"metal-os/stable/ubuntu/20.04/20201026/img.tar.lz4",
+		"metal-os/stable/ubuntu/20.04/20201026/img.tar.lz4.md5",
+		"metal-os/stable/ubuntu/20.04/20201027/img.tar.lz4",
+		"metal-os/stable/ubuntu/22.04/20230101/img.tar.lz4",
+		"metal-os/stable/firewall/2.0/20210304/img.tar.lz4",
+		"metal-os/stable/firewall/2.0/latest/img.tar.lz4",
+		"unrelated-file",
+	}
+	for _, f := range files {
+		require.NoError(t, afero.WriteFile(fs, "/cache/"+f, []byte("a"), 0644))
+	}
+
+	c := MustImageMetrics(slog.Default(), fs, "/cache")
+
+	gather := func() map[string]float64 {
+		families, err := c.GetGatherer().Gather()
+		require.NoError(t, err)
+
+		got := map[string]float64{}
+		for _, f := range families {
+			if f.GetName() != "cache_images_by_os" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				labels := map[string]string{}
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				got[labels["os"]+"-"+labels["major_minor"]] = m.GetGauge().GetValue()
+			}
+		}
+		return got
+	}
+
+	assert.Equal(t, map[string]float64{
+		"ubuntu-20.04": 2,
+		"ubuntu-22.04": 1,
+		"firewall-2.0": 1,
+	}, gather())
+
+	// concurrent scrapes see all images
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			families, err := c.GetGatherer().Gather()
+			if assert.NoError(t, err) {
+				for _, f := range families {
+					if f.GetName() == "cache_images_by_os" {
+						assert.Len(t, f.GetMetric(), 3)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// scrapes do not walk the directory, the sync keeps the counts up to date
+	require.NoError(t, fs.RemoveAll("/cache/metal-os/stable/firewall"))
+	assert.Equal(t, map[string]float64{
+		"ubuntu-20.04": 2,
+		"ubuntu-22.04": 1,
+		"firewall-2.0": 1,
+	}, gather())
+
+	c.UpdateCacheStats("metal-os/stable/firewall/2.0/20210304/img.tar.lz4", -1, -1)
+	c.UpdateCacheStats("metal-os/stable/ubuntu/22.04/20230102/img.tar.lz4", 1, 1)
+	assert.Equal(t, map[string]float64{
+		"ubuntu-20.04": 2,
+		"ubuntu-22.04": 2,
+	}, gather())
+}
@@ -4,49 +4,150 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type DownloadCollector interface {
 	IncrementCacheMiss()
 	IncrementDownloads()
+	SetOrphans(count int, bytes int64)
+	AddServedBytes(b int64)
+	AddSyncDownloadBytes(b int64)
+	Savings() Savings
+	SetLastSyncTime(t time.Time)
+	ObserveSyncDuration(d time.Duration)
+	IncrementSyncs(succeeded bool)
+	UpdateCacheStats(subPath string, deltaBytes, deltaCount int64)
+	CacheStats() CacheStats
 
 	GetGatherer() prometheus.Gatherer
 }
 
-func fileCount(path string) (int64, error) {
-	var count int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && !strings.HasSuffix(info.Name(), ".md5") {
-			count += 1
-		}
-		return nil
+// Savings describes the bandwidth saved by the cache during instance lifetime.
+type Savings struct {
+	Served     int64 `json:"served"`
+	Downloaded int64 `json:"downloaded"`
+	Saved      int64 `json:"saved"`
+}
+
+// CacheStats describes the size and the amount of files of a cache.
+type CacheStats struct {
+	Size  int64 `json:"size"`
+	Files int64 `json:"files"`
+}
+
+// bandwidth tracks the bytes served by the cache and downloaded from the origin by the sync.
+type bandwidth struct {
+	served     atomic.Int64
+	downloaded atomic.Int64
+}
+
+func (b *bandwidth) AddServedBytes(n int64) {
+	b.served.Add(n)
+}
+
+func (b *bandwidth) AddSyncDownloadBytes(n int64) {
+	b.downloaded.Add(n)
+}
+
+func (b *bandwidth) Savings() Savings {
+	served := b.served.Load()
+	downloaded := b.downloaded.Load()
+
+	return Savings{
+		Served:     served,
+		Downloaded: downloaded,
+		Saved:      served - downloaded,
+	}
+}
+
+func (b *bandwidth) bandwidthCollectors() []prometheus.Collector {
+	served := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "cache_served_bytes_total",
+		Help: "Amount of bytes written to clients by the cache during instance lifetime",
+	}, func() float64 {
+		return float64(b.served.Load())
+	})
+
+	saved := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cache_bandwidth_saved_bytes",
+		Help: "Amount of bytes served by the cache minus the amount of bytes downloaded by the sync during instance lifetime",
+	}, func() float64 {
+		return float64(b.Savings().Saved)
 	})
-	if err != nil {
-		return 0, err
+
+	return []prometheus.Collector{served, saved}
+}
+
+// syncStatus tracks the duration, the result and the last successful completion of the sync of a cache.
+type syncStatus struct {
+	lastSuccessfulSync prometheus.Gauge
+	syncDuration       prometheus.Histogram
+	syncs              *prometheus.CounterVec
+}
+
+func newSyncStatus() syncStatus {
+	return syncStatus{
+		lastSuccessfulSync: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "last_successful_sync_timestamp_seconds",
+			Help: "Unix time of the last sync of the cache that completed without error",
+		}),
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "sync_duration_seconds",
+			Help:    "Duration of the syncs of the cache in seconds",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		syncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "syncs_total",
+			Help: "Amount of syncs of the cache by result (success|failure)",
+		}, []string{"result"}),
 	}
+}
 
-	return count, nil
+func (s *syncStatus) SetLastSyncTime(t time.Time) {
+	s.lastSuccessfulSync.Set(float64(t.Unix()))
 }
 
-func dirSize(path string) (int64, error) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-	if err != nil {
-		return 0, err
+func (s *syncStatus) ObserveSyncDuration(d time.Duration) {
+	s.syncDuration.Observe(d.Seconds())
+}
+
+func (s *syncStatus) IncrementSyncs(succeeded bool) {
+	result := "failure"
+	if succeeded {
+		result = "success"
 	}
+	s.syncs.WithLabelValues(result).Inc()
+}
 
-	return size, nil
+func (s *syncStatus) syncStatusCollectors() []prometheus.Collector {
+	return []prometheus.Collector{s.lastSuccessfulSync, s.syncDuration, s.syncs}
+}
+
+// isLatestLink returns true for the latest links next to the version directories, they are copies of a version
+// directory on filesystems without symlink support and must not be counted twice.
+func isLatestLink(rootPath, p string, info os.FileInfo) bool {
+	return p != rootPath && info.Name() == utils.LatestLinkName
+}
+
+// skipLatestLink skips a latest link during a walk.
+func skipLatestLink(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// isSidecar returns true for checksum and metadata files written next to the cached files.
+func isSidecar(name string) bool {
+	for _, suffix := range []string{".md5", ".sha256", ".meta"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
 }
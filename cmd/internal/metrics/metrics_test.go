@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSavings(t *testing.T) {
+	c := MustKernelMetrics(slog.Default(), afero.NewOsFs(), t.TempDir())
+
+	c.AddServedBytes(600)
+	c.AddServedBytes(400)
+	c.AddSyncDownloadBytes(300)
+
+	assert.Equal(t, Savings{Served: 1000, Downloaded: 300, Saved: 700}, c.Savings())
+
+	families, err := c.GetGatherer().Gather()
+	require.NoError(t, err)
+
+	found := map[string]bool{}
+	for _, f := range families {
+		switch f.GetName() {
+		case "cache_bandwidth_saved_bytes":
+			found[f.GetName()] = true
+			assert.Equal(t, float64(700), f.GetMetric()[0].GetGauge().GetValue())
+		case "cache_served_bytes_total":
+			found[f.GetName()] = true
+			assert.Equal(t, float64(1000), f.GetMetric()[0].GetCounter().GetValue())
+		}
+	}
+	assert.Len(t, found, 2, "bandwidth metrics were not gathered")
+}
+
+func TestSyncStatus(t *testing.T) {
+	c := MustBootImageMetrics(slog.Default(), afero.NewOsFs(), t.TempDir())
+
+	c.ObserveSyncDuration(3 * time.Second)
+	c.SetLastSyncTime(time.Unix(1700000000, 0))
+	c.IncrementSyncs(true)
+	c.IncrementSyncs(false)
+	c.IncrementSyncs(false)
+
+	families, err := c.GetGatherer().Gather()
+	require.NoError(t, err)
+
+	found := map[string]bool{}
+	for _, f := range families {
+		switch f.GetName() {
+		case "last_successful_sync_timestamp_seconds":
+			found[f.GetName()] = true
+			assert.Equal(t, float64(1700000000), f.GetMetric()[0].GetGauge().GetValue())
+		case "sync_duration_seconds":
+			found[f.GetName()] = true
+			assert.Equal(t, uint64(1), f.GetMetric()[0].GetHistogram().GetSampleCount())
+			assert.Equal(t, float64(3), f.GetMetric()[0].GetHistogram().GetSampleSum())
+		case "syncs_total":
+			found[f.GetName()] = true
+			results := map[string]float64{}
+			for _, m := range f.GetMetric() {
+				results[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+			}
+			assert.Equal(t, map[string]float64{"success": 1, "failure": 2}, results)
+		}
+	}
+	assert.Len(t, found, 3, "sync status metrics were not gathered")
+}
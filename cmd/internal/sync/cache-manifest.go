@@ -0,0 +1,180 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+)
+
+// cacheManifest records the origin and the time of download of every cached file. it is persisted as json file
+// after every sync, such that it is available for debugging even if the http servers are not reachable.
+type cacheManifest struct {
+	fs    afero.Fs
+	path  string
+	mutex sync.Mutex
+	// entries are stored by root path and sub path
+	entries map[string]map[string]api.ManifestEntry
+}
+
+// newCacheManifest loads the cache manifest from the given path.
+func newCacheManifest(logger *slog.Logger, fs afero.Fs, p string) *cacheManifest {
+	m := &cacheManifest{
+		fs:      fs,
+		path:    p,
+		entries: map[string]map[string]api.ManifestEntry{},
+	}
+
+	raw, err := afero.ReadFile(fs, p)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("unable to read cache manifest, starting with an empty one", "path", p, "error", err)
+		}
+		return m
+	}
+
+	err = json.Unmarshal(raw, &m.entries)
+	if err != nil {
+		logger.Warn("cache manifest is corrupt, starting with an empty one", "path", p, "error", err)
+		m.entries = map[string]map[string]api.ManifestEntry{}
+	}
+
+	return m
+}
+
+// record remembers the origin of a file that was just downloaded into the given root path.
+func (m *cacheManifest) record(rootPath string, e api.CacheEntity, at time.Time) {
+	entry := api.ManifestEntry{
+		Name:     e.GetName(),
+		SubPath:  e.GetSubPath(),
+		Size:     e.GetSize(),
+		SyncedAt: &at,
+	}
+	if s, ok := e.(api.Sourced); ok {
+		entry.Source = s.GetSource()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.entries[rootPath] == nil {
+		m.entries[rootPath] = map[string]api.ManifestEntry{}
+	}
+	m.entries[rootPath][e.GetSubPath()] = entry
+}
+
+// get returns the recorded entry of a file in the given root path.
+func (m *cacheManifest) get(rootPath, subPath string) (api.ManifestEntry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.entries[rootPath][subPath]
+	return entry, ok
+}
+
+// update replaces the entries of the given root path with the currently cached files, the origin and the time
+// of download are kept from the recorded entries.
+func (m *cacheManifest) update(rootPath string, current []api.ManifestEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entries := map[string]api.ManifestEntry{}
+	for _, e := range current {
+		if recorded, ok := m.entries[rootPath][e.SubPath]; ok {
+			e.Name = recorded.Name
+			e.Source = recorded.Source
+			e.SyncedAt = recorded.SyncedAt
+		}
+		entries[e.SubPath] = e
+	}
+
+	m.entries[rootPath] = entries
+}
+
+func (m *cacheManifest) persist() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	raw, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = m.fs.MkdirAll(path.Dir(m.path), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating cache manifest directory:%w", err)
+	}
+
+	// written to a tmp file first such that a crash does not leave a truncated manifest behind
+	tmp := m.path + ".tmp"
+	err = afero.WriteFile(m.fs, tmp, raw, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing cache manifest:%w", err)
+	}
+
+	return m.fs.Rename(tmp, m.path)
+}
+
+// synced returns true if at least one file of the given root path was downloaded by the sync.
+func (m *cacheManifest) synced(rootPath string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, e := range m.entries[rootPath] {
+		if e.SyncedAt != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSyncedContent returns true if the sync downloaded at least one file into the given root path, also by previous
+// runs of the process. a failing sync does not remove the content synced before, so the cache can still serve it.
+func (s *Syncer) HasSyncedContent(rootPath string) bool {
+	if s.cacheManifest == nil {
+		return false
+	}
+	return s.cacheManifest.synced(rootPath)
+}
+
+// updateCacheManifest records the currently cached files of the given root path in the cache manifest, errors are
+// only logged as the cache manifest is informational.
+func (s *Syncer) updateCacheManifest(rootPath string) {
+	if s.cacheManifest == nil {
+		return
+	}
+
+	current, err := s.cacheStore().List(rootPath)
+	if err != nil {
+		s.logger.Warn("unable to update cache manifest", "root", rootPath, "error", err)
+		return
+	}
+
+	var entries []api.ManifestEntry
+	for _, e := range current {
+		// the checksum is only taken from the md5 sidecar file, hashing every file after each sync is too expensive
+		checksum, _ := SidecarMD5(s.fs, strings.Join([]string{rootPath, e.GetSubPath()}, string(os.PathSeparator)))
+
+		entries = append(entries, api.ManifestEntry{
+			Name:    e.GetName(),
+			SubPath: e.GetSubPath(),
+			Size:    e.GetSize(),
+			MD5:     checksum,
+		})
+	}
+
+	s.cacheManifest.update(rootPath, entries)
+
+	err = s.cacheManifest.persist()
+	if err != nil {
+		s.logger.Warn("unable to persist cache manifest", "error", err)
+	}
+}
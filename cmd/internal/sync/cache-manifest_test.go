@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_updateCacheManifest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer ts.Close()
+
+	const manifestPath = "/tmp/cache-manifest.json"
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, cacheRoot+"/metal-hammer/old-kernel", []byte("old"), 0644))
+
+	s := &Syncer{
+		logger:        slog.Default(),
+		fs:            fs,
+		tmpPath:       "/tmp/test-download",
+		stop:          context.TODO(),
+		httpClient:    http.DefaultClient,
+		cacheManifest: newCacheManifest(slog.Default(), fs, manifestPath),
+	}
+
+	err := s.download(context.TODO(), cacheRoot, nil, api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL + "/kernel"})
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(fs, cacheRoot+"/metal-hammer/kernel.md5", []byte("0cbc6611f5540bd0809a388dc95a615b  kernel"), 0644))
+
+	s.updateCacheManifest(cacheRoot)
+
+	// the manifest survives a restart
+	m := newCacheManifest(slog.Default(), fs, manifestPath)
+
+	got, ok := m.get(cacheRoot, "metal-hammer/kernel")
+	require.True(t, ok)
+	assert.Equal(t, ts.URL+"/kernel", got.Source)
+	assert.Equal(t, "0cbc6611f5540bd0809a388dc95a615b", got.MD5)
+	assert.Equal(t, int64(6), got.Size)
+	require.NotNil(t, got.SyncedAt)
+
+	// files cached before the manifest existed are listed without origin
+	got, ok = m.get(cacheRoot, "metal-hammer/old-kernel")
+	require.True(t, ok)
+	assert.Empty(t, got.Source)
+	assert.Nil(t, got.SyncedAt)
+
+	require.NoError(t, fs.Remove(cacheRoot+"/metal-hammer/old-kernel"))
+	s.updateCacheManifest(cacheRoot)
+
+	_, ok = s.cacheManifest.get(cacheRoot, "metal-hammer/old-kernel")
+	assert.False(t, ok)
+
+	manifest, err := s.Manifest(cacheRoot)
+	require.NoError(t, err)
+	require.Len(t, manifest, 1)
+	assert.Equal(t, ts.URL+"/kernel", manifest[0].Source)
+}
+
+func TestSyncer_HasSyncedContent(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := &Syncer{cacheManifest: newCacheManifest(slog.Default(), fs, "/tmp/cache-manifest.json")}
+
+	assert.False(t, s.HasSyncedContent(cacheRoot))
+
+	// files cached before the manifest existed do not count as synced content
+	s.cacheManifest.update(cacheRoot, []api.ManifestEntry{{SubPath: "metal-hammer/old-kernel"}})
+	assert.False(t, s.HasSyncedContent(cacheRoot))
+
+	s.cacheManifest.record(cacheRoot, api.Kernel{SubPath: "metal-hammer/kernel"}, time.Now())
+	assert.True(t, s.HasSyncedContent(cacheRoot))
+	assert.False(t, s.HasSyncedContent("/tmp/other-path"))
+
+	assert.False(t, (&Syncer{}).HasSyncedContent(cacheRoot))
+}
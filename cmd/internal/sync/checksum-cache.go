@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	checksumAlgorithmMD5    = "md5"
+	checksumAlgorithmSHA256 = "sha256"
+)
+
+// checksumCache remembers checksums of local files, such that unchanged files do not need to be hashed again.
+type checksumCache interface {
+	// Lookup returns the stored checksum if the file did not change since it was stored.
+	Lookup(p, algorithm string, info os.FileInfo) (string, bool)
+	Store(p, algorithm string, info os.FileInfo, checksum string)
+	Forget(p string)
+	Persist() error
+}
+
+type checksumCacheEntry struct {
+	Size      int64             `json:"size"`
+	ModTime   time.Time         `json:"mtime"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+// jsonChecksumCache is a checksum cache persisted as json file, entries are invalidated when size or mtime of a file differ.
+type jsonChecksumCache struct {
+	fs      afero.Fs
+	path    string
+	mutex   sync.Mutex
+	entries map[string]checksumCacheEntry
+}
+
+// newJSONChecksumCache loads the checksum cache from the given path, entries of files that do not exist anymore are dropped.
+func newJSONChecksumCache(logger *slog.Logger, fs afero.Fs, p string) *jsonChecksumCache {
+	c := &jsonChecksumCache{
+		fs:      fs,
+		path:    p,
+		entries: map[string]checksumCacheEntry{},
+	}
+
+	raw, err := afero.ReadFile(fs, p)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("unable to read checksum cache, starting with an empty one", "path", p, "error", err)
+		}
+		return c
+	}
+
+	err = json.Unmarshal(raw, &c.entries)
+	if err != nil {
+		logger.Warn("checksum cache is corrupt, starting with an empty one", "path", p, "error", err)
+		c.entries = map[string]checksumCacheEntry{}
+		return c
+	}
+
+	for filePath := range c.entries {
+		if exists, err := afero.Exists(fs, filePath); err != nil || !exists {
+			delete(c.entries, filePath)
+		}
+	}
+
+	return c
+}
+
+func (c *jsonChecksumCache) Lookup(p, algorithm string, info os.FileInfo) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[p]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+
+	checksum, ok := entry.Checksums[algorithm]
+	return checksum, ok
+}
+
+func (c *jsonChecksumCache) Store(p, algorithm string, info os.FileInfo, checksum string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[p]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		entry = checksumCacheEntry{
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			Checksums: map[string]string{},
+		}
+	}
+
+	entry.Checksums[algorithm] = checksum
+	c.entries[p] = entry
+}
+
+func (c *jsonChecksumCache) Forget(p string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, p)
+}
+
+func (c *jsonChecksumCache) Persist() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	raw, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	err = c.fs.MkdirAll(path.Dir(c.path), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating checksum cache directory:%w", err)
+	}
+
+	// written to a tmp file first such that a crash does not leave a truncated cache behind
+	tmp := c.path + ".tmp"
+	err = afero.WriteFile(c.fs, tmp, raw, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing checksum cache:%w", err)
+	}
+
+	return c.fs.Rename(tmp, c.path)
+}
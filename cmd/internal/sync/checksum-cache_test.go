@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"context"
+	// nolint
+	"crypto/md5"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openCountingFs counts how often the given path is opened
+type openCountingFs struct {
+	afero.Fs
+	path  string
+	opens *atomic.Int32
+}
+
+func (c openCountingFs) Open(name string) (afero.File, error) {
+	if name == c.path {
+		c.opens.Add(1)
+	}
+	return c.Fs.Open(name)
+}
+
+func TestSyncer_SyncChecksumCache(t *testing.T) {
+	const key = "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4"
+
+	var opens atomic.Int32
+	fs := openCountingFs{Fs: afero.NewMemMapFs(), path: cacheRoot + "/" + key, opens: &opens}
+	createTestFile(t, fs, cacheRoot+"/"+key)
+
+	want := api.CacheEntities{
+		api.OS{
+			BucketKey:  key,
+			BucketName: "metal-os",
+			MD5Ref:     s3.Object{Key: strPtr(key + ".md5")},
+		},
+	}
+
+	newSyncer := func() *Syncer {
+		s3Client, _ := dlObjectSvc(map[string][]byte{key + ".md5": []byte("0cbc6611f5540bd0809a388dc95a615b  img.tar.lz4")})
+		return &Syncer{
+			logger:        slog.Default(),
+			fs:            fs,
+			s3:            s3manager.NewDownloaderWithClient(s3Client),
+			stop:          context.TODO(),
+			checksumCache: newJSONChecksumCache(slog.Default(), fs, "/tmp/checksum-cache.json"),
+		}
+	}
+
+	// the second syncer loads the persisted cache, like after a restart
+	for i := 0; i < 2; i++ {
+		require.NoError(t, newSyncer().Sync(cacheRoot, want))
+	}
+	assert.Equal(t, int32(1), opens.Load(), "unchanged file was hashed more than once")
+
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, fs.Chtimes(cacheRoot+"/"+key, later, later))
+
+	require.NoError(t, newSyncer().Sync(cacheRoot, want))
+	assert.Equal(t, int32(2), opens.Load(), "modified file was not hashed again")
+}
+
+func TestSyncer_SyncChecksumCacheRedownload(t *testing.T) {
+	const key = "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4"
+
+	fs := afero.NewMemMapFs()
+	c := &api.Config{CacheRootPath: "/var/lib/metal-image-cache-sync"}
+	target := c.GetImageRootPath() + "/" + key
+	lastModified := time.Date(2020, 10, 25, 0, 0, 0, 0, time.UTC)
+
+	// the cached file is corrupt but has the size and modification time of the origin
+	require.NoError(t, afero.WriteFile(fs, target, []byte("Test1"), 0644))
+	require.NoError(t, fs.Chtimes(target, lastModified, lastModified))
+
+	s3Client, requests := dlObjectSvc(map[string][]byte{
+		key:          []byte("Test2"),
+		key + ".md5": []byte(fmt.Sprintf("%x  img.tar.lz4", md5.Sum([]byte("Test2")))),
+	})
+
+	want := api.CacheEntities{
+		api.OS{
+			BucketKey:  key,
+			BucketName: "metal-os",
+			ImageRef:   s3.Object{Key: strPtr(key), Size: aws.Int64(5), LastModified: &lastModified},
+			MD5Ref:     s3.Object{Key: strPtr(key + ".md5")},
+		},
+	}
+
+	// the second syncer loads the persisted cache, like after a restart
+	for i := 0; i < 2; i++ {
+		s, err := NewSyncer(slog.Default(), fs, s3manager.NewDownloaderWithClient(s3Client), http.DefaultClient, c, metrics.MustImageMetrics(slog.Default(), fs, c.GetImageRootPath()), context.TODO())
+		require.NoError(t, err)
+		s.diskStat = nil
+		require.NoError(t, s.Sync(c.GetImageRootPath(), want))
+	}
+
+	downloads := 0
+	for _, k := range requests.downloads() {
+		if k == key {
+			downloads++
+		}
+	}
+	assert.Equal(t, 1, downloads, "replaced file was downloaded again")
+
+	content, err := afero.ReadFile(fs, target)
+	require.NoError(t, err)
+	assert.Equal(t, "Test2", string(content))
+}
@@ -0,0 +1,200 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// minisign algorithm of legacy signatures over the message itself
+	minisignAlgorithm = "Ed"
+	// minisign algorithm of signatures over the blake2b-512 hash of the message
+	minisignAlgorithmPrehashed = "ED"
+)
+
+// minisignKey is a minisign public key, see https://jedisct1.github.io/minisign/
+type minisignKey struct {
+	id  []byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignPublicKey parses a minisign public key file, the untrusted comment line is optional.
+func parseMinisignPublicKey(raw []byte) (*minisignKey, error) {
+	line, err := minisignDataLine(raw, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, fmt.Errorf("minisign public key is not base64 encoded:%w", err)
+	}
+
+	if len(decoded) != 2+8+ed25519.PublicKeySize || string(decoded[:2]) != minisignAlgorithm {
+		return nil, fmt.Errorf("minisign public key has unexpected format")
+	}
+
+	return &minisignKey{
+		id:  decoded[2:10],
+		key: ed25519.PublicKey(decoded[10:]),
+	}, nil
+}
+
+// verify checks a minisign signature file of the given message including its trusted comment.
+func (k *minisignKey) verify(message, signature []byte) error {
+	line, err := minisignDataLine(signature, 0)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return fmt.Errorf("minisign signature is not base64 encoded:%w", err)
+	}
+
+	if len(decoded) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("minisign signature has unexpected format")
+	}
+
+	algorithm, keyID, sig := string(decoded[:2]), decoded[2:10], decoded[10:]
+
+	if !bytes.Equal(keyID, k.id) {
+		return fmt.Errorf("minisign signature was created with another key")
+	}
+
+	switch algorithm {
+	case minisignAlgorithm:
+	case minisignAlgorithmPrehashed:
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	default:
+		return fmt.Errorf("minisign signature algorithm %q is not supported", algorithm)
+	}
+
+	if !ed25519.Verify(k.key, message, sig) {
+		return fmt.Errorf("minisign signature is invalid")
+	}
+
+	trustedComment, globalSig, err := minisignTrustedComment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(k.key, append(append([]byte{}, sig...), trustedComment...), globalSig) {
+		return fmt.Errorf("minisign trusted comment signature is invalid")
+	}
+
+	return nil
+}
+
+// minisignDataLine returns the n-th line of a minisign file that is not a comment.
+func minisignDataLine(raw []byte, n int) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") || strings.HasPrefix(line, "trusted comment:") {
+			continue
+		}
+		if n == 0 {
+			return line, nil
+		}
+		n--
+	}
+
+	return "", fmt.Errorf("minisign file has unexpected format")
+}
+
+func minisignTrustedComment(raw []byte) (string, []byte, error) {
+	var comment string
+	for _, line := range strings.Split(string(raw), "\n") {
+		if c, ok := strings.CutPrefix(strings.TrimSpace(line), "trusted comment:"); ok {
+			comment = strings.TrimPrefix(c, " ")
+		}
+	}
+
+	line, err := minisignDataLine(raw, 1)
+	if err != nil {
+		return "", nil, fmt.Errorf("minisign signature has no trusted comment signature")
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return "", nil, fmt.Errorf("minisign trusted comment signature is not base64 encoded:%w", err)
+	}
+
+	return comment, globalSig, nil
+}
+
+// verifyChecksumSignature verifies the signature of the checksum file of an entity, the checksum must not be trusted if an error is returned.
+// in lenient mode, checksums without signature are trusted.
+func (s *Syncer) verifyChecksumSignature(e api.CacheEntity, checksumFile []byte) error {
+	if s.checksumKey == nil {
+		return nil
+	}
+
+	signed, ok := e.(api.SignedChecksum)
+	if !ok {
+		if s.checksumStrict {
+			return fmt.Errorf("checksum of %s cannot be signed", e.GetSubPath())
+		}
+		return nil
+	}
+
+	signature, err := signed.DownloadMD5Signature(s.stop, s.httpClient, s.s3)
+	if err != nil {
+		if errors.Is(err, api.ErrChecksumSignatureNotFound) && !s.checksumStrict {
+			s.logger.Warn("checksum is not signed, trusting it anyway", "key", e.GetSubPath())
+			return nil
+		}
+		return fmt.Errorf("error downloading checksum signature of %s:%w", e.GetSubPath(), err)
+	}
+
+	err = s.checksumKey.verify(checksumFile, signature)
+	if err != nil {
+		return fmt.Errorf("checksum signature of %s is not valid:%w", e.GetSubPath(), err)
+	}
+
+	return nil
+}
+
+// verifyUnsignedSHA256 decides whether the sha256 checksum of an entity is trusted, the origin only signs md5 checksums.
+// in strict mode, sha256 checksums are refused while a checksum signature key is configured.
+func (s *Syncer) verifyUnsignedSHA256(e api.CacheEntity) error {
+	if s.checksumKey == nil {
+		return nil
+	}
+
+	if s.checksumStrict {
+		return fmt.Errorf("sha256 checksum of %s is not signed", e.GetSubPath())
+	}
+
+	s.logger.Warn("sha256 checksum is not signed, trusting it anyway", "key", e.GetSubPath())
+	return nil
+}
+
+// downloadChecksumFile returns the raw checksum file of an entity.
+func (s *Syncer) downloadChecksumFile(e api.CacheEntity) ([]byte, error) {
+	fs := afero.NewMemMapFs()
+
+	f, err := fs.Create("checksum")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = e.DownloadMD5(s.stop, &f, s.httpClient, s.s3)
+	if err != nil {
+		return nil, err
+	}
+
+	return afero.ReadFile(fs, "checksum")
+}
@@ -0,0 +1,283 @@
+package sync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/metal-stack/metal-go/api/models"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+var testMinisignKeyID = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func minisignPublicKey(pub ed25519.PublicKey) []byte {
+	raw := append(append([]byte(minisignAlgorithm), testMinisignKeyID...), pub...)
+	return []byte("untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n")
+}
+
+func minisign(priv ed25519.PrivateKey, message []byte) []byte {
+	hash := blake2b.Sum512(message)
+	sig := ed25519.Sign(priv, hash[:])
+	raw := append(append([]byte(minisignAlgorithmPrehashed), testMinisignKeyID...), sig...)
+
+	trustedComment := "timestamp:1603670400"
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, sig...), trustedComment...))
+
+	return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), trustedComment, base64.StdEncoding.EncodeToString(globalSig)))
+}
+
+func TestSyncer_verifyChecksumSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	key, err := parseMinisignPublicKey(minisignPublicKey(pub))
+	require.NoError(t, err)
+
+	checksum := []byte("0cbc6611f5540bd0809a388dc95a615b  initrd.img.lz4\n")
+
+	tests := []struct {
+		name      string
+		signature []byte
+		strict    bool
+		wantErr   bool
+	}{
+		{
+			name:      "valid signature strict",
+			signature: minisign(priv, checksum),
+			strict:    true,
+		},
+		{
+			name:      "valid signature lenient",
+			signature: minisign(priv, checksum),
+		},
+		{
+			name:      "bad signature strict",
+			signature: minisign(otherPriv, checksum),
+			strict:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "bad signature lenient",
+			signature: minisign(priv, []byte("another checksum")),
+			wantErr:   true,
+		},
+		{
+			name:    "missing signature strict",
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name: "missing signature lenient",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/initrd.img.lz4.md5":
+					_, _ = w.Write(checksum)
+				case "/initrd.img.lz4.md5.minisig":
+					if tt.signature == nil {
+						http.NotFound(w, r)
+						return
+					}
+					_, _ = w.Write(tt.signature)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+
+			s := &Syncer{
+				logger:         slog.Default(),
+				stop:           context.TODO(),
+				httpClient:     http.DefaultClient,
+				checksumKey:    key,
+				checksumStrict: tt.strict,
+			}
+
+			e := api.BootImage{SubPath: "initrd.img.lz4", URL: ts.URL + "/initrd.img.lz4"}
+
+			raw, err := s.downloadChecksumFile(e)
+			require.NoError(t, err)
+			require.Equal(t, checksum, raw)
+
+			err = s.verifyChecksumSignature(e, raw)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSyncer_downloadChecksumSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	key, err := parseMinisignPublicKey(minisignPublicKey(pub))
+	require.NoError(t, err)
+
+	checksum := []byte("0cbc6611f5540bd0809a388dc95a615b  initrd.img.lz4\n")
+
+	tests := []struct {
+		name      string
+		signature []byte
+		wantPuts  []string
+		wantErr   bool
+	}{
+		{
+			name:      "valid signature",
+			signature: minisign(priv, checksum),
+			wantPuts:  []string{cacheRoot + "/initrd.img.lz4", cacheRoot + "/initrd.img.lz4.md5"},
+		},
+		{
+			name:      "bad signature",
+			signature: minisign(otherPriv, checksum),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/initrd.img.lz4":
+					_, _ = w.Write([]byte("initrd"))
+				case "/initrd.img.lz4.md5":
+					_, _ = w.Write(checksum)
+				case "/initrd.img.lz4.md5.minisig":
+					_, _ = w.Write(tt.signature)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+
+			fs := afero.NewMemMapFs()
+			store := &recordingStore{CacheStore: newFSStore(slog.Default(), fs)}
+			s := &Syncer{
+				logger:         slog.Default(),
+				fs:             fs,
+				store:          store,
+				tmpPath:        "/tmp/test-download",
+				stop:           context.TODO(),
+				httpClient:     http.DefaultClient,
+				checksumKey:    key,
+				checksumStrict: true,
+			}
+
+			err := s.download(context.TODO(), cacheRoot, nil, api.BootImage{SubPath: "initrd.img.lz4", URL: ts.URL + "/initrd.img.lz4"})
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			// a refused file is never put into the cache
+			assert.Equal(t, tt.wantPuts, store.puts)
+
+			exists, err := afero.Exists(fs, cacheRoot+"/initrd.img.lz4.md5")
+			require.NoError(t, err)
+			assert.Equal(t, !tt.wantErr, exists)
+		})
+	}
+}
+
+func TestSyncer_unsignedSHA256(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	key, err := parseMinisignPublicKey(minisignPublicKey(pub))
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.tar.lz4":
+			_, _ = w.Write([]byte("image"))
+		case "/img.tar.lz4.sha256":
+			_, _ = fmt.Fprintf(w, "%x  img.tar.lz4", sha256.Sum256([]byte("image")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	img := api.OS{
+		BucketKey:       "img.tar.lz4",
+		ApiRef:          models.V1ImageResponse{URL: ts.URL + "/img.tar.lz4"},
+		ViaHTTP:         true,
+		Size:            5,
+		MD5Missing:      true,
+		SHA256Available: true,
+	}
+
+	tests := []struct {
+		name     string
+		strict   bool
+		wantErr  bool
+		wantKeep api.CacheEntities
+	}{
+		{
+			name:     "lenient mode trusts the sha256 checksum",
+			wantKeep: api.CacheEntities{img},
+		},
+		{
+			name:    "strict mode refuses the sha256 checksum",
+			strict:  true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			s := &Syncer{
+				logger:         slog.Default(),
+				fs:             fs,
+				tmpPath:        "/tmp/test-download",
+				stop:           context.TODO(),
+				httpClient:     http.DefaultClient,
+				checksumKey:    key,
+				checksumStrict: tt.strict,
+				imageCollector: metrics.MustImageMetrics(slog.Default(), fs, cacheRoot),
+			}
+
+			err := s.download(context.TODO(), cacheRoot, nil, img)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, afero.WriteFile(fs, cacheRoot+"/img.tar.lz4", []byte("image"), 0644))
+			current, err := s.cacheStore().List(cacheRoot)
+			require.NoError(t, err)
+
+			// an untrusted checksum neither keeps nor replaces the cached file
+			_, keep, add, err := s.defineDiff(cacheRoot, current, api.CacheEntities{img})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantKeep, keep)
+			assert.Empty(t, add)
+		})
+	}
+}
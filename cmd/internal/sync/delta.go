@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"context"
+	// nolint
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// downloadDelta reconstructs the image from a delta against an already cached base version, the reconstructed image
+// is verified against the given md5 checksum of the origin.
+// returns false if no delta could be applied, in this case the full image needs to be downloaded.
+func (s *Syncer) downloadDelta(ctx context.Context, rootPath string, e api.CacheEntity, expectedMD5 string, target afero.File) (int64, bool) {
+	img, ok := e.(api.OS)
+	if !ok || expectedMD5 == "" {
+		return 0, false
+	}
+
+	for _, d := range img.Deltas {
+		basePath := strings.Join([]string{rootPath, d.BaseSubPath}, string(os.PathSeparator))
+
+		exists, err := afero.Exists(s.fs, basePath)
+		if err != nil || !exists {
+			continue
+		}
+
+		n, err := s.applyDelta(ctx, img, d, basePath, expectedMD5, target)
+		if err != nil {
+			s.logger.Warn("unable to reconstruct image from delta, downloading full image", "key", img.BucketKey, "base", d.BaseSubPath, "error", err)
+
+			_, err = target.Seek(0, 0)
+			if err != nil {
+				return 0, false
+			}
+			err = target.Truncate(0)
+			if err != nil {
+				return 0, false
+			}
+
+			continue
+		}
+
+		return n, true
+	}
+
+	return 0, false
+}
+
+func (s *Syncer) applyDelta(ctx context.Context, img api.OS, d api.Delta, basePath, expectedMD5 string, target afero.File) (int64, error) {
+	s.logger.Log(s.stop, s.fileLogLevel, "downloading delta", "id", img.GetName(), "key", img.GetSubPath(), "base", d.BaseSubPath)
+
+	patch, err := img.DownloadDelta(ctx, d, s.s3)
+	if err != nil {
+		return 0, err
+	}
+
+	base, err := s.fs.Open(basePath)
+	if err != nil {
+		return 0, fmt.Errorf("error reading base image:%w", err)
+	}
+	defer base.Close()
+
+	info, err := base.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading base image:%w", err)
+	}
+
+	hash := md5.New() // nolint
+	n, err := utils.BSPatch(base, info.Size(), patch, io.MultiWriter(target, hash), img.GetSize())
+	if err != nil {
+		return 0, fmt.Errorf("error applying delta:%w", err)
+	}
+
+	if fmt.Sprintf("%x", hash.Sum(nil)) != expectedMD5 {
+		return 0, fmt.Errorf("checksum of reconstructed image does not match")
+	}
+
+	return n, nil
+}
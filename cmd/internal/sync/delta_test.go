@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_downloadDelta(t *testing.T) {
+	base, err := os.ReadFile("testdata/delta/base")
+	require.NoError(t, err)
+	delta, err := os.ReadFile("testdata/delta/delta.bsdiff")
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/delta/expected")
+	require.NoError(t, err)
+
+	const (
+		baseKey  = "metal-os/master/ubuntu/20.04/20201025/img.tar.lz4"
+		imageKey = "metal-os/master/ubuntu/20.04/20201026/img.tar.lz4"
+		deltaKey = imageKey + ".from-20201025.bsdiff"
+	)
+
+	tests := []struct {
+		name         string
+		checksum     string
+		size         *int64
+		wantRequests []string
+	}{
+		{
+			name:         "reconstruct image from base and delta",
+			checksum:     "5292fd00702d71b0ee5056d29f8bc9d6  img.tar.lz4",
+			wantRequests: []string{imageKey + ".md5", deltaKey},
+		},
+		{
+			name:         "reconstruct image of known size from base and delta",
+			checksum:     "5292fd00702d71b0ee5056d29f8bc9d6  img.tar.lz4",
+			size:         aws.Int64(int64(len(expected))),
+			wantRequests: []string{imageKey + ".md5", deltaKey},
+		},
+		{
+			name:         "fall back to full download on checksum mismatch",
+			checksum:     "ffffffffffffffffffffffffffffffff  img.tar.lz4",
+			wantRequests: []string{imageKey + ".md5", deltaKey, imageKey},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, cacheRoot+"/"+baseKey, base, 0644))
+
+			s3Client, requests := dlObjectSvc(map[string][]byte{
+				imageKey:          expected,
+				imageKey + ".md5": []byte(tt.checksum),
+				deltaKey:          delta,
+			})
+
+			s := &Syncer{
+				logger:  slog.Default(),
+				fs:      fs,
+				tmpPath: "/tmp/test-download",
+				s3:      s3manager.NewDownloaderWithClient(s3Client),
+				stop:    context.TODO(),
+
+				imageCollector: metrics.MustImageMetrics(slog.Default(), fs, cacheRoot),
+			}
+
+			err := s.download(context.TODO(), cacheRoot, nil, api.OS{
+				BucketKey:  imageKey,
+				BucketName: "metal-os",
+				ImageRef:   s3.Object{Key: strPtr(imageKey), Size: tt.size},
+				MD5Ref:     s3.Object{Key: strPtr(imageKey + ".md5")},
+				Deltas: []api.Delta{
+					{
+						BaseSubPath: baseKey,
+						Ref:         s3.Object{Key: strPtr(deltaKey)},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			got, err := afero.ReadFile(fs, cacheRoot+"/"+imageKey)
+			require.NoError(t, err)
+			assert.Equal(t, expected, got)
+			assert.Equal(t, tt.wantRequests, requests.downloads())
+		})
+	}
+}
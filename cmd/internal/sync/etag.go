@@ -0,0 +1,63 @@
+package sync
+
+import (
+	"os"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+)
+
+// etagSuffix is the suffix of the sidecar file storing the etag of the origin object a file was downloaded from.
+const etagSuffix = ".meta"
+
+// entityETag returns the etag of the given entity if it can be used for change detection. etags of multipart
+// uploads do not equal the checksum of the content and are ignored.
+func entityETag(e api.CacheEntity) string {
+	tagged, ok := e.(api.ETagged)
+	if !ok {
+		return ""
+	}
+
+	etag := tagged.GetETag()
+	if strings.Contains(etag, "-") {
+		return ""
+	}
+
+	return etag
+}
+
+// etagUnchanged returns true if the cached file was downloaded from an origin object with the same etag,
+// such that the checksum verification of the local file can be skipped.
+func (s *Syncer) etagUnchanged(rootPath string, want api.CacheEntity, existing api.CacheEntry) bool {
+	etag := entityETag(want)
+	if etag == "" {
+		return false
+	}
+
+	if want.GetSize() > 0 && want.GetSize() != existing.GetSize() {
+		return false
+	}
+
+	p := strings.Join([]string{rootPath, existing.GetSubPath()}, string(os.PathSeparator))
+	stored, err := afero.ReadFile(s.fs, p+etagSuffix)
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(string(stored)) == etag
+}
+
+// writeETag stores the etag of the origin object next to the downloaded file, errors are only logged
+// as the file is verified by checksum in the next sync anyway.
+func (s *Syncer) writeETag(targetPath string, e api.CacheEntity) {
+	etag := entityETag(e)
+	if etag == "" {
+		return
+	}
+
+	err := afero.WriteFile(s.fs, targetPath+etagSuffix, []byte(etag), 0644)
+	if err != nil {
+		s.logger.Warn("unable to store etag of downloaded file", "path", targetPath, "error", err)
+	}
+}
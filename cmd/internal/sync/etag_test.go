@@ -0,0 +1,84 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_defineDiffETag(t *testing.T) {
+	const key = "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4"
+
+	tests := []struct {
+		name          string
+		storedETag    string
+		remoteETag    string
+		wantDownloads int
+	}{
+		{
+			name:          "unchanged etag skips verification",
+			storedETag:    "0cbc6611f5540bd0809a388dc95a615b",
+			remoteETag:    `"0cbc6611f5540bd0809a388dc95a615b"`,
+			wantDownloads: 0,
+		},
+		{
+			name:          "changed etag is verified",
+			storedETag:    "0cbc6611f5540bd0809a388dc95a615b",
+			remoteETag:    `"d41d8cd98f00b204e9800998ecf8427e"`,
+			wantDownloads: 1,
+		},
+		{
+			name:          "multipart etag is verified",
+			storedETag:    "0cbc6611f5540bd0809a388dc95a615b-2",
+			remoteETag:    `"0cbc6611f5540bd0809a388dc95a615b-2"`,
+			wantDownloads: 1,
+		},
+		{
+			name:          "missing etag sidecar is verified",
+			remoteETag:    `"0cbc6611f5540bd0809a388dc95a615b"`,
+			wantDownloads: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			createTestFile(t, fs, cacheRoot+"/"+key)
+			if tt.storedETag != "" {
+				require.NoError(t, afero.WriteFile(fs, cacheRoot+"/"+key+etagSuffix, []byte(tt.storedETag), 0644))
+			}
+
+			s3Client, requests := dlObjectSvc(map[string][]byte{key + ".md5": []byte("0cbc6611f5540bd0809a388dc95a615b  img.tar.lz4")})
+			s := &Syncer{
+				logger: slog.Default(),
+				fs:     fs,
+				s3:     s3manager.NewDownloaderWithClient(s3Client),
+				stop:   context.TODO(),
+			}
+
+			want := api.OS{
+				BucketKey:  key,
+				BucketName: "metal-os",
+				ImageRef:   s3.Object{ETag: aws.String(tt.remoteETag), Size: aws.Int64(4)},
+				MD5Ref:     s3.Object{Key: strPtr(key + ".md5")},
+			}
+
+			current, err := currentFileIndex(s.logger, fs, cacheRoot)
+			require.NoError(t, err)
+
+			_, keep, add, err := s.defineDiff(cacheRoot, current, api.CacheEntities{want})
+			require.NoError(t, err)
+			assert.Len(t, keep, 1)
+			assert.Empty(t, add)
+			assert.Len(t, requests.downloads(), tt.wantDownloads)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"fmt"
+
+	"github.com/docker/go-units"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+)
+
+// diskStat returns the amount of bytes available to the process on the filesystem containing the given path.
+type diskStat interface {
+	Free(path string) (uint64, error)
+}
+
+// preflight compares the planned download size with the free space of the cache filesystem, the space freed by
+// the planned removals is taken into account and the configured minimum free space is kept as headroom.
+// if there is not enough space, the plan is trimmed to fit if configured, otherwise an error is returned.
+func (s *Syncer) preflight(rootPath string, remove api.CacheEntries, add api.CacheEntities) (api.CacheEntities, error) {
+	free, err := s.diskStat.Free(rootPath)
+	if err != nil {
+		s.logger.Warn("unable to determine free space of cache filesystem, skipping preflight check", "error", err)
+		return add, nil
+	}
+
+	available := int64(free) - s.minFreeDiskBytes
+	for _, e := range remove {
+		available += e.GetSize()
+	}
+
+	var planned int64
+	for _, e := range add {
+		planned += e.GetSize()
+	}
+
+	if planned <= available {
+		s.imageCollector.SetMissingFreeSpace(rootPath, 0)
+		return add, nil
+	}
+
+	s.imageCollector.SetMissingFreeSpace(rootPath, planned-available)
+
+	if !s.trimPlan {
+		return nil, fmt.Errorf("insufficient free space on cache filesystem, planned %s but only %s available (keeping %s free)", units.BytesSize(float64(planned)), units.BytesSize(float64(available)), units.BytesSize(float64(s.minFreeDiskBytes)))
+	}
+
+	s.logger.Warn("insufficient free space for sync plan, trimming plan", "root", rootPath, "planned", units.BytesSize(float64(planned)), "available", units.BytesSize(float64(available)))
+
+	var (
+		trimmed api.CacheEntities
+		size    int64
+	)
+	for _, e := range add {
+		if size+e.GetSize() > available {
+			s.logger.Warn("not enough free space, skipping download", "key", e.GetSubPath(), "size", e.GetSize())
+			continue
+		}
+		size += e.GetSize()
+		trimmed = append(trimmed, e)
+	}
+
+	return trimmed, nil
+}
@@ -0,0 +1,15 @@
+package sync
+
+import "syscall"
+
+type statfsDiskStat struct{}
+
+func (statfsDiskStat) Free(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
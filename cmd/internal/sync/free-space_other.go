@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sync
+
+import "fmt"
+
+type statfsDiskStat struct{}
+
+func (statfsDiskStat) Free(path string) (uint64, error) {
+	return 0, fmt.Errorf("determining free space is not supported on this platform")
+}
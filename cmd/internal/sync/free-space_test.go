@@ -0,0 +1,114 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDiskStat uint64
+
+func (f fakeDiskStat) Free(path string) (uint64, error) {
+	return uint64(f), nil
+}
+
+func TestSyncer_preflight(t *testing.T) {
+	add := api.CacheEntities{
+		api.Kernel{SubPath: "metal-hammer/v0.1.0/kernel", Size: 60},
+		api.Kernel{SubPath: "metal-hammer/v0.2.0/kernel", Size: 50},
+		api.Kernel{SubPath: "metal-hammer/v0.3.0/kernel", Size: 30},
+	}
+
+	tests := []struct {
+		name         string
+		free         uint64
+		minFreeBytes int64
+		remove       api.CacheEntries
+		trimPlan     bool
+		want         api.CacheEntities
+		wantMissing  float64
+		wantErr      bool
+	}{
+		{
+			name:        "enough free space",
+			free:        140,
+			want:        add,
+			wantMissing: 0,
+		},
+		{
+			name: "enough free space after removals",
+			free: 100,
+			remove: api.CacheEntries{
+				api.LocalFile{SubPath: "metal-hammer/v0.0.1/kernel", Size: 40},
+			},
+			want:        add,
+			wantMissing: 0,
+		},
+		{
+			name:        "insufficient free space aborts without trimming",
+			free:        100,
+			want:        nil,
+			wantMissing: 40,
+			wantErr:     true,
+		},
+		{
+			name:         "min free disk bytes are kept as headroom",
+			free:         140,
+			minFreeBytes: 10,
+			want:         nil,
+			wantMissing:  10,
+			wantErr:      true,
+		},
+		{
+			name:     "insufficient free space trims plan",
+			free:     100,
+			trimPlan: true,
+			want: api.CacheEntities{
+				api.Kernel{SubPath: "metal-hammer/v0.1.0/kernel", Size: 60},
+				api.Kernel{SubPath: "metal-hammer/v0.3.0/kernel", Size: 30},
+			},
+			wantMissing: 40,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			collector := metrics.MustImageMetrics(slog.Default(), afero.NewMemMapFs(), cacheRoot)
+			s := &Syncer{
+				logger:           slog.Default(),
+				stop:             context.TODO(),
+				diskStat:         fakeDiskStat(tt.free),
+				trimPlan:         tt.trimPlan,
+				minFreeDiskBytes: tt.minFreeBytes,
+				imageCollector:   collector,
+			}
+
+			got, err := s.preflight(cacheRoot, tt.remove, add)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+
+			families, err := collector.GetGatherer().Gather()
+			require.NoError(t, err)
+
+			found := false
+			for _, f := range families {
+				if f.GetName() != "cache_sync_missing_free_space_bytes" {
+					continue
+				}
+				found = true
+				assert.Equal(t, tt.wantMissing, f.GetMetric()[0].GetGauge().GetValue())
+			}
+			assert.True(t, found, "metric was not set")
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// latestDir is the name of the link next to the version directories of an os major.minor, it points to the
+// directory of the newest cached version.
+const latestDir = utils.LatestLinkName
+
+// isLatestLink returns true for the latest links maintained by the syncer, they are not part of the cache index.
+func isLatestLink(rootPath, p string, info os.FileInfo) bool {
+	return p != rootPath && info.Name() == latestDir
+}
+
+// updateLatestLinks points the latest link of every os major.minor in the given root path to the directory of the
+// newest cached version, links of os versions that are not cached anymore are removed. a copy of the version
+// directory is created on filesystems without symlink support.
+func (s *Syncer) updateLatestLinks(rootPath string, entities api.CacheEntities) error {
+	newest := map[string]api.OS{}
+	for _, e := range entities {
+		img, ok := e.(api.OS)
+		if !ok || img.Version == nil {
+			continue
+		}
+
+		versionDir := path.Dir(img.GetSubPath())
+		if versionDir == "." {
+			continue
+		}
+
+		_, err := s.cacheStore().Stat(path.Join(rootPath, img.GetSubPath()))
+		if err != nil {
+			// not cached, e.g. because the download was trimmed from the plan
+			continue
+		}
+
+		key := path.Dir(versionDir)
+		if current, ok := newest[key]; !ok || img.NewerThan(current) {
+			newest[key] = img
+		}
+	}
+
+	for key, img := range newest {
+		err := s.linkLatest(path.Join(rootPath, key), path.Base(path.Dir(img.GetSubPath())))
+		if err != nil {
+			return fmt.Errorf("error updating latest link of %s:%w", key, err)
+		}
+	}
+
+	var stale []string
+	err := afero.Walk(s.fs, rootPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == rootPath {
+				return err
+			}
+			return nil
+		}
+		if !isLatestLink(rootPath, p, info) {
+			return nil
+		}
+
+		key, err := filepath.Rel(rootPath, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		if _, ok := newest[filepath.ToSlash(key)]; !ok {
+			stale = append(stale, p)
+		}
+
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range stale {
+		s.logger.Info("removing stale latest link", "root", rootPath, "path", p)
+
+		err = s.fs.RemoveAll(p)
+		if err != nil {
+			return fmt.Errorf("error removing stale latest link %s:%w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// linkLatest points the latest link in the given directory to the given version directory.
+func (s *Syncer) linkLatest(dir, version string) error {
+	latest := path.Join(dir, latestDir)
+
+	if reader, ok := s.fs.(afero.LinkReader); ok {
+		target, err := reader.ReadlinkIfPossible(latest)
+		if err == nil && target == version {
+			return nil
+		}
+	}
+
+	if linker, ok := s.fs.(afero.Linker); ok {
+		// the new link is moved over the old one such that the latest path never vanishes
+		tmp := latest + ".tmp"
+		_ = s.fs.RemoveAll(tmp)
+
+		err := linker.SymlinkIfPossible(version, tmp)
+		if err == nil {
+			err = s.removeLatestCopy(latest)
+			if err != nil {
+				return err
+			}
+
+			s.logger.Info("updating latest link", "dir", dir, "version", version)
+			return s.fs.Rename(tmp, latest)
+		}
+		if !errors.Is(err, afero.ErrNoSymlink) {
+			return err
+		}
+	}
+
+	return s.copyLatest(dir, version)
+}
+
+// removeLatestCopy removes a copied latest directory, e.g. when the filesystem gained symlink support.
+func (s *Syncer) removeLatestCopy(latest string) error {
+	var (
+		info os.FileInfo
+		err  error
+	)
+	if lstater, ok := s.fs.(afero.Lstater); ok {
+		info, _, err = lstater.LstatIfPossible(latest)
+	} else {
+		info, err = s.fs.Stat(latest)
+	}
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+
+	return s.fs.RemoveAll(latest)
+}
+
+// copyLatest copies the files of the given version directory into the latest directory, files that are already
+// copied with the same size and modification time are kept.
+func (s *Syncer) copyLatest(dir, version string) error {
+	latest := path.Join(dir, latestDir)
+
+	files, err := afero.ReadDir(s.fs, path.Join(dir, version))
+	if err != nil {
+		return err
+	}
+
+	upToDate := true
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		copied, err := s.fs.Stat(path.Join(latest, f.Name()))
+		if err != nil || copied.Size() != f.Size() || !copied.ModTime().Equal(f.ModTime()) {
+			upToDate = false
+			break
+		}
+	}
+	if upToDate {
+		return nil
+	}
+
+	s.logger.Info("updating latest copy, filesystem does not support symlinks", "dir", dir, "version", version)
+
+	err = s.fs.RemoveAll(latest)
+	if err != nil {
+		return err
+	}
+
+	err = s.fs.MkdirAll(latest, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		err = s.copyFile(path.Join(dir, version, f.Name()), path.Join(latest, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = s.fs.Chtimes(path.Join(latest, f.Name()), f.ModTime(), f.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Syncer) copyFile(src, dst string) error {
+	in, err := s.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := s.fs.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
+}
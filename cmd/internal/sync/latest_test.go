@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_updateLatestLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		fs       func(t *testing.T) (afero.Fs, string)
+		symlinks bool
+	}{
+		{
+			name: "symlinks",
+			fs: func(t *testing.T) (afero.Fs, string) {
+				return afero.NewOsFs(), t.TempDir()
+			},
+			symlinks: true,
+		},
+		{
+			name: "copy on filesystems without symlink support",
+			fs: func(t *testing.T) (afero.Fs, string) {
+				return afero.NewMemMapFs(), cacheRoot
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs, root := tt.fs(t)
+
+			older := testOS("ubuntu", "20.04.20201025")
+			newer := testOS("ubuntu", "20.04.20201026")
+			require.NoError(t, fs.MkdirAll(root+"/ubuntu/20.04/20201025", 0755))
+			require.NoError(t, fs.MkdirAll(root+"/ubuntu/20.04/20201026", 0755))
+			require.NoError(t, afero.WriteFile(fs, root+"/"+older.GetSubPath(), []byte("older"), 0644))
+			require.NoError(t, afero.WriteFile(fs, root+"/"+newer.GetSubPath(), []byte("newer"), 0644))
+
+			s := &Syncer{
+				logger: slog.Default(),
+				fs:     fs,
+			}
+
+			latest := func() string {
+				raw, err := afero.ReadFile(fs, root+"/ubuntu/20.04/latest/img.tar.lz4")
+				require.NoError(t, err)
+				return string(raw)
+			}
+
+			err := s.updateLatestLinks(root, api.CacheEntities{older, newer})
+			require.NoError(t, err)
+			assert.Equal(t, "newer", latest())
+
+			if tt.symlinks {
+				target, err := os.Readlink(root + "/ubuntu/20.04/latest")
+				require.NoError(t, err)
+				assert.Equal(t, "20201026", target)
+			}
+
+			// the latest link is not part of the cache index
+			index, err := currentFileIndex(slog.Default(), fs, root)
+			require.NoError(t, err)
+			assert.Len(t, index, 2)
+
+			// the newest version is evicted
+			require.NoError(t, fs.RemoveAll(root+"/ubuntu/20.04/20201026"))
+
+			err = s.updateLatestLinks(root, api.CacheEntities{older})
+			require.NoError(t, err)
+			assert.Equal(t, "older", latest())
+
+			// the os is not cached anymore
+			require.NoError(t, fs.RemoveAll(root+"/ubuntu/20.04/20201025"))
+
+			err = s.updateLatestLinks(root, api.CacheEntities{})
+			require.NoError(t, err)
+
+			_, err = fs.Stat(root + "/ubuntu/20.04/latest")
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func testOS(name, version string) api.OS {
+	v := semver.MustParse(version)
+	return api.OS{
+		Name:      name,
+		Version:   v,
+		BucketKey: fmt.Sprintf("%s/%d.%02d/%d/img.tar.lz4", name, v.Major(), v.Minor(), v.Patch()),
+	}
+}
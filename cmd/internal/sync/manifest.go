@@ -0,0 +1,149 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// Manifest lists all files in the given root path along with their checksums, such that peers can replicate them.
+// the checksum is taken from the md5 sidecar file if present, otherwise it is calculated.
+func (s *Syncer) Manifest(rootPath string) ([]api.ManifestEntry, error) {
+	current, err := s.cacheStore().List(rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file index:%w", err)
+	}
+
+	result := []api.ManifestEntry{}
+	for _, e := range current {
+		p := strings.Join([]string{rootPath, e.GetSubPath()}, string(os.PathSeparator))
+
+		checksum, err := localMD5(s.fs, p)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := api.ManifestEntry{
+			Name:    e.GetName(),
+			SubPath: e.GetSubPath(),
+			Size:    e.GetSize(),
+			MD5:     checksum,
+		}
+		if s.cacheManifest != nil {
+			if recorded, ok := s.cacheManifest.get(rootPath, e.GetSubPath()); ok {
+				entry.Source = recorded.Source
+				entry.SyncedAt = recorded.SyncedAt
+			}
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// Index lists all files in the given root path along with their modification time, checksum files are excluded.
+func (s *Syncer) Index(rootPath string) ([]api.IndexEntry, error) {
+	current, err := s.cacheStore().List(rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file index:%w", err)
+	}
+
+	result := []api.IndexEntry{}
+	for _, e := range current {
+		info, err := s.cacheStore().Stat(strings.Join([]string{rootPath, e.GetSubPath()}, string(os.PathSeparator)))
+		if err != nil {
+			s.logger.Warn("skipping unreadable entry in cache", "path", e.GetSubPath(), "error", err)
+			continue
+		}
+
+		result = append(result, api.IndexEntry{
+			Name:    e.GetName(),
+			SubPath: e.GetSubPath(),
+			Size:    e.GetSize(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return result, nil
+}
+
+func localMD5(fs afero.Fs, p string) (string, error) {
+	if checksum, ok := SidecarMD5(fs, p); ok {
+		return checksum, nil
+	}
+
+	checksum, err := utils.FileMD5(fs, p)
+	if err != nil {
+		return "", fmt.Errorf("error calculating hash sum of local file:%w", err)
+	}
+
+	return checksum, nil
+}
+
+// SidecarMD5 returns the checksum stored in the md5 sidecar file of the given file if present.
+func SidecarMD5(fs afero.Fs, p string) (string, bool) {
+	return sidecarChecksum(fs, p+".md5")
+}
+
+// SidecarSHA256 returns the checksum stored in the sha256 sidecar file of the given file if present.
+func SidecarSHA256(fs afero.Fs, p string) (string, bool) {
+	return sidecarChecksum(fs, p+".sha256")
+}
+
+func sidecarChecksum(fs afero.Fs, sidecarPath string) (string, bool) {
+	content, err := afero.ReadFile(fs, sidecarPath)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.Fields(string(content))
+	if len(parts) == 0 {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// ArtifactStatus returns whether the file is cached in the given root path and matches its md5 or sha256 sidecar file.
+func (s *Syncer) ArtifactStatus(rootPath, subPath string) string {
+	if subPath == "" {
+		return api.ArtifactMissing
+	}
+
+	p := strings.Join([]string{rootPath, subPath}, string(os.PathSeparator))
+
+	exists, err := afero.Exists(s.fs, p)
+	if err != nil || !exists {
+		return api.ArtifactMissing
+	}
+
+	algorithm := checksumAlgorithmMD5
+	content, err := afero.ReadFile(s.fs, p+".md5")
+	if err != nil {
+		algorithm = checksumAlgorithmSHA256
+		content, err = afero.ReadFile(s.fs, p+".sha256")
+		if err != nil {
+			return api.ArtifactPresent
+		}
+	}
+
+	parts := strings.Fields(string(content))
+	if len(parts) == 0 {
+		return api.ArtifactMismatch
+	}
+
+	// the checksum cache hashes a file only once as long as it does not change
+	s.artifactStatusMutex.Lock()
+	checksum, err := s.fileChecksum(p, algorithm)
+	s.artifactStatusMutex.Unlock()
+	if err != nil || checksum != parts[0] {
+		return api.ArtifactMismatch
+	}
+
+	return api.ArtifactPresent
+}
@@ -0,0 +1,41 @@
+package sync
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"testing"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_ArtifactStatus(t *testing.T) {
+	const subPath = "v1/initrd.img.lz4"
+
+	var opens atomic.Int32
+	fs := openCountingFs{Fs: afero.NewMemMapFs(), path: cacheRoot + "/" + subPath, opens: &opens}
+	createTestFile(t, fs, cacheRoot+"/"+subPath)
+	require.NoError(t, afero.WriteFile(fs, cacheRoot+"/"+subPath+".md5", []byte("0cbc6611f5540bd0809a388dc95a615b  initrd.img.lz4"), 0644))
+
+	s := &Syncer{
+		logger:        slog.Default(),
+		fs:            fs,
+		checksumCache: newJSONChecksumCache(slog.Default(), fs, "/tmp/checksum-cache.json"),
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, api.ArtifactPresent, s.ArtifactStatus(cacheRoot, subPath))
+	}
+	assert.Equal(t, int32(1), opens.Load(), "unchanged file was hashed more than once")
+
+	require.NoError(t, afero.WriteFile(fs, cacheRoot+"/"+subPath, []byte("Changed"), 0644))
+	assert.Equal(t, api.ArtifactMismatch, s.ArtifactStatus(cacheRoot, subPath))
+	assert.Equal(t, api.ArtifactMissing, s.ArtifactStatus(cacheRoot, "v2/initrd.img.lz4"))
+
+	// without md5 sidecar the sha256 sidecar is verified
+	createTestFile(t, fs, cacheRoot+"/v3/initrd.img.lz4")
+	require.NoError(t, afero.WriteFile(fs, cacheRoot+"/v3/initrd.img.lz4.sha256", []byte("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  initrd.img.lz4"), 0644))
+	assert.Equal(t, api.ArtifactMismatch, s.ArtifactStatus(cacheRoot, "v3/initrd.img.lz4"))
+}
@@ -0,0 +1,58 @@
+package sync
+
+import "path"
+
+const (
+	// maxRequestIDsPerMiss limits the amount of request ids remembered for a single missing file
+	maxRequestIDsPerMiss = 10
+	// maxMissedFiles limits the amount of missing files remembered in between two syncs, the paths are taken from
+	// client requests and would otherwise grow without bound
+	maxMissedFiles = 1000
+)
+
+// RecordMiss remembers the id of a request that could not be served from the cache, such that the
+// download of the missing file in the next sync can be correlated with the request.
+func (s *Syncer) RecordMiss(rootPath, subPath, requestID string) {
+	s.missesMutex.Lock()
+	defer s.missesMutex.Unlock()
+
+	if s.misses == nil {
+		s.misses = map[string][]string{}
+	}
+
+	key := path.Join(rootPath, subPath)
+	ids, ok := s.misses[key]
+	if !ok && len(s.misses) >= maxMissedFiles {
+		return
+	}
+	if len(ids) >= maxRequestIDsPerMiss {
+		return
+	}
+
+	s.misses[key] = append(s.misses[key], requestID)
+}
+
+// takeMisses returns the request ids of all misses of the given file and forgets them.
+func (s *Syncer) takeMisses(rootPath, subPath string) []string {
+	s.missesMutex.Lock()
+	defer s.missesMutex.Unlock()
+
+	key := path.Join(rootPath, subPath)
+	ids := s.misses[key]
+	delete(s.misses, key)
+
+	return ids
+}
+
+// clearMisses forgets the misses of all files in the given root path, which were not downloaded during the sync.
+// it is called after every sync of the root path, also if the sync failed.
+func (s *Syncer) clearMisses(rootPath string) {
+	s.missesMutex.Lock()
+	defer s.missesMutex.Unlock()
+
+	for key := range s.misses {
+		if len(key) > len(rootPath) && key[:len(rootPath)+1] == rootPath+"/" {
+			delete(s.misses, key)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package sync
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncer_RecordMiss(t *testing.T) {
+	s := &Syncer{}
+
+	for i := range maxRequestIDsPerMiss + 1 {
+		s.RecordMiss(cacheRoot, "metal-hammer/kernel", fmt.Sprintf("request-%d", i))
+	}
+	for i := range maxMissedFiles + 1 {
+		s.RecordMiss(cacheRoot, fmt.Sprintf("unknown/%d", i), "request")
+	}
+
+	assert.Len(t, s.misses, maxMissedFiles)
+	assert.Len(t, s.takeMisses(cacheRoot, "metal-hammer/kernel"), maxRequestIDsPerMiss)
+
+	// room is made by taking the misses of downloaded files
+	s.RecordMiss(cacheRoot, "unknown/new", "request")
+	assert.Equal(t, []string{"request"}, s.takeMisses(cacheRoot, "unknown/new"))
+
+	s.RecordMiss("/other-root", "metal-hammer/kernel", "request")
+	s.clearMisses(cacheRoot)
+	assert.Len(t, s.misses, 1)
+}
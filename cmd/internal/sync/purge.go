@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+)
+
+// sidecarSuffixes are the suffixes of the checksum and metadata files written next to the downloaded files.
+var sidecarSuffixes = []string{".md5", ".sha256", etagSuffix}
+
+// orphanedSidecarFiles returns the sidecar files in the given root path whose file does not exist anymore.
+func orphanedSidecarFiles(fs afero.Fs, rootPath string) ([]string, error) {
+	var result []string
+	err := afero.Walk(fs, rootPath, func(p string, info os.FileInfo, innerErr error) error {
+		if innerErr != nil {
+			if p == rootPath {
+				return fmt.Errorf("error while walking through root path %s error:%w", rootPath, innerErr)
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		for _, suffix := range sidecarSuffixes {
+			if !strings.HasSuffix(p, suffix) {
+				continue
+			}
+
+			exists, err := afero.Exists(fs, strings.TrimSuffix(p, suffix))
+			if err != nil {
+				return err
+			}
+			if !exists {
+				result = append(result, p)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// withinRoot returns true if the given path is located inside of the root path.
+func withinRoot(rootPath, p string) bool {
+	rel, err := filepath.Rel(rootPath, p)
+	if err != nil {
+		return false
+	}
+
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// knownBySync returns true if the file was downloaded by the syncer according to the cache manifest. all files
+// are treated as known if there is no cache manifest.
+func (s *Syncer) knownBySync(rootPath string, e api.CacheEntry) bool {
+	if s.cacheManifest == nil {
+		return true
+	}
+
+	entry, ok := s.cacheManifest.get(rootPath, e.GetSubPath())
+	return ok && entry.SyncedAt != nil
+}
+
+// removable returns the files to remove without the unknown ones, unless unknown files are purged. such that
+// manually copied files and leftovers of older versions are only deleted on explicit request.
+func (s *Syncer) removable(rootPath string, remove api.CacheEntries) api.CacheEntries {
+	if s.purgeUnknown {
+		return remove
+	}
+
+	var result api.CacheEntries
+	for _, e := range remove {
+		if !s.knownBySync(rootPath, e) {
+			s.logger.Log(s.stop, s.fileLogLevel, "keeping unknown file, it is only deleted with purge-unknown", "root", rootPath, "path", e.GetSubPath())
+			continue
+		}
+		result = append(result, e)
+	}
+
+	return result
+}
+
+// removeOrphanedSidecars deletes sidecar files whose file is gone, e.g. because it was deleted manually or
+// a previous sync crashed. only called in purge mode, every deleted file is logged for auditing.
+func (s *Syncer) removeOrphanedSidecars(rootPath string) error {
+	orphans, err := orphanedSidecarFiles(s.fs, rootPath)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range orphans {
+		if !withinRoot(rootPath, p) {
+			s.logger.Error("refusing to delete file outside of cache root", "root", rootPath, "path", p)
+			continue
+		}
+
+		s.logger.Info("removing orphaned sidecar file", "root", rootPath, "path", p, "reason", "orphaned-sidecar")
+
+		err = s.cacheStore().Delete(p)
+		if err != nil {
+			return fmt.Errorf("error deleting orphaned sidecar file %s:%w", p, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_SyncPurgeUnknown(t *testing.T) {
+	tests := []struct {
+		name         string
+		purgeUnknown bool
+		wantExists   map[string]bool
+	}{
+		{
+			name:         "only files downloaded by the sync are deleted",
+			purgeUnknown: false,
+			wantExists: map[string]bool{
+				"/metal-os/ubuntu/20.04/img.tar.lz4":        true,
+				"/metal-os/ubuntu/20.04/img.tar.lz4.md5":    true,
+				"/metal-os/ubuntu/19.04/img.tar.lz4.md5":    true,
+				"/metal-os/ubuntu/19.04/img.tar.lz4.sha256": true,
+				"/metal-os/debian/10/img.tar.lz4":           true,
+				"/metal-os/debian/11/img.tar.lz4":           false,
+			},
+		},
+		{
+			name:         "unknown files and orphaned checksum files are deleted in purge mode",
+			purgeUnknown: true,
+			wantExists: map[string]bool{
+				"/metal-os/ubuntu/20.04/img.tar.lz4":        true,
+				"/metal-os/ubuntu/20.04/img.tar.lz4.md5":    true,
+				"/metal-os/ubuntu/19.04/img.tar.lz4.md5":    false,
+				"/metal-os/ubuntu/19.04/img.tar.lz4.sha256": false,
+				"/metal-os/debian/10/img.tar.lz4":           false,
+				"/metal-os/debian/11/img.tar.lz4":           false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+			createTestFile(t, fs, cacheRoot+"/metal-os/ubuntu/20.04/img.tar.lz4")
+			createTestFile(t, fs, cacheRoot+"/metal-os/ubuntu/20.04/img.tar.lz4.md5")
+			createTestFile(t, fs, cacheRoot+"/metal-os/ubuntu/19.04/img.tar.lz4.md5")
+			createTestFile(t, fs, cacheRoot+"/metal-os/ubuntu/19.04/img.tar.lz4.sha256")
+			createTestFile(t, fs, cacheRoot+"/metal-os/debian/10/img.tar.lz4")
+			createTestFile(t, fs, cacheRoot+"/metal-os/debian/11/img.tar.lz4")
+
+			// only debian 11 was downloaded by a previous sync
+			manifest := newCacheManifest(slog.Default(), fs, "/tmp/cache-manifest.json")
+			manifest.record(cacheRoot, api.Kernel{SubPath: "metal-os/debian/11/img.tar.lz4"}, time.Now())
+
+			s := &Syncer{
+				logger:        slog.Default(),
+				fs:            fs,
+				tmpPath:       "/tmp/test-download",
+				stop:          context.TODO(),
+				httpClient:    http.DefaultClient,
+				purgeUnknown:  tt.purgeUnknown,
+				cacheManifest: manifest,
+			}
+
+			err := s.Sync(cacheRoot, api.CacheEntities{
+				api.Kernel{SubPath: "metal-os/ubuntu/20.04/img.tar.lz4"},
+			})
+			require.NoError(t, err)
+
+			for p, want := range tt.wantExists {
+				exists, err := afero.Exists(fs, cacheRoot+p)
+				require.NoError(t, err)
+				assert.Equal(t, want, exists, "unexpected existence of %s", p)
+			}
+		})
+	}
+}
+
+func Test_withinRoot(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: cacheRoot + "/metal-os/img.tar.lz4", want: true},
+		{path: cacheRoot + "/metal-os/../img.tar.lz4", want: true},
+		{path: cacheRoot, want: false},
+		{path: cacheRoot + "/..", want: false},
+		{path: cacheRoot + "/../other/img.tar.lz4", want: false},
+		{path: "/etc/passwd", want: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, withinRoot(cacheRoot, tt.path))
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package sync
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+)
+
+// NewHTTPTransport returns the transport for the requests to the origins and the image store.
+func NewHTTPTransport(config *api.Config) *http.Transport {
+	return utils.NewHTTPTransport(config.HTTPProxyURL, config.HTTPMaxIdleConnsPerHost, config.HTTPIdleConnTimeout, config.HTTPTLSHandshakeTimeout)
+}
+
+// NewHTTPClient returns the client for the requests to the origins. it is shared by the sync lister and the syncer,
+// such that connections to the origins are reused.
+func NewHTTPClient(config *api.Config, transport *http.Transport) *http.Client {
+	c := newHTTPClient(utils.NewUserAgentTransport(transport, config.HTTPUserAgent), config.MaxRedirects, config.AllowedRedirectHosts)
+	c.Timeout = config.HTTPTimeout
+
+	return c
+}
+
+// newHTTPClient returns the client used for downloading entities, it follows at most maxRedirects redirects.
+// redirects to a host other than the one of the original request are only followed if the host is contained in allowedHosts,
+// all hosts are allowed if allowedHosts is empty.
+func newHTTPClient(transport http.RoundTripper, maxRedirects int, allowedHosts []string) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+
+			if len(allowedHosts) == 0 || req.URL.Host == via[0].URL.Host {
+				return nil
+			}
+
+			if !slices.Contains(allowedHosts, req.URL.Hostname()) && !slices.Contains(allowedHosts, req.URL.Host) {
+				return fmt.Errorf("redirect to host %s is not allowed", req.URL.Host)
+			}
+
+			return nil
+		},
+	}
+}
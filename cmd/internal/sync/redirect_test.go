@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newHTTPClient(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer other.Close()
+
+	// same server on a different host name
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	// /chain/<n> redirects n times before serving the file, /cross redirects to the other host
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/chain/"):
+			n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/chain/"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if n == 0 {
+				_, _ = w.Write([]byte("kernel"))
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf("/chain/%d", n-1), http.StatusFound)
+		case r.URL.Path == "/cross":
+			http.Redirect(w, r, otherURL+"/kernel", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name         string
+		path         string
+		maxRedirects int
+		allowedHosts []string
+		wantErr      bool
+	}{
+		{
+			name:         "redirects within limit are followed",
+			path:         "/chain/3",
+			maxRedirects: 3,
+		},
+		{
+			name:         "redirects exceeding limit are rejected",
+			path:         "/chain/4",
+			maxRedirects: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "zero max redirects rejects any redirect",
+			path:         "/chain/1",
+			maxRedirects: 0,
+			wantErr:      true,
+		},
+		{
+			name:         "cross host redirect allowed without allowed hosts",
+			path:         "/cross",
+			maxRedirects: 10,
+		},
+		{
+			name:         "same host redirect allowed with allowed hosts",
+			path:         "/chain/2",
+			maxRedirects: 10,
+			allowedHosts: []string{"example.com"},
+		},
+		{
+			name:         "cross host redirect to allowed host",
+			path:         "/cross",
+			maxRedirects: 10,
+			allowedHosts: []string{"localhost"},
+		},
+		{
+			name:         "cross host redirect to disallowed host",
+			path:         "/cross",
+			maxRedirects: 10,
+			allowedHosts: []string{"example.com"},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := newHTTPClient(nil, tt.maxRedirects, tt.allowedHosts)
+
+			resp, err := c.Get(origin.URL + tt.path)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	config := &api.Config{
+		MaxRedirects:            10,
+		HTTPUserAgent:           "metal-image-cache-sync/v0.1.0",
+		HTTPMaxIdleConnsPerHost: 4,
+		HTTPIdleConnTimeout:     90 * time.Second,
+		HTTPTLSHandshakeTimeout: 10 * time.Second,
+		HTTPTimeout:             50 * time.Millisecond,
+	}
+	c := NewHTTPClient(config, NewHTTPTransport(config))
+
+	resp, err := c.Get(ts.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "metal-image-cache-sync/v0.1.0", userAgent)
+
+	_, err = c.Get(ts.URL + "/slow")
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "Client.Timeout exceeded")
+}
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+	"github.com/spf13/afero"
+)
+
+// resumeDir returns the directory of the partial downloads of the given root path, partial downloads are kept
+// across syncs and restarts such that an interrupted download continues where it stopped.
+func (s *Syncer) resumeDir(rootPath string) string {
+	return path.Join(s.tmpPath, "resume", rootPath)
+}
+
+// openPartialDownload opens the partial download of the given entity, the returned offset is the amount of bytes
+// that were already downloaded.
+func (s *Syncer) openPartialDownload(rootPath string, e api.CacheEntity) (afero.File, int64, error) {
+	p := path.Join(s.resumeDir(rootPath), e.GetSubPath())
+
+	err := s.fs.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating partial download path:%w", err)
+	}
+
+	f, err := s.fs.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening partial download %s: %w", p, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, fmt.Errorf("error reading partial download %s: %w", p, err)
+	}
+
+	offset := info.Size()
+	if e.GetSize() > 0 && offset > e.GetSize() {
+		// the origin was replaced by a smaller file since the download was interrupted
+		err = f.Truncate(0)
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, fmt.Errorf("error truncating partial download %s: %w", p, err)
+		}
+		offset = 0
+	}
+
+	return f, offset, nil
+}
+
+// downloadResumable continues the download of the entity from the given offset, the whole file is downloaded if
+// the origin does not support ranged requests.
+func (s *Syncer) downloadResumable(ctx context.Context, e api.CacheEntity, r api.Resumable, f afero.File, offset int64) (int64, error) {
+	if offset > 0 && offset == e.GetSize() {
+		return offset, nil
+	}
+
+	if offset > 0 {
+		s.logger.Info("resuming interrupted download", "key", e.GetSubPath(), "offset", offset, "size", e.GetSize())
+
+		n, err := r.DownloadFrom(ctx, f, offset, s.httpClient, s.s3)
+		if err == nil {
+			return offset + n, nil
+		}
+		if !errors.Is(err, api.ErrRangeNotSupported) {
+			return 0, err
+		}
+
+		s.logger.Warn("unable to resume download, downloading whole file", "key", e.GetSubPath(), "error", err)
+
+		err = f.Truncate(0)
+		if err != nil {
+			return 0, fmt.Errorf("error truncating partial download:%w", err)
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, fmt.Errorf("error truncating partial download:%w", err)
+		}
+	}
+
+	return e.Download(ctx, f, s.httpClient, s.s3)
+}
+
+// verifyResumed compares the checksum of a resumed download with the one of the origin before it is moved into
+// the cache, the origin may have changed in between the partial downloads.
+func (s *Syncer) verifyResumed(ctx context.Context, e api.CacheEntity, filePath string) error {
+	var (
+		want, got string
+		err       error
+	)
+
+	switch {
+	case e.HasMD5():
+		want, err = e.DownloadMD5(ctx, nil, s.httpClient, s.s3)
+		if err == nil {
+			got, err = utils.FileMD5(s.fs, filePath)
+		}
+	case e.HasSHA256():
+		want, err = e.DownloadSHA256(ctx, nil, s.httpClient, s.s3)
+		if err == nil {
+			got, err = utils.FileSHA256(s.fs, filePath)
+		}
+	default:
+		// only the size can be verified
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error verifying resumed download of %s:%w", e.GetSubPath(), err)
+	}
+
+	if got != want {
+		return fmt.Errorf("checksum of resumed download of %s does not match the origin", e.GetSubPath())
+	}
+
+	return nil
+}
+
+// removeStalePartialDownloads removes the partial downloads of the given root path that are not wanted anymore.
+func (s *Syncer) removeStalePartialDownloads(rootPath string, wanted api.CacheEntities) error {
+	dir := s.resumeDir(rootPath)
+
+	exists, err := afero.DirExists(s.fs, dir)
+	if err != nil || !exists {
+		return err
+	}
+
+	subPaths := map[string]bool{}
+	for _, e := range wanted {
+		subPaths[e.GetSubPath()] = true
+	}
+
+	err = afero.Walk(s.fs, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		subPath := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, dir)), "/")
+		if subPaths[subPath] {
+			return nil
+		}
+
+		s.logger.Debug("removing stale partial download", "root", rootPath, "key", subPath)
+		return s.fs.Remove(p)
+	})
+	if err != nil {
+		return err
+	}
+
+	return cleanEmptyDirs(s.fs, dir)
+}
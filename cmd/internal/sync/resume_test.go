@@ -0,0 +1,222 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_downloadResume(t *testing.T) {
+	const (
+		content = "metal-kernel"
+		// md5 of the content
+		checksum = "99598b607deb356555e572b18f29ebfd"
+	)
+
+	tests := []struct {
+		name        string
+		partial     string
+		ranges      bool
+		wantErr     bool
+		wantRange   string
+		wantPartial bool
+	}{
+		{
+			name:      "download is resumed",
+			partial:   "metal-",
+			ranges:    true,
+			wantRange: "bytes=6-",
+		},
+		{
+			name:    "whole file is downloaded if the origin does not support ranges",
+			partial: "metal-",
+			ranges:  false,
+		},
+		{
+			name:      "resumed download with a changed origin is refused",
+			partial:   "other-",
+			ranges:    true,
+			wantErr:   true,
+			wantRange: "bytes=6-",
+		},
+		{
+			name:   "download without partial file",
+			ranges: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRange string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/metal-kernel.md5" {
+					_, _ = w.Write([]byte(checksum + "  metal-kernel"))
+					return
+				}
+
+				gotRange = r.Header.Get("Range")
+				if !tt.ranges {
+					_, _ = w.Write([]byte(content))
+					return
+				}
+				http.ServeContent(w, r, "metal-kernel", time.Time{}, bytes.NewReader([]byte(content)))
+			}))
+			defer ts.Close()
+
+			fs := afero.NewMemMapFs()
+			s := &Syncer{
+				logger:          slog.Default(),
+				fs:              fs,
+				tmpPath:         "/tmp/test-download",
+				stop:            context.TODO(),
+				httpClient:      http.DefaultClient,
+				resumeDownloads: true,
+			}
+
+			k := api.Kernel{SubPath: "metal-hammer/metal-kernel", URL: ts.URL + "/metal-kernel", Size: int64(len(content)), MD5Available: true}
+
+			partialPath := s.resumeDir(cacheRoot) + "/metal-hammer/metal-kernel"
+			if tt.partial != "" {
+				require.NoError(t, afero.WriteFile(fs, partialPath, []byte(tt.partial), 0644))
+			}
+
+			err := s.download(context.TODO(), cacheRoot, nil, k)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+
+				got, err := afero.ReadFile(fs, cacheRoot+"/metal-hammer/metal-kernel")
+				require.NoError(t, err)
+				assert.Equal(t, content, string(got))
+			}
+
+			if tt.ranges {
+				assert.Equal(t, tt.wantRange, gotRange)
+			}
+
+			exists, err := afero.Exists(fs, partialPath)
+			require.NoError(t, err)
+			assert.False(t, exists, "partial download must not be kept")
+		})
+	}
+}
+
+func TestSyncer_downloadResumeInterrupted(t *testing.T) {
+	const content = "metal-kernel"
+
+	interrupt := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if interrupt {
+			w.Header().Set("Content-Length", "12")
+			_, _ = w.Write([]byte(content[:6]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "metal-kernel", time.Time{}, bytes.NewReader([]byte(content)))
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:          slog.Default(),
+		fs:              fs,
+		tmpPath:         "/tmp/test-download",
+		stop:            context.TODO(),
+		httpClient:      http.DefaultClient,
+		resumeDownloads: true,
+	}
+
+	k := api.Kernel{SubPath: "metal-hammer/metal-kernel", URL: ts.URL + "/metal-kernel", Size: int64(len(content))}
+
+	err := s.download(context.TODO(), cacheRoot, nil, k)
+	require.Error(t, err)
+
+	partial, err := afero.ReadFile(fs, s.resumeDir(cacheRoot)+"/metal-hammer/metal-kernel")
+	require.NoError(t, err)
+	assert.Equal(t, content[:6], string(partial))
+
+	interrupt = false
+	err = s.download(context.TODO(), cacheRoot, nil, k)
+	require.NoError(t, err)
+
+	got, err := afero.ReadFile(fs, cacheRoot+"/metal-hammer/metal-kernel")
+	require.NoError(t, err)
+	assert.Equal(t, content, string(got))
+}
+
+func TestSyncer_downloadResumeS3(t *testing.T) {
+	data := []byte("ubuntu-image")
+	s3Client, requests := dlObjectSvc(map[string][]byte{
+		"ubuntu/20.04/20201026/img.tar.lz4":     data,
+		"ubuntu/20.04/20201026/img.tar.lz4.md5": []byte("d09481b9cf194d3643f98e2de7b3365a  img.tar.lz4"),
+	})
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:          slog.Default(),
+		fs:              fs,
+		tmpPath:         "/tmp/test-download",
+		stop:            context.TODO(),
+		s3:              s3manager.NewDownloaderWithClient(s3Client),
+		imageCollector:  metrics.MustImageMetrics(slog.Default(), fs, cacheRoot),
+		resumeDownloads: true,
+	}
+
+	img := api.OS{
+		Name:       "ubuntu",
+		BucketName: "images",
+		BucketKey:  "ubuntu/20.04/20201026/img.tar.lz4",
+		ImageRef:   s3.Object{Size: aws.Int64(int64(len(data)))},
+		MD5Ref:     s3.Object{Key: aws.String("ubuntu/20.04/20201026/img.tar.lz4.md5")},
+	}
+
+	require.NoError(t, afero.WriteFile(fs, s.resumeDir(cacheRoot)+"/"+img.GetSubPath(), data[:7], 0644))
+
+	err := s.download(context.TODO(), cacheRoot, nil, img)
+	require.NoError(t, err)
+
+	// the checksums are downloaded in chunks from the start
+	assert.Contains(t, requests.requestedRanges(), "bytes=7-")
+
+	got, err := afero.ReadFile(fs, cacheRoot+"/"+img.GetSubPath())
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestSyncer_removeStalePartialDownloads(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:  slog.Default(),
+		fs:      fs,
+		tmpPath: "/tmp/test-download",
+	}
+
+	dir := s.resumeDir(cacheRoot)
+	require.NoError(t, afero.WriteFile(fs, dir+"/metal-hammer/wanted", []byte("Te"), 0644))
+	require.NoError(t, afero.WriteFile(fs, dir+"/metal-hammer/stale", []byte("Te"), 0644))
+	require.NoError(t, afero.WriteFile(fs, dir+"/other/stale", []byte("Te"), 0644))
+
+	err := s.removeStalePartialDownloads(cacheRoot, api.CacheEntities{api.Kernel{SubPath: "metal-hammer/wanted"}})
+	require.NoError(t, err)
+
+	exists, _ := afero.Exists(fs, dir+"/metal-hammer/wanted")
+	assert.True(t, exists)
+	exists, _ = afero.Exists(fs, dir+"/metal-hammer/stale")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(fs, dir+"/other")
+	assert.False(t, exists)
+}
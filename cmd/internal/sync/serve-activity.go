@@ -0,0 +1,157 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+)
+
+// ServeActivity tracks the requests served by the caches, the sync yields download concurrency
+// to serving while the request rate is above a threshold.
+type ServeActivity struct {
+	mutex     sync.Mutex
+	window    time.Duration
+	threshold int
+	requests  []time.Time
+	now       func() time.Time
+}
+
+// NewServeActivity returns a tracker that considers serving active if at least threshold requests were served within the window.
+func NewServeActivity(window time.Duration, threshold int) *ServeActivity {
+	return &ServeActivity{
+		window:    window,
+		threshold: threshold,
+		now:       time.Now,
+	}
+}
+
+// Record records a served request.
+func (a *ServeActivity) Record() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.prune()
+	a.requests = append(a.requests, a.now())
+}
+
+// Active returns true if the request rate is above the threshold.
+func (a *ServeActivity) Active() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.prune()
+	return a.threshold > 0 && len(a.requests) >= a.threshold
+}
+
+func (a *ServeActivity) prune() {
+	cutoff := a.now().Add(-a.window)
+
+	i := 0
+	for i < len(a.requests) && !a.requests[i].After(cutoff) {
+		i++
+	}
+	a.requests = a.requests[i:]
+}
+
+// downloadLimit returns the amount of downloads that may run in parallel right now.
+func (s *Syncer) downloadLimit() int {
+	limit := s.downloadConcurrency
+	if s.serveActivity != nil && s.serveActivity.Active() {
+		limit = s.downloadConcurrencyServing
+	}
+
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+// downloadAll downloads the given entities in parallel, the concurrency is re-evaluated before starting every download
+// such that the sync yields to serve traffic. failed downloads are retried, entities that still fail are skipped
+// and the sync continues with the others, all errors are returned joined. downloads are verified against the given
+// signed manifest if it is not nil.
+func (s *Syncer) downloadAll(rootPath string, manifest signedManifest, add api.CacheEntities) (int64, error) {
+	var (
+		mutex   sync.Mutex
+		cond    = sync.NewCond(&mutex)
+		wg      sync.WaitGroup
+		running int
+		bytes   int64
+		errs    []error
+	)
+
+	for _, e := range add {
+		mutex.Lock()
+		for running >= s.downloadLimit() {
+			cond.Wait()
+		}
+		if s.stop.Err() != nil {
+			mutex.Unlock()
+			break
+		}
+		running++
+		mutex.Unlock()
+
+		wg.Add(1)
+		go func(e api.CacheEntity) {
+			defer wg.Done()
+
+			err := s.downloadRecovered(rootPath, manifest, e)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			running--
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error downloading %s:%w", e.GetSubPath(), err))
+			} else {
+				bytes += e.GetSize()
+			}
+			cond.Broadcast()
+		}(e)
+	}
+
+	wg.Wait()
+
+	if err := s.stop.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return bytes, errors.Join(errs...)
+}
+
+// downloadRecovered downloads the given entity and turns a panic into an error, such that a single malformed entity
+// does not crash the whole process.
+func (s *Syncer) downloadRecovered(rootPath string, manifest signedManifest, e api.CacheEntity) (err error) {
+	defer s.recoverPanic(&err, "download of "+e.GetSubPath())
+
+	return s.downloadWithRetry(rootPath, manifest, e)
+}
+
+// downloadWithRetry downloads the given entity and retries with exponential backoff on failure.
+func (s *Syncer) downloadWithRetry(rootPath string, manifest signedManifest, e api.CacheEntity) error {
+	backoff := s.downloadRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := s.download(s.stop, rootPath, manifest, e)
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.downloadMaxRetries {
+			return err
+		}
+
+		s.logger.Warn("download failed, retrying", "key", e.GetSubPath(), "attempt", attempt+1, "backoff", backoff, "error", err)
+
+		select {
+		case <-s.stop.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeActivity(t *testing.T) {
+	now := time.Now()
+
+	a := NewServeActivity(time.Minute, 3)
+	a.now = func() time.Time { return now }
+
+	a.Record()
+	a.Record()
+	assert.False(t, a.Active())
+
+	a.Record()
+	assert.True(t, a.Active())
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, a.Active())
+}
+
+func TestSyncer_downloadAllYieldsToServing(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if current <= max || maxInFlight.CompareAndSwap(max, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("Test"))
+	}))
+	defer ts.Close()
+
+	var add api.CacheEntities
+	for i := 0; i < 8; i++ {
+		add = append(add, api.PeerFile{
+			SubPath: fmt.Sprintf("kernels/%d/kernel", i),
+			URL:     fmt.Sprintf("%s/kernels/%d/kernel", ts.URL, i),
+			Size:    4,
+		})
+	}
+
+	tests := []struct {
+		name            string
+		serving         bool
+		wantMaxInFlight int32
+	}{
+		{
+			name:            "full concurrency without serve activity",
+			serving:         false,
+			wantMaxInFlight: 4,
+		},
+		{
+			name:            "reduced concurrency while serving",
+			serving:         true,
+			wantMaxInFlight: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxInFlight.Store(0)
+
+			activity := NewServeActivity(time.Minute, 1)
+			if tt.serving {
+				activity.Record()
+			}
+
+			s := &Syncer{
+				logger:                     slog.Default(),
+				fs:                         afero.NewMemMapFs(),
+				tmpPath:                    "/tmp/test-path/tmp",
+				stop:                       context.TODO(),
+				httpClient:                 http.DefaultClient,
+				downloadConcurrency:        4,
+				downloadConcurrencyServing: 1,
+				serveActivity:              activity,
+			}
+
+			n, err := s.downloadAll(cacheRoot, nil, add)
+			require.NoError(t, err)
+			assert.Equal(t, int64(32), n)
+			assert.Equal(t, tt.wantMaxInFlight, maxInFlight.Load())
+		})
+	}
+}
+
+func TestSyncer_downloadAllRetries(t *testing.T) {
+	var mutex sync.Mutex
+	requests := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests[r.URL.Path]++
+		count := requests[r.URL.Path]
+		mutex.Unlock()
+
+		if r.URL.Path == "/broken" || (r.URL.Path == "/flaky" && count < 3) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("Test"))
+	}))
+	defer ts.Close()
+
+	add := api.CacheEntities{
+		api.PeerFile{SubPath: "broken", URL: ts.URL + "/broken", Size: 4},
+		api.PeerFile{SubPath: "flaky", URL: ts.URL + "/flaky", Size: 4},
+		api.PeerFile{SubPath: "stable", URL: ts.URL + "/stable", Size: 4},
+	}
+
+	s := &Syncer{
+		logger:                     slog.Default(),
+		fs:                         afero.NewMemMapFs(),
+		tmpPath:                    "/tmp/test-path/tmp",
+		stop:                       context.TODO(),
+		httpClient:                 http.DefaultClient,
+		downloadConcurrency:        1,
+		downloadConcurrencyServing: 1,
+		downloadMaxRetries:         2,
+		downloadRetryBackoff:       time.Millisecond,
+	}
+
+	n, err := s.downloadAll(cacheRoot, nil, add)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error downloading broken")
+	assert.NotContains(t, err.Error(), "flaky")
+	assert.Equal(t, int64(8), n)
+	assert.Equal(t, map[string]int{"/broken": 3, "/flaky": 3, "/stable": 1}, requests)
+}
+
+// panickingEntity panics when its checksum or content is downloaded
+type panickingEntity struct {
+	api.PeerFile
+}
+
+func (p panickingEntity) HasMD5() bool {
+	return true
+}
+
+func (p panickingEntity) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	panic("malformed entity")
+}
+
+func (p panickingEntity) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	panic("malformed entity")
+}
+
+func TestSyncer_recoverPanic(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Test"))
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:                     slog.Default(),
+		fs:                         fs,
+		tmpPath:                    "/tmp/test-path/tmp",
+		stop:                       context.TODO(),
+		httpClient:                 http.DefaultClient,
+		downloadConcurrency:        2,
+		downloadConcurrencyServing: 2,
+	}
+
+	n, err := s.downloadAll(cacheRoot, nil, api.CacheEntities{
+		panickingEntity{api.PeerFile{SubPath: "broken", URL: ts.URL + "/broken", Size: 4}},
+		api.PeerFile{SubPath: "stable", URL: ts.URL + "/stable", Size: 4},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "panic during download of broken: malformed entity")
+	assert.Equal(t, int64(4), n)
+
+	createTestFile(t, fs, cacheRoot+"/broken")
+	current, err := s.cacheStore().List(cacheRoot)
+	require.NoError(t, err)
+
+	_, _, _, err = s.defineDiff(cacheRoot, current, api.CacheEntities{
+		panickingEntity{api.PeerFile{SubPath: "broken", URL: ts.URL + "/broken", Size: 4}},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "panic during checksum verification of broken: malformed entity")
+}
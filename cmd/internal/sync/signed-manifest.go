@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+)
+
+// signedManifest contains the checksums of all artifacts that the origin expects to be cached, mapped by sub path.
+type signedManifest map[string]string
+
+func parsePublicKey(raw []byte) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base64 encoded:%w", err)
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key has unexpected length %d", len(key))
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// verifyManifest checks the base64 encoded ed25519 signature of the manifest and parses it.
+// the manifest uses the md5sum format, one "<checksum>  <sub path>" entry per line.
+func verifyManifest(publicKey ed25519.PublicKey, manifest []byte, signature []byte) (signedManifest, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return nil, fmt.Errorf("manifest signature is not base64 encoded:%w", err)
+	}
+
+	if !ed25519.Verify(publicKey, manifest, sig) {
+		return nil, fmt.Errorf("manifest signature is invalid")
+	}
+
+	result := signedManifest{}
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("manifest line has unexpected format: %q", line)
+		}
+
+		result[strings.TrimPrefix(parts[1], "/")] = parts[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading manifest:%w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Syncer) fetchSignedManifest() (signedManifest, error) {
+	manifest, err := httpGet(s.stop, s.httpClient, s.manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading manifest:%w", err)
+	}
+
+	signature, err := httpGet(s.stop, s.httpClient, s.manifestURL+".sig")
+	if err != nil {
+		return nil, fmt.Errorf("error downloading manifest signature:%w", err)
+	}
+
+	return verifyManifest(s.manifestKey, manifest, signature)
+}
+
+func httpGet(ctx context.Context, c *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create get request:%w", err)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get request to url did not return OK: %s", url)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// filterSignedManifest drops all entities that are not contained in the signed manifest.
+func (s *Syncer) filterSignedManifest(manifest signedManifest, entities api.CacheEntities) api.CacheEntities {
+	var result api.CacheEntities
+	for _, e := range entities {
+		if _, ok := manifest[e.GetSubPath()]; !ok {
+			s.logger.Warn("entity is not contained in signed manifest, refusing to cache", "path", e.GetSubPath(), "id", e.GetName())
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// verifyKeep re-schedules a download for kept entities whose local checksum does not match the signed manifest.
+func (s *Syncer) verifyKeep(rootPath string, manifest signedManifest, keep api.CacheEntities, add api.CacheEntities) (api.CacheEntities, api.CacheEntities, error) {
+	var verified api.CacheEntities
+	for _, e := range keep {
+		hash, err := s.fileMD5(strings.Join([]string{rootPath, e.GetSubPath()}, string(os.PathSeparator)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error calculating hash sum of local file:%w", err)
+		}
+
+		if hash != manifest[e.GetSubPath()] {
+			s.logger.Info("found entity not matching signed manifest, schedule new download", "path", e.GetSubPath())
+			add = append(add, e)
+			continue
+		}
+
+		verified = append(verified, e)
+	}
+
+	return verified, add, nil
+}
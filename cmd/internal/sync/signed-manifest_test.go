@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"context"
+	"crypto/ed25519"
+	// nolint
+	"crypto/md5"
+
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncer_SyncSignedManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	// md5 of "Test"
+	manifest := []byte("0cbc6611f5540bd0809a388dc95a615b  metal-hammer/kernel\n")
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifest))
+
+	tests := []struct {
+		name        string
+		manifest    []byte
+		entities    api.CacheEntities
+		wantErr     bool
+		wantCached  []string
+		wantMissing []string
+	}{
+		{
+			name:     "valid manifest",
+			manifest: manifest,
+			entities: api.CacheEntities{
+				api.Kernel{SubPath: "metal-hammer/kernel"},
+				api.Kernel{SubPath: "metal-hammer/unsigned-kernel"},
+			},
+			wantCached:  []string{"metal-hammer/kernel"},
+			wantMissing: []string{"metal-hammer/unsigned-kernel"},
+		},
+		{
+			name:     "tampered manifest",
+			manifest: []byte("0cbc6611f5540bd0809a388dc95a615b  metal-hammer/kernel\n0cbc6611f5540bd0809a388dc95a615b  metal-hammer/unsigned-kernel\n"),
+			entities: api.CacheEntities{
+				api.Kernel{SubPath: "metal-hammer/kernel"},
+				api.Kernel{SubPath: "metal-hammer/unsigned-kernel"},
+			},
+			wantErr:     true,
+			wantMissing: []string{"metal-hammer/kernel", "metal-hammer/unsigned-kernel"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/manifest":
+					_, _ = w.Write(tt.manifest)
+				case "/manifest.sig":
+					_, _ = w.Write([]byte(signature))
+				default:
+					_, _ = w.Write([]byte("Test"))
+				}
+			}))
+			defer ts.Close()
+
+			var entities api.CacheEntities
+			for _, e := range tt.entities {
+				k := e.(api.Kernel)
+				k.URL = ts.URL + "/" + k.SubPath
+				entities = append(entities, k)
+			}
+
+			fs := afero.NewMemMapFs()
+			require.NoError(t, fs.MkdirAll(cacheRoot+"/kernels", 0755))
+
+			s := &Syncer{
+				logger:      slog.Default(),
+				fs:          fs,
+				tmpPath:     cacheRoot + "/tmp",
+				stop:        context.TODO(),
+				httpClient:  http.DefaultClient,
+				manifestURL: ts.URL + "/manifest",
+				manifestKey: publicKey,
+			}
+
+			err := s.Sync(cacheRoot+"/kernels", entities)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Syncer.Sync() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for _, p := range tt.wantCached {
+				exists, err := afero.Exists(fs, cacheRoot+"/kernels/"+p)
+				require.NoError(t, err)
+				assert.True(t, exists, "file was not cached: %s", p)
+			}
+			for _, p := range tt.wantMissing {
+				exists, err := afero.Exists(fs, cacheRoot+"/kernels/"+p)
+				require.NoError(t, err)
+				assert.False(t, exists, "file was cached: %s", p)
+			}
+		})
+	}
+}
+
+func Test_verifyManifest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	manifest := []byte("0cbc6611f5540bd0809a388dc95a615b  /metal-os/ubuntu/20.04/20201026/img.tar.lz4\n")
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifest)))
+
+	got, err := verifyManifest(publicKey, manifest, signature)
+	require.NoError(t, err)
+	assert.Equal(t, signedManifest{"metal-os/ubuntu/20.04/20201026/img.tar.lz4": "0cbc6611f5540bd0809a388dc95a615b"}, got)
+
+	tampered := []byte("ffffffffffffffffffffffffffffffff  /metal-os/ubuntu/20.04/20201026/img.tar.lz4\n")
+	_, err = verifyManifest(publicKey, tampered, signature)
+	assert.EqualError(t, err, "manifest signature is invalid")
+}
+
+func TestSyncer_downloadSignedManifest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer ts.Close()
+
+	s := &Syncer{
+		logger:     slog.Default(),
+		fs:         afero.NewMemMapFs(),
+		tmpPath:    "/tmp/test-download",
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+	}
+
+	k := api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL}
+
+	// every download is verified against the manifest of its own sync
+	err := s.download(context.TODO(), cacheRoot, signedManifest{"metal-hammer/kernel": "ffffffffffffffffffffffffffffffff"}, k)
+	require.EqualError(t, err, "downloaded file metal-hammer/kernel does not match signed manifest")
+
+	err = s.download(context.TODO(), cacheRoot, signedManifest{"metal-hammer/kernel": fmt.Sprintf("%x", md5.Sum([]byte("kernel")))}, k)
+	require.NoError(t, err)
+
+	err = s.download(context.TODO(), cacheRoot, nil, k)
+	require.NoError(t, err)
+}
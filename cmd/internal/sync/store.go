@@ -0,0 +1,67 @@
+package sync
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+)
+
+// CacheStore holds the files of the caches. downloads are written to a tmp file first and then put into the store,
+// such that a store only ever contains complete files. checksum and metadata sidecar files go through the store as well.
+type CacheStore interface {
+	// Put moves the downloaded tmp file to the given path in the store.
+	Put(tmpPath, p string) error
+	// Delete removes the file at the given path from the store.
+	Delete(p string) error
+	// List returns the files in the given root path of the store without checksum and metadata files.
+	List(rootPath string) (api.CacheEntries, error)
+	// Stat returns the file info of the file at the given path, os.ErrNotExist is returned for missing files.
+	Stat(p string) (os.FileInfo, error)
+}
+
+// fsStore stores the cached files in a filesystem, which is the local disk of the cache unless a different
+// filesystem is injected.
+type fsStore struct {
+	logger *slog.Logger
+	fs     afero.Fs
+}
+
+func newFSStore(logger *slog.Logger, fs afero.Fs) *fsStore {
+	return &fsStore{
+		logger: logger,
+		fs:     fs,
+	}
+}
+
+func (f *fsStore) Put(tmpPath, p string) error {
+	err := f.fs.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating path in cache root:%w", err)
+	}
+
+	return f.fs.Rename(tmpPath, p)
+}
+
+func (f *fsStore) Delete(p string) error {
+	return f.fs.Remove(p)
+}
+
+func (f *fsStore) List(rootPath string) (api.CacheEntries, error) {
+	return currentFileIndex(f.logger, f.fs, rootPath)
+}
+
+func (f *fsStore) Stat(p string) (os.FileInfo, error) {
+	return f.fs.Stat(p)
+}
+
+// cacheStore returns the store of the syncer, syncers that are not created by NewSyncer store into their filesystem.
+func (s *Syncer) cacheStore() CacheStore {
+	if s.store != nil {
+		return s.store
+	}
+	return newFSStore(s.logger, s.fs)
+}
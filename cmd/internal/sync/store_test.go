@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fsStore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := newFSStore(slog.Default(), fs)
+
+	require.NoError(t, afero.WriteFile(fs, "/tmp/kernel-123", []byte("kernel"), 0644))
+	require.NoError(t, store.Put("/tmp/kernel-123", cacheRoot+"/metal-hammer/kernel"))
+	require.NoError(t, afero.WriteFile(fs, cacheRoot+"/metal-hammer/kernel.md5", []byte("md5"), 0644))
+
+	info, err := store.Stat(cacheRoot + "/metal-hammer/kernel")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), info.Size())
+
+	entries, err := store.List(cacheRoot)
+	require.NoError(t, err)
+	assert.Equal(t, api.CacheEntries{
+		api.LocalFile{Name: "kernel", SubPath: "metal-hammer/kernel", Size: 6},
+	}, entries)
+
+	require.NoError(t, store.Delete(cacheRoot+"/metal-hammer/kernel"))
+	_, err = store.Stat(cacheRoot + "/metal-hammer/kernel")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// recordingStore records the files put into and deleted from the wrapped store.
+type recordingStore struct {
+	CacheStore
+	puts    []string
+	deletes []string
+}
+
+func (r *recordingStore) Put(tmpPath, p string) error {
+	r.puts = append(r.puts, p)
+	return r.CacheStore.Put(tmpPath, p)
+}
+
+func (r *recordingStore) Delete(p string) error {
+	r.deletes = append(r.deletes, p)
+	return r.CacheStore.Delete(p)
+}
+
+func TestSyncer_SyncThroughStore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	createTestFile(t, fs, cacheRoot+"/metal-hammer/v0.1.0/kernel")
+	createTestFile(t, fs, cacheRoot+"/metal-hammer/v0.1.0/kernel.md5")
+
+	lastModified := time.Date(2020, 10, 25, 0, 0, 0, 0, time.UTC)
+
+	store := &recordingStore{CacheStore: newFSStore(slog.Default(), fs)}
+	s := &Syncer{
+		logger:     slog.Default(),
+		fs:         fs,
+		store:      store,
+		tmpPath:    "/tmp/test-download",
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+	}
+
+	err := s.Sync(cacheRoot, api.CacheEntities{
+		api.Kernel{SubPath: "metal-hammer/v0.2.0/kernel", URL: ts.URL, ETag: "etag", LastModified: lastModified},
+	})
+	require.NoError(t, err)
+
+	// sidecar files are put into the store as well
+	assert.Equal(t, []string{cacheRoot + "/metal-hammer/v0.2.0/kernel", cacheRoot + "/metal-hammer/v0.2.0/kernel" + etagSuffix}, store.puts)
+
+	info, err := store.Stat(cacheRoot + "/metal-hammer/v0.2.0/kernel")
+	require.NoError(t, err)
+	assert.True(t, lastModified.Equal(info.ModTime()))
+	assert.Equal(t, []string{cacheRoot + "/metal-hammer/v0.1.0/kernel", cacheRoot + "/metal-hammer/v0.1.0/kernel.md5"}, store.deletes)
+}
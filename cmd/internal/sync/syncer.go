@@ -2,37 +2,96 @@ package sync
 
 import (
 	"context"
-	"log/slog"
-
-	// nolint
-	"crypto/md5"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/docker/go-units"
 	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
 	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/afero"
 )
 
+const (
+	// defaultDownloadRetryBackoff is the wait time before the first retry of a failed download, doubled with every further retry
+	defaultDownloadRetryBackoff = 2 * time.Second
+
+	// reasonNew is the reason for downloading an entity that is not cached yet
+	reasonNew = "new"
+	// reasonChecksumMismatch is the reason for downloading an entity again that is cached with a wrong checksum
+	reasonChecksumMismatch = "checksum-mismatch"
+	// reasonUnchanged is the reason for keeping a cached entity
+	reasonUnchanged = "unchanged"
+	// reasonNoLongerReferenced is the reason for deleting a cached entity that is not wanted anymore
+	reasonNoLongerReferenced = "no-longer-referenced"
+	// reasonUnknown is the reason for purging a file that was not downloaded by the syncer
+	reasonUnknown = "unknown"
+)
+
 type Syncer struct {
 	logger         *slog.Logger
 	fs             afero.Fs
+	store          CacheStore
 	tmpPath        string
 	s3             *s3manager.Downloader
 	stop           context.Context
 	dry            bool
 	imageCollector *metrics.ImageCollector
 	httpClient     *http.Client
+	manifestURL    string
+	manifestKey    ed25519.PublicKey
+	checksumKey    *minisignKey
+	checksumStrict bool
+	fileLogLevel   slog.Level
+	originAbsent   string
+	diskStat       diskStat
+	trimPlan       bool
+	purgeUnknown   bool
+	verifyLZ4      bool
+	// resumeDownloads keeps interrupted downloads to continue them with a ranged request
+	resumeDownloads bool
+	// latestLinks maintains a latest link to the newest cached version of every os major.minor
+	latestLinks bool
+	// minFreeDiskBytes is kept free on the cache filesystem by the preflight check
+	minFreeDiskBytes int64
+	// checksumWorkers bounds the amount of local files hashed in parallel during defineDiff
+	checksumWorkers int
+	checksumCache   checksumCache
+	cacheManifest   *cacheManifest
+
+	wantedMutex sync.RWMutex
+	wanted      map[string]map[string]bool
+
+	missesMutex sync.Mutex
+	misses      map[string][]string
+
+	// artifactStatusMutex serializes the status checks such that concurrent requests do not hash the same file
+	artifactStatusMutex sync.Mutex
+
+	collectors map[string]metrics.DownloadCollector
+
+	downloadConcurrency        int
+	downloadConcurrencyServing int
+	downloadMaxRetries         int
+	// downloadTimeout bounds a single download such that a stuck transfer does not hang the whole sync, disabled if zero
+	downloadTimeout      time.Duration
+	downloadRetryBackoff time.Duration
+	serveActivity        *ServeActivity
 }
 
-func NewSyncer(logger *slog.Logger, fs afero.Fs, s3 *s3manager.Downloader, config *api.Config, collector *metrics.ImageCollector, stop context.Context) (*Syncer, error) {
+func NewSyncer(logger *slog.Logger, fs afero.Fs, s3 *s3manager.Downloader, httpClient *http.Client, config *api.Config, collector *metrics.ImageCollector, stop context.Context) (*Syncer, error) {
 	err := fs.MkdirAll(config.GetImageRootPath(), 0755)
 	if err != nil {
 		return nil, fmt.Errorf("error creating image subdirectory in cache root:%w", err)
@@ -46,73 +105,265 @@ func NewSyncer(logger *slog.Logger, fs afero.Fs, s3 *s3manager.Downloader, confi
 		return nil, fmt.Errorf("error creating boot image subdirectory in cache root:%w", err)
 	}
 
-	return &Syncer{
-		logger:         logger,
-		fs:             fs,
-		tmpPath:        config.GetTmpDownloadPath(),
-		s3:             s3,
-		stop:           stop,
-		httpClient:     http.DefaultClient,
-		dry:            config.DryRun,
-		imageCollector: collector,
-	}, nil
+	s := &Syncer{
+		logger:           logger,
+		fs:               fs,
+		store:            newFSStore(logger, fs),
+		tmpPath:          config.GetTmpDownloadPath(),
+		s3:               s3,
+		stop:             stop,
+		httpClient:       httpClient,
+		dry:              config.DryRun,
+		imageCollector:   collector,
+		fileLogLevel:     slog.LevelInfo,
+		originAbsent:     config.OriginAbsentPolicy,
+		diskStat:         statfsDiskStat{},
+		trimPlan:         config.TrimPlanToFreeSpace,
+		purgeUnknown:     config.PurgeUnknown,
+		verifyLZ4:        config.VerifyLZ4,
+		resumeDownloads:  config.ResumeDownloads,
+		latestLinks:      config.LatestLinks,
+		minFreeDiskBytes: config.MinFreeDiskBytes,
+		checksumWorkers:  config.ChecksumWorkers,
+		cacheManifest:    newCacheManifest(logger, fs, config.GetCacheManifestPath()),
+		checksumCache:    newJSONChecksumCache(logger, fs, config.GetChecksumCachePath()),
+		wanted:           map[string]map[string]bool{},
+		collectors:       map[string]metrics.DownloadCollector{},
+
+		downloadConcurrency:        config.DownloadConcurrency,
+		downloadConcurrencyServing: config.DownloadConcurrencyServing,
+		downloadMaxRetries:         config.DownloadMaxRetries,
+		downloadTimeout:            config.DownloadTimeout,
+		downloadRetryBackoff:       defaultDownloadRetryBackoff,
+	}
+
+	if config.LogVerbosity == api.LogVerbositySummary {
+		s.fileLogLevel = slog.LevelDebug
+	}
+
+	if config.ChecksumSignaturePublicKey != "" {
+		raw, err := afero.ReadFile(fs, config.ChecksumSignaturePublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading checksum signature public key:%w", err)
+		}
+
+		s.checksumKey, err = parseMinisignPublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing checksum signature public key:%w", err)
+		}
+		s.checksumStrict = config.ChecksumSignatureMode == api.ChecksumSignatureModeStrict
+	}
+
+	if config.VerifySignedManifest {
+		raw, err := afero.ReadFile(fs, config.SignedManifestPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signed manifest public key:%w", err)
+		}
+
+		s.manifestKey, err = parsePublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing signed manifest public key:%w", err)
+		}
+		s.manifestURL = config.SignedManifestURL
+	}
+
+	return s, nil
+}
+
+// RegisterCollector registers the collector of the cache served from the given root path,
+// which is informed about the bytes downloaded by the sync into this root path.
+func (s *Syncer) RegisterCollector(rootPath string, collector metrics.DownloadCollector) {
+	s.collectors[rootPath] = collector
+}
+
+// SetServeActivity sets the tracker of served requests, download concurrency is reduced while serving is active.
+func (s *Syncer) SetServeActivity(a *ServeActivity) {
+	s.serveActivity = a
 }
 
 func (s *Syncer) Sync(rootPath string, entitiesToSync api.CacheEntities) error {
-	current, err := currentFileIndex(s.fs, rootPath)
+	defer s.clearMisses(rootPath)
+
+	// the signed manifest is fetched for every sync, downloads of this sync are verified against it
+	var manifest signedManifest
+	if s.manifestKey != nil {
+		var err error
+		manifest, err = s.fetchSignedManifest()
+		if err != nil {
+			return fmt.Errorf("error verifying signed manifest:%w", err)
+		}
+
+		entitiesToSync = s.filterSignedManifest(manifest, entitiesToSync)
+	}
+
+	current, err := s.cacheStore().List(rootPath)
 	if err != nil {
 		return fmt.Errorf("error creating file index:%w", err)
 	}
 
+	entitiesToSync = s.applyOriginAbsentPolicy(current, entitiesToSync)
+
 	remove, keep, add, err := s.defineDiff(rootPath, current, entitiesToSync)
 	if err != nil {
 		return fmt.Errorf("error creating cache diff:%w", err)
 	}
 
-	s.printSyncPlan(remove, keep, add)
+	remove = s.removable(rootPath, remove)
+
+	if manifest != nil {
+		keep, add, err = s.verifyKeep(rootPath, manifest, keep, add)
+		if err != nil {
+			return fmt.Errorf("error verifying cache against signed manifest:%w", err)
+		}
+	}
+
+	if s.diskStat != nil {
+		add, err = s.preflight(rootPath, remove, add)
+		if err != nil {
+			return fmt.Errorf("error during sync preflight, retrying in next sync schedule: %w", err)
+		}
+	}
+
+	s.setWanted(rootPath, entitiesToSync)
+
+	s.printSyncPlan(current, remove, keep, add)
 
 	if s.dry {
 		s.logger.Info("dry run: not downloading or deleting files")
 		return nil
 	}
 
+	var removedBytes, downloadedBytes int64
 	for _, e := range remove {
+		if s.purgeUnknown && !s.knownBySync(rootPath, e) {
+			s.logger.Info("purging unknown file", "root", rootPath, "path", e.GetSubPath(), "size", e.GetSize(), "reason", reasonUnknown)
+		}
+
 		err := s.remove(rootPath, e)
 		if err != nil {
 			return fmt.Errorf("error deleting cached file, retrying in next sync schedule: %w", err)
 		}
+		removedBytes += e.GetSize()
 	}
 
-	for _, e := range add {
-		err := s.download(rootPath, e)
+	if s.purgeUnknown {
+		err = s.removeOrphanedSidecars(rootPath)
 		if err != nil {
-			return fmt.Errorf("error downloading file, retrying in next sync schedule: %w", err)
+			return fmt.Errorf("error deleting orphaned sidecar files:%w", err)
 		}
 	}
 
+	downloadedBytes, err = s.downloadAll(rootPath, manifest, add)
+	// downloads replace the checksums of their targets
+	s.persistChecksumCache()
+
+	// the links only point to cached versions, such that they are updated after failed downloads as well
+	if s.latestLinks {
+		err := s.updateLatestLinks(rootPath, entitiesToSync)
+		if err != nil {
+			s.logger.Warn("unable to update latest links", "root", rootPath, "error", err)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("error downloading file, retrying in next sync schedule: %w", err)
+	}
+
+	if s.resumeDownloads {
+		err = s.removeStalePartialDownloads(rootPath, entitiesToSync)
+		if err != nil {
+			s.logger.Warn("unable to remove stale partial downloads", "root", rootPath, "error", err)
+		}
+	}
+
+	s.logger.Info("sync summary", "root", rootPath, "removed", len(remove), "removed-bytes", removedBytes, "downloaded", len(add), "downloaded-bytes", downloadedBytes, "kept", len(keep))
+
 	err = cleanEmptyDirs(s.fs, rootPath)
 	if err != nil {
 		return fmt.Errorf("error cleaning up empty directories:%w", err)
 	}
 
+	s.updateCacheManifest(rootPath)
+
 	return nil
 }
 
-func currentFileIndex(fs afero.Fs, rootPath string) (api.CacheEntities, error) {
-	var result api.CacheEntities
+func (s *Syncer) setWanted(rootPath string, entities api.CacheEntities) {
+	wanted := map[string]bool{}
+	for _, e := range entities {
+		wanted[e.GetSubPath()] = true
+	}
+
+	s.wantedMutex.Lock()
+	defer s.wantedMutex.Unlock()
+
+	if s.wanted == nil {
+		s.wanted = map[string]map[string]bool{}
+	}
+	s.wanted[rootPath] = wanted
+}
+
+// Orphans returns the files in the given root path that are not contained in the want-list of the last sync of this root path.
+// returns nil if this root path has not been synced yet.
+func (s *Syncer) Orphans(rootPath string) (api.CacheEntries, error) {
+	s.wantedMutex.RLock()
+	wanted, ok := s.wanted[rootPath]
+	s.wantedMutex.RUnlock()
+
+	if !ok {
+		return nil, nil
+	}
+
+	current, err := s.cacheStore().List(rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file index:%w", err)
+	}
+
+	var result api.CacheEntries
+	for _, e := range current {
+		if !wanted[e.GetSubPath()] {
+			result = append(result, e)
+		}
+	}
+
+	return result, nil
+}
+
+// FileIndex lists the files cached in the root path without checksum and metadata files, it does not require a syncer.
+func FileIndex(logger *slog.Logger, fs afero.Fs, rootPath string) (api.CacheEntries, error) {
+	return currentFileIndex(logger, fs, rootPath)
+}
+
+// currentFileIndex lists the files in the root path, entries that cannot be read are logged and skipped.
+func currentFileIndex(logger *slog.Logger, fs afero.Fs, rootPath string) (api.CacheEntries, error) {
+	var result api.CacheEntries
 	err := afero.Walk(fs, rootPath, func(p string, info os.FileInfo, innerErr error) error {
 		if innerErr != nil {
-			return fmt.Errorf("error while walking through root path %s error:%w", rootPath, innerErr)
+			if p == rootPath {
+				return fmt.Errorf("error while walking through root path %s error:%w", rootPath, innerErr)
+			}
+
+			logger.Warn("skipping unreadable entry in cache", "path", p, "error", innerErr)
+			return nil
 		}
 
-		if info.IsDir() {
+		if isLatestLink(rootPath, p, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		if strings.HasSuffix(p, ".md5") {
+		if info.IsDir() {
 			return nil
 		}
 
+		for _, suffix := range sidecarSuffixes {
+			if strings.HasSuffix(p, suffix) {
+				return nil
+			}
+		}
+
 		result = append(result, api.LocalFile{
 			Name:    info.Name(),
 			SubPath: p[len(rootPath)+1:],
@@ -128,10 +379,60 @@ func currentFileIndex(fs afero.Fs, rootPath string) (api.CacheEntities, error) {
 	return result, nil
 }
 
-func (s *Syncer) defineDiff(rootPath string, currentEntities api.CacheEntities, wantEntities api.CacheEntities) (remove api.CacheEntities, keep api.CacheEntities, add api.CacheEntities, err error) {
-	// define entities to add
-	for _, wantEntity := range wantEntities {
-		var existing api.CacheEntity
+// applyOriginAbsentPolicy decides whether cached images, which are not contained in the image store anymore, are kept.
+// such images can never be downloaded, so they are only kept if they are already present in the cache.
+func (s *Syncer) applyOriginAbsentPolicy(currentEntities api.CacheEntries, wantEntities api.CacheEntities) api.CacheEntities {
+	current := map[string]bool{}
+	for _, e := range currentEntities {
+		current[e.GetSubPath()] = true
+	}
+
+	var result api.CacheEntities
+	for _, e := range wantEntities {
+		img, ok := e.(api.OS)
+		if !ok || !img.OriginAbsent {
+			result = append(result, e)
+			continue
+		}
+
+		if !current[img.GetSubPath()] {
+			s.logger.Error("image is not contained in global image store, skipping", "path", img.GetSubPath(), "id", img.GetName())
+			continue
+		}
+
+		switch s.originAbsent {
+		case api.OriginAbsentPolicyKeep:
+			result = append(result, e)
+		case api.OriginAbsentPolicyWarn:
+			s.logger.Warn("cached image is not contained in global image store anymore, keeping it without checksum verification", "path", img.GetSubPath(), "id", img.GetName())
+			result = append(result, e)
+		default:
+			s.logger.Info("cached image is not contained in global image store anymore, removing it", "path", img.GetSubPath(), "id", img.GetName())
+		}
+	}
+
+	return result
+}
+
+func (s *Syncer) defineDiff(rootPath string, currentEntities api.CacheEntries, wantEntities api.CacheEntities) (remove api.CacheEntries, keep api.CacheEntities, add api.CacheEntities, err error) {
+	// define entities to add, checksums of existing files are verified in parallel
+	type verification struct {
+		valid   bool
+		skipped bool
+		err     error
+	}
+
+	workers := s.checksumWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	verifications := make([]*verification, len(wantEntities))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i, wantEntity := range wantEntities {
+		var existing api.CacheEntry
 		for _, entityOnDisk := range currentEntities {
 			if entityOnDisk.GetSubPath() == wantEntity.GetSubPath() {
 				existing = entityOnDisk
@@ -140,28 +441,107 @@ func (s *Syncer) defineDiff(rootPath string, currentEntities api.CacheEntities,
 		}
 
 		if existing == nil {
-			add = append(add, wantEntity)
 			continue
 		}
 
-		if !wantEntity.HasMD5() {
-			keep = append(keep, wantEntity)
+		v := &verification{}
+		verifications[i] = v
+
+		if !wantEntity.HasMD5() && !wantEntity.HasSHA256() {
+			v.valid = true
 			continue
 		}
 
-		expected, err := wantEntity.DownloadMD5(s.stop, nil, s.httpClient, s.s3)
-		if err != nil {
-			s.logger.Error("error downloading checksum", "error", err)
+		if s.etagUnchanged(rootPath, wantEntity, existing) {
+			v.valid = true
 			continue
 		}
 
-		hash, err := s.fileMD5(strings.Join([]string{rootPath, existing.GetSubPath()}, string(os.PathSeparator)))
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf("error calculating hash sum of local file:%w", err)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(wantEntity api.CacheEntity, existing api.CacheEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer s.recoverPanic(&v.err, "checksum verification of "+wantEntity.GetSubPath())
+
+			localPath := strings.Join([]string{rootPath, existing.GetSubPath()}, string(os.PathSeparator))
+
+			// sha256 is preferred over md5, unless only the md5 checksum can be verified against its signature
+			if wantEntity.HasSHA256() && (s.checksumKey == nil || !wantEntity.HasMD5()) {
+				err := s.verifyUnsignedSHA256(wantEntity)
+				if err != nil {
+					s.logger.Error("checksum is not trusted", "error", err)
+					v.skipped = true
+					return
+				}
+
+				expected, err := wantEntity.DownloadSHA256(s.stop, nil, s.httpClient, s.s3)
+				if err != nil {
+					s.logger.Error("error downloading checksum", "error", err)
+					v.skipped = true
+					return
+				}
+
+				hash, err := s.fileSHA256(localPath)
+				if err != nil {
+					v.err = fmt.Errorf("error calculating hash sum of local file:%w", err)
+					return
+				}
+
+				v.valid = hash == expected
+				return
+			}
+
+			expected, err := wantEntity.DownloadMD5(s.stop, nil, s.httpClient, s.s3)
+			if err != nil {
+				s.logger.Error("error downloading checksum", "error", err)
+				v.skipped = true
+				return
+			}
+
+			if s.checksumKey != nil {
+				raw, err := s.downloadChecksumFile(wantEntity)
+				if err == nil {
+					err = s.verifyChecksumSignature(wantEntity, raw)
+				}
+				if err != nil {
+					s.logger.Error("checksum is not trusted", "error", err)
+					v.skipped = true
+					return
+				}
+			}
+
+			hash, err := s.fileMD5(localPath)
+			if err != nil {
+				v.err = fmt.Errorf("error calculating hash sum of local file:%w", err)
+				return
+			}
+
+			v.valid = hash == expected
+		}(wantEntity, existing)
+	}
+
+	wg.Wait()
+
+	s.persistChecksumCache()
+
+	for i, wantEntity := range wantEntities {
+		v := verifications[i]
+		if v == nil {
+			add = append(add, wantEntity)
+			continue
+		}
+
+		if v.err != nil {
+			return nil, nil, nil, v.err
 		}
 
-		if hash != expected {
-			s.logger.Info("found image with invalid hash sum, schedule new download")
+		if v.skipped {
+			continue
+		}
+
+		if !v.valid {
+			s.logger.Info("found image with invalid hash sum, schedule new download", "subpath", wantEntity.GetSubPath(), "reason", reasonChecksumMismatch)
 			add = append(add, wantEntity)
 		} else {
 			keep = append(keep, wantEntity)
@@ -185,53 +565,190 @@ func (s *Syncer) defineDiff(rootPath string, currentEntities api.CacheEntities,
 	return remove, keep, add, err
 }
 
+// recoverPanic turns a panic of a sync goroutine into an error, the recover of the sync phase only covers its own goroutine.
+// it has to be deferred directly.
+func (s *Syncer) recoverPanic(err *error, task string) {
+	if r := recover(); r != nil {
+		s.logger.Error("recovered from panic during sync", "task", task, "panic", r, "stack", string(debug.Stack()))
+		*err = fmt.Errorf("panic during %s: %v", task, r)
+	}
+}
+
 func (s *Syncer) fileMD5(filePath string) (string, error) {
-	file, err := s.fs.Open(filePath)
+	return s.fileChecksum(filePath, checksumAlgorithmMD5)
+}
+
+func (s *Syncer) fileSHA256(filePath string) (string, error) {
+	return s.fileChecksum(filePath, checksumAlgorithmSHA256)
+}
+
+func (s *Syncer) persistChecksumCache() {
+	if s.checksumCache == nil {
+		return
+	}
+
+	err := s.checksumCache.Persist()
+	if err != nil {
+		s.logger.Warn("unable to persist checksum cache", "error", err)
+	}
+}
+
+// fileChecksum hashes the given file, the checksum is taken from the checksum cache if the file did not change.
+func (s *Syncer) fileChecksum(filePath, algorithm string) (string, error) {
+	hashFile := utils.FileMD5
+	if algorithm == checksumAlgorithmSHA256 {
+		hashFile = utils.FileSHA256
+	}
+
+	if s.checksumCache == nil {
+		return hashFile(s.fs, filePath)
+	}
+
+	info, err := s.fs.Stat(filePath)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
-	hash := md5.New() // nolint
-	if _, err := io.Copy(hash, file); err != nil {
+
+	if checksum, ok := s.checksumCache.Lookup(filePath, algorithm, info); ok {
+		return checksum, nil
+	}
+
+	checksum, err := hashFile(s.fs, filePath)
+	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	s.checksumCache.Store(filePath, algorithm, info, checksum)
+
+	return checksum, nil
 }
 
-func (s *Syncer) download(rootPath string, e api.CacheEntity) error {
-	tmpTargetPath := strings.Join([]string{s.tmpPath, "tmp"}, string(os.PathSeparator))
+func (s *Syncer) download(ctx context.Context, rootPath string, manifest signedManifest, e api.CacheEntity) error {
+	if s.downloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.downloadTimeout)
+		defer cancel()
+	}
+
 	targetPath := strings.Join([]string{rootPath, e.GetSubPath()}, string(os.PathSeparator))
-	md5TargetPath := strings.Join([]string{rootPath, e.GetSubPath() + ".md5"}, string(os.PathSeparator))
+	if !withinRoot(rootPath, targetPath) {
+		return fmt.Errorf("refusing to download %s outside of cache root %s", e.GetSubPath(), rootPath)
+	}
 
-	_ = s.fs.Remove(tmpTargetPath)
-	_ = s.fs.Remove(targetPath)
-	_ = s.fs.Remove(md5TargetPath)
+	store := s.cacheStore()
+	if info, err := store.Stat(targetPath); err == nil && store.Delete(targetPath) == nil {
+		s.updateCacheStats(rootPath, e.GetSubPath(), -info.Size(), -1)
+	}
+	for _, suffix := range sidecarSuffixes {
+		if _, err := store.Stat(targetPath + suffix); err == nil {
+			_ = store.Delete(targetPath + suffix)
+		}
+	}
 
-	err := s.fs.MkdirAll(path.Dir(tmpTargetPath), 0755)
+	err := s.fs.MkdirAll(s.tmpPath, 0755)
 	if err != nil {
 		return fmt.Errorf("error creating tmp download path in cache root:%w", err)
 	}
 
-	err = s.fs.MkdirAll(path.Dir(targetPath), 0755)
-	if err != nil {
-		return fmt.Errorf("error creating path in cache root:%w", err)
+	resumable, canResume := e.(api.Resumable)
+	canResume = canResume && s.resumeDownloads
+
+	var (
+		f      afero.File
+		offset int64
+	)
+	if canResume {
+		f, offset, err = s.openPartialDownload(rootPath, e)
+		if err != nil {
+			return err
+		}
+	} else {
+		// downloads run in parallel and failed downloads may leave their tmp file behind,
+		// so every download gets its own uniquely named tmp file
+		f, err = afero.TempFile(s.fs, s.tmpPath, path.Base(e.GetSubPath())+"-*")
+		if err != nil {
+			return fmt.Errorf("error creating tmp file for %s: %w", targetPath, err)
+		}
 	}
+	tmpTargetPath := f.Name()
+	tmpMD5Path := tmpTargetPath + ".md5"
+	tmpSHA256Path := tmpTargetPath + ".sha256"
+	closed := false
+	// an interrupted transfer keeps its partial download such that the next attempt resumes it
+	keepPartial := false
+	defer func() {
+		if !closed {
+			_ = f.Close()
+		}
+		if !keepPartial {
+			_ = s.fs.Remove(tmpTargetPath)
+		}
+		for _, suffix := range sidecarSuffixes {
+			_ = s.fs.Remove(tmpTargetPath + suffix)
+		}
+	}()
 
-	f, err := s.fs.Create(tmpTargetPath)
-	if err != nil {
-		return fmt.Errorf("error opening file path %s: %w", targetPath, err)
+	// the checksum is fetched first such that a reconstruction from a delta is verified without fetching it twice
+	var expectedMD5 string
+	if e.HasMD5() {
+		err = s.downloadMD5(ctx, e, tmpMD5Path)
+		if err != nil {
+			return err
+		}
+		expectedMD5, _ = SidecarMD5(s.fs, tmpTargetPath)
 	}
-	defer f.Close()
 
-	s.logger.Info("downloading file", "id", e.GetName(), "key", e.GetSubPath(), "size", e.GetSize(), "to", tmpTargetPath)
-	n, err := e.Download(s.stop, f, s.httpClient, s.s3)
-	if err != nil {
-		return err
+	s.logger.Log(s.stop, s.fileLogLevel, "downloading file", "id", e.GetName(), "key", e.GetSubPath(), "size", e.GetSize(), "to", tmpTargetPath)
+	if ids := s.takeMisses(rootPath, e.GetSubPath()); len(ids) > 0 {
+		s.logger.Info("downloading file previously missed by requests", "key", e.GetSubPath(), "request-ids", ids)
+	}
+	var (
+		n  int64
+		ok bool
+	)
+	if offset == 0 {
+		n, ok = s.downloadDelta(ctx, rootPath, e, expectedMD5, f)
+	}
+	if !ok && canResume {
+		n, err = s.downloadResumable(ctx, e, resumable, f, offset)
+		if err != nil {
+			// an error page of the origin is not worth resuming
+			keepPartial = !errors.Is(err, api.ErrUnexpectedContent)
+			return err
+		}
+	} else if !ok {
+		n, err = e.Download(ctx, f, s.httpClient, s.s3)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a truncated transfer is not detected for entities without checksum otherwise
+	if e.GetSize() > 0 && n != e.GetSize() {
+		return fmt.Errorf("downloaded %d bytes of %s but expected %d bytes", n, e.GetSubPath(), e.GetSize())
+	}
+
+	if offset > 0 {
+		err = s.verifyResumed(ctx, e, tmpTargetPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var verifiedMD5 string
+	if manifest != nil {
+		verifiedMD5, err = utils.FileMD5(s.fs, tmpTargetPath)
+		if err != nil {
+			return fmt.Errorf("error calculating hash sum of downloaded file:%w", err)
+		}
+		if verifiedMD5 != manifest[e.GetSubPath()] {
+			return fmt.Errorf("downloaded file %s does not match signed manifest", e.GetSubPath())
+		}
+	}
+
+	if collector, ok := s.collectors[rootPath]; ok {
+		collector.AddSyncDownloadBytes(n)
 	}
-	defer func() {
-		_ = s.fs.Remove(tmpTargetPath)
-	}()
 
 	switch ent := e.(type) {
 	case api.OS:
@@ -239,72 +756,213 @@ func (s *Syncer) download(rootPath string, e api.CacheEntity) error {
 		s.imageCollector.IncrementSyncDownloadImageCount()
 	case api.BootImage:
 	case api.Kernel:
-	case api.LocalFile:
+	case api.PeerFile:
 	default:
 		s.logger.Error("unexpected entity type for metrics collection", "entity", ent)
 	}
 
-	err = s.fs.Rename(tmpTargetPath, targetPath)
+	if s.verifyLZ4 && strings.HasSuffix(e.GetSubPath(), ".lz4") {
+		err = utils.VerifyLZ4(s.fs, tmpTargetPath)
+		if err != nil {
+			s.logger.Error("downloaded file cannot be decompressed, scheduling new download", "key", e.GetSubPath(), "error", err)
+			return err
+		}
+	}
+
+	// verified before the file is put into the cache, such that a refused file is never served
+	if s.checksumKey != nil && e.HasMD5() {
+		raw, err := afero.ReadFile(s.fs, tmpMD5Path)
+		if err == nil {
+			err = s.verifyChecksumSignature(e, raw)
+		}
+		if err != nil {
+			return fmt.Errorf("refusing downloaded file %s:%w", e.GetSubPath(), err)
+		}
+	}
+	if e.HasSHA256() && !e.HasMD5() {
+		err = s.verifyUnsignedSHA256(e)
+		if err != nil {
+			return fmt.Errorf("refusing downloaded file %s:%w", e.GetSubPath(), err)
+		}
+	}
+
+	if e.HasSHA256() {
+		err = s.downloadSHA256(ctx, e, tmpSHA256Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// close before setting the modification time, such that it is not touched afterwards
+	closed = true
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("error closing downloaded file:%w", err)
+	}
+
+	// the modification time and the etag are set on the tmp file, such that all writes to the cache go through the store
+	s.preserveModTime(tmpTargetPath, e)
+	s.writeETag(tmpTargetPath, e)
+
+	err = store.Put(tmpTargetPath, targetPath)
 	if err != nil {
 		return fmt.Errorf("error moving downloaded file to final destination:%w", err)
 	}
 
-	if !e.HasMD5() {
-		return nil
+	s.updateCacheStats(rootPath, e.GetSubPath(), n, 1)
+	s.updateChecksumCache(targetPath, verifiedMD5)
+	if s.cacheManifest != nil {
+		s.cacheManifest.record(rootPath, e, time.Now())
+	}
+
+	for _, suffix := range sidecarSuffixes {
+		exists, err := afero.Exists(s.fs, tmpTargetPath+suffix)
+		if err != nil || !exists {
+			continue
+		}
+
+		err = store.Put(tmpTargetPath+suffix, targetPath+suffix)
+		if err != nil {
+			return fmt.Errorf("error moving %s sidecar file to final destination:%w", suffix, err)
+		}
+	}
+
+	return nil
+}
+
+// updateChecksumCache drops the checksums of a replaced file, the new file may have the same size and modification time
+// as the replaced one because the modification time is taken from the origin.
+func (s *Syncer) updateChecksumCache(targetPath, verifiedMD5 string) {
+	if s.checksumCache == nil {
+		return
 	}
 
-	f, err = s.fs.Create(md5TargetPath)
+	s.checksumCache.Forget(targetPath)
+	if verifiedMD5 == "" {
+		return
+	}
+
+	info, err := s.fs.Stat(targetPath)
 	if err != nil {
-		return fmt.Errorf("error opening file path %s: %w", md5TargetPath, err)
+		return
 	}
-	defer f.Close()
+	s.checksumCache.Store(targetPath, checksumAlgorithmMD5, info, verifiedMD5)
+}
 
-	s.logger.Info("downloading md5 checksum", "id", e.GetName(), "key", e.GetSubPath(), "to", md5TargetPath)
-	_, err = e.DownloadMD5(s.stop, &f, s.httpClient, s.s3)
+// downloadMD5 downloads the md5 checksum file of the entity to the given path.
+func (s *Syncer) downloadMD5(ctx context.Context, e api.CacheEntity, p string) error {
+	mf, err := s.fs.Create(p)
 	if err != nil {
-		return err
+		return fmt.Errorf("error opening file path %s: %w", p, err)
 	}
+	defer mf.Close()
 
-	return nil
+	s.logger.Log(s.stop, s.fileLogLevel, "downloading md5 checksum", "id", e.GetName(), "key", e.GetSubPath(), "to", p)
+	_, err = e.DownloadMD5(ctx, &mf, s.httpClient, s.s3)
+	return err
+}
+
+// downloadSHA256 downloads the sha256 checksum file of the entity to the given path.
+func (s *Syncer) downloadSHA256(ctx context.Context, e api.CacheEntity, p string) error {
+	sf, err := s.fs.Create(p)
+	if err != nil {
+		return fmt.Errorf("error opening file path %s: %w", p, err)
+	}
+	defer sf.Close()
+
+	s.logger.Log(s.stop, s.fileLogLevel, "downloading sha256 checksum", "id", e.GetName(), "key", e.GetSubPath(), "to", p)
+	_, err = e.DownloadSHA256(ctx, &sf, s.httpClient, s.s3)
+	return err
 }
 
-func (s *Syncer) remove(rootPath string, e api.CacheEntity) error {
+// updateCacheStats informs the collector of the given root path about the files added to and removed from the cache.
+func (s *Syncer) updateCacheStats(rootPath, subPath string, deltaBytes, deltaCount int64) {
+	if collector, ok := s.collectors[rootPath]; ok {
+		collector.UpdateCacheStats(subPath, deltaBytes, deltaCount)
+	}
+}
+
+// preserveModTime sets the modification time of a downloaded file to the one of its origin, errors are only logged
+// as the modification time is informational.
+func (s *Syncer) preserveModTime(targetPath string, e api.CacheEntity) {
+	lm, ok := e.(api.LastModified)
+	if !ok || lm.GetLastModified().IsZero() {
+		return
+	}
+
+	t := lm.GetLastModified()
+	err := s.fs.Chtimes(targetPath, t, t)
+	if err != nil {
+		s.logger.Warn("unable to preserve modification time of downloaded file", "path", targetPath, "error", err)
+	}
+}
+
+func (s *Syncer) remove(rootPath string, e api.CacheEntry) error {
 	path := strings.Join([]string{rootPath, e.GetSubPath()}, string(os.PathSeparator))
-	s.logger.Info("removing file from disk", "path", e.GetSubPath(), "id", e.GetName())
-	err := s.fs.Remove(path)
+	if !withinRoot(rootPath, path) {
+		return fmt.Errorf("refusing to delete %s outside of cache root %s", e.GetSubPath(), rootPath)
+	}
+
+	s.logger.Log(s.stop, s.fileLogLevel, "removing file from disk", "path", e.GetSubPath(), "id", e.GetName())
+	if s.checksumCache != nil {
+		s.checksumCache.Forget(path)
+	}
+	store := s.cacheStore()
+	err := store.Delete(path)
 	if err != nil {
 		s.logger.Error("error deleting file", "error", err)
 		return err
 	}
-	exists, err := afero.Exists(s.fs, path+".md5")
-	if err != nil {
-		s.logger.Error("error checking whether md5 exists", "error", err)
-	} else if exists {
-		err = s.fs.Remove(path + ".md5")
-		if err != nil {
-			s.logger.Error("error deleting os image md5 file", "error", err)
-			return err
+	s.updateCacheStats(rootPath, e.GetSubPath(), -e.GetSize(), -1)
+	for _, suffix := range sidecarSuffixes {
+		_, err := store.Stat(path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Error("error checking whether sidecar file exists", "path", path+suffix, "error", err)
+		} else if err == nil {
+			err = store.Delete(path + suffix)
+			if err != nil {
+				s.logger.Error("error deleting sidecar file", "path", path+suffix, "error", err)
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func (s *Syncer) printSyncPlan(remove api.CacheEntities, keep []api.CacheEntity, add []api.CacheEntity) {
+func (s *Syncer) printSyncPlan(current api.CacheEntries, remove api.CacheEntries, keep []api.CacheEntity, add []api.CacheEntity) {
+	cached := map[string]bool{}
+	for _, e := range current {
+		cached[e.GetSubPath()] = true
+	}
+
 	cacheSize := int64(0)
 	data := [][]string{}
 	for _, e := range remove {
 		data = append(data, []string{"", e.GetSubPath(), units.HumanSize(float64(e.GetSize())), "delete"})
+		s.logPlanEvent("delete", e, reasonNoLongerReferenced)
 	}
 	for _, e := range keep {
 		cacheSize += e.GetSize()
 		data = append(data, []string{e.GetName(), e.GetSubPath(), units.HumanSize(float64(e.GetSize())), "keep"})
+		s.logPlanEvent("keep", e, reasonUnchanged)
 	}
 	for _, e := range add {
 		cacheSize += e.GetSize()
 		data = append(data, []string{e.GetName(), e.GetSubPath(), units.HumanSize(float64(e.GetSize())), "download"})
+		if cached[e.GetSubPath()] {
+			s.logPlanEvent("download", e, reasonChecksumMismatch)
+		} else {
+			s.logPlanEvent("download", e, reasonNew)
+		}
 	}
 
 	s.logger.Info("sync plan", "amount", len(keep)+len(add), "cache-size-after-sync", units.BytesSize(float64(cacheSize)))
+
+	// the table has a row per file, so it is only printed if per-file lines are logged
+	if !s.logger.Enabled(s.stop, s.fileLogLevel) {
+		return
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader([]string{"ID", "Path", "Size", "Action"})
 
@@ -314,6 +972,11 @@ func (s *Syncer) printSyncPlan(remove api.CacheEntities, keep []api.CacheEntity,
 	table.Render()
 }
 
+// logPlanEvent logs a structured line for a single decision of the sync plan, such that cache churn can be evaluated from the logs.
+func (s *Syncer) logPlanEvent(action string, e api.CacheEntry, reason string) {
+	s.logger.Log(s.stop, s.fileLogLevel, "sync plan event", "action", action, "subpath", e.GetSubPath(), "size", e.GetSize(), "reason", reason)
+}
+
 func cleanEmptyDirs(fs afero.Fs, rootPath string) error {
 	files, err := afero.ReadDir(fs, rootPath)
 	if err != nil {
@@ -3,17 +3,24 @@ package sync
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -21,7 +28,9 @@ import (
 	"github.com/go-openapi/strfmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
 	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/pierrec/lz4/v4"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -35,7 +44,7 @@ func Test_currentFileIndex(t *testing.T) {
 	tests := []struct {
 		name      string
 		fsModFunc func(t *testing.T, fs afero.Fs)
-		want      api.CacheEntities
+		want      api.CacheEntries
 		wantErr   bool
 	}{
 		{
@@ -54,7 +63,7 @@ func Test_currentFileIndex(t *testing.T) {
 				createTestFile(t, fs, cacheRoot+"/ubuntu/20.10/20201026/img.tar.lz4")
 				createTestFile(t, fs, cacheRoot+"/ubuntu/20.10/20201026/img.tar.lz4.md5")
 			},
-			want: api.CacheEntities{
+			want: api.CacheEntries{
 				api.LocalFile{
 					Name:    "img.tar.lz4",
 					SubPath: "ubuntu/19.04/20201025/img.tar.lz4",
@@ -82,7 +91,7 @@ func Test_currentFileIndex(t *testing.T) {
 			if tt.fsModFunc != nil {
 				tt.fsModFunc(t, fs)
 			}
-			got, err := currentFileIndex(fs, cacheRoot)
+			got, err := currentFileIndex(slog.Default(), fs, cacheRoot)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Syncer.currentImageIndex() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -107,25 +116,67 @@ func createTestDir(t *testing.T, fs afero.Fs, p string) {
 	require.NoError(t, fs.MkdirAll(p, 0755))
 }
 
-func dlLoggingSvc(data []byte) (*s3.S3, *[]string, *[]string) {
-	var m sync.Mutex
-	names := []string{}
-	ranges := []string{}
+// dlRequests records the requests received by the in-memory image store of dlObjectSvc.
+type dlRequests struct {
+	mutex  sync.Mutex
+	keys   []string
+	ranges []string
+}
+
+// downloads returns the keys of the requests starting at the beginning of an object, i.e. one key per download.
+func (d *dlRequests) downloads() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var result []string
+	for i, rng := range d.ranges {
+		if rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+			result = append(result, d.keys[i])
+		}
+	}
+	return result
+}
+
+// requestedRanges returns the ranges of all requests.
+func (d *dlRequests) requestedRanges() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]string{}, d.ranges...)
+}
+
+// dlObjectSvc serves the given objects by key from memory and honors requested ranges, including open ranges of
+// resumed downloads. requests for other keys fail with NoSuchKey.
+func dlObjectSvc(objects map[string][]byte) (*s3.S3, *dlRequests) {
+	requests := &dlRequests{}
+	rerng := regexp.MustCompile(`bytes=(\d+)-(\d*)`)
 
 	svc := s3.New(unit.Session)
 	svc.Handlers.Send.Clear()
 	svc.Handlers.Send.PushBack(func(r *request.Request) {
-		m.Lock()
-		defer m.Unlock()
+		in := r.Params.(*s3.GetObjectInput)
 
-		names = append(names, r.Operation.Name)
-		ranges = append(ranges, *r.Params.(*s3.GetObjectInput).Range)
+		requests.mutex.Lock()
+		defer requests.mutex.Unlock()
 
-		rerng := regexp.MustCompile(`bytes=(\d+)-(\d+)`)
-		rng := rerng.FindStringSubmatch(r.HTTPRequest.Header.Get("Range"))
-		start, _ := strconv.ParseInt(rng[1], 10, 64)
-		fin, _ := strconv.ParseInt(rng[2], 10, 64)
-		fin++
+		requests.keys = append(requests.keys, aws.StringValue(in.Key))
+		requests.ranges = append(requests.ranges, aws.StringValue(in.Range))
+
+		data, ok := objects[aws.StringValue(in.Key)]
+		if !ok {
+			r.HTTPResponse = &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil)), Header: http.Header{}}
+			r.Error = awserr.New(s3.ErrCodeNoSuchKey, "the specified key does not exist", nil)
+			return
+		}
+
+		start, fin := int64(0), int64(len(data))
+		if rng := rerng.FindStringSubmatch(aws.StringValue(in.Range)); rng != nil {
+			start, _ = strconv.ParseInt(rng[1], 10, 64)
+			if rng[2] != "" {
+				fin, _ = strconv.ParseInt(rng[2], 10, 64)
+				fin++
+			}
+		}
 
 		if fin > int64(len(data)) {
 			fin = int64(len(data))
@@ -142,17 +193,52 @@ func dlLoggingSvc(data []byte) (*s3.S3, *[]string, *[]string) {
 		r.HTTPResponse.Header.Set("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
 	})
 
-	return svc, &names, &ranges
+	return svc, requests
+}
+
+// unreadableFs fails to stat the given path
+type unreadableFs struct {
+	afero.Fs
+	path string
+}
+
+func (u unreadableFs) Stat(name string) (os.FileInfo, error) {
+	if name == u.path {
+		return nil, os.ErrPermission
+	}
+	return u.Fs.Stat(name)
+}
+
+func Test_currentFileIndexUnreadableEntry(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	createTestFile(t, memFs, cacheRoot+"/ubuntu/19.04/20201025/img.tar.lz4")
+	createTestFile(t, memFs, cacheRoot+"/ubuntu/19.04/20201026/img.tar.lz4")
+
+	fs := unreadableFs{Fs: memFs, path: cacheRoot + "/ubuntu/19.04/20201025/img.tar.lz4"}
+
+	got, err := currentFileIndex(slog.Default(), fs, cacheRoot)
+	require.NoError(t, err)
+	assert.Equal(t, api.CacheEntries{
+		api.LocalFile{
+			Name:    "img.tar.lz4",
+			SubPath: "ubuntu/19.04/20201026/img.tar.lz4",
+			Size:    4,
+		},
+	}, got)
+
+	fs.path = cacheRoot
+	_, err = currentFileIndex(slog.Default(), fs, cacheRoot)
+	require.Error(t, err)
 }
 
 func TestSyncer_defineImageDiff(t *testing.T) {
 	tests := []struct {
 		name               string
 		fsModFunc          func(t *testing.T, fs afero.Fs)
-		currentImages      api.CacheEntities
+		currentImages      api.CacheEntries
 		remoteChecksumFile string
 		wantImages         api.CacheEntities
-		remove             api.CacheEntities
+		remove             api.CacheEntries
 		keep               api.CacheEntities
 		add                api.CacheEntities
 		wantErr            bool
@@ -168,7 +254,7 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 		},
 		{
 			name: "remove unexisting images",
-			currentImages: api.CacheEntities{
+			currentImages: api.CacheEntries{
 				api.OS{
 					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
 					BucketName: "metal-os",
@@ -182,7 +268,7 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 			},
 			wantImages: nil,
 			add:        nil,
-			remove: api.CacheEntities{
+			remove: api.CacheEntries{
 				api.OS{
 					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
 					BucketName: "metal-os",
@@ -232,7 +318,7 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 		},
 		{
 			name: "don't download existing images when checksum is proper",
-			currentImages: api.CacheEntities{
+			currentImages: api.CacheEntries{
 				api.OS{
 					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
 					BucketName: "metal-os",
@@ -270,7 +356,7 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 		},
 		{
 			name: "download existing images when checksum is incorrect",
-			currentImages: api.CacheEntities{
+			currentImages: api.CacheEntries{
 				api.OS{
 					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
 					BucketName: "metal-os",
@@ -306,6 +392,45 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 			remove:  nil,
 			wantErr: false,
 		},
+		{
+			name: "verify existing images against sha256 checksum",
+			currentImages: api.CacheEntries{
+				api.OS{
+					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
+					BucketName: "metal-os",
+					Version:    &semver.Version{},
+				},
+			},
+			wantImages: api.CacheEntities{
+				api.OS{
+					Name:       "ubuntu",
+					Version:    semver.MustParse("19.04.20201025"),
+					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
+					BucketName: "metal-os",
+					SHA256Ref: s3.Object{
+						Key: strPtr("metal-os/master/ubuntu/19.04/20201025/img.tar.lz4.sha256"),
+					},
+				},
+			},
+			fsModFunc: func(t *testing.T, fs afero.Fs) {
+				createTestFile(t, fs, cacheRoot+"/metal-os/master/ubuntu/19.04/20201025/img.tar.lz4")
+			},
+			remoteChecksumFile: "532eaabd9574880dbf76b9b8cc00832c20a6ec113d682299550d7a6e0f345e25  img.tar.lz4",
+			add:                nil,
+			keep: api.CacheEntities{
+				api.OS{
+					Name:       "ubuntu",
+					Version:    semver.MustParse("19.04.20201025"),
+					BucketKey:  "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
+					BucketName: "metal-os",
+					SHA256Ref: s3.Object{
+						Key: strPtr("metal-os/master/ubuntu/19.04/20201025/img.tar.lz4.sha256"),
+					},
+				},
+			},
+			remove:  nil,
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -321,7 +446,18 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 				remoteChecksumFile = tt.remoteChecksumFile
 			}
 
-			s3Client, _, _ := dlLoggingSvc([]byte(remoteChecksumFile))
+			objects := map[string][]byte{}
+			for _, e := range tt.wantImages {
+				if o, ok := e.(api.OS); ok {
+					for _, ref := range []s3.Object{o.MD5Ref, o.SHA256Ref} {
+						if ref.Key != nil {
+							objects[*ref.Key] = []byte(remoteChecksumFile)
+						}
+					}
+				}
+			}
+
+			s3Client, _ := dlObjectSvc(objects)
 			d := s3manager.NewDownloaderWithClient(s3Client)
 			s := &Syncer{
 				logger: slog.Default(),
@@ -348,6 +484,64 @@ func TestSyncer_defineImageDiff(t *testing.T) {
 	}
 }
 
+func TestSyncer_defineDiffConcurrent(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+
+	var (
+		current    api.CacheEntries
+		want       api.CacheEntities
+		wantKeep   api.CacheEntities
+		wantAdd    api.CacheEntities
+		wantRemove api.CacheEntries
+	)
+	for i := 0; i < 50; i++ {
+		subPath := fmt.Sprintf("kernels/%d/kernel", i)
+
+		// a third of the files is cached with a valid checksum, a third with an invalid one and a third is missing
+		md5 := "0cbc6611f5540bd0809a388dc95a615b"
+		if i%3 == 1 {
+			md5 = "not-equal"
+		}
+
+		e := api.PeerFile{SubPath: subPath, MD5: md5}
+		want = append(want, e)
+
+		switch i % 3 {
+		case 0:
+			wantKeep = append(wantKeep, e)
+		default:
+			wantAdd = append(wantAdd, e)
+		}
+
+		if i%3 != 2 {
+			createTestFile(t, fs, cacheRoot+"/"+subPath)
+			current = append(current, api.LocalFile{Name: "kernel", SubPath: subPath, Size: 4})
+		}
+	}
+
+	orphan := api.LocalFile{Name: "kernel", SubPath: "kernels/orphan/kernel", Size: 4}
+	createTestFile(t, fs, cacheRoot+"/"+orphan.SubPath)
+	current = append(current, orphan)
+	wantRemove = append(wantRemove, orphan)
+
+	for _, workers := range []int{1, 8} {
+		s := &Syncer{
+			logger:          slog.Default(),
+			fs:              fs,
+			stop:            context.TODO(),
+			checksumWorkers: workers,
+		}
+
+		gotRemove, gotKeep, gotAdd, err := s.defineDiff(cacheRoot, current, want)
+		require.NoError(t, err)
+
+		assert.Equal(t, wantRemove, gotRemove, "workers %d", workers)
+		assert.Equal(t, wantKeep, gotKeep, "workers %d", workers)
+		assert.Equal(t, wantAdd, gotAdd, "workers %d", workers)
+	}
+}
+
 func strPtr(s string) *string {
 	return &s
 }
@@ -478,3 +672,641 @@ func Test_cleanEmptyDirs(t *testing.T) {
 		})
 	}
 }
+
+func TestSyncer_SyncLogVerbosity(t *testing.T) {
+	tests := []struct {
+		name         string
+		fileLogLevel slog.Level
+		wantMessages map[string]int
+		wantTable    bool
+	}{
+		{
+			name:         "per-file logs every file",
+			fileLogLevel: slog.LevelInfo,
+			wantMessages: map[string]int{
+				"downloading file":        2,
+				"removing file from disk": 1,
+				"sync summary":            1,
+			},
+			wantTable: true,
+		},
+		{
+			name:         "summary only logs a single summary line",
+			fileLogLevel: slog.LevelDebug,
+			wantMessages: map[string]int{
+				"downloading file":        0,
+				"removing file from disk": 0,
+				"sync summary":            1,
+			},
+			wantTable: false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("Test"))
+			}))
+			defer ts.Close()
+
+			fs := afero.NewMemMapFs()
+			require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+			createTestFile(t, fs, cacheRoot+"/metal-hammer/v0.1.0/kernel")
+
+			var buf bytes.Buffer
+			s := &Syncer{
+				logger:       slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})),
+				fs:           fs,
+				tmpPath:      "/tmp/test-download",
+				stop:         context.TODO(),
+				httpClient:   http.DefaultClient,
+				fileLogLevel: tt.fileLogLevel,
+			}
+
+			// the sync plan table is printed to stdout
+			stdout := os.Stdout
+			r, w, err := os.Pipe()
+			require.NoError(t, err)
+			os.Stdout = w
+			defer func() {
+				os.Stdout = stdout
+			}()
+
+			var table bytes.Buffer
+			copied := make(chan struct{})
+			go func() {
+				defer close(copied)
+				_, _ = io.Copy(&table, r)
+			}()
+
+			err = s.Sync(cacheRoot, api.CacheEntities{
+				api.Kernel{SubPath: "metal-hammer/v0.2.0/kernel", URL: ts.URL + "/metal-hammer/v0.2.0/kernel", Size: 4},
+				api.Kernel{SubPath: "metal-hammer/v0.3.0/kernel", URL: ts.URL + "/metal-hammer/v0.3.0/kernel", Size: 4},
+			})
+			os.Stdout = stdout
+			require.NoError(t, w.Close())
+			<-copied
+			require.NoError(t, err)
+
+			if tt.wantTable {
+				assert.Contains(t, table.String(), "metal-hammer/v0.2.0/kernel")
+			} else {
+				assert.Empty(t, table.String())
+			}
+
+			got := map[string]int{}
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var entry struct {
+					Msg string `json:"msg"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(line), &entry))
+				got[entry.Msg]++
+			}
+
+			for msg, count := range tt.wantMessages {
+				assert.Equal(t, count, got[msg], "unexpected amount of %q log lines", msg)
+			}
+		})
+	}
+}
+
+func TestSyncer_printSyncPlanEvents(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Syncer{
+		logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		stop:   context.TODO(),
+	}
+
+	current := api.CacheEntries{
+		api.LocalFile{SubPath: "metal-hammer/v0.1.0/kernel", Size: 4},
+		api.LocalFile{SubPath: "metal-hammer/v0.2.0/kernel", Size: 4},
+		api.LocalFile{SubPath: "metal-hammer/v0.3.0/kernel", Size: 4},
+	}
+
+	s.printSyncPlan(current,
+		api.CacheEntries{current[0]},
+		api.CacheEntities{api.Kernel{SubPath: "metal-hammer/v0.2.0/kernel", Size: 4}},
+		api.CacheEntities{
+			api.Kernel{SubPath: "metal-hammer/v0.3.0/kernel", Size: 4},
+			api.Kernel{SubPath: "metal-hammer/v0.4.0/kernel", Size: 4},
+		},
+	)
+
+	type event struct {
+		Msg     string `json:"msg"`
+		Action  string `json:"action"`
+		SubPath string `json:"subpath"`
+		Size    int64  `json:"size"`
+		Reason  string `json:"reason"`
+	}
+
+	var got []event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		if e.Msg == "sync plan event" {
+			e.Msg = ""
+			got = append(got, e)
+		}
+	}
+
+	assert.Equal(t, []event{
+		{Action: "delete", SubPath: "metal-hammer/v0.1.0/kernel", Size: 4, Reason: "no-longer-referenced"},
+		{Action: "keep", SubPath: "metal-hammer/v0.2.0/kernel", Size: 4, Reason: "unchanged"},
+		{Action: "download", SubPath: "metal-hammer/v0.3.0/kernel", Size: 4, Reason: "checksum-mismatch"},
+		{Action: "download", SubPath: "metal-hammer/v0.4.0/kernel", Size: 4, Reason: "new"},
+	}, got)
+}
+
+func TestSyncer_Orphans(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+	createTestFile(t, fs, cacheRoot+"/metal-hammer/v0.1.0/kernel")
+	createTestFile(t, fs, cacheRoot+"/metal-hammer/orphan/kernel")
+
+	s := &Syncer{
+		logger: slog.Default(),
+		fs:     fs,
+		stop:   context.TODO(),
+		dry:    true,
+	}
+
+	orphans, err := s.Orphans(cacheRoot)
+	require.NoError(t, err)
+	assert.Nil(t, orphans, "orphans reported before first sync")
+
+	err = s.Sync(cacheRoot, api.CacheEntities{
+		api.Kernel{SubPath: "metal-hammer/v0.1.0/kernel"},
+	})
+	require.NoError(t, err)
+
+	orphans, err = s.Orphans(cacheRoot)
+	require.NoError(t, err)
+	assert.Equal(t, api.CacheEntries{
+		api.LocalFile{
+			Name:    "kernel",
+			SubPath: "metal-hammer/orphan/kernel",
+			Size:    4,
+		},
+	}, orphans)
+}
+
+func TestSyncer_Index(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+	createTestFile(t, fs, cacheRoot+"/metal-hammer/v0.1.0/kernel")
+	createTestFile(t, fs, cacheRoot+"/metal-hammer/v0.1.0/kernel.md5")
+
+	mtime := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, fs.Chtimes(cacheRoot+"/metal-hammer/v0.1.0/kernel", mtime, mtime))
+
+	s := &Syncer{
+		logger: slog.Default(),
+		fs:     fs,
+	}
+
+	index, err := s.Index(cacheRoot)
+	require.NoError(t, err)
+	require.Len(t, index, 1)
+	assert.Equal(t, "kernel", index[0].Name)
+	assert.Equal(t, "metal-hammer/v0.1.0/kernel", index[0].SubPath)
+	assert.Equal(t, int64(4), index[0].Size)
+	assert.True(t, mtime.Equal(index[0].ModTime))
+}
+
+func TestSyncer_SyncOriginAbsentPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantExists bool
+		wantWarn   bool
+	}{
+		{
+			name:       "keep",
+			policy:     api.OriginAbsentPolicyKeep,
+			wantExists: true,
+			wantWarn:   false,
+		},
+		{
+			name:       "remove",
+			policy:     api.OriginAbsentPolicyRemove,
+			wantExists: false,
+			wantWarn:   false,
+		},
+		{
+			name:       "warn",
+			policy:     api.OriginAbsentPolicyWarn,
+			wantExists: true,
+			wantWarn:   true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, fs.MkdirAll(cacheRoot, 0755))
+			createTestFile(t, fs, cacheRoot+"/metal-os/master/ubuntu/19.04/20201025/img.tar.lz4")
+
+			var buf bytes.Buffer
+			s := &Syncer{
+				logger:       slog.New(slog.NewJSONHandler(&buf, nil)),
+				fs:           fs,
+				stop:         context.TODO(),
+				originAbsent: tt.policy,
+			}
+
+			err := s.Sync(cacheRoot, api.CacheEntities{
+				api.OS{
+					Name:         "ubuntu",
+					Version:      semver.MustParse("19.04.20201025"),
+					BucketKey:    "metal-os/master/ubuntu/19.04/20201025/img.tar.lz4",
+					BucketName:   "metal-os",
+					OriginAbsent: true,
+				},
+				api.OS{
+					Name:         "ubuntu",
+					Version:      semver.MustParse("19.04.20201026"),
+					BucketKey:    "metal-os/master/ubuntu/19.04/20201026/img.tar.lz4",
+					BucketName:   "metal-os",
+					OriginAbsent: true,
+				},
+			})
+			require.NoError(t, err)
+
+			exists, err := afero.Exists(fs, cacheRoot+"/metal-os/master/ubuntu/19.04/20201025/img.tar.lz4")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantExists, exists)
+
+			exists, err = afero.Exists(fs, cacheRoot+"/metal-os/master/ubuntu/19.04/20201026/img.tar.lz4")
+			require.NoError(t, err)
+			assert.False(t, exists, "origin absent image must not be downloaded")
+
+			assert.Equal(t, tt.wantWarn, strings.Contains(buf.String(), `"level":"WARN"`))
+		})
+	}
+}
+
+func TestSyncer_downloadParallel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// write in chunks such that both downloads interleave
+		for i := 0; i < 100; i++ {
+			_, _ = w.Write([]byte(r.URL.Path))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:     slog.Default(),
+		fs:         fs,
+		tmpPath:    "/tmp/test-download",
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+	}
+
+	entities := []api.PeerFile{
+		{SubPath: "metal-kernel/a/metal-kernel", URL: ts.URL + "/a"},
+		{SubPath: "metal-kernel/b/metal-kernel", URL: ts.URL + "/b"},
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(entities))
+	for i, e := range entities {
+		wg.Add(1)
+		go func(i int, e api.PeerFile) {
+			defer wg.Done()
+			errs[i] = s.download(context.TODO(), cacheRoot, nil, e)
+		}(i, e)
+	}
+	wg.Wait()
+
+	for i, e := range entities {
+		require.NoError(t, errs[i])
+
+		got, err := afero.ReadFile(fs, cacheRoot+"/"+e.SubPath)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat(strings.TrimPrefix(e.URL, ts.URL), 100), string(got))
+	}
+
+	tmpFiles, err := afero.ReadDir(fs, "/tmp/test-download")
+	require.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+}
+
+func TestSyncer_downloadVerifyLZ4(t *testing.T) {
+	var valid bytes.Buffer
+	w := lz4.NewWriter(&valid)
+	_, err := w.Write([]byte("Test"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{
+			name:    "valid lz4 stream",
+			content: valid.Bytes(),
+			wantErr: false,
+		},
+		{
+			name:    "corrupt lz4 stream",
+			content: valid.Bytes()[:valid.Len()-6],
+			wantErr: true,
+		},
+		{
+			name:    "no lz4 stream at all",
+			content: []byte("Test"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(tt.content)
+			}))
+			defer ts.Close()
+
+			fs := afero.NewMemMapFs()
+			s := &Syncer{
+				logger:     slog.Default(),
+				fs:         fs,
+				tmpPath:    "/tmp/test-download",
+				stop:       context.TODO(),
+				httpClient: http.DefaultClient,
+				verifyLZ4:  true,
+			}
+
+			err := s.download(context.TODO(), cacheRoot, nil, api.PeerFile{SubPath: "metal-os/ubuntu/20.04/img.tar.lz4", URL: ts.URL})
+
+			exists, existsErr := afero.Exists(fs, cacheRoot+"/metal-os/ubuntu/20.04/img.tar.lz4")
+			require.NoError(t, existsErr)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.False(t, exists)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, exists)
+			}
+		})
+	}
+}
+
+func TestSyncer_downloadPreservesModTime(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer ts.Close()
+
+	lastModified := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:     slog.Default(),
+		fs:         fs,
+		tmpPath:    "/tmp/test-download",
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+	}
+
+	err := s.download(context.TODO(), cacheRoot, nil, api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL, LastModified: lastModified})
+	require.NoError(t, err)
+
+	info, err := fs.Stat(cacheRoot + "/metal-hammer/kernel")
+	require.NoError(t, err)
+	assert.True(t, lastModified.Equal(info.ModTime()), "mtime %s was not propagated", info.ModTime())
+}
+
+func TestSyncer_downloadSizeMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		wantErr bool
+	}{
+		{
+			name:    "matching size",
+			size:    6,
+			wantErr: false,
+		},
+		{
+			name:    "truncated download",
+			size:    10,
+			wantErr: true,
+		},
+		{
+			name:    "unknown size",
+			size:    0,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("kernel"))
+			}))
+			defer ts.Close()
+
+			fs := afero.NewMemMapFs()
+			s := &Syncer{
+				logger:     slog.Default(),
+				fs:         fs,
+				tmpPath:    "/tmp/test-download",
+				stop:       context.TODO(),
+				httpClient: http.DefaultClient,
+			}
+
+			err := s.download(context.TODO(), cacheRoot, nil, api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL, Size: tt.size})
+
+			exists, existsErr := afero.Exists(fs, cacheRoot+"/metal-hammer/kernel")
+			require.NoError(t, existsErr)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.False(t, exists)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, exists)
+			}
+
+			tmpFiles, err := afero.ReadDir(fs, "/tmp/test-download")
+			require.NoError(t, err)
+			assert.Empty(t, tmpFiles)
+		})
+	}
+}
+
+func TestSyncer_downloadUnexpectedContent(t *testing.T) {
+	tests := []struct {
+		name            string
+		handler         http.HandlerFunc
+		resumeDownloads bool
+	}{
+		{
+			name: "html error page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte("<html><body>object not found</body></html>"))
+			},
+		},
+		{
+			name: "html error page of a resumable download",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte("<html><body>object not found</body></html>"))
+			},
+			resumeDownloads: true,
+		},
+		{
+			name: "empty body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+
+			fs := afero.NewMemMapFs()
+			s := &Syncer{
+				logger:          slog.Default(),
+				fs:              fs,
+				tmpPath:         "/tmp/test-download",
+				stop:            context.TODO(),
+				httpClient:      http.DefaultClient,
+				resumeDownloads: tt.resumeDownloads,
+			}
+
+			k := api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL}
+
+			err := s.download(context.TODO(), cacheRoot, nil, k)
+			require.ErrorIs(t, err, api.ErrUnexpectedContent)
+
+			exists, err := afero.Exists(fs, cacheRoot+"/metal-hammer/kernel")
+			require.NoError(t, err)
+			assert.False(t, exists)
+
+			exists, err = afero.Exists(fs, path.Join(s.resumeDir(cacheRoot), k.SubPath))
+			require.NoError(t, err)
+			assert.False(t, exists, "partial download must not be kept")
+
+			tmpFiles, err := afero.ReadDir(fs, "/tmp/test-download")
+			require.NoError(t, err)
+			for _, f := range tmpFiles {
+				assert.True(t, f.IsDir(), "tmp file %s must be removed", f.Name())
+			}
+		})
+	}
+}
+
+func TestSyncer_downloadOutsideOfRoot(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("evil"))
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:     slog.Default(),
+		fs:         fs,
+		tmpPath:    "/tmp/test-download",
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+	}
+
+	err := s.download(context.TODO(), cacheRoot, nil, api.PeerFile{SubPath: "../../etc/cron.d/evil", URL: ts.URL})
+	require.EqualError(t, err, "refusing to download ../../etc/cron.d/evil outside of cache root /tmp/test-path")
+
+	exists, err := afero.Exists(fs, "/etc/cron.d/evil")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestSyncer_downloadTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// the connection is accepted but the body is never sent
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	s := &Syncer{
+		logger:          slog.Default(),
+		fs:              fs,
+		tmpPath:         "/tmp/test-download",
+		stop:            context.TODO(),
+		httpClient:      http.DefaultClient,
+		downloadTimeout: 100 * time.Millisecond,
+	}
+
+	err := s.download(context.TODO(), cacheRoot, nil, api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	exists, err := afero.Exists(fs, cacheRoot+"/metal-hammer/kernel")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestSyncer_updateCacheStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer ts.Close()
+
+	collector := metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), t.TempDir())
+
+	stats := func() (float64, float64) {
+		families, err := collector.GetGatherer().Gather()
+		require.NoError(t, err)
+
+		var size, count float64
+		for _, f := range families {
+			switch f.GetName() {
+			case "current_cache_size":
+				size = f.GetMetric()[0].GetGauge().GetValue()
+			case "cache_kernel_count":
+				count = f.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return size, count
+	}
+
+	size, count := stats()
+	require.Zero(t, size)
+	require.Zero(t, count)
+
+	s := &Syncer{
+		logger:     slog.Default(),
+		fs:         afero.NewMemMapFs(),
+		tmpPath:    "/tmp/test-download",
+		stop:       context.TODO(),
+		httpClient: http.DefaultClient,
+		collectors: map[string]metrics.DownloadCollector{},
+	}
+	s.RegisterCollector(cacheRoot, collector)
+
+	kernel := api.Kernel{SubPath: "metal-hammer/kernel", URL: ts.URL}
+
+	require.NoError(t, s.download(context.TODO(), cacheRoot, nil, kernel))
+	size, count = stats()
+	assert.Equal(t, float64(6), size)
+	assert.Equal(t, float64(1), count)
+
+	// a download replacing a cached file does not change the count
+	require.NoError(t, s.download(context.TODO(), cacheRoot, nil, kernel))
+	size, count = stats()
+	assert.Equal(t, float64(6), size)
+	assert.Equal(t, float64(1), count)
+
+	require.NoError(t, s.remove(cacheRoot, api.LocalFile{SubPath: "metal-hammer/kernel", Size: 6}))
+	size, count = stats()
+	assert.Zero(t, size)
+	assert.Zero(t, count)
+}
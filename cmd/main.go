@@ -2,13 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,8 +32,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/docker/go-units"
 	metalgo "github.com/metal-stack/metal-go"
 	synclister "github.com/metal-stack/metal-image-cache-sync/cmd/internal/determine-sync-images"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/layout"
 	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
 	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/sync"
 	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
@@ -35,6 +52,11 @@ import (
 const (
 	moduleName  = "metal-image-cache-sync"
 	cfgFileType = "yaml"
+
+	requestIDHeader = "X-Request-Id"
+
+	// tlsCertCheckInterval is the interval the tls certificate files are checked for a rotation
+	tlsCertCheckInterval = 30 * time.Second
 )
 
 var (
@@ -62,6 +84,30 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+var migrateLayoutCmd = &cobra.Command{
+	Use:   "migrate-layout",
+	Short: "migrates the on-disk cache from one layout to another",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrateLayout()
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists the files currently cached without running a sync",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listCache(cmd.OutOrStdout(), viper.GetString("cache-root-path"), viper.GetBool("json"))
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "verifies the checksums of all cached files against their md5 files, exits non-zero on mismatches",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return verifyCache(cmd.OutOrStdout(), viper.GetString("cache-root-path"))
+	},
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -70,38 +116,146 @@ func main() {
 
 func init() {
 	rootCmd.Flags().String("log-level", "info", "sets the application log level")
+	rootCmd.Flags().String("log-verbosity", api.LogVerbosityPerFile, "per-file logs every downloaded and removed file, summary logs a single summary per sync and per-file lines as well as the sync plan table only on debug level")
 
 	rootCmd.Flags().String("image-store", "metal-stack.io", "url to the image store")
-	rootCmd.Flags().String("image-store-bucket", "images", "bucket of the image store")
+	rootCmd.Flags().StringSlice("image-store-bucket", []string{"images"}, "buckets of the image store, images are looked up in the bucket named by their url or in the order of the given buckets")
+	rootCmd.Flags().String("image-store-region", "dummy", "region of the image store, only relevant for stores that validate the region like aws s3")
+	rootCmd.Flags().Bool("image-store-path-style", true, "uses path-style addressing (endpoint/bucket/key) for the image store as required by minio and most on-prem gateways, virtual-hosted style (bucket.endpoint/key) is used if disabled, which fails tls verification for bucket names containing dots")
+	rootCmd.Flags().String("image-store-access-key", "", "access key for authenticated access to the image store, anonymous access is used if not set")
+	rootCmd.Flags().String("image-store-secret-key", "", "secret key for authenticated access to the image store, anonymous access is used if not set")
+	rootCmd.Flags().Bool("image-store-http-fallback", false, "syncs images over http from their url if the image store cannot be listed, e.g. for mirrors that do not expose the s3 api")
+	rootCmd.Flags().Int("s3-max-retries", 3, "amount of times a failed request to the image store is retried, disabled if zero")
+	rootCmd.Flags().Duration("s3-min-retry-delay", 10*time.Second, "minimum delay before retrying a failed request to the image store, doubled with every retry and randomized by up to the same amount to spread retries of multiple cache instances")
 
 	rootCmd.Flags().String("metal-api-endpoint", "", "endpoint of the metal-api")
 	rootCmd.Flags().String("metal-api-hmac", "", "hmac of the metal-api (requires view access)")
 
+	rootCmd.Flags().String("replicate-from", "", "url of a peer cache to replicate from instead of syncing from the origin (e.g. http://10.0.0.1), the peer is expected to serve on the same ports as this instance")
+
 	rootCmd.Flags().String("schedule", "*/10 * * * *", "cron sync schedule")
+	rootCmd.Flags().Duration("schedule-jitter", 0, "maximum random delay of scheduled syncs, the delay is chosen once at startup such that many caches with the same schedule do not hit the origin at the same time, disabled if zero")
 	rootCmd.Flags().Bool("dry-run", false, "does not download any images, useful for development purposes")
+	rootCmd.Flags().Bool("once", false, "runs a single sync and exits without starting the cron schedule and the http servers, exits non-zero if the sync failed")
+	rootCmd.Flags().Bool("async-initial-sync", false, "runs the initial sync in the background instead of blocking the start of the cron schedule, cache misses are redirected to the origin until the cache is filled")
 
 	rootCmd.Flags().String("max-cache-size", "10G", "maximum size that the cache should have in the end (can exceed if min amount of images for all image variants is reached)")
+	rootCmd.Flags().String("max-total-cache-size", "", "maximum size of the image, kernel and boot image caches together, evicts images first and then the kernels and boot images referenced by the least partitions (disabled if empty)")
 	rootCmd.Flags().Int("min-images-per-name", 3, "minimum amount of images to keep of an image variant")
 	rootCmd.Flags().Int("max-images-per-name", -1, "maximum amount of images to cache for an image variant, unlimited if less than zero")
+	rootCmd.Flags().String("eviction-strategy", api.EvictionStrategyBalanced, "how to reduce the images to sync when exceeding the max cache size, balanced evicts from the image variant with the most images, largest-first evicts the largest images to free space faster (balanced|largest-first)")
+	// per-os-limits can only be set in the config file, e.g. per-os-limits: {firewall: {min: 5, max: 5}}, and override the min and max images per name
+
+	rootCmd.Flags().Bool("enable-deltas", false, "reconstructs images from binary deltas (bsdiff) published by the origin when the base version is already cached instead of downloading the full image")
+
+	rootCmd.Flags().Bool("verify-lz4", false, "decodes downloaded lz4 files to verify their frame structure before moving them into the cache, a corrupt file is downloaded again (costs cpu)")
+
+	rootCmd.Flags().String("origin-absent-policy", api.OriginAbsentPolicyRemove, "what to do with cached images that are still referenced by the metal-api but not contained in the image store anymore (keep|remove|warn)")
 
 	rootCmd.Flags().Uint("expiration-grace-period", 0, "the amount of days to still sync images even if they have already expired in the metal-api (defaults to zero)")
+	rootCmd.Flags().Uint("max-image-age-days", 0, "the amount of days after which images are not synced anymore, the age is taken from the datestamp of the image version (e.g. 20200408), disabled if zero")
+	rootCmd.Flags().Bool("age-respects-min", false, "keeps the minimum amount of images per name even if they exceed the max image age")
+
+	rootCmd.Flags().String("fallback-image", "", "id of an image that is always cached and never evicted, regardless of expiration, retention and cache size settings")
+
+	rootCmd.PersistentFlags().String("cache-root-path", "/var/lib/metal-image-cache-sync", "root path of where to store the cached entities")
 
-	rootCmd.Flags().String("cache-root-path", "/var/lib/metal-image-cache-sync", "root path of where to store the cached entities")
+	rootCmd.Flags().Int("checksum-workers", 4, "amount of cached files to verify checksums of in parallel when determining which entities need to be downloaded")
 
-	rootCmd.Flags().String("image-cache-bind-address", "0.0.0.0:3000", "image cache http server bind address")
+	rootCmd.Flags().Int("download-concurrency", 4, "amount of files downloaded in parallel during a sync")
+	rootCmd.Flags().Int("download-concurrency-while-serving", 1, "amount of files downloaded in parallel during a sync while the caches are actively serving requests, yields bandwidth to serving (e.g. PXE boots)")
+	rootCmd.Flags().Int("download-max-retries", 3, "amount of times a failed download is retried with exponential backoff before it is skipped until the next sync")
+	rootCmd.Flags().Duration("download-timeout", 30*time.Minute, "maximum duration of a single download, a stuck transfer fails after this duration such that the rest of the sync proceeds, disabled if zero")
+	rootCmd.Flags().Int("http-max-idle-conns-per-host", 4, "amount of idle connections kept per origin host for reuse by the next requests")
+	rootCmd.Flags().Duration("http-idle-conn-timeout", 90*time.Second, "duration after which idle connections to the origins are closed")
+	rootCmd.Flags().Duration("http-tls-handshake-timeout", 10*time.Second, "maximum duration of the tls handshake with an origin")
+	rootCmd.Flags().Duration("http-timeout", 1*time.Hour, "maximum duration of a single request to an origin including reading the body, applies in addition to the download timeout, disabled if zero")
+	rootCmd.Flags().String("http-proxy", "", "url of the proxy for the requests to the origins and the image store, overrides the proxy from the HTTP_PROXY and HTTPS_PROXY environment variables")
+	rootCmd.Flags().String("http-user-agent", moduleName+"/"+v.Version, "user agent of the requests to the origins, allows mirror operators to identify the traffic of the caches")
+	rootCmd.Flags().Bool("resume-downloads", false, "keeps the partial file of an interrupted download and resumes it with a ranged request in the next attempt, the checksum of a resumed file is verified before it is moved into the cache")
+	rootCmd.Flags().Bool("latest-links", false, "maintains a latest symlink next to the version directories of every os major.minor pointing to the newest cached version, e.g. ubuntu/20.04/latest/img.tar.lz4, the directory is copied on filesystems without symlink support")
+	rootCmd.Flags().Duration("serve-activity-window", 1*time.Minute, "window in which served requests are counted to determine whether the caches are actively serving")
+	rootCmd.Flags().Int("serve-activity-threshold", 10, "amount of requests served within the serve activity window from which on the caches are considered actively serving, disabled if zero")
+
+	rootCmd.Flags().Bool("trim-plan-to-free-space", false, "skips downloads of a sync that do not fit into the free space of the cache filesystem instead of aborting the sync")
+	rootCmd.Flags().Bool("purge-unknown", false, "deletes files that were not downloaded by the sync according to the cache manifest and stray checksum files, each deleted file is logged for auditing. without this flag only files downloaded by the sync are deleted, files outside of the cache root are never touched")
+	rootCmd.Flags().Int64("min-free-disk-bytes", 0, "amount of bytes to keep free on the cache filesystem, a sync is aborted (or trimmed) before downloading if the planned downloads would exceed this headroom")
+
+	rootCmd.Flags().String("image-cache-bind-address", "0.0.0.0:3000", "image cache http server bind address, a comma-separated list of addresses to listen on multiple addresses (e.g. 10.0.0.1:3000,[fd00::1]:3000)")
+	rootCmd.Flags().String("admin-token", "", "bearer token required to trigger a sync through POST /sync on the image cache http server, the endpoint is disabled if not set")
 
 	rootCmd.Flags().Bool("enable-kernel-cache", true, "enables caching kernels used for PXE booting inside partitions")
-	rootCmd.Flags().String("kernel-cache-bind-address", "0.0.0.0:3001", "kernel cache http server bind address")
+	rootCmd.Flags().String("kernel-cache-bind-address", "0.0.0.0:3001", "kernel cache http server bind address, a comma-separated list of addresses to listen on multiple addresses")
 
 	rootCmd.Flags().Bool("enable-boot-image-cache", true, "enables caching initrd images used for PXE booting inside partitions")
-	rootCmd.Flags().String("boot-image-cache-bind-address", "0.0.0.0:3002", "kernel cache http server bind address")
+	rootCmd.Flags().Bool("require-boot-image-md5", true, "skips boot images without md5 checksum at the origin, if disabled they are synced without checksum verification")
+	rootCmd.Flags().String("boot-image-cache-bind-address", "0.0.0.0:3002", "boot image cache http server bind address, a comma-separated list of addresses to listen on multiple addresses")
+
+	rootCmd.Flags().String("subpath-naming", api.SubPathNamingPath, "how kernels and boot images are named in the cache, path uses the url path, host prefixes it with the url host and hash uses a hash of the full url to avoid collisions of urls from different hosts sharing a path (path|host|hash), clients must request the resulting path")
+
+	rootCmd.Flags().Duration("head-cache-ttl", 0, "duration to cache artifact sizes probed from the origin when the origin does not send cache headers itself, disabled if zero")
+
+	rootCmd.Flags().String("served-cache-control", "public, max-age=86400, immutable", "cache-control header of files served from the cache, cache misses never carry it, disabled if empty")
+	rootCmd.Flags().Bool("serve-decompressed", false, "serves cached lz4 and zstd compressed files decompressed on the fly when requested without their compression suffix (e.g. img.tar for img.tar.lz4)")
+
+	rootCmd.Flags().String("origin-base-url", "", "base url of the origin cache misses are redirected to (e.g. https://images.metal-stack.io), redirects to the requested host via https if not set")
+	rootCmd.Flags().StringSlice("proxy-miss-paths", []string{}, "url path prefixes for which cache misses are streamed from the origin through the cache instead of redirecting the client to the origin")
+	rootCmd.Flags().String("proxy-miss-origin", "", "base url of the origin to stream proxied cache misses from (e.g. https://images.metal-stack.io)")
+	rootCmd.Flags().StringToString("proxy-miss-headers", map[string]string{}, "headers added to proxied cache misses to authenticate against the origin (e.g. Authorization=Bearer <token>)")
+
+	rootCmd.Flags().Int("max-redirects", 10, "maximum amount of redirects to follow when downloading from the origin, zero disables following redirects")
+	rootCmd.Flags().StringSlice("allowed-redirect-hosts", []string{}, "hosts that downloads from the origin may be redirected to in addition to the requested host, all hosts are allowed if empty")
 
 	rootCmd.Flags().StringSlice("excludes", []string{"/pull_requests/"}, "url paths to exclude from the sync")
+	rootCmd.Flags().StringSlice("image-excludes", []string{}, "url paths to exclude from the image sync, replaces the global excludes for images if set")
+	rootCmd.Flags().StringSlice("kernel-excludes", []string{}, "url paths to exclude from the kernel sync, replaces the global excludes for kernels if set")
+	rootCmd.Flags().StringSlice("boot-image-excludes", []string{}, "url paths to exclude from the boot image sync, replaces the global excludes for boot images if set")
+	rootCmd.Flags().StringSlice("exclude-regex", []string{}, "regular expressions of urls to exclude from the sync in addition to the excluded url paths (e.g. /pull_requests/.*-pr[0-9]+/), note that the default --excludes drops everything under /pull_requests/, so it has to be overridden (e.g. --excludes '') to keep release candidates published there")
+	rootCmd.Flags().StringSlice("include-os", []string{}, "names of the operating systems to sync images for, all are synced if empty (excludes take precedence)")
+
+	rootCmd.Flags().Bool("verify-signed-manifest", false, "only caches artifacts contained in a signed manifest of the origin and verifies their checksums against it")
+	rootCmd.Flags().String("signed-manifest-url", "", "url to the signed manifest (md5sum format), the ed25519 signature is expected at the same url with .sig suffix")
+	rootCmd.Flags().String("signed-manifest-public-key", "", "path to a file containing the base64 encoded ed25519 public key used to verify the signed manifest")
+
+	rootCmd.Flags().String("checksum-signature-public-key", "", "path to a minisign public key, if set checksum files are only trusted if their minisign signature (<checksum file>.minisig) is valid, only md5 checksum files are signed")
+	rootCmd.Flags().String("checksum-signature-mode", api.ChecksumSignatureModeStrict, "strict refuses checksums without signature, lenient trusts them (strict|lenient), checksums with an invalid signature are always refused")
+
+	rootCmd.Flags().Duration("http-read-header-timeout", 1*time.Minute, "maximum duration for reading the request headers of the cache http servers")
+	rootCmd.Flags().Duration("http-read-timeout", 0, "maximum duration for reading an entire request of the cache http servers, unlimited if zero")
+	rootCmd.Flags().Duration("http-write-timeout", 0, "maximum duration for writing a response of the cache http servers, unlimited if zero (should stay unlimited as serving large images can take long)")
+	rootCmd.Flags().Duration("http-idle-timeout", 5*time.Minute, "maximum duration to wait for the next request on a keep-alive connection of the cache http servers")
+	rootCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "time to let in-flight requests of the http servers drain on shutdown before closing them forcefully")
+	rootCmd.Flags().String("tls-cert", "", "path to the tls certificate the cache http servers serve https with, checked for changes every 30s such that a rotated certificate is picked up without restart, plain http is served if not set")
+	rootCmd.Flags().String("tls-key", "", "path to the private key of the tls certificate")
 
 	err := viper.BindPFlags(rootCmd.Flags())
 	if err != nil {
 		log.Fatalf("error setup root cmd: %v", err)
 	}
+	err = viper.BindPFlags(rootCmd.PersistentFlags())
+	if err != nil {
+		log.Fatalf("error setup root cmd: %v", err)
+	}
+
+	migrateLayoutCmd.Flags().String("from-layout", layout.Mirror, "layout of the existing cache ("+layout.Mirror+"|"+layout.Flat+")")
+	migrateLayoutCmd.Flags().String("to-layout", layout.Mirror, "layout to migrate the cache to ("+layout.Mirror+"|"+layout.Flat+"), the cache servers only serve the "+layout.Mirror+" layout")
+	migrateLayoutCmd.Flags().String("target-root-path", "", "root path to migrate the cache to, migrates in place if empty")
+
+	err = viper.BindPFlags(migrateLayoutCmd.Flags())
+	if err != nil {
+		log.Fatalf("error setup migrate-layout cmd: %v", err)
+	}
+
+	listCmd.Flags().Bool("json", false, "prints the cached files as json")
+
+	err = viper.BindPFlags(listCmd.Flags())
+	if err != nil {
+		log.Fatalf("error setup list cmd: %v", err)
+	}
+
+	rootCmd.AddCommand(migrateLayoutCmd)
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(verifyCmd)
 }
 
 func initLogging() {
@@ -164,25 +318,38 @@ func run() error {
 		return err
 	}
 
-	mc, err := metalgo.NewDriver(c.MetalAPIEndpoint, "", c.MetalAPIHMAC, metalgo.AuthType("Metal-View"))
+	err = c.Complete()
 	if err != nil {
-		logger.Error("cannot create metal-api client", "error", err)
+		logger.Error("error completing config", "error", err)
 		return err
 	}
 
-	imageCollector := metrics.MustImageMetrics(logger.WithGroup("metrics"), c.GetImageRootPath())
-	kernelCollector := metrics.MustKernelMetrics(logger.WithGroup("metrics"), c.GetKernelRootPath())
-	bootImageCollector := metrics.MustBootImageMetrics(logger.WithGroup("metrics"), c.GetBootImageRootPath())
+	mc, err := newMetalClient(c)
+	if err != nil {
+		logger.Error("cannot create metal client", "error", err)
+		return err
+	}
+
+	imageCollector := metrics.MustImageMetrics(logger.WithGroup("metrics"), fs, c.GetImageRootPath())
+	kernelCollector := metrics.MustKernelMetrics(logger.WithGroup("metrics"), fs, c.GetKernelRootPath())
+	bootImageCollector := metrics.MustBootImageMetrics(logger.WithGroup("metrics"), fs, c.GetBootImageRootPath())
+
+	// the image store is reached through the same proxy as the origins
+	transport := sync.NewHTTPTransport(c)
 
-	dummyRegion := "dummy" // we don't use AWS S3, we don't need a proper region
 	ss, err := session.NewSession(&aws.Config{
 		Endpoint:    &c.ImageStore,
-		Region:      &dummyRegion,
-		Credentials: credentials.AnonymousCredentials,
+		Region:      &c.ImageStoreRegion,
+		Credentials: imageStoreCredentials(c),
+		HTTPClient:  &http.Client{Transport: transport},
+		// the default retryer backs off exponentially and adds jitter to every delay
 		Retryer: client.DefaultRetryer{
-			NumMaxRetries: 3,
-			MinRetryDelay: 10 * time.Second,
+			NumMaxRetries: c.S3MaxRetries,
+			MinRetryDelay: c.S3MinRetryDelay,
 		},
+		// virtual-hosted style puts the bucket name into the host name, bucket names with dots
+		// then do not match the wildcard certificate of the endpoint anymore
+		S3ForcePathStyle: aws.Bool(c.ImageStorePathStyle),
 	})
 	if err != nil {
 		logger.Error("cannot create s3 client", "error", err)
@@ -192,24 +359,71 @@ func run() error {
 	s3Client := s3.New(ss)
 	s3Downloader := s3manager.NewDownloader(ss)
 
-	lister = synclister.NewSyncLister(logger.WithGroup("sync-lister"), mc, s3Client, imageCollector, c, stop)
+	httpClient := sync.NewHTTPClient(c, transport)
+
+	lister = synclister.NewSyncLister(logger.WithGroup("sync-lister"), mc, s3Client, httpClient, imageCollector, c, stop)
 
-	syncer, err = sync.NewSyncer(logger.WithGroup("syncer"), fs, s3Downloader, c, imageCollector, stop)
+	syncer, err = sync.NewSyncer(logger.WithGroup("syncer"), fs, s3Downloader, httpClient, c, imageCollector, stop)
 	if err != nil {
 		logger.Error("cannot create syncer", "error", err)
 		return err
 	}
 
+	syncer.RegisterCollector(c.GetImageRootPath(), imageCollector)
+	syncer.RegisterCollector(c.GetKernelRootPath(), kernelCollector)
+	syncer.RegisterCollector(c.GetBootImageRootPath(), bootImageCollector)
+
+	if c.Once {
+		logger.Info("running single sync", "version", v.V.String())
+		err = runSync(c, nil, imageCollector, kernelCollector, bootImageCollector)
+		if err != nil {
+			logger.Error("error during sync", "error", err)
+			return err
+		}
+		logger.Info("single sync finished successfully")
+		return nil
+	}
+
 	cronjob := cron.New(cron.WithChain(
 		cron.SkipIfStillRunning(utils.NewCronLogger(logger.WithGroup("cron"))),
 	))
 
-	id, err := cronjob.AddFunc(c.SyncSchedule, func() {
-		err := runSync(c)
+	var handlers []cacheFileHandler
+
+	trigger := &syncTrigger{}
+	tracker := &syncTracker{}
+	// readiness is tracked per cache, such that a failing sync of one cache does not keep the others from being ready
+	ready := map[string]*atomic.Bool{
+		c.GetImageRootPath():     {},
+		c.GetKernelRootPath():    {},
+		c.GetBootImageRootPath(): {},
+	}
+	syncAll := func() {
+		tracker.started(time.Now())
+		err := runSync(c, ready, imageCollector, kernelCollector, bootImageCollector)
+		tracker.finished(time.Now(), err)
 		if err != nil {
 			logger.Error("error during sync", "error", err)
 		}
 
+		updateOrphanMetrics(handlers)
+		imageCollector.UpdateCacheSizeUtilization(c.MaxCacheSize)
+	}
+
+	scheduleOffset := scheduleJitterOffset(c.ScheduleJitter)
+	if scheduleOffset > 0 {
+		logger.Info("delaying scheduled syncs by schedule jitter", "offset", scheduleOffset.String())
+	}
+
+	id, err := cronjob.AddFunc(c.SyncSchedule, func() {
+		if !waitScheduleOffset(stop, scheduleOffset) {
+			return
+		}
+
+		if !trigger.Run(syncAll) {
+			logger.Info("sync is already running, skipping scheduled sync")
+		}
+
 		for _, e := range cronjob.Entries() {
 			logger.Info("scheduling next sync", "at", e.Next.String())
 		}
@@ -218,16 +432,63 @@ func run() error {
 		return fmt.Errorf("could not initialize cron schedule:%w", err)
 	}
 
-	handlers := []cacheFileHandler{newCacheFileHandler(c.ImageCacheBindAddress, c.GetImageRootPath(), imageCollector)}
+	nextSync := func() time.Time {
+		next := cronjob.Entry(id).Next
+		if next.IsZero() {
+			return next
+		}
+		return next.Add(scheduleOffset)
+	}
+
+	var proxy *utils.OriginProxy
+	if len(c.ProxyMissPaths) > 0 {
+		origin, err := url.Parse(c.ProxyMissOrigin)
+		if err != nil {
+			return fmt.Errorf("proxy miss origin is invalid:%w", err)
+		}
+		proxy = utils.NewOriginProxy(origin, c.ProxyMissPaths, c.ProxyMissHeaders, utils.NewUserAgentTransport(transport, c.HTTPUserAgent))
+	}
+
+	handlers = []cacheFileHandler{newCacheFileHandler(c.ImageCacheBindAddress, c.GetImageRootPath(), imageCollector, proxy)}
 	if c.KernelCacheEnabled {
-		handlers = append(handlers, newCacheFileHandler(c.KernelCacheBindAddress, c.GetKernelRootPath(), kernelCollector))
+		handlers = append(handlers, newCacheFileHandler(c.KernelCacheBindAddress, c.GetKernelRootPath(), kernelCollector, proxy))
 	}
 	if c.BootImageCacheEnabled {
-		handlers = append(handlers, newCacheFileHandler(c.BootImageCacheBindAddress, c.GetBootImageRootPath(), bootImageCollector))
+		handlers = append(handlers, newCacheFileHandler(c.BootImageCacheBindAddress, c.GetBootImageRootPath(), bootImageCollector, proxy))
+	}
+	var redirectOrigin *url.URL
+	if c.OriginBaseURL != "" {
+		redirectOrigin, err = url.Parse(c.OriginBaseURL)
+		if err != nil {
+			return fmt.Errorf("origin base url is invalid:%w", err)
+		}
+	}
+
+	activity := sync.NewServeActivity(c.ServeActivityWindow, c.ServeActivityThreshold)
+	syncer.SetServeActivity(activity)
+	for i := range handlers {
+		handlers[i].decompress = c.ServeDecompressed
+		handlers[i].activity = activity
+		handlers[i].redirectOrigin = redirectOrigin
+		handlers[i].cacheControl = c.ServedCacheControl
+		handlers[i].ready = ready[handlers[i].serveDir]
 	}
 
 	logger.Info("start metal stack image sync", "version", v.V.String())
 
+	var tlsConfig *tls.Config
+	if c.TLSCert != "" {
+		reloader, err := utils.NewCertReloader(logger.WithGroup("tls"), c.TLSCert, c.TLSKey)
+		if err != nil {
+			return err
+		}
+		go reloader.Watch(stop, tlsCertCheckInterval)
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+
 	var srvs []*http.Server
 	for _, h := range handlers {
 		h := h
@@ -240,31 +501,44 @@ func run() error {
 				logger.Error("health endpoint could not write response body", "error", err)
 			}
 		})
+		router.HandleFunc("/readyz", readyHandler(h.ready, h.serveDir))
+		router.HandleFunc("/orphans", utils.GzipHandler(h.orphans))
+		router.HandleFunc("/manifest.json", utils.GzipHandler(h.manifest))
+		router.HandleFunc("/index.json", utils.GzipHandler(h.index))
+		router.HandleFunc("/savings", utils.GzipHandler(h.savings))
+		router.HandleFunc("/status", utils.GzipHandler(statusHandler(tracker, nextSync, h.collector)))
+		router.HandleFunc("/partitions", utils.GzipHandler(func(w http.ResponseWriter, r *http.Request) {
+			partitions(w, r, c)
+		}))
+		if c.AdminToken != "" && h.serveDir == c.GetImageRootPath() {
+			router.HandleFunc("/sync", syncHandler(trigger, c.AdminToken, syncAll))
+		}
 		router.HandleFunc("/", h.handle)
 
-		srv := http.Server{
-			Addr:              h.bindAddress,
-			Handler:           router,
-			ReadHeaderTimeout: 1 * time.Minute,
-		}
+		for _, addr := range h.bindAddresses {
+			addr := addr
+			srv := newServer(addr, router, c)
+			srv.TLSConfig = tlsConfig
 
-		srvs = append(srvs, &srv)
+			srvs = append(srvs, srv)
 
-		go func() {
-			logger.Info("starting to serve files", "bind-address", h.bindAddress, "directory", h.serveDir)
-			err := srv.ListenAndServe()
-			if err != nil {
-				if errors.Is(err, http.ErrServerClosed) {
-					log.Fatalf("error starting http server, shutting down... %v", err)
+			go func() {
+				logger.Info("starting to serve files", "bind-address", addr, "directory", h.serveDir, "tls", srv.TLSConfig != nil)
+				err := listenAndServe(srv)
+				if err != nil {
+					if !errors.Is(err, http.ErrServerClosed) {
+						log.Fatalf("error starting http server, shutting down... %v", err)
+					}
 				}
-			}
-		}()
-
+			}()
+		}
 	}
 
-	err = runSync(c)
-	if err != nil {
-		logger.Error("error during initial sync", "error", err)
+	if c.AsyncInitialSync {
+		// scheduled syncs are skipped by the trigger while the initial sync is still running
+		trigger.Start(syncAll)
+	} else {
+		trigger.Run(syncAll)
 	}
 	cronjob.Start()
 	logger.Info("scheduling next sync", "at", cronjob.Entry(id).Next.String())
@@ -273,122 +547,978 @@ func run() error {
 	logger.Info("received stop signal, shutting down...")
 	cronjob.Stop()
 
+	shutdownServers(srvs, c.ShutdownTimeout)
+
+	return nil
+
+}
+
+// shutdownServers lets in-flight requests drain before shutting down the given servers, servers still serving
+// requests after the timeout are closed forcefully.
+func shutdownServers(srvs []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
 	for _, srv := range srvs {
+		err := srv.Shutdown(ctx)
+		if err == nil {
+			continue
+		}
+
+		logger.Error("http server did not shut down gracefully, closing", "bind-address", srv.Addr, "error", err)
 		err = srv.Close()
 		if err != nil {
 			logger.Error("error shutting down http server", "error", err)
 		}
 	}
+}
+
+// listenAndServe serves https if the server has a tls config, the certificate is taken from the tls config.
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+func newServer(bindAddr string, handler http.Handler, c *api.Config) *http.Server {
+	return &http.Server{
+		Addr:              bindAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.HTTPReadHeaderTimeout,
+		ReadTimeout:       c.HTTPReadTimeout,
+		WriteTimeout:      c.HTTPWriteTimeout,
+		IdleTimeout:       c.HTTPIdleTimeout,
+	}
+}
+
+func migrateLayout() error {
+	fs := afero.NewOsFs()
+
+	from, err := layout.New(viper.GetString("from-layout"))
+	if err != nil {
+		return err
+	}
+	to, err := layout.New(viper.GetString("to-layout"))
+	if err != nil {
+		return err
+	}
+
+	if viper.GetString("from-layout") == viper.GetString("to-layout") && viper.GetString("target-root-path") == "" {
+		logger.Info("cache already has the requested layout, nothing to migrate", "layout", viper.GetString("to-layout"))
+		return nil
+	}
+	if viper.GetString("to-layout") != layout.Mirror {
+		return fmt.Errorf("the cache servers only serve the %s layout, refusing to migrate to %s", layout.Mirror, viper.GetString("to-layout"))
+	}
+
+	source := &api.Config{CacheRootPath: viper.GetString("cache-root-path")}
+	target := source
+	if viper.GetString("target-root-path") != "" {
+		target = &api.Config{CacheRootPath: viper.GetString("target-root-path")}
+	}
+
+	for _, roots := range [][]string{
+		{source.GetImageRootPath(), target.GetImageRootPath()},
+		{source.GetKernelRootPath(), target.GetKernelRootPath()},
+		{source.GetBootImageRootPath(), target.GetBootImageRootPath()},
+	} {
+		exists, err := afero.DirExists(fs, roots[0])
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		err = layout.Migrate(logger.WithGroup("migrate-layout"), fs, roots[0], roots[1], from, to)
+		if err != nil {
+			return fmt.Errorf("error migrating %s:%w", roots[0], err)
+		}
+	}
+
+	logger.Info("successfully migrated cache layout", "from", viper.GetString("from-layout"), "to", viper.GetString("to-layout"))
 
 	return nil
+}
+
+// cacheListEntry is a file in the cache as printed by the list command.
+type cacheListEntry struct {
+	Kind    string `json:"kind"`
+	SubPath string `json:"subpath"`
+	Size    int64  `json:"size"`
+}
+
+// cachedFile is a file in one of the caches below the cache root path.
+type cachedFile struct {
+	kind     string
+	rootPath string
+	entity   api.CacheEntry
+}
+
+// cachedFiles returns the files of the image, kernel and boot image caches in the given cache root path.
+func cachedFiles(fs afero.Fs, cacheRootPath string) ([]cachedFile, error) {
+	c := &api.Config{CacheRootPath: cacheRootPath}
+
+	var result []cachedFile
+	for _, root := range []struct {
+		kind string
+		path string
+	}{
+		{kind: "image", path: c.GetImageRootPath()},
+		{kind: "kernel", path: c.GetKernelRootPath()},
+		{kind: "boot-image", path: c.GetBootImageRootPath()},
+	} {
+		exists, err := afero.DirExists(fs, root.path)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		files, err := sync.FileIndex(logger, fs, root.path)
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s:%w", root.path, err)
+		}
+
+		for _, f := range files {
+			result = append(result, cachedFile{kind: root.kind, rootPath: root.path, entity: f})
+		}
+	}
+
+	return result, nil
+}
+
+// listCache prints the files cached in the given cache root path grouped by images, kernels and boot images.
+func listCache(w io.Writer, cacheRootPath string, asJSON bool) error {
+	files, err := cachedFiles(afero.NewOsFs(), cacheRootPath)
+	if err != nil {
+		return err
+	}
+
+	entries := []cacheListEntry{}
+	for _, f := range files {
+		entries = append(entries, cacheListEntry{Kind: f.kind, SubPath: f.entity.GetSubPath(), Size: f.entity.GetSize()})
+	}
+
+	if asJSON {
+		return json.NewEncoder(w).Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tPATH\tSIZE")
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Kind, e.SubPath, units.BytesSize(float64(e.Size)))
+	}
+	fmt.Fprintf(tw, "\t%d files\t%s\n", len(entries), units.BytesSize(float64(total)))
 
+	return tw.Flush()
+}
+
+// verifyCache recalculates the checksums of all files cached in the given cache root path and compares them
+// to their md5 files, or their sha256 files if there is no md5 file. files without checksum file are skipped.
+// returns an error if any file does not match.
+func verifyCache(w io.Writer, cacheRootPath string) error {
+	fs := afero.NewOsFs()
+
+	files, err := cachedFiles(fs, cacheRootPath)
+	if err != nil {
+		return err
+	}
+
+	var passed, failed, skipped int
+	for _, f := range files {
+		p := filepath.Join(f.rootPath, f.entity.GetSubPath())
+
+		hashFile := utils.FileMD5
+		expected, ok := sync.SidecarMD5(fs, p)
+		if !ok {
+			hashFile = utils.FileSHA256
+			expected, ok = sync.SidecarSHA256(fs, p)
+		}
+		if !ok {
+			skipped++
+			fmt.Fprintf(w, "SKIP %s (no checksum file)\n", p)
+			continue
+		}
+
+		checksum, err := hashFile(fs, p)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s (%s)\n", p, err)
+			continue
+		}
+
+		if checksum != expected {
+			failed++
+			fmt.Fprintf(w, "FAIL %s (expected %s, got %s)\n", p, expected, checksum)
+			continue
+		}
+
+		passed++
+		fmt.Fprintf(w, "PASS %s\n", p)
+	}
+
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+
+	if failed > 0 {
+		return fmt.Errorf("%d cached files do not match their checksum", failed)
+	}
+
+	return nil
 }
 
 type cacheFileHandler struct {
 	serveDir     string
 	serveHandler http.Handler
 	collector    metrics.DownloadCollector
-	bindAddress  string
+	// bindAddresses are the addresses a http server is started on, all of them share this handler
+	bindAddresses []string
+	proxy         *utils.OriginProxy
+	decompress    bool
+	activity      *sync.ServeActivity
+	// redirectOrigin is the origin cache misses are redirected to, the requested host is used if nil
+	redirectOrigin *url.URL
+	cacheControl   string
+	// ready is set once the cache has content to serve, see readyHandler
+	ready *atomic.Bool
 }
 
-func newCacheFileHandler(bindAddr, serveDir string, collector metrics.DownloadCollector) cacheFileHandler {
+func newCacheFileHandler(bindAddr, serveDir string, collector metrics.DownloadCollector, proxy *utils.OriginProxy) cacheFileHandler {
 	return cacheFileHandler{
-		serveDir:     serveDir,
-		serveHandler: http.FileServer(http.Dir(serveDir)),
-		collector:    collector,
-		bindAddress:  bindAddr,
+		serveDir:      serveDir,
+		serveHandler:  http.FileServer(http.Dir(serveDir)),
+		collector:     collector,
+		bindAddresses: api.BindAddresses(bindAddr),
+		proxy:         proxy,
+	}
+}
+
+// serveDecompressed streams a cached compressed file decompressed if the file was requested without its compression suffix,
+// the decompressed copy is not persisted.
+func (c *cacheFileHandler) serveDecompressed(w http.ResponseWriter, r *http.Request, subPath, id string) bool {
+	if !c.decompress || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	p := filepath.Join(c.serveDir, filepath.FromSlash(subPath))
+	if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+
+	for _, suffix := range utils.CompressionSuffixes {
+		f, err := os.Open(p + suffix)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		c.setCacheControl(w, subPath)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return true
+		}
+
+		d, err := utils.NewDecompressor(f, suffix)
+		if err != nil {
+			logger.Error("unable to decompress cached file", "path", p+suffix, "error", err, "request-id", id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return true
+		}
+		defer d.Close()
+
+		logger.Info("serving cached file decompressed", "url", r.URL.String(), "from", p+suffix, "request-id", id)
+
+		w.WriteHeader(http.StatusOK)
+		n, err := io.Copy(w, d)
+		if err != nil {
+			logger.Error("error serving decompressed file", "path", p+suffix, "error", err, "request-id", id)
+		}
+
+		c.collector.IncrementDownloads()
+		c.collector.AddServedBytes(n)
+
+		return true
+	}
+
+	return false
+}
+
+// setCacheControl sets the configured cache-control header, files served through a latest link change with every
+// new version and have to be revalidated.
+func (c *cacheFileHandler) setCacheControl(w http.ResponseWriter, subPath string) {
+	if c.cacheControl == "" {
+		return
+	}
+
+	if utils.IsLatestPath(subPath) {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+
+	w.Header().Set("Cache-Control", c.cacheControl)
+}
+
+// proxyMiss streams the requested file from the origin if it is not cached and misses of the path are configured to be proxied.
+func (c *cacheFileHandler) proxyMiss(w http.ResponseWriter, r *http.Request, subPath, id string) bool {
+	if c.proxy == nil || !c.proxy.Matches(r.URL.Path) {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(c.serveDir, filepath.FromSlash(subPath)))
+	if !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+
+	logger.Info("cache miss, proxying request to origin", "url", r.URL.String(), "request-id", id)
+	c.collector.IncrementCacheMiss()
+	if syncer != nil {
+		syncer.RecordMiss(c.serveDir, subPath, id)
 	}
+
+	c.proxy.ServeHTTP(w, r)
+
+	return true
 }
 
 func (c *cacheFileHandler) handle(w http.ResponseWriter, r *http.Request) {
-	logger.Info("serving cache download request", "url", r.URL.String(), "from", r.RemoteAddr)
-	hw := utils.NewHTTPRedirectResponseWriter(w, r)
+	id := requestID(r)
+	subPath := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	w.Header().Set(requestIDHeader, id)
+
+	if c.activity != nil {
+		c.activity.Record()
+	}
+
+	logger.Info("serving cache download request", "url", r.URL.String(), "from", r.RemoteAddr, "request-id", id)
+
+	if c.serveDecompressed(w, r, subPath, id) {
+		return
+	}
+
+	if c.proxyMiss(w, r, subPath, id) {
+		return
+	}
+
+	if utils.IsMetadataFile(subPath) {
+		utils.GzipHandler(func(w http.ResponseWriter, r *http.Request) {
+			c.serveFile(w, r, subPath, id)
+		})(w, r)
+		return
+	}
+
+	c.serveFile(w, r, subPath, id)
+}
+
+// serveFile serves the requested file from the cache directory or redirects to the origin on a cache miss.
+func (c *cacheFileHandler) serveFile(w http.ResponseWriter, r *http.Request, subPath, id string) {
+	// cached files are immutable as their path contains the version, misses are redirected and must not be cached
+	if fi, err := os.Stat(filepath.Join(c.serveDir, filepath.FromSlash(subPath))); err == nil && fi.Mode().IsRegular() {
+		c.setCacheControl(w, subPath)
+	}
+
+	hw := utils.NewHTTPRedirectResponseWriter(w, r, c.redirectOrigin)
 	c.serveHandler.ServeHTTP(hw, r)
 	switch code := hw.GetStatus(); code {
 	case http.StatusTemporaryRedirect:
-		logger.Info("cache miss", "url", r.URL.String())
+		logger.Info("cache miss", "url", r.URL.String(), "request-id", id)
 		c.collector.IncrementCacheMiss()
-	case http.StatusOK:
+		if syncer != nil {
+			syncer.RecordMiss(c.serveDir, subPath, id)
+		}
+	case http.StatusOK, http.StatusPartialContent:
+		// range requests are used by clients to resume interrupted downloads, they count as downloads as well
 		c.collector.IncrementDownloads()
+		c.collector.AddServedBytes(hw.GetWritten())
 	case 0:
 		// occurs when just visting directories through browser, swallow
 	default:
-		logger.Info("responded with error code for download", "url", r.URL.String(), "code", code)
+		logger.Info("responded with error code for download", "url", r.URL.String(), "code", code, "request-id", id)
 	}
 }
 
-func runSync(c *api.Config) error {
-	var errs []error
+// newMetalClient returns the client listing images and partitions from the metal-api.
+func newMetalClient(c *api.Config) (synclister.MetalClient, error) {
+	driver, err := metalgo.NewDriver(c.MetalAPIEndpoint, "", c.MetalAPIHMAC, metalgo.AuthType("Metal-View"))
+	if err != nil {
+		return nil, err
+	}
+	return synclister.NewMetalAPIClient(driver), nil
+}
+
+// requestID returns the id of the request provided by the client or generates a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+type cacheEntry struct {
+	Name    string `json:"name"`
+	SubPath string `json:"subpath"`
+	Size    int64  `json:"size"`
+}
+
+func (c *cacheFileHandler) orphans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-	err := func() error {
-		syncImages, err := lister.DetermineImageSyncList()
+	orphans, err := syncer.Orphans(c.serveDir)
+	if err != nil {
+		logger.Error("error determining orphaned files", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	result := []cacheEntry{}
+	for _, e := range orphans {
+		result = append(result, cacheEntry{
+			Name:    e.GetName(),
+			SubPath: e.GetSubPath(),
+			Size:    e.GetSize(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		logger.Error("orphans endpoint could not write response body", "error", err)
+	}
+}
+
+func updateOrphanMetrics(handlers []cacheFileHandler) {
+	for _, h := range handlers {
+		orphans, err := syncer.Orphans(h.serveDir)
 		if err != nil {
-			return fmt.Errorf("cannot gather images:%w", err)
+			logger.Error("error determining orphaned files", "directory", h.serveDir, "error", err)
+			continue
 		}
 
-		var converted api.CacheEntities
-		for _, s := range syncImages {
-			converted = append(converted, s)
+		var size int64
+		for _, e := range orphans {
+			size += e.GetSize()
 		}
 
-		err = syncer.Sync(c.GetImageRootPath(), converted)
-		if err != nil {
-			return fmt.Errorf("error during image sync:%w", err)
-		}
+		h.collector.SetOrphans(len(orphans), size)
+	}
+}
 
-		return nil
-	}()
+// determinePeerSyncList lists the files of a peer cache, the peer is expected to serve on the same port as the given bind address.
+func determinePeerSyncList(replicateFrom string, bindAddress string) (api.CacheEntities, error) {
+	u, err := url.Parse(replicateFrom)
 	if err != nil {
-		errs = append(errs, err)
+		return nil, fmt.Errorf("replication url is invalid:%w", err)
 	}
 
-	err = func() error {
-		syncKernels, err := lister.DetermineKernelSyncList()
-		if err != nil {
-			return fmt.Errorf("cannot kernel images:%w", err)
+	// peers listen on the same ports, so the port of the first bind address is used
+	addrs := api.BindAddresses(bindAddress)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("bind address must be set")
+	}
+
+	_, port, err := net.SplitHostPort(addrs[0])
+	if err != nil {
+		return nil, fmt.Errorf("bind address is invalid:%w", err)
+	}
+
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+
+	files, err := lister.DeterminePeerSyncList(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var result api.CacheEntities
+	for _, f := range files {
+		result = append(result, f)
+	}
+
+	return result, nil
+}
+
+// partitions reports whether the boot artifacts of every partition are cached.
+func partitions(w http.ResponseWriter, r *http.Request, c *api.Config) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	artifacts, err := lister.DeterminePartitionBootArtifacts()
+	if err != nil {
+		logger.Error("error determining partition boot artifacts", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(partitionReadiness(artifacts, c.GetKernelRootPath(), c.GetBootImageRootPath()))
+	if err != nil {
+		logger.Error("partitions endpoint could not write response body", "error", err)
+	}
+}
+
+func partitionReadiness(artifacts []api.PartitionBootArtifacts, kernelRoot, bootImageRoot string) map[string]api.PartitionReadiness {
+	result := map[string]api.PartitionReadiness{}
+	for _, a := range artifacts {
+		result[a.ID] = api.PartitionReadiness{
+			Kernel:    syncer.ArtifactStatus(kernelRoot, a.KernelSubPath),
+			BootImage: syncer.ArtifactStatus(bootImageRoot, a.BootImageSubPath),
 		}
+	}
+	return result
+}
+
+func (c *cacheFileHandler) savings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(c.collector.Savings())
+	if err != nil {
+		logger.Error("savings endpoint could not write response body", "error", err)
+	}
+}
+
+func (c *cacheFileHandler) manifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	manifest, err := syncer.Manifest(c.serveDir)
+	if err != nil {
+		logger.Error("error creating manifest", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(manifest)
+	if err != nil {
+		logger.Error("manifest endpoint could not write response body", "error", err)
+	}
+}
+
+func (c *cacheFileHandler) index(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-		var converted api.CacheEntities
-		for _, s := range syncKernels {
-			converted = append(converted, s)
+	index, err := syncer.Index(c.serveDir)
+	if err != nil {
+		logger.Error("error creating index", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(index)
+	if err != nil {
+		logger.Error("index endpoint could not write response body", "error", err)
+	}
+}
+
+// scheduleJitterOffset returns a random offset between zero and the given jitter.
+func scheduleJitterOffset(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return mathrand.N(jitter + 1)
+}
+
+// waitScheduleOffset delays a scheduled sync by the given offset, returns false if stopped while waiting.
+func waitScheduleOffset(ctx context.Context, offset time.Duration) bool {
+	if offset <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(offset)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// runSync runs the sync of all caches, the readiness of a cache is set once it has content to serve. the readiness
+// is not tracked if ready is nil.
+func runSync(c *api.Config, ready map[string]*atomic.Bool, imageCollector, kernelCollector, bootImageCollector metrics.DownloadCollector) error {
+	// with a total cache size all sync lists are required to reduce them together, they are determined by the first phase
+	// such that a failing lister is reported by the phases
+	var lists *synclister.SyncLists
+	totalCacheSize := c.MaxTotalCacheSize > 0 && c.ReplicateFrom == ""
+	syncLists := func() *synclister.SyncLists {
+		if lists == nil {
+			lists = lister.DetermineSyncLists()
 		}
+		return lists
+	}
+
+	return runPhases([]syncPhase{
+		{
+			name:      "image",
+			rootPath:  c.GetImageRootPath(),
+			ready:     ready[c.GetImageRootPath()],
+			collector: imageCollector,
+			run: func() error {
+				var converted api.CacheEntities
+				if c.ReplicateFrom != "" {
+					peerFiles, err := determinePeerSyncList(c.ReplicateFrom, c.ImageCacheBindAddress)
+					if err != nil {
+						return fmt.Errorf("cannot gather files from peer:%w", err)
+					}
+					converted = peerFiles
+				} else if totalCacheSize {
+					l := syncLists()
+					if l.ImagesErr != nil {
+						return l.ImagesErr
+					}
+					for _, s := range l.Images {
+						converted = append(converted, s)
+					}
+				} else {
+					syncImages, err := lister.DetermineImageSyncList()
+					if err != nil {
+						return fmt.Errorf("cannot gather images:%w", err)
+					}
+
+					for _, s := range syncImages {
+						converted = append(converted, s)
+					}
+				}
+
+				err := syncer.Sync(c.GetImageRootPath(), converted)
+				if err != nil {
+					return fmt.Errorf("error during image sync:%w", err)
+				}
+
+				return nil
+			},
+		},
+		{
+			name:      "kernel",
+			rootPath:  c.GetKernelRootPath(),
+			ready:     ready[c.GetKernelRootPath()],
+			collector: kernelCollector,
+			run: func() error {
+				var converted api.CacheEntities
+				if c.ReplicateFrom != "" {
+					peerFiles, err := determinePeerSyncList(c.ReplicateFrom, c.KernelCacheBindAddress)
+					if err != nil {
+						return fmt.Errorf("cannot gather files from peer:%w", err)
+					}
+					converted = peerFiles
+				} else if totalCacheSize {
+					l := syncLists()
+					if l.KernelsErr != nil {
+						return l.KernelsErr
+					}
+					for _, s := range l.Kernels {
+						converted = append(converted, s)
+					}
+				} else {
+					syncKernels, err := lister.DetermineKernelSyncList()
+					if err != nil {
+						return fmt.Errorf("cannot kernel images:%w", err)
+					}
+
+					for _, s := range syncKernels {
+						converted = append(converted, s)
+					}
+				}
+
+				err := syncer.Sync(c.GetKernelRootPath(), converted)
+				if err != nil {
+					return fmt.Errorf("error during kernel sync:%w", err)
+				}
+
+				return nil
+			},
+		},
+		{
+			name:      "boot image",
+			rootPath:  c.GetBootImageRootPath(),
+			ready:     ready[c.GetBootImageRootPath()],
+			collector: bootImageCollector,
+			run: func() error {
+				var converted api.CacheEntities
+				if c.ReplicateFrom != "" {
+					peerFiles, err := determinePeerSyncList(c.ReplicateFrom, c.BootImageCacheBindAddress)
+					if err != nil {
+						return fmt.Errorf("cannot gather files from peer:%w", err)
+					}
+					converted = peerFiles
+				} else if totalCacheSize {
+					l := syncLists()
+					if l.BootImagesErr != nil {
+						return l.BootImagesErr
+					}
+					for _, s := range l.BootImages {
+						converted = append(converted, s)
+					}
+				} else {
+					syncImages, err := lister.DetermineBootImageSyncList()
+					if err != nil {
+						return fmt.Errorf("cannot gather boot images:%w", err)
+					}
+
+					for _, s := range syncImages {
+						converted = append(converted, s)
+					}
+				}
+
+				err := syncer.Sync(c.GetBootImageRootPath(), converted)
+				if err != nil {
+					return fmt.Errorf("error during boot image sync:%w", err)
+				}
+
+				return nil
+			},
+		},
+	})
+}
 
-		err = syncer.Sync(c.GetKernelRootPath(), converted)
+// syncPhase is the sync of a single cache, phases are independent of each other such that a failing phase
+// does not prevent the remaining phases from running.
+type syncPhase struct {
+	name      string
+	rootPath  string
+	collector metrics.DownloadCollector
+	// ready is the readiness of the cache synced by this phase, not tracked if nil
+	ready *atomic.Bool
+	run   func() error
+}
+
+func runPhases(phases []syncPhase) error {
+	var errs []error
+	for _, p := range phases {
+		start := time.Now()
+		err := runPhase(p)
+		observeSync(p.collector, start, err)
+		markReady(p, err)
 		if err != nil {
-			return fmt.Errorf("error during kernel sync:%w", err)
+			errs = append(errs, err)
 		}
+	}
 
-		return nil
+	if len(errs) > 0 {
+		return fmt.Errorf("errors occurred during sync: %v", errs)
+	}
+
+	return nil
+}
+
+// markReady marks the cache of a sync phase as ready once the phase succeeded or the sync downloaded content into it
+// before, such that a cache with valid content is served even if its sync keeps failing.
+func markReady(p syncPhase, err error) {
+	if p.ready == nil {
+		return
+	}
+
+	if err == nil || syncer.HasSyncedContent(p.rootPath) {
+		p.ready.Store(true)
+	}
+}
+
+// runPhase runs a sync phase and recovers from panics, e.g. caused by a malformed entity, such that the remaining
+// phases still run.
+func runPhase(p syncPhase) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("recovered from panic during sync", "phase", p.name, "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic during %s sync: %v", p.name, r)
+		}
 	}()
+
+	return p.run()
+}
+
+// observeSync records the duration and the result of a sync phase and, if it completed without error, the time of completion.
+func observeSync(collector metrics.DownloadCollector, start time.Time, err error) {
+	now := time.Now()
+	collector.ObserveSyncDuration(now.Sub(start))
+	collector.IncrementSyncs(err == nil)
+	if err == nil {
+		collector.SetLastSyncTime(now)
+	}
+}
+
+// imageStoreCredentials returns static credentials if configured, anonymous credentials otherwise.
+func imageStoreCredentials(c *api.Config) *credentials.Credentials {
+	if c.ImageStoreAccessKey != "" && c.ImageStoreSecretKey != "" {
+		return credentials.NewStaticCredentials(c.ImageStoreAccessKey, c.ImageStoreSecretKey, "")
+	}
+	return credentials.AnonymousCredentials
+}
+
+// syncTrigger ensures that only a single sync runs at a time, regardless of whether it was started
+// by the cron schedule or triggered manually.
+type syncTrigger struct {
+	running atomic.Bool
+}
+
+// Run runs the given sync and blocks until it is finished, returns false if another sync is already running.
+func (t *syncTrigger) Run(fn func()) bool {
+	if !t.running.CompareAndSwap(false, true) {
+		return false
+	}
+	defer t.running.Store(false)
+
+	fn()
+	return true
+}
+
+// Start runs the given sync in the background, returns false if another sync is already running.
+func (t *syncTrigger) Start(fn func()) bool {
+	if !t.running.CompareAndSwap(false, true) {
+		return false
+	}
+
+	go func() {
+		defer t.running.Store(false)
+		fn()
+	}()
+	return true
+}
+
+// syncStatus is the state of the syncs reported by the status endpoint.
+type syncStatus struct {
+	LastSyncStart *time.Time `json:"last_sync_start,omitempty"`
+	LastSyncEnd   *time.Time `json:"last_sync_end,omitempty"`
+	// LastSyncResult is either ok or error, empty if no sync finished yet
+	LastSyncResult string             `json:"last_sync_result,omitempty"`
+	LastSyncError  string             `json:"last_sync_error,omitempty"`
+	NextSync       *time.Time         `json:"next_sync,omitempty"`
+	Cache          metrics.CacheStats `json:"cache"`
+}
+
+// syncTracker records the start and the result of the last sync for the status endpoint.
+type syncTracker struct {
+	last atomic.Pointer[syncStatus]
+}
+
+func (t *syncTracker) started(at time.Time) {
+	status := t.status()
+	status.LastSyncStart = &at
+	t.last.Store(&status)
+}
+
+func (t *syncTracker) finished(at time.Time, err error) {
+	status := t.status()
+	status.LastSyncEnd = &at
+	status.LastSyncResult = "ok"
+	status.LastSyncError = ""
 	if err != nil {
-		errs = append(errs, err)
+		status.LastSyncResult = "error"
+		status.LastSyncError = err.Error()
 	}
+	t.last.Store(&status)
+}
 
-	err = func() error {
-		syncImages, err := lister.DetermineBootImageSyncList()
-		if err != nil {
-			return fmt.Errorf("cannot gather boot images:%w", err)
+// status returns a copy of the recorded sync status.
+func (t *syncTracker) status() syncStatus {
+	if last := t.last.Load(); last != nil {
+		return *last
+	}
+	return syncStatus{}
+}
+
+// statusHandler reports the last sync, the next scheduled sync and the stats of the cache of the collector.
+func statusHandler(tracker *syncTracker, nextSync func() time.Time, collector metrics.DownloadCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
 		}
 
-		var converted api.CacheEntities
-		for _, s := range syncImages {
-			converted = append(converted, s)
+		status := tracker.status()
+		if next := nextSync(); !next.IsZero() {
+			status.NextSync = &next
 		}
+		status.Cache = collector.CacheStats()
 
-		err = syncer.Sync(c.GetBootImageRootPath(), converted)
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(status)
 		if err != nil {
-			return fmt.Errorf("error during boot image sync:%w", err)
+			logger.Error("status endpoint could not write response body", "error", err)
 		}
+	}
+}
 
-		return nil
-	}()
-	if err != nil {
-		errs = append(errs, err)
+// syncHandler triggers a sync on POST requests authorized with the given bearer token.
+func syncHandler(trigger *syncTrigger, token string, fn func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !trigger.Start(fn) {
+			logger.Info("sync is already running, rejecting triggered sync", "request-id", requestID(r))
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		logger.Info("sync triggered manually", "request-id", requestID(r))
+		w.WriteHeader(http.StatusAccepted)
 	}
+}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("errors occurred during sync: %v", errs)
+// readyHandler reports ready once the served cache has content to serve and the served directory contains files,
+// in contrast to the health endpoint which only reports that the server is up.
+func readyHandler(ready *atomic.Bool, serveDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ready == nil || !ready.Load() || !containsFiles(serveDir) {
+			http.Error(w, "NOT READY", http.StatusServiceUnavailable)
+			return
+		}
+
+		_, err := w.Write([]byte("READY"))
+		if err != nil {
+			logger.Error("readiness endpoint could not write response body", "error", err)
+		}
 	}
+}
 
-	return nil
+// containsFiles returns true if the given directory or one of its sub directories contains a regular file.
+func containsFiles(dir string) bool {
+	found := false
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			found = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return found
 }
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/klauspost/compress/zstd"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/metrics"
+	"github.com/metal-stack/metal-image-cache-sync/cmd/internal/sync"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/api"
+	"github.com/metal-stack/metal-image-cache-sync/pkg/utils"
+	"github.com/pierrec/lz4/v4"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newServer(t *testing.T) {
+	handler := http.NewServeMux()
+	c := &api.Config{
+		HTTPReadHeaderTimeout: 1 * time.Minute,
+		HTTPReadTimeout:       2 * time.Minute,
+		HTTPWriteTimeout:      0,
+		HTTPIdleTimeout:       5 * time.Minute,
+	}
+
+	srv := newServer("0.0.0.0:3000", handler, c)
+
+	assert.Equal(t, "0.0.0.0:3000", srv.Addr)
+	assert.Equal(t, handler, srv.Handler)
+	assert.Equal(t, 1*time.Minute, srv.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Minute, srv.ReadTimeout)
+	assert.Equal(t, time.Duration(0), srv.WriteTimeout)
+	assert.Equal(t, 5*time.Minute, srv.IdleTimeout)
+}
+
+func Test_cacheFileHandler_requestID(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "kernel"), []byte("Test"), 0644))
+
+	var buf bytes.Buffer
+	logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	h := newCacheFileHandler("", dir, metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir), nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/kernel", nil)
+	r.Header.Set(requestIDHeader, "a-request-id")
+	w := httptest.NewRecorder()
+
+	h.handle(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a-request-id", w.Header().Get(requestIDHeader))
+
+	var entry struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request-id"`
+	}
+	require.NoError(t, json.Unmarshal(bytes.Split(buf.Bytes(), []byte("\n"))[0], &entry))
+	assert.Equal(t, "serving cache download request", entry.Msg)
+	assert.Equal(t, "a-request-id", entry.RequestID)
+
+	buf.Reset()
+	w = httptest.NewRecorder()
+	h.handle(w, httptest.NewRequest(http.MethodGet, "/kernel", nil))
+
+	generated := w.Header().Get(requestIDHeader)
+	assert.Len(t, generated, 32)
+	assert.Contains(t, buf.String(), generated)
+}
+
+func Test_cacheFileHandler_proxyMiss(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		// proxied requests are sent through the transport of the sync
+		if r.Header.Get("User-Agent") != "metal-image-cache-sync/test" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("from origin " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "private"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "private", "cached"), []byte("Test"), 0644))
+
+	logger = slog.Default()
+
+	transport := utils.NewUserAgentTransport(http.DefaultTransport, "metal-image-cache-sync/test")
+	proxy := utils.NewOriginProxy(originURL, []string{"/private/"}, map[string]string{"Authorization": "Bearer secret"}, transport)
+	h := newCacheFileHandler("", dir, metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir), proxy)
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "miss on proxied path is streamed from origin with credentials",
+			path:     "/private/kernel",
+			wantCode: http.StatusOK,
+			wantBody: "from origin /private/kernel",
+		},
+		{
+			name:     "hit on proxied path is served from cache",
+			path:     "/private/cached",
+			wantCode: http.StatusOK,
+			wantBody: "Test",
+		},
+		{
+			name:     "miss on other path is redirected",
+			path:     "/public/kernel",
+			wantCode: http.StatusTemporaryRedirect,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.handle(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_cacheFileHandler_redirectMiss(t *testing.T) {
+	dir := t.TempDir()
+
+	logger = slog.Default()
+
+	tests := []struct {
+		name         string
+		origin       string
+		wantLocation string
+	}{
+		{
+			name:         "miss is redirected to the requested host",
+			wantLocation: "https://cache.internal/images/ubuntu/20.04/img.tar.lz4?x=1",
+		},
+		{
+			name:         "miss is redirected to the origin",
+			origin:       "https://images.metal-stack.io",
+			wantLocation: "https://images.metal-stack.io/images/ubuntu/20.04/img.tar.lz4?x=1",
+		},
+		{
+			name:         "miss is redirected to the origin with base path",
+			origin:       "https://mirror.example.com/metal/",
+			wantLocation: "https://mirror.example.com/metal/images/ubuntu/20.04/img.tar.lz4?x=1",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCacheFileHandler("", dir, metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir), nil)
+			if tt.origin != "" {
+				origin, err := url.Parse(tt.origin)
+				require.NoError(t, err)
+				h.redirectOrigin = origin
+			}
+
+			w := httptest.NewRecorder()
+			h.handle(w, httptest.NewRequest(http.MethodGet, "http://cache.internal/images/ubuntu/20.04/img.tar.lz4?x=1", nil))
+
+			assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+			assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+		})
+	}
+}
+
+func Test_cacheFileHandler_gzipMetadata(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "img.tar.lz4"), []byte("image"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "img.tar.lz4.md5"), []byte("0cbc6611f5540bd0809a388dc95a615b"), 0644))
+
+	logger = slog.Default()
+
+	h := newCacheFileHandler("", dir, metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir), nil)
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+		wantBody       string
+	}{
+		{
+			name:           "checksum is compressed",
+			path:           "/img.tar.lz4.md5",
+			acceptEncoding: "deflate, gzip;q=0.8",
+			wantGzip:       true,
+			wantBody:       "0cbc6611f5540bd0809a388dc95a615b",
+		},
+		{
+			name:     "checksum is not compressed if not accepted",
+			path:     "/img.tar.lz4.md5",
+			wantBody: "0cbc6611f5540bd0809a388dc95a615b",
+		},
+		{
+			name:           "image is never compressed",
+			path:           "/img.tar.lz4",
+			acceptEncoding: "gzip",
+			wantBody:       "image",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+
+			h.handle(w, r)
+
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var body io.Reader = w.Body
+			if tt.wantGzip {
+				assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+				assert.Empty(t, w.Header().Get("Content-Length"))
+				gz, err := gzip.NewReader(w.Body)
+				require.NoError(t, err)
+				body = gz
+			} else {
+				assert.Empty(t, w.Header().Get("Content-Encoding"))
+			}
+
+			got, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantBody, string(got))
+		})
+	}
+}
+
+func Test_cacheFileHandler_cacheControl(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "kernel"), []byte("Test"), 0644))
+	require.NoError(t, os.MkdirAll(path.Join(dir, "ubuntu", "20.04", "latest"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "ubuntu", "20.04", "latest", "img.tar.lz4"), []byte("Test"), 0644))
+
+	logger = slog.Default()
+
+	h := newCacheFileHandler("", dir, metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir), nil)
+	h.cacheControl = "public, max-age=86400, immutable"
+
+	w := httptest.NewRecorder()
+	h.handle(w, httptest.NewRequest(http.MethodGet, "/kernel", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=86400, immutable", w.Header().Get("Cache-Control"))
+
+	// the file behind a latest link changes with every new version
+	w = httptest.NewRecorder()
+	h.handle(w, httptest.NewRequest(http.MethodGet, "/ubuntu/20.04/latest/img.tar.lz4", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	w = httptest.NewRecorder()
+	h.handle(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+}
+
+func Test_cacheFileHandler_savings(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "kernel"), []byte("Test"), 0644))
+
+	logger = slog.Default()
+
+	collector := metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir)
+	collector.AddSyncDownloadBytes(4)
+
+	h := newCacheFileHandler("", dir, collector, nil)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.handle(w, httptest.NewRequest(http.MethodGet, "/kernel", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// cache misses are redirected and must not count as served bytes
+	w := httptest.NewRecorder()
+	h.handle(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	w = httptest.NewRecorder()
+	h.savings(w, httptest.NewRequest(http.MethodGet, "/savings", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var got metrics.Savings
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, metrics.Savings{Served: 12, Downloaded: 4, Saved: 8}, got)
+}
+
+func Test_cacheFileHandler_rangeRequest(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "kernel"), []byte("Test"), 0644))
+
+	logger = slog.Default()
+
+	collector := metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir)
+	h := newCacheFileHandler("", dir, collector, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/kernel", nil)
+	r.Header.Set("Range", "bytes=1-2")
+	w := httptest.NewRecorder()
+	h.handle(w, r)
+
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "es", w.Body.String())
+	assert.Equal(t, "bytes 1-2/4", w.Header().Get("Content-Range"))
+	assert.Equal(t, int64(2), collector.Savings().Served)
+
+	families, err := collector.GetGatherer().Gather()
+	require.NoError(t, err)
+	var downloads float64
+	for _, f := range families {
+		if f.GetName() == "cache_downloads" {
+			downloads = f.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, float64(1), downloads)
+}
+
+func Test_cacheFileHandler_serveDecompressed(t *testing.T) {
+	content := bytes.Repeat([]byte("metal-stack "), 1000)
+
+	dir := t.TempDir()
+
+	var lz4Buf bytes.Buffer
+	lw := lz4.NewWriter(&lz4Buf)
+	_, err := lw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, lw.Close())
+	require.NoError(t, os.WriteFile(path.Join(dir, "img.tar.lz4"), lz4Buf.Bytes(), 0644))
+
+	var zstBuf bytes.Buffer
+	zw, err := zstd.NewWriter(&zstBuf)
+	require.NoError(t, err)
+	_, err = zw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(path.Join(dir, "kernel.zst"), zstBuf.Bytes(), 0644))
+
+	logger = slog.Default()
+
+	tests := []struct {
+		name       string
+		path       string
+		decompress bool
+		wantCode   int
+		wantBody   []byte
+	}{
+		{
+			name:       "lz4 compressed file is served decompressed",
+			path:       "/img.tar",
+			decompress: true,
+			wantCode:   http.StatusOK,
+			wantBody:   content,
+		},
+		{
+			name:       "zstd compressed file is served decompressed",
+			path:       "/kernel",
+			decompress: true,
+			wantCode:   http.StatusOK,
+			wantBody:   content,
+		},
+		{
+			name:       "compressed file is served as is",
+			path:       "/img.tar.lz4",
+			decompress: true,
+			wantCode:   http.StatusOK,
+			wantBody:   lz4Buf.Bytes(),
+		},
+		{
+			name:       "decompression disabled",
+			path:       "/img.tar",
+			decompress: false,
+			wantCode:   http.StatusTemporaryRedirect,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCacheFileHandler("", dir, metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir), nil)
+			h.decompress = tt.decompress
+
+			w := httptest.NewRecorder()
+			h.handle(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != nil {
+				assert.Equal(t, tt.wantBody, w.Body.Bytes())
+			}
+		})
+	}
+
+	_, err = os.Stat(path.Join(dir, "img.tar"))
+	assert.True(t, os.IsNotExist(err), "decompressed file must not be persisted")
+}
+
+func Test_partitionReadiness(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	c := &api.Config{CacheRootPath: "/var/lib/metal-image-cache-sync"}
+
+	var err error
+	syncer, err = sync.NewSyncer(slog.Default(), fs, nil, http.DefaultClient, c, nil, context.TODO())
+	require.NoError(t, err)
+	defer func() {
+		syncer = nil
+	}()
+
+	files := map[string]string{
+		c.GetKernelRootPath() + "/v1/metal-kernel":          "Test",
+		c.GetBootImageRootPath() + "/v1/initrd.img.lz4":     "Test",
+		c.GetBootImageRootPath() + "/v1/initrd.img.lz4.md5": "0cbc6611f5540bd0809a388dc95a615b  initrd.img.lz4",
+		c.GetBootImageRootPath() + "/v2/initrd.img.lz4":     "Test",
+		c.GetBootImageRootPath() + "/v2/initrd.img.lz4.md5": "d41d8cd98f00b204e9800998ecf8427e  initrd.img.lz4",
+	}
+	for p, content := range files {
+		require.NoError(t, afero.WriteFile(fs, p, []byte(content), 0644))
+	}
+
+	got := partitionReadiness([]api.PartitionBootArtifacts{
+		{
+			ID:               "fully-cached",
+			KernelSubPath:    "v1/metal-kernel",
+			BootImageSubPath: "v1/initrd.img.lz4",
+		},
+		{
+			ID:               "kernel-missing",
+			KernelSubPath:    "v2/metal-kernel",
+			BootImageSubPath: "v2/initrd.img.lz4",
+		},
+	}, c.GetKernelRootPath(), c.GetBootImageRootPath())
+
+	assert.Equal(t, map[string]api.PartitionReadiness{
+		"fully-cached": {
+			Kernel:    api.ArtifactPresent,
+			BootImage: api.ArtifactPresent,
+		},
+		"kernel-missing": {
+			Kernel:    api.ArtifactMissing,
+			BootImage: api.ArtifactMismatch,
+		},
+	}, got)
+}
+
+func Test_runPhases(t *testing.T) {
+	logger = slog.Default()
+
+	dir := t.TempDir()
+	imageCollector := metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), dir)
+	kernelCollector := metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir)
+	bootImageCollector := metrics.MustBootImageMetrics(slog.Default(), afero.NewOsFs(), dir)
+
+	var ran []string
+	err := runPhases([]syncPhase{
+		{
+			name:      "image",
+			collector: imageCollector,
+			run: func() error {
+				var img *api.OS
+				ran = append(ran, "image")
+				return fmt.Errorf("unreachable %s", img.Name)
+			},
+		},
+		{
+			name:      "kernel",
+			collector: kernelCollector,
+			run: func() error {
+				ran = append(ran, "kernel")
+				return fmt.Errorf("cannot list partitions")
+			},
+		},
+		{
+			name:      "boot image",
+			collector: bootImageCollector,
+			run: func() error {
+				ran = append(ran, "boot image")
+				return nil
+			},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "panic during image sync")
+	assert.Contains(t, err.Error(), "cannot list partitions")
+	assert.Equal(t, []string{"image", "kernel", "boot image"}, ran)
+
+	syncs := func(collector metrics.DownloadCollector) map[string]float64 {
+		families, err := collector.GetGatherer().Gather()
+		require.NoError(t, err)
+
+		result := map[string]float64{}
+		for _, f := range families {
+			if f.GetName() != "syncs_total" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				result[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+			}
+		}
+		return result
+	}
+
+	assert.Equal(t, map[string]float64{"failure": 1}, syncs(imageCollector))
+	assert.Equal(t, map[string]float64{"failure": 1}, syncs(kernelCollector))
+	assert.Equal(t, map[string]float64{"success": 1}, syncs(bootImageCollector))
+}
+
+func Test_listCache(t *testing.T) {
+	logger = slog.Default()
+
+	root := t.TempDir()
+	c := &api.Config{CacheRootPath: root}
+	require.NoError(t, os.MkdirAll(path.Join(c.GetImageRootPath(), "ubuntu", "20.04"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(c.GetImageRootPath(), "ubuntu", "20.04", "img.tar.lz4"), []byte("image"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(c.GetImageRootPath(), "ubuntu", "20.04", "img.tar.lz4.md5"), []byte("checksum"), 0644))
+	require.NoError(t, os.MkdirAll(c.GetKernelRootPath(), 0755))
+	require.NoError(t, os.WriteFile(path.Join(c.GetKernelRootPath(), "metal-kernel"), []byte("kernel"), 0644))
+
+	var buf bytes.Buffer
+	require.NoError(t, listCache(&buf, root, true))
+
+	var got []cacheListEntry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, []cacheListEntry{
+		{Kind: "image", SubPath: "ubuntu/20.04/img.tar.lz4", Size: 5},
+		{Kind: "kernel", SubPath: "metal-kernel", Size: 6},
+	}, got)
+
+	buf.Reset()
+	require.NoError(t, listCache(&buf, root, false))
+	assert.Contains(t, buf.String(), "ubuntu/20.04/img.tar.lz4")
+	assert.Contains(t, buf.String(), "2 files")
+}
+
+func Test_verifyCache(t *testing.T) {
+	logger = slog.Default()
+
+	root := t.TempDir()
+	c := &api.Config{CacheRootPath: root}
+	require.NoError(t, os.MkdirAll(c.GetImageRootPath(), 0755))
+	require.NoError(t, os.WriteFile(path.Join(c.GetImageRootPath(), "img.tar.lz4"), []byte("Test"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(c.GetImageRootPath(), "img.tar.lz4.md5"), []byte("0cbc6611f5540bd0809a388dc95a615b  img.tar.lz4"), 0644))
+	require.NoError(t, os.MkdirAll(c.GetKernelRootPath(), 0755))
+	require.NoError(t, os.WriteFile(path.Join(c.GetKernelRootPath(), "metal-kernel"), []byte("kernel"), 0644))
+	require.NoError(t, os.MkdirAll(c.GetBootImageRootPath(), 0755))
+	require.NoError(t, os.WriteFile(path.Join(c.GetBootImageRootPath(), "initrd.img.lz4"), []byte("Test"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(c.GetBootImageRootPath(), "initrd.img.lz4.sha256"), []byte("532eaabd9574880dbf76b9b8cc00832c20a6ec113d682299550d7a6e0f345e25  initrd.img.lz4"), 0644))
+
+	var buf bytes.Buffer
+	require.NoError(t, verifyCache(&buf, root))
+	assert.Contains(t, buf.String(), "PASS "+path.Join(c.GetImageRootPath(), "img.tar.lz4"))
+	assert.Contains(t, buf.String(), "PASS "+path.Join(c.GetBootImageRootPath(), "initrd.img.lz4"))
+	assert.Contains(t, buf.String(), "2 passed, 0 failed, 1 skipped")
+
+	// a truncated file does not match its checksum anymore
+	require.NoError(t, os.WriteFile(path.Join(c.GetImageRootPath(), "img.tar.lz4"), []byte("Te"), 0644))
+
+	buf.Reset()
+	require.Error(t, verifyCache(&buf, root))
+	assert.Contains(t, buf.String(), "FAIL "+path.Join(c.GetImageRootPath(), "img.tar.lz4"))
+	assert.Contains(t, buf.String(), "1 passed, 1 failed, 1 skipped")
+}
+
+func Test_imageStoreCredentials(t *testing.T) {
+	assert.Same(t, credentials.AnonymousCredentials, imageStoreCredentials(&api.Config{}))
+
+	creds, err := imageStoreCredentials(&api.Config{
+		ImageStoreAccessKey: "access",
+		ImageStoreSecretKey: "secret",
+	}).Get()
+	require.NoError(t, err)
+	assert.Equal(t, "access", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+}
+
+func Test_syncHandler(t *testing.T) {
+	logger = slog.Default()
+
+	trigger := &syncTrigger{}
+	release := make(chan struct{})
+	done := make(chan struct{})
+	handler := syncHandler(trigger, "secret", func() {
+		<-release
+		close(done)
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{
+			name:   "method not allowed",
+			method: http.MethodGet,
+			token:  "secret",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "missing token",
+			method: http.MethodPost,
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "wrong token",
+			method: http.MethodPost,
+			token:  "wrong",
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "sync is triggered",
+			method: http.MethodPost,
+			token:  "secret",
+			want:   http.StatusAccepted,
+		},
+		{
+			name:   "sync is already running",
+			method: http.MethodPost,
+			token:  "secret",
+			want:   http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/sync", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, r)
+
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+
+	close(release)
+	<-done
+	assert.Eventually(t, func() bool { return trigger.Run(func() {}) }, time.Second, 10*time.Millisecond)
+}
+
+func Test_runPhasesReadiness(t *testing.T) {
+	logger = slog.Default()
+	previous := syncer
+	syncer = &sync.Syncer{}
+	defer func() {
+		syncer = previous
+	}()
+
+	dir := t.TempDir()
+	var imageReady, kernelReady atomic.Bool
+
+	err := runPhases([]syncPhase{
+		{
+			name:      "image",
+			rootPath:  path.Join(dir, "images"),
+			ready:     &imageReady,
+			collector: metrics.MustImageMetrics(slog.Default(), afero.NewOsFs(), dir),
+			run: func() error {
+				return fmt.Errorf("cannot list images")
+			},
+		},
+		{
+			name:      "kernel",
+			rootPath:  path.Join(dir, "kernels"),
+			ready:     &kernelReady,
+			collector: metrics.MustKernelMetrics(slog.Default(), afero.NewOsFs(), dir),
+			run: func() error {
+				return nil
+			},
+		},
+	})
+	require.Error(t, err)
+
+	// a failing image sync without synced content does not keep the kernel cache from being ready
+	assert.False(t, imageReady.Load())
+	assert.True(t, kernelReady.Load())
+}
+
+func Test_readyHandler(t *testing.T) {
+	logger = slog.Default()
+
+	dir := t.TempDir()
+	var synced atomic.Bool
+	handler := readyHandler(&synced, dir)
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+
+	synced.Store(true)
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "empty cache must not be ready")
+
+	require.NoError(t, os.MkdirAll(path.Join(dir, "ubuntu", "20.04"), 0755))
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "directories only must not be ready")
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "ubuntu", "20.04", "img.tar.lz4"), []byte("test"), 0644))
+	assert.Equal(t, http.StatusOK, ready())
+}
+
+func Test_shutdownServers(t *testing.T) {
+	logger = slog.Default()
+
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		wantBody bool
+	}{
+		{
+			name:     "in-flight requests are drained",
+			timeout:  5 * time.Second,
+			wantBody: true,
+		},
+		{
+			name:     "servers are closed after the timeout",
+			timeout:  10 * time.Millisecond,
+			wantBody: false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				_, _ = w.Write([]byte("Test"))
+			}))
+			defer ts.Close()
+
+			type result struct {
+				body []byte
+				err  error
+			}
+			done := make(chan result)
+			go func() {
+				resp, err := http.Get(ts.URL)
+				if err != nil {
+					done <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				done <- result{body: body, err: err}
+			}()
+
+			<-started
+			shutdownServers([]*http.Server{ts.Config}, tt.timeout)
+
+			res := <-done
+			if tt.wantBody {
+				require.NoError(t, res.err)
+				assert.Equal(t, "Test", string(res.body))
+			} else {
+				assert.Error(t, res.err)
+			}
+		})
+	}
+}
+
+func Test_scheduleJitterOffset(t *testing.T) {
+	assert.Zero(t, scheduleJitterOffset(0))
+
+	for range 100 {
+		offset := scheduleJitterOffset(time.Minute)
+		assert.GreaterOrEqual(t, offset, time.Duration(0))
+		assert.LessOrEqual(t, offset, time.Minute)
+	}
+}
+
+func Test_waitScheduleOffset(t *testing.T) {
+	assert.True(t, waitScheduleOffset(context.Background(), 0))
+	assert.True(t, waitScheduleOffset(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	assert.False(t, waitScheduleOffset(ctx, time.Hour))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_statusHandler(t *testing.T) {
+	logger = slog.Default()
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/var/cache/kernels/metal-kernel", []byte("Test"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/var/cache/kernels/metal-kernel.md5", []byte("abc"), 0644))
+
+	next := time.Date(2020, 10, 27, 10, 10, 0, 0, time.UTC)
+	tracker := &syncTracker{}
+	handler := statusHandler(tracker, func() time.Time { return next }, metrics.MustKernelMetrics(slog.Default(), fs, "/var/cache/kernels"))
+
+	get := func() syncStatus {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var status syncStatus
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+		return status
+	}
+
+	status := get()
+	assert.Nil(t, status.LastSyncStart)
+	assert.Empty(t, status.LastSyncResult)
+	require.NotNil(t, status.NextSync)
+	assert.True(t, next.Equal(*status.NextSync))
+	assert.Equal(t, metrics.CacheStats{Size: 7, Files: 1}, status.Cache)
+
+	start := time.Date(2020, 10, 27, 10, 0, 0, 0, time.UTC)
+	tracker.started(start)
+	tracker.finished(start.Add(time.Minute), fmt.Errorf("image store not reachable"))
+
+	status = get()
+	require.NotNil(t, status.LastSyncStart)
+	assert.True(t, start.Equal(*status.LastSyncStart))
+	require.NotNil(t, status.LastSyncEnd)
+	assert.Equal(t, "error", status.LastSyncResult)
+	assert.Equal(t, "image store not reachable", status.LastSyncError)
+
+	tracker.started(start.Add(10 * time.Minute))
+	tracker.finished(start.Add(11*time.Minute), nil)
+
+	status = get()
+	assert.Equal(t, "ok", status.LastSyncResult)
+	assert.Empty(t, status.LastSyncError)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/status", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
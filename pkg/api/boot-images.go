@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/afero"
@@ -15,6 +16,14 @@ type BootImage struct {
 	SubPath string
 	URL     string
 	Size    int64
+	// MD5Missing is set for boot images synced without checksum because the origin does not provide one
+	MD5Missing bool
+	// SHA256Available is set for boot images the origin provides a sha256 checksum for
+	SHA256Available bool
+	LastModified    time.Time
+	ETag            string
+	// References is the amount of partitions booting this boot image
+	References int
 }
 
 func (b BootImage) GetName() string {
@@ -29,8 +38,20 @@ func (b BootImage) GetSize() int64 {
 	return b.Size
 }
 
+func (b BootImage) GetSource() string {
+	return b.URL
+}
+
+func (b BootImage) GetLastModified() time.Time {
+	return b.LastModified
+}
+
+func (b BootImage) GetETag() string {
+	return b.ETag
+}
+
 func (b BootImage) HasMD5() bool {
-	return true
+	return !b.MD5Missing
 }
 
 func (b BootImage) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
@@ -71,24 +92,89 @@ func (b BootImage) DownloadMD5(ctx context.Context, target *afero.File, c *http.
 	return parts[0], nil
 }
 
-func (b BootImage) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
-	req, err := http.NewRequest(http.MethodGet, b.URL, nil)
+func (b BootImage) HasSHA256() bool {
+	return b.SHA256Available
+}
+
+func (b BootImage) DownloadSHA256(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	sha256URL := b.URL + ".sha256"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sha256URL, nil)
 	if err != nil {
-		return 0, fmt.Errorf("unable to create get request:%w", err)
+		return "", fmt.Errorf("unable to create get request:%w", err)
 	}
 
-	req = req.WithContext(ctx)
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("boot image sha256 download error:%w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("boot image sha256 download of %s did not return OK", sha256URL)
+	}
+
+	if target != nil {
+		_, err = io.Copy(*target, resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("boot image sha256 download error:%w", err)
+		}
+
+		return "", nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("boot image sha256 download error:%w", err)
+	}
+
+	return parseChecksumFile(body)
+}
+
+func (b BootImage) DownloadMD5Signature(ctx context.Context, c *http.Client, s3downloader *s3manager.Downloader) ([]byte, error) {
+	signatureURL := b.URL + ".md5" + ChecksumSignatureSuffix
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signatureURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create get request:%w", err)
+	}
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("boot image download error:%w", err)
+		return nil, fmt.Errorf("boot image md5 signature download error:%w", err)
 	}
 	defer resp.Body.Close()
 
-	n, err := io.Copy(target, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrChecksumSignatureNotFound
+	default:
+		return nil, fmt.Errorf("boot image md5 signature download of %s did not return OK", signatureURL)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("boot image md5 signature download error:%w", err)
+	}
+
+	return body, nil
+}
+
+func (b BootImage) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	n, err := httpDownload(ctx, c, b.URL, target)
 	if err != nil {
 		return 0, fmt.Errorf("boot image download error:%w", err)
 	}
 
 	return n, nil
 }
+
+func (b BootImage) DownloadFrom(ctx context.Context, target afero.File, offset int64, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	n, err := httpDownloadFrom(ctx, c, b.URL, target, offset)
+	if err != nil {
+		return n, fmt.Errorf("boot image download error:%w", err)
+	}
+
+	return n, nil
+}
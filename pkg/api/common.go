@@ -2,26 +2,87 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/afero"
 )
 
+const (
+	// ChecksumSignatureSuffix is the suffix of minisign signatures of checksum files published next to the checksum file
+	ChecksumSignatureSuffix = ".minisig"
+)
+
+// ErrChecksumSignatureNotFound is returned if the origin does not provide a signature for a checksum file.
+var ErrChecksumSignatureNotFound = errors.New("checksum signature not found")
+
 type CacheEntities []CacheEntity
 
-type CacheEntity interface {
+type CacheEntries []CacheEntry
+
+// SignedChecksum is implemented by entities whose checksum file can be signed by the origin.
+type SignedChecksum interface {
+	DownloadMD5Signature(ctx context.Context, c *http.Client, s3downloader *s3manager.Downloader) ([]byte, error)
+}
+
+// CacheEntry describes a file in the cache.
+type CacheEntry interface {
 	GetName() string
 	GetSubPath() string
 	GetSize() int64
+}
+
+// Downloadable is implemented by entities that can be downloaded from their origin.
+type Downloadable interface {
 	HasMD5() bool
 	DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error)
+	HasSHA256() bool
+	DownloadSHA256(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error)
 	Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error)
 }
 
+// Resumable is implemented by entities whose download can be continued from an offset, e.g. after an interrupted download.
+type Resumable interface {
+	// DownloadFrom writes the content of the entity from the given offset on to the same offset of the target,
+	// ErrRangeNotSupported is returned if the origin cannot serve the content from the offset.
+	DownloadFrom(ctx context.Context, target afero.File, offset int64, c *http.Client, s3downloader *s3manager.Downloader) (int64, error)
+}
+
+// CacheEntity is an entity of the origin that is synced into the cache.
+type CacheEntity interface {
+	CacheEntry
+	Downloadable
+}
+
+// IndexEntry describes a file currently cached.
+type IndexEntry struct {
+	Name    string    `json:"name"`
+	SubPath string    `json:"subpath"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// ETagged is implemented by entities whose origin provides an etag, which allows detecting changes without hashing.
+type ETagged interface {
+	GetETag() string
+}
+
+// LastModified is implemented by entities that know the modification time of their origin, zero if unknown.
+type LastModified interface {
+	GetLastModified() time.Time
+}
+
+// Sourced is implemented by entities that know the location of their origin, e.g. an url or a bucket key.
+type Sourced interface {
+	GetSource() string
+}
+
+// LocalFile is a file found in the cache, it only serves as index entry and cannot be downloaded.
 type LocalFile struct {
 	Name    string
 	SubPath string
@@ -40,16 +101,14 @@ func (l LocalFile) GetSize() int64 {
 	return l.Size
 }
 
-func (l LocalFile) HasMD5() bool {
-	return false
-}
-
-func (l LocalFile) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
-	return "", nil
-}
+// parseChecksumFile returns the checksum of a checksum file in the format of md5sum or sha256sum.
+func parseChecksumFile(content []byte) (string, error) {
+	parts := strings.Fields(string(content))
+	if len(parts) == 0 {
+		return "", fmt.Errorf("checksum file has unexpected format")
+	}
 
-func (l LocalFile) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
-	return 0, fmt.Errorf("not implemented on local file")
+	return parts[0], nil
 }
 
 func semverOrURL(url string) string {
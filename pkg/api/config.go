@@ -2,30 +2,120 @@ package api
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/go-playground/validator/v10"
+	"github.com/robfig/cron/v3"
 	"github.com/spf13/afero"
 	"github.com/spf13/viper"
 )
 
+const (
+	// LogVerbosityPerFile logs every downloaded and removed file
+	LogVerbosityPerFile = "per-file"
+	// LogVerbositySummary logs a single summary per sync, per-file lines are only logged on debug level
+	LogVerbositySummary = "summary"
+)
+
+const (
+	// OriginAbsentPolicyKeep keeps cached images that are referenced by the metal-api but not contained in the image store anymore
+	OriginAbsentPolicyKeep = "keep"
+	// OriginAbsentPolicyRemove removes cached images that are referenced by the metal-api but not contained in the image store anymore
+	OriginAbsentPolicyRemove = "remove"
+	// OriginAbsentPolicyWarn keeps cached images that are referenced by the metal-api but not contained in the image store anymore and logs a warning
+	OriginAbsentPolicyWarn = "warn"
+)
+
+const (
+	// SubPathNamingPath stores kernels and boot images under the path of their url
+	SubPathNamingPath = "path"
+	// SubPathNamingHost stores kernels and boot images under the host and path of their url
+	SubPathNamingHost = "host"
+	// SubPathNamingHash stores kernels and boot images under a hash of their full url
+	SubPathNamingHash = "hash"
+)
+
+const (
+	// EvictionStrategyBalanced evicts the oldest image of the image variant with the most images
+	EvictionStrategyBalanced = "balanced"
+	// EvictionStrategyLargestFirst evicts the largest image of all image variants above their minimum amount of images
+	EvictionStrategyLargestFirst = "largest-first"
+)
+
+const (
+	// ChecksumSignatureModeStrict refuses checksums without a valid signature
+	ChecksumSignatureModeStrict = "strict"
+	// ChecksumSignatureModeLenient trusts checksums without signature, checksums with an invalid signature are refused
+	ChecksumSignatureModeLenient = "lenient"
+)
+
+// ImageLimits defines the minimum and maximum amount of images to keep of an image variant, zero values fall back to the global settings.
+type ImageLimits struct {
+	Min int `mapstructure:"min"`
+	Max int `mapstructure:"max"`
+}
+
 type Config struct {
 	CacheRootPath string `validate:"required"`
 
 	KernelCacheEnabled    bool `validate:"required"`
 	BootImageCacheEnabled bool `validate:"required"`
 
+	// bind addresses are comma-separated lists of addresses, a cache server listens on every address
 	ImageCacheBindAddress     string `validate:"required"`
 	KernelCacheBindAddress    string
 	BootImageCacheBindAddress string
 
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	ShutdownTimeout       time.Duration
+
+	// TLSCert and TLSKey are the paths to the certificate the cache http servers serve https with, plain http is served if not set
+	TLSCert string
+	TLSKey  string
+
 	MetalAPIEndpoint string `validate:"required"`
 	MetalAPIHMAC     string `validate:"required"`
 
 	SyncSchedule string `validate:"required"`
-	DryRun       bool
-	ExcludePaths []string
+	// ScheduleJitter is the maximum random delay of scheduled syncs, spreads the load of many caches on the origin
+	ScheduleJitter time.Duration
+	DryRun         bool
+	Once           bool
+	AdminToken     string
+	ExcludePaths   []string
+	IncludeOS      []string
+
+	// ImageExcludes, KernelExcludes and BootImageExcludes replace the global exclude paths for their kind of entity if set
+	ImageExcludes     []string
+	KernelExcludes    []string
+	BootImageExcludes []string
+
+	// ExcludeRegex are regular expressions of urls to exclude from the sync, they are compiled into ExcludeRegexps by Complete
+	ExcludeRegex   []string
+	ExcludeRegexps []*regexp.Regexp
+
+	// HTTPProxy overrides the proxy from the environment for the requests to the origins and the image store,
+	// it is parsed into HTTPProxyURL by Complete
+	HTTPProxy    string
+	HTTPProxyURL *url.URL
+
+	// AsyncInitialSync runs the initial sync in the background while the caches already serve
+	AsyncInitialSync bool
+
+	LogVerbosity string
+
+	SubPathNaming string
+
+	RequireBootImageMD5 bool
 
 	// OS Image related settings
 
@@ -33,30 +123,172 @@ type Config struct {
 	MaxImagesPerName int   `validate:"required"`
 	MaxCacheSize     int64 `validate:"required"`
 
-	ImageStore  string `validate:"required"`
-	ImageBucket string `validate:"required"`
+	// MaxTotalCacheSize limits the size of images, kernels and boot images together, disabled if zero
+	MaxTotalCacheSize int64
+
+	// PerOSLimits overrides the minimum and maximum images per name for an operating system
+	PerOSLimits map[string]ImageLimits
+
+	EvictionStrategy string
+
+	ImageStore   string   `validate:"required"`
+	ImageBuckets []string `validate:"required,min=1"`
+
+	ImageStoreRegion    string
+	ImageStorePathStyle bool
+	ImageStoreAccessKey string
+	ImageStoreSecretKey string
+
+	ImageStoreHTTPFallback bool
+
+	// S3MaxRetries and S3MinRetryDelay configure the retries of failed requests to the image store, the delay
+	// grows exponentially with jitter
+	S3MaxRetries    int
+	S3MinRetryDelay time.Duration
 
 	ExpirationGraceDays uint
+
+	// MaxImageAgeDays drops images whose version datestamp is older, unless AgeRespectsMin keeps them for the minimum images per name
+	MaxImageAgeDays uint
+	AgeRespectsMin  bool
+
+	// FallbackImage is always synced and never evicted, regardless of the retention and cache size settings
+	FallbackImage string
+
+	HeadCacheTTL time.Duration
+
+	EnableDeltas bool
+
+	VerifyLZ4 bool
+
+	OriginAbsentPolicy string
+
+	TrimPlanToFreeSpace bool
+	PurgeUnknown        bool
+	MinFreeDiskBytes    int64
+
+	ChecksumWorkers int
+
+	DownloadConcurrency        int
+	DownloadConcurrencyServing int
+	DownloadMaxRetries         int
+	DownloadTimeout            time.Duration
+	ResumeDownloads            bool
+	HTTPUserAgent              string
+	HTTPMaxIdleConnsPerHost    int
+	HTTPIdleConnTimeout        time.Duration
+	HTTPTLSHandshakeTimeout    time.Duration
+	HTTPTimeout                time.Duration
+	LatestLinks                bool
+	ServeActivityWindow        time.Duration
+	ServeActivityThreshold     int
+
+	ReplicateFrom string
+
+	ServeDecompressed bool
+
+	// ServedCacheControl is the cache-control header of files served from the cache
+	ServedCacheControl string
+
+	// OriginBaseURL is the origin cache misses are redirected to, the requested host is used if empty
+	OriginBaseURL string
+
+	ProxyMissPaths   []string
+	ProxyMissOrigin  string
+	ProxyMissHeaders map[string]string
+
+	MaxRedirects         int
+	AllowedRedirectHosts []string
+
+	ChecksumSignaturePublicKey string
+	ChecksumSignatureMode      string
+
+	VerifySignedManifest    bool
+	SignedManifestURL       string
+	SignedManifestPublicKey string
 }
 
 func NewConfig() (*Config, error) {
 	c := &Config{
-		CacheRootPath:             viper.GetString("cache-root-path"),
-		KernelCacheEnabled:        viper.GetBool("enable-kernel-cache"),
-		BootImageCacheEnabled:     viper.GetBool("enable-boot-image-cache"),
-		ImageCacheBindAddress:     viper.GetString("image-cache-bind-address"),
-		MetalAPIEndpoint:          viper.GetString("metal-api-endpoint"),
-		MetalAPIHMAC:              viper.GetString("metal-api-hmac"),
-		BootImageCacheBindAddress: viper.GetString("boot-image-cache-bind-address"),
-		KernelCacheBindAddress:    viper.GetString("kernel-cache-bind-address"),
-		MinImagesPerName:          viper.GetInt("min-images-per-name"),
-		MaxImagesPerName:          viper.GetInt("max-images-per-name"),
-		ImageStore:                viper.GetString("image-store"),
-		ImageBucket:               viper.GetString("image-store-bucket"),
-		SyncSchedule:              viper.GetString("schedule"),
-		DryRun:                    viper.GetBool("dry-run"),
-		ExcludePaths:              viper.GetStringSlice("excludes"),
-		ExpirationGraceDays:       viper.GetUint("expiration-grace-period"),
+		CacheRootPath:              viper.GetString("cache-root-path"),
+		KernelCacheEnabled:         viper.GetBool("enable-kernel-cache"),
+		BootImageCacheEnabled:      viper.GetBool("enable-boot-image-cache"),
+		ImageCacheBindAddress:      viper.GetString("image-cache-bind-address"),
+		MetalAPIEndpoint:           viper.GetString("metal-api-endpoint"),
+		MetalAPIHMAC:               viper.GetString("metal-api-hmac"),
+		BootImageCacheBindAddress:  viper.GetString("boot-image-cache-bind-address"),
+		KernelCacheBindAddress:     viper.GetString("kernel-cache-bind-address"),
+		MinImagesPerName:           viper.GetInt("min-images-per-name"),
+		MaxImagesPerName:           viper.GetInt("max-images-per-name"),
+		EvictionStrategy:           viper.GetString("eviction-strategy"),
+		ImageStore:                 viper.GetString("image-store"),
+		ImageBuckets:               viper.GetStringSlice("image-store-bucket"),
+		ImageStoreRegion:           viper.GetString("image-store-region"),
+		ImageStorePathStyle:        viper.GetBool("image-store-path-style"),
+		ImageStoreAccessKey:        viper.GetString("image-store-access-key"),
+		ImageStoreSecretKey:        viper.GetString("image-store-secret-key"),
+		ImageStoreHTTPFallback:     viper.GetBool("image-store-http-fallback"),
+		S3MaxRetries:               viper.GetInt("s3-max-retries"),
+		S3MinRetryDelay:            viper.GetDuration("s3-min-retry-delay"),
+		SyncSchedule:               viper.GetString("schedule"),
+		ScheduleJitter:             viper.GetDuration("schedule-jitter"),
+		DryRun:                     viper.GetBool("dry-run"),
+		Once:                       viper.GetBool("once"),
+		AsyncInitialSync:           viper.GetBool("async-initial-sync"),
+		AdminToken:                 viper.GetString("admin-token"),
+		LogVerbosity:               viper.GetString("log-verbosity"),
+		HeadCacheTTL:               viper.GetDuration("head-cache-ttl"),
+		EnableDeltas:               viper.GetBool("enable-deltas"),
+		VerifyLZ4:                  viper.GetBool("verify-lz4"),
+		OriginAbsentPolicy:         viper.GetString("origin-absent-policy"),
+		TrimPlanToFreeSpace:        viper.GetBool("trim-plan-to-free-space"),
+		PurgeUnknown:               viper.GetBool("purge-unknown"),
+		MinFreeDiskBytes:           viper.GetInt64("min-free-disk-bytes"),
+		ChecksumWorkers:            viper.GetInt("checksum-workers"),
+		DownloadConcurrency:        viper.GetInt("download-concurrency"),
+		DownloadConcurrencyServing: viper.GetInt("download-concurrency-while-serving"),
+		DownloadMaxRetries:         viper.GetInt("download-max-retries"),
+		DownloadTimeout:            viper.GetDuration("download-timeout"),
+		ResumeDownloads:            viper.GetBool("resume-downloads"),
+		HTTPUserAgent:              viper.GetString("http-user-agent"),
+		HTTPMaxIdleConnsPerHost:    viper.GetInt("http-max-idle-conns-per-host"),
+		HTTPIdleConnTimeout:        viper.GetDuration("http-idle-conn-timeout"),
+		HTTPTLSHandshakeTimeout:    viper.GetDuration("http-tls-handshake-timeout"),
+		HTTPTimeout:                viper.GetDuration("http-timeout"),
+		HTTPProxy:                  viper.GetString("http-proxy"),
+		LatestLinks:                viper.GetBool("latest-links"),
+		ServeActivityWindow:        viper.GetDuration("serve-activity-window"),
+		ServeActivityThreshold:     viper.GetInt("serve-activity-threshold"),
+		ReplicateFrom:              viper.GetString("replicate-from"),
+		ServeDecompressed:          viper.GetBool("serve-decompressed"),
+		ServedCacheControl:         viper.GetString("served-cache-control"),
+		OriginBaseURL:              viper.GetString("origin-base-url"),
+		ProxyMissPaths:             viper.GetStringSlice("proxy-miss-paths"),
+		ProxyMissOrigin:            viper.GetString("proxy-miss-origin"),
+		ProxyMissHeaders:           viper.GetStringMapString("proxy-miss-headers"),
+		MaxRedirects:               viper.GetInt("max-redirects"),
+		AllowedRedirectHosts:       viper.GetStringSlice("allowed-redirect-hosts"),
+		ExcludePaths:               viper.GetStringSlice("excludes"),
+		IncludeOS:                  viper.GetStringSlice("include-os"),
+		ExcludeRegex:               viper.GetStringSlice("exclude-regex"),
+		ImageExcludes:              viper.GetStringSlice("image-excludes"),
+		KernelExcludes:             viper.GetStringSlice("kernel-excludes"),
+		BootImageExcludes:          viper.GetStringSlice("boot-image-excludes"),
+		SubPathNaming:              viper.GetString("subpath-naming"),
+		ExpirationGraceDays:        viper.GetUint("expiration-grace-period"),
+		MaxImageAgeDays:            viper.GetUint("max-image-age-days"),
+		AgeRespectsMin:             viper.GetBool("age-respects-min"),
+		FallbackImage:              viper.GetString("fallback-image"),
+		HTTPReadHeaderTimeout:      viper.GetDuration("http-read-header-timeout"),
+		HTTPReadTimeout:            viper.GetDuration("http-read-timeout"),
+		HTTPWriteTimeout:           viper.GetDuration("http-write-timeout"),
+		HTTPIdleTimeout:            viper.GetDuration("http-idle-timeout"),
+		ShutdownTimeout:            viper.GetDuration("shutdown-timeout"),
+		TLSCert:                    viper.GetString("tls-cert"),
+		TLSKey:                     viper.GetString("tls-key"),
+		VerifySignedManifest:       viper.GetBool("verify-signed-manifest"),
+		SignedManifestURL:          viper.GetString("signed-manifest-url"),
+		SignedManifestPublicKey:    viper.GetString("signed-manifest-public-key"),
 	}
 
 	var err error
@@ -65,13 +297,54 @@ func NewConfig() (*Config, error) {
 		return nil, fmt.Errorf("cannot read max cache size:%w", err)
 	}
 
+	if total := viper.GetString("max-total-cache-size"); total != "" {
+		c.MaxTotalCacheSize, err = units.FromHumanSize(total)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read max total cache size:%w", err)
+		}
+	}
+
+	err = viper.UnmarshalKey("per-os-limits", &c.PerOSLimits)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read per os limits:%w", err)
+	}
+
 	return c, nil
 }
 
+// ImageLimitsFor returns the minimum and maximum images per name for the given operating system.
+func (c *Config) ImageLimitsFor(os string) ImageLimits {
+	limits := ImageLimits{
+		Min: c.MinImagesPerName,
+		Max: c.MaxImagesPerName,
+	}
+
+	override, ok := c.PerOSLimits[os]
+	if !ok {
+		return limits
+	}
+	if override.Min != 0 {
+		limits.Min = override.Min
+	}
+	if override.Max != 0 {
+		limits.Max = override.Max
+	}
+
+	return limits
+}
+
 func (c *Config) GetImageRootPath() string {
 	return path.Join(c.CacheRootPath, "images")
 }
 
+func (c *Config) GetChecksumCachePath() string {
+	return path.Join(c.CacheRootPath, "checksum-cache.json")
+}
+
+func (c *Config) GetCacheManifestPath() string {
+	return path.Join(c.CacheRootPath, "cache-manifest.json")
+}
+
 func (c *Config) GetTmpDownloadPath() string {
 	return path.Join(c.CacheRootPath, "tmp")
 }
@@ -91,6 +364,16 @@ func (c *Config) Validate(fs afero.Fs) error {
 		return err
 	}
 
+	_, err = cron.ParseStandard(c.SyncSchedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q:%w", c.SyncSchedule, err)
+	}
+
+	_, err = c.compileExcludeRegex()
+	if err != nil {
+		return err
+	}
+
 	isDir, err := afero.IsDir(fs, c.CacheRootPath)
 	if err != nil {
 		return fmt.Errorf("cannot open cache root path:%w", err)
@@ -103,17 +386,214 @@ func (c *Config) Validate(fs afero.Fs) error {
 		return fmt.Errorf("minimum images per name must be at least 1")
 	}
 
+	// a negative maximum means unlimited
+	if c.MaxImagesPerName > 0 && c.MaxImagesPerName < c.MinImagesPerName {
+		return fmt.Errorf("maximum images per name (%d) must not be less than the minimum images per name (%d)", c.MaxImagesPerName, c.MinImagesPerName)
+	}
+
+	for os, limits := range c.PerOSLimits {
+		if limits.Min < 0 {
+			return fmt.Errorf("minimum images per name of os %s must not be negative", os)
+		}
+	}
+
+	switch c.EvictionStrategy {
+	case EvictionStrategyBalanced, EvictionStrategyLargestFirst:
+	default:
+		return fmt.Errorf("eviction strategy must be one of %s or %s", EvictionStrategyBalanced, EvictionStrategyLargestFirst)
+	}
+
+	switch c.LogVerbosity {
+	case LogVerbosityPerFile, LogVerbositySummary:
+	default:
+		return fmt.Errorf("log verbosity must be one of %s or %s", LogVerbosityPerFile, LogVerbositySummary)
+	}
+
+	switch c.SubPathNaming {
+	case SubPathNamingPath, SubPathNamingHost, SubPathNamingHash:
+	default:
+		return fmt.Errorf("subpath naming must be one of %s, %s or %s", SubPathNamingPath, SubPathNamingHost, SubPathNamingHash)
+	}
+
+	switch c.OriginAbsentPolicy {
+	case OriginAbsentPolicyKeep, OriginAbsentPolicyRemove, OriginAbsentPolicyWarn:
+	default:
+		return fmt.Errorf("origin absent policy must be one of %s, %s or %s", OriginAbsentPolicyKeep, OriginAbsentPolicyRemove, OriginAbsentPolicyWarn)
+	}
+
+	if c.HTTPReadHeaderTimeout < 0 || c.HTTPReadTimeout < 0 || c.HTTPWriteTimeout < 0 || c.HTTPIdleTimeout < 0 || c.ShutdownTimeout < 0 {
+		return fmt.Errorf("http server timeouts must not be negative")
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls cert and tls key must be set together")
+	}
+
+	if (c.ImageStoreAccessKey == "") != (c.ImageStoreSecretKey == "") {
+		return fmt.Errorf("image store access key and secret key must be set together")
+	}
+
+	if c.MinFreeDiskBytes < 0 {
+		return fmt.Errorf("min free disk bytes must not be negative")
+	}
+
+	if c.ChecksumWorkers < 1 {
+		return fmt.Errorf("checksum workers must be at least 1")
+	}
+
+	if c.OriginBaseURL != "" {
+		u, err := url.Parse(c.OriginBaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("origin base url must be an absolute url")
+		}
+	}
+
+	if len(c.ProxyMissPaths) > 0 && c.ProxyMissOrigin == "" {
+		return fmt.Errorf("proxy miss origin must be set when proxying cache misses")
+	}
+
+	if c.DownloadConcurrency < 1 || c.DownloadConcurrencyServing < 1 {
+		return fmt.Errorf("download concurrency must be at least 1")
+	}
+
+	if c.DownloadMaxRetries < 0 {
+		return fmt.Errorf("download max retries must not be negative")
+	}
+
+	if c.DownloadTimeout < 0 {
+		return fmt.Errorf("download timeout must not be negative")
+	}
+
+	if c.HTTPMaxIdleConnsPerHost < 0 || c.HTTPIdleConnTimeout < 0 || c.HTTPTLSHandshakeTimeout < 0 || c.HTTPTimeout < 0 {
+		return fmt.Errorf("http connection settings and timeouts must not be negative")
+	}
+
+	_, err = c.parseHTTPProxy()
+	if err != nil {
+		return err
+	}
+
+	if c.ScheduleJitter < 0 {
+		return fmt.Errorf("schedule jitter must not be negative")
+	}
+
+	if c.S3MaxRetries < 0 || c.S3MinRetryDelay < 0 {
+		return fmt.Errorf("s3 max retries and min retry delay must not be negative")
+	}
+
+	if c.MaxRedirects < 0 {
+		return fmt.Errorf("max redirects must not be negative")
+	}
+
+	switch c.ChecksumSignatureMode {
+	case ChecksumSignatureModeStrict, ChecksumSignatureModeLenient:
+	default:
+		return fmt.Errorf("checksum signature mode must be one of %s or %s", ChecksumSignatureModeStrict, ChecksumSignatureModeLenient)
+	}
+
+	if c.VerifySignedManifest {
+		if c.SignedManifestURL == "" {
+			return fmt.Errorf("signed manifest url must be set when verifying signed manifest")
+		}
+		if c.SignedManifestPublicKey == "" {
+			return fmt.Errorf("signed manifest public key must be set when verifying signed manifest")
+		}
+	}
+
+	err = validateBindAddresses("image", c.ImageCacheBindAddress)
+	if err != nil {
+		return err
+	}
+
 	if c.KernelCacheEnabled {
-		if c.KernelCacheBindAddress == "" {
-			return fmt.Errorf("kernel cache bind address must be set")
+		err = validateBindAddresses("kernel", c.KernelCacheBindAddress)
+		if err != nil {
+			return err
 		}
 	}
 
 	if c.BootImageCacheEnabled {
-		if c.BootImageCacheBindAddress == "" {
-			return fmt.Errorf("boot image cache bind address must be set")
+		err = validateBindAddresses("boot image", c.BootImageCacheBindAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Complete derives the parsed settings from the raw ones, it is meant to be called after Validate.
+func (c *Config) Complete() error {
+	var err error
+
+	c.ExcludeRegexps, err = c.compileExcludeRegex()
+	if err != nil {
+		return err
+	}
+
+	c.HTTPProxyURL, err = c.parseHTTPProxy()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Config) compileExcludeRegex() ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range c.ExcludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude regex %q:%w", expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func (c *Config) parseHTTPProxy() (*url.URL, error) {
+	if c.HTTPProxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.HTTPProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http proxy %q:%w", c.HTTPProxy, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("http proxy %q must be an absolute url", c.HTTPProxy)
+	}
+
+	return u, nil
+}
+
+func validateBindAddresses(cache, addresses string) error {
+	addrs := BindAddresses(addresses)
+	if len(addrs) == 0 {
+		return fmt.Errorf("%s cache bind address must be set", cache)
+	}
+
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("%s cache bind address %q is invalid:%w", cache, addr, err)
+		}
+		if port == "" {
+			return fmt.Errorf("%s cache bind address %q has no port", cache, addr)
 		}
 	}
 
 	return nil
 }
+
+// BindAddresses splits a comma-separated list of bind addresses, ipv6 addresses need to be enclosed in brackets (e.g. [::1]:3000).
+func BindAddresses(addresses string) []string {
+	var result []string
+	for _, addr := range strings.Split(addresses, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
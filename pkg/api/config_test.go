@@ -0,0 +1,251 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validConfig() *Config {
+	return &Config{
+		CacheRootPath:              "/var/lib/metal-image-cache-sync",
+		KernelCacheEnabled:         true,
+		BootImageCacheEnabled:      true,
+		ImageCacheBindAddress:      "0.0.0.0:3000",
+		KernelCacheBindAddress:     "0.0.0.0:3001",
+		BootImageCacheBindAddress:  "0.0.0.0:3002",
+		MetalAPIEndpoint:           "http://metal-api",
+		MetalAPIHMAC:               "hmac",
+		SyncSchedule:               "*/10 * * * *",
+		LogVerbosity:               LogVerbosityPerFile,
+		SubPathNaming:              SubPathNamingPath,
+		OriginAbsentPolicy:         OriginAbsentPolicyRemove,
+		ChecksumSignatureMode:      ChecksumSignatureModeStrict,
+		ChecksumWorkers:            1,
+		DownloadConcurrency:        1,
+		DownloadConcurrencyServing: 1,
+		MinImagesPerName:           1,
+		MaxImagesPerName:           -1,
+		EvictionStrategy:           EvictionStrategyBalanced,
+		MaxCacheSize:               1024,
+		ImageStore:                 "metal-stack.io",
+		ImageBuckets:               []string{"images"},
+	}
+}
+
+func TestConfig_ValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		wantErr  string
+	}{
+		{
+			name:     "valid schedule",
+			schedule: "*/10 * * * *",
+		},
+		{
+			name:     "valid descriptor",
+			schedule: "@hourly",
+		},
+		{
+			name:     "too few fields",
+			schedule: "*/10 * * *",
+			wantErr:  "invalid schedule",
+		},
+		{
+			name:     "malformed field",
+			schedule: "*/x * * * *",
+			wantErr:  "invalid schedule",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			c := validConfig()
+			require.NoError(t, fs.MkdirAll(c.CacheRootPath, 0755))
+			c.SyncSchedule = tt.schedule
+
+			err := c.Validate(fs)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestConfig_ValidateBindAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		wantErr string
+	}{
+		{
+			name:    "single address",
+			address: "0.0.0.0:3000",
+		},
+		{
+			name:    "dual stack",
+			address: "0.0.0.0:3000, [::]:3000",
+		},
+		{
+			name:    "all interfaces",
+			address: ":3000",
+		},
+		{
+			name:    "empty",
+			address: " , ",
+			wantErr: "image cache bind address must be set",
+		},
+		{
+			name:    "ipv6 without brackets",
+			address: "0.0.0.0:3000,::1:3000",
+			wantErr: "image cache bind address \"::1:3000\" is invalid",
+		},
+		{
+			name:    "missing port",
+			address: "10.0.0.1:",
+			wantErr: "has no port",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			c := validConfig()
+			require.NoError(t, fs.MkdirAll(c.CacheRootPath, 0755))
+			c.ImageCacheBindAddress = tt.address
+
+			err := c.Validate(fs)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestConfig_ValidateExcludeRegex(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	c := validConfig()
+	require.NoError(t, fs.MkdirAll(c.CacheRootPath, 0755))
+
+	c.ExcludeRegex = []string{`/pull_requests/[0-9]+-`}
+	require.NoError(t, c.Validate(fs))
+	assert.Nil(t, c.ExcludeRegexps, "validate must not modify the config")
+	require.NoError(t, c.Complete())
+	require.Len(t, c.ExcludeRegexps, 1)
+	assert.True(t, c.ExcludeRegexps[0].MatchString("/metal-os/pull_requests/42-foo/img.tar.lz4"))
+
+	c.ExcludeRegex = []string{`/pull_requests/(`}
+	err := c.Validate(fs)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid exclude regex")
+}
+
+func TestConfig_ValidateHTTPProxy(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	c := validConfig()
+	require.NoError(t, fs.MkdirAll(c.CacheRootPath, 0755))
+
+	require.NoError(t, c.Validate(fs))
+	require.NoError(t, c.Complete())
+	assert.Nil(t, c.HTTPProxyURL)
+
+	c.HTTPProxy = "http://proxy.example.com:3128"
+	require.NoError(t, c.Validate(fs))
+	assert.Nil(t, c.HTTPProxyURL, "validate must not modify the config")
+	require.NoError(t, c.Complete())
+	require.NotNil(t, c.HTTPProxyURL)
+	assert.Equal(t, "proxy.example.com:3128", c.HTTPProxyURL.Host)
+
+	c.HTTPProxy = "proxy.example.com:3128"
+	err := c.Validate(fs)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "http proxy")
+}
+
+func TestBindAddresses(t *testing.T) {
+	assert.Equal(t, []string{"0.0.0.0:3000", "[::]:3000"}, BindAddresses("0.0.0.0:3000, [::]:3000,"))
+	assert.Nil(t, BindAddresses(""))
+}
+
+func TestConfig_ImageLimitsFor(t *testing.T) {
+	c := validConfig()
+	c.MinImagesPerName = 3
+	c.MaxImagesPerName = -1
+	c.PerOSLimits = map[string]ImageLimits{
+		"firewall": {Min: 5, Max: 5},
+		"ubuntu":   {Max: 2},
+	}
+
+	assert.Equal(t, ImageLimits{Min: 5, Max: 5}, c.ImageLimitsFor("firewall"))
+	assert.Equal(t, ImageLimits{Min: 3, Max: 2}, c.ImageLimitsFor("ubuntu"))
+	assert.Equal(t, ImageLimits{Min: 3, Max: -1}, c.ImageLimitsFor("debian"))
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll(c.CacheRootPath, 0755))
+	require.NoError(t, c.Validate(fs))
+
+	c.PerOSLimits["debian"] = ImageLimits{Min: -1}
+	err := c.Validate(fs)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "os debian")
+}
+
+func TestConfig_ValidateImagesPerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		min     int
+		max     int
+		wantErr bool
+	}{
+		{
+			name: "unlimited maximum",
+			min:  5,
+			max:  -1,
+		},
+		{
+			name: "maximum equals minimum",
+			min:  3,
+			max:  3,
+		},
+		{
+			name: "maximum above minimum",
+			min:  3,
+			max:  5,
+		},
+		{
+			name:    "maximum below minimum",
+			min:     5,
+			max:     3,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			c.MinImagesPerName = tt.min
+			c.MaxImagesPerName = tt.max
+
+			fs := afero.NewMemMapFs()
+			require.NoError(t, fs.MkdirAll(c.CacheRootPath, 0755))
+
+			err := c.Validate(fs)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "maximum images per name")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
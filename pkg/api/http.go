@@ -0,0 +1,166 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/spf13/afero"
+)
+
+var errHTTPNotFound = errors.New("not found")
+
+// ErrRangeNotSupported is returned by resumed downloads if the origin cannot serve the content from the requested offset.
+var ErrRangeNotSupported = errors.New("origin does not support ranged requests")
+
+// ErrUnexpectedContent is returned by downloads if the origin responded with content that cannot be the requested
+// file, e.g. the html error page of a misconfigured mirror.
+var ErrUnexpectedContent = errors.New("origin returned unexpected content")
+
+// httpGet requests the given url and returns the response body if the status is OK.
+func httpGet(ctx context.Context, c *http.Client, url string) (io.ReadCloser, error) {
+	resp, err := httpGetResponse(ctx, c, url)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// httpGetResponse requests the given url and returns the response if the status is OK.
+func httpGetResponse(ctx context.Context, c *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create get request:%w", err)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s:%w", url, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("request of %s failed:%w", url, errHTTPNotFound)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("request of %s did not return OK but %d", url, resp.StatusCode)
+	}
+}
+
+// checkContentType rejects html responses, some mirrors answer requests of missing files with an error page and status OK.
+func checkContentType(resp *http.Response, url string) error {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// unparsable content types are not rejected, the checksums catch broken downloads
+		return nil
+	}
+
+	if mediaType == "text/html" {
+		return fmt.Errorf("request of %s returned content type %s:%w", url, mediaType, ErrUnexpectedContent)
+	}
+
+	return nil
+}
+
+// httpDownload writes the content of the given url to the target, html error pages and empty responses are rejected.
+func httpDownload(ctx context.Context, c *http.Client, url string, target afero.File) (int64, error) {
+	resp, err := httpGetResponse(ctx, c, url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	err = checkContentType(resp, url)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(target, resp.Body)
+	if err != nil {
+		return n, err
+	}
+
+	if n == 0 {
+		return 0, fmt.Errorf("request of %s returned an empty body:%w", url, ErrUnexpectedContent)
+	}
+
+	return n, nil
+}
+
+// httpGetFrom requests the given url from the given offset on and returns the response body of the partial content.
+func httpGetFrom(ctx context.Context, c *http.Client, url string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create get request:%w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s:%w", url, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		err = checkContentType(resp, url)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+		// the origin ignored the range or the content changed in the meantime
+		resp.Body.Close()
+		return nil, fmt.Errorf("request of %s from offset %d failed:%w", url, offset, ErrRangeNotSupported)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("request of %s did not return partial content but %d", url, resp.StatusCode)
+	}
+}
+
+// httpDownloadFrom writes the content of the given url from the given offset on to the same offset of the target.
+func httpDownloadFrom(ctx context.Context, c *http.Client, url string, target afero.File, offset int64) (int64, error) {
+	body, err := httpGetFrom(ctx, c, url, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	return io.Copy(io.NewOffsetWriter(target, offset), body)
+}
+
+// httpDownloadChecksum writes the checksum file at the given url to target or returns the checksum contained in it if target is nil.
+func httpDownloadChecksum(ctx context.Context, c *http.Client, url string, target *afero.File) (string, error) {
+	body, err := httpGet(ctx, c, url)
+	if err != nil {
+		return "", fmt.Errorf("error downloading checksum:%w", err)
+	}
+	defer body.Close()
+
+	if target != nil {
+		_, err = io.Copy(*target, body)
+		if err != nil {
+			return "", fmt.Errorf("error downloading checksum:%w", err)
+		}
+		return "", nil
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("error downloading checksum:%w", err)
+	}
+
+	return parseChecksumFile(content)
+}
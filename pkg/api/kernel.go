@@ -3,17 +3,23 @@ package api
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/afero"
 )
 
 type Kernel struct {
-	SubPath string
-	URL     string
-	Size    int64
+	SubPath      string
+	URL          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	// MD5Available is set for kernels the origin provides an md5 checksum for
+	MD5Available bool
+	// References is the amount of partitions booting this kernel
+	References int
 }
 
 func (k Kernel) GetName() string {
@@ -28,31 +34,56 @@ func (k Kernel) GetSize() int64 {
 	return k.Size
 }
 
+func (k Kernel) GetSource() string {
+	return k.URL
+}
+
+func (k Kernel) GetLastModified() time.Time {
+	return k.LastModified
+}
+
+func (k Kernel) GetETag() string {
+	return k.ETag
+}
+
 func (k Kernel) HasMD5() bool {
-	return false
+	return k.MD5Available
 }
 
 func (k Kernel) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
-	return "", nil
-}
+	if !k.MD5Available {
+		return "", nil
+	}
 
-func (k Kernel) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
-	req, err := http.NewRequest(http.MethodGet, k.URL, nil)
+	checksum, err := httpDownloadChecksum(ctx, c, k.URL+".md5", target)
 	if err != nil {
-		return 0, fmt.Errorf("unable to create get request:%w", err)
+		return "", fmt.Errorf("kernel md5 download error:%w", err)
 	}
 
-	req = req.WithContext(ctx)
+	return checksum, nil
+}
 
-	resp, err := c.Do(req)
+func (k Kernel) HasSHA256() bool {
+	return false
+}
+
+func (k Kernel) DownloadSHA256(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	return "", nil
+}
+
+func (k Kernel) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	n, err := httpDownload(ctx, c, k.URL, target)
 	if err != nil {
 		return 0, fmt.Errorf("kernel download error:%w", err)
 	}
-	defer resp.Body.Close()
 
-	n, err := io.Copy(target, resp.Body)
+	return n, nil
+}
+
+func (k Kernel) DownloadFrom(ctx context.Context, target afero.File, offset int64, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	n, err := httpDownloadFrom(ctx, c, k.URL, target, offset)
 	if err != nil {
-		return 0, fmt.Errorf("kernel download error:%w", err)
+		return n, fmt.Errorf("kernel download error:%w", err)
 	}
 
 	return n, nil
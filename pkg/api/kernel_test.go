@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernel_DownloadMD5(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metal-kernel.md5":
+			_, _ = w.Write([]byte("8b1a9953c4611296a827abf8c47804d7  metal-kernel"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	k := Kernel{URL: ts.URL + "/metal-kernel", MD5Available: true}
+	md5, err := k.DownloadMD5(context.Background(), nil, http.DefaultClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "8b1a9953c4611296a827abf8c47804d7", md5)
+
+	k = Kernel{URL: ts.URL + "/other-kernel", MD5Available: true}
+	_, err = k.DownloadMD5(context.Background(), nil, http.DefaultClient, nil)
+	require.Error(t, err)
+}
+
+func TestKernel_DownloadFrom(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metal-kernel":
+			http.ServeContent(w, r, "metal-kernel", time.Time{}, strings.NewReader("metal-kernel"))
+		default:
+			// ignores the range
+			_, _ = w.Write([]byte("metal-kernel"))
+		}
+	}))
+	defer ts.Close()
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/partial", []byte("metal-"), 0644))
+	f, err := fs.OpenFile("/partial", os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+
+	k := Kernel{URL: ts.URL + "/metal-kernel"}
+	n, err := k.DownloadFrom(context.Background(), f, 6, http.DefaultClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), n)
+
+	got, err := afero.ReadFile(fs, "/partial")
+	require.NoError(t, err)
+	assert.Equal(t, "metal-kernel", string(got))
+
+	k = Kernel{URL: ts.URL + "/other-kernel"}
+	_, err = k.DownloadFrom(context.Background(), f, 6, http.DefaultClient, nil)
+	require.ErrorIs(t, err, ErrRangeNotSupported)
+}
@@ -2,13 +2,17 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/metal-stack/metal-go/api/models"
@@ -21,21 +25,53 @@ type OS struct {
 	ApiRef     models.V1ImageResponse
 	ImageRef   s3.Object
 	MD5Ref     s3.Object
+	SHA256Ref  s3.Object
 	BucketKey  string
 	BucketName string
+	Deltas     []Delta
+	// OriginAbsent is set for images referenced by the metal-api that are not contained in the image store
+	OriginAbsent bool
+
+	// ViaHTTP is set for images synced over http from their url instead of the image store,
+	// Size, MD5Missing, SHA256Available and LastModified are only considered for those images
+	ViaHTTP         bool
+	Size            int64
+	MD5Missing      bool
+	SHA256Available bool
+	LastModified    time.Time
+}
+
+// Delta is a binary patch in bsdiff format published by the origin, which reconstructs an image from an older base image.
+type Delta struct {
+	BaseSubPath string
+	Ref         s3.Object
 }
+
 type OSImagesByVersion map[string][]OS
 type OSImagesByOS map[string]OSImagesByVersion
 
+// SortOSImagesByName sorts the images by name and ascending version, images without version are sorted last.
 func SortOSImagesByName(imgs []OS) {
 	sort.Slice(imgs, func(i, j int) bool {
 		if imgs[i].Name == imgs[j].Name {
+			if imgs[i].Version == nil || imgs[j].Version == nil {
+				return imgs[i].Version != nil && imgs[j].Version == nil
+			}
 			return imgs[i].Version.LessThan(imgs[j].Version)
 		}
 		return strings.Compare(imgs[i].Name, imgs[j].Name) < 0
 	})
 }
 
+// NewerThan returns true if the image has a newer version than the other image, images without version are
+// considered older than images with version.
+func (o OS) NewerThan(other OS) bool {
+	if o.Version == nil || other.Version == nil {
+		return o.Version != nil && other.Version == nil
+	}
+	return o.Version.GreaterThan(other.Version)
+}
+
 func (o *OS) MajorMinor() (string, error) {
 	if o.Version == nil {
 		return "", fmt.Errorf("image version is nil")
@@ -55,17 +91,87 @@ func (o OS) GetSubPath() string {
 }
 
 func (o OS) GetSize() int64 {
+	if o.ViaHTTP {
+		return o.Size
+	}
 	if o.ImageRef.Size == nil {
 		return 0
 	}
 	return *o.ImageRef.Size
 }
 
+// GetSource returns the url of images synced over http, the bucket and key in the image store otherwise.
+func (o OS) GetSource() string {
+	if o.ViaHTTP {
+		return o.ApiRef.URL
+	}
+	return "s3://" + o.BucketName + "/" + o.BucketKey
+}
+
+// GetETag returns the etag of the image in the image store, for single-part uploads it equals the md5 checksum.
+func (o OS) GetETag() string {
+	return strings.Trim(aws.StringValue(o.ImageRef.ETag), `"`)
+}
+
+// GetLastModified returns the modification time of the image in the image store.
+func (o OS) GetLastModified() time.Time {
+	if o.ViaHTTP {
+		return o.LastModified
+	}
+	return aws.TimeValue(o.ImageRef.LastModified)
+}
+
 func (o OS) HasMD5() bool {
-	return true
+	if o.OriginAbsent {
+		return false
+	}
+	if o.ViaHTTP {
+		return !o.MD5Missing
+	}
+	// images are expected to ship md5 checksums unless only a sha256 checksum was found
+	return o.MD5Ref.Key != nil || o.SHA256Ref.Key == nil
+}
+
+func (o OS) HasSHA256() bool {
+	if o.ViaHTTP {
+		return o.SHA256Available
+	}
+	return !o.OriginAbsent && o.SHA256Ref.Key != nil
+}
+
+func (o OS) DownloadSHA256(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	if o.ViaHTTP {
+		return httpDownloadChecksum(ctx, c, o.ApiRef.URL+".sha256", target)
+	}
+
+	if target != nil {
+		_, err := s3downloader.DownloadWithContext(ctx, *target, &s3.GetObjectInput{
+			Bucket: &o.BucketName,
+			Key:    o.SHA256Ref.Key,
+		})
+		if err != nil {
+			return "", fmt.Errorf("error downloading sha256 checksum of image: %s error:%w", o.BucketKey, err)
+		}
+		return "", nil
+	}
+
+	buff := &aws.WriteAtBuffer{}
+	_, err := s3downloader.DownloadWithContext(ctx, buff, &s3.GetObjectInput{
+		Bucket: &o.BucketName,
+		Key:    o.SHA256Ref.Key,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error downloading sha256 checksum of image: %s error:%w", o.BucketKey, err)
+	}
+
+	return parseChecksumFile(buff.Bytes())
 }
 
 func (o OS) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	if o.ViaHTTP {
+		return httpDownloadChecksum(ctx, c, o.ApiRef.URL+".md5", target)
+	}
+
 	if target != nil {
 		_, err := s3downloader.DownloadWithContext(ctx, *target, &s3.GetObjectInput{
 			Bucket: &o.BucketName,
@@ -94,7 +200,56 @@ func (o OS) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client,
 	return parts[0], nil
 }
 
+func (o OS) DownloadMD5Signature(ctx context.Context, c *http.Client, s3downloader *s3manager.Downloader) ([]byte, error) {
+	if o.ViaHTTP {
+		body, err := httpGet(ctx, c, o.ApiRef.URL+".md5"+ChecksumSignatureSuffix)
+		if errors.Is(err, errHTTPNotFound) {
+			return nil, ErrChecksumSignatureNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error downloading checksum signature of image: %s error:%w", o.BucketKey, err)
+		}
+		defer body.Close()
+
+		return io.ReadAll(body)
+	}
+
+	if o.MD5Ref.Key == nil {
+		return nil, ErrChecksumSignatureNotFound
+	}
+
+	buff := &aws.WriteAtBuffer{}
+	_, err := s3downloader.DownloadWithContext(ctx, buff, &s3.GetObjectInput{
+		Bucket: &o.BucketName,
+		Key:    aws.String(*o.MD5Ref.Key + ChecksumSignatureSuffix),
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+			return nil, ErrChecksumSignatureNotFound
+		}
+		return nil, fmt.Errorf("error downloading checksum signature of image: %s error:%w", o.BucketKey, err)
+	}
+
+	return buff.Bytes(), nil
+}
+
 func (o OS) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	if o.ViaHTTP {
+		body, err := httpGet(ctx, c, o.ApiRef.URL)
+		if err != nil {
+			return 0, fmt.Errorf("image download error:%w", err)
+		}
+		defer body.Close()
+
+		n, err := io.Copy(target, body)
+		if err != nil {
+			return 0, fmt.Errorf("image download error:%w", err)
+		}
+
+		return n, nil
+	}
+
 	n, err := s3downloader.DownloadWithContext(ctx, target, &s3.GetObjectInput{
 		Bucket: &o.BucketName,
 		Key:    &o.BucketKey,
@@ -105,3 +260,42 @@ func (o OS) Download(ctx context.Context, target afero.File, c *http.Client, s3d
 
 	return n, nil
 }
+
+func (o OS) DownloadFrom(ctx context.Context, target afero.File, offset int64, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	if o.ViaHTTP {
+		n, err := httpDownloadFrom(ctx, c, o.ApiRef.URL, target, offset)
+		if err != nil {
+			return n, fmt.Errorf("image download error:%w", err)
+		}
+		return n, nil
+	}
+
+	// the downloader writes a range relative to the start of the range
+	n, err := s3downloader.DownloadWithContext(ctx, io.NewOffsetWriter(target, offset), &s3.GetObjectInput{
+		Bucket: &o.BucketName,
+		Key:    &o.BucketKey,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			return n, fmt.Errorf("image download error:%w", ErrRangeNotSupported)
+		}
+		return n, fmt.Errorf("image download error:%w", err)
+	}
+
+	return n, nil
+}
+
+func (o OS) DownloadDelta(ctx context.Context, d Delta, s3downloader *s3manager.Downloader) ([]byte, error) {
+	buff := &aws.WriteAtBuffer{}
+	_, err := s3downloader.DownloadWithContext(ctx, buff, &s3.GetObjectInput{
+		Bucket: &o.BucketName,
+		Key:    d.Ref.Key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error downloading delta of image: %s error:%w", o.BucketKey, err)
+	}
+
+	return buff.Bytes(), nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/metal-stack/metal-go/api/models"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOS_DownloadViaHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.tar.lz4":
+			_, _ = w.Write([]byte("image"))
+		case "/img.tar.lz4.md5":
+			_, _ = w.Write([]byte("78805a221a988e79ef3f42d7c5bfd418  img.tar.lz4"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	o := OS{
+		ApiRef:  models.V1ImageResponse{URL: ts.URL + "/img.tar.lz4"},
+		ViaHTTP: true,
+		Size:    5,
+	}
+
+	assert.Equal(t, int64(5), o.GetSize())
+
+	md5, err := o.DownloadMD5(context.Background(), nil, http.DefaultClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "78805a221a988e79ef3f42d7c5bfd418", md5)
+
+	_, err = o.DownloadMD5Signature(context.Background(), http.DefaultClient, nil)
+	require.ErrorIs(t, err, ErrChecksumSignatureNotFound)
+
+	fs := afero.NewMemMapFs()
+	f, err := fs.Create("/img.tar.lz4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	n, err := o.Download(context.Background(), f, http.DefaultClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	content, err := afero.ReadFile(fs, "/img.tar.lz4")
+	require.NoError(t, err)
+	assert.Equal(t, "image", string(content))
+}
+
+func TestSortOSImagesByNameNilVersion(t *testing.T) {
+	imgs := []OS{
+		{Name: "ubuntu", BucketKey: "unversioned"},
+		{Name: "ubuntu", BucketKey: "20.04.20201026", Version: semver.MustParse("20.04.20201026")},
+		{Name: "debian", BucketKey: "unversioned-debian"},
+		{Name: "ubuntu", BucketKey: "20.04.20201024", Version: semver.MustParse("20.04.20201024")},
+	}
+
+	require.NotPanics(t, func() { SortOSImagesByName(imgs) })
+
+	var got []string
+	for _, img := range imgs {
+		got = append(got, img.BucketKey)
+	}
+	assert.Equal(t, []string{"unversioned-debian", "20.04.20201024", "20.04.20201026", "unversioned"}, got)
+
+	assert.True(t, imgs[1].NewerThan(imgs[3]))
+	assert.False(t, imgs[3].NewerThan(imgs[1]))
+	assert.False(t, imgs[3].NewerThan(imgs[3]))
+}
@@ -0,0 +1,23 @@
+package api
+
+const (
+	// ArtifactPresent means the artifact is cached and matches its checksum
+	ArtifactPresent = "present"
+	// ArtifactMissing means the artifact is not cached
+	ArtifactMissing = "missing"
+	// ArtifactMismatch means the cached artifact does not match its checksum
+	ArtifactMismatch = "mismatch"
+)
+
+// PartitionBootArtifacts are the sub paths of the artifacts a partition requires for PXE booting.
+type PartitionBootArtifacts struct {
+	ID               string
+	KernelSubPath    string
+	BootImageSubPath string
+}
+
+// PartitionReadiness is the cache status of the boot artifacts of a partition.
+type PartitionReadiness struct {
+	Kernel    string `json:"kernel"`
+	BootImage string `json:"boot-image"`
+}
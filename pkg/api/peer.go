@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	// nolint
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/afero"
+)
+
+// ManifestEntry describes a file served by a cache, source and sync time are only known for files downloaded
+// since the cache manifest was introduced.
+type ManifestEntry struct {
+	Name     string     `json:"name"`
+	SubPath  string     `json:"subpath"`
+	Size     int64      `json:"size"`
+	MD5      string     `json:"md5"`
+	Source   string     `json:"source,omitempty"`
+	SyncedAt *time.Time `json:"synced_at,omitempty"`
+}
+
+// PeerFile is a file replicated from the cache of a peer instead of the origin.
+type PeerFile struct {
+	SubPath string
+	URL     string
+	Size    int64
+	MD5     string
+}
+
+func (p PeerFile) GetName() string {
+	return p.SubPath
+}
+
+func (p PeerFile) GetSource() string {
+	return p.URL
+}
+
+func (p PeerFile) GetSubPath() string {
+	return p.SubPath
+}
+
+func (p PeerFile) GetSize() int64 {
+	return p.Size
+}
+
+func (p PeerFile) HasMD5() bool {
+	return p.MD5 != ""
+}
+
+func (p PeerFile) DownloadMD5(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	if target != nil {
+		_, err := fmt.Fprintf(*target, "%s  %s\n", p.MD5, path.Base(p.SubPath))
+		if err != nil {
+			return "", fmt.Errorf("peer md5 write error:%w", err)
+		}
+		return "", nil
+	}
+
+	return p.MD5, nil
+}
+
+func (p PeerFile) HasSHA256() bool {
+	return false
+}
+
+func (p PeerFile) DownloadSHA256(ctx context.Context, target *afero.File, c *http.Client, s3downloader *s3manager.Downloader) (string, error) {
+	return "", nil
+}
+
+func (p PeerFile) Download(ctx context.Context, target afero.File, c *http.Client, s3downloader *s3manager.Downloader) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create get request:%w", err)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("peer download error:%w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer download of %s did not return OK", p.URL)
+	}
+
+	hash := md5.New() // nolint
+	n, err := io.Copy(io.MultiWriter(target, hash), resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("peer download error:%w", err)
+	}
+
+	if p.MD5 != "" && fmt.Sprintf("%x", hash.Sum(nil)) != p.MD5 {
+		return 0, fmt.Errorf("checksum of file replicated from peer does not match: %s", p.SubPath)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	bsdiffMagic = "BSDIFF40"
+	// bspatchChunkSize is the amount of bytes of the old file and the diff block held in memory at once
+	bspatchChunkSize = 64 * 1024
+)
+
+// BSPatch applies a patch in bsdiff 4.x format to the old file contents and writes the new file contents to w,
+// the amount of written bytes is returned. the old file is read in chunks and the new file is written as it is
+// reconstructed, such that neither is held in memory. patches producing more than maxNewSize bytes are refused
+// if maxNewSize is positive.
+func BSPatch(old io.ReaderAt, oldSize int64, patch []byte, w io.Writer, maxNewSize int64) (int64, error) {
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return 0, fmt.Errorf("patch is not in bsdiff format")
+	}
+
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > int64(len(patch)) {
+		return 0, fmt.Errorf("patch header is corrupt")
+	}
+	if maxNewSize > 0 && newSize > maxNewSize {
+		return 0, fmt.Errorf("patch produces %d bytes but %d bytes are expected", newSize, maxNewSize)
+	}
+
+	ctrl := bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	var (
+		buf     = make([]byte, 24)
+		diffBuf = make([]byte, bspatchChunkSize)
+		oldBuf  = make([]byte, bspatchChunkSize)
+	)
+
+	var oldPos, newPos int64
+	for newPos < newSize {
+		_, err := io.ReadFull(ctrl, buf)
+		if err != nil {
+			return newPos, fmt.Errorf("error reading patch control block:%w", err)
+		}
+
+		addLen, copyLen, seek := offtin(buf[0:8]), offtin(buf[8:16]), offtin(buf[16:24])
+		if addLen < 0 || copyLen < 0 || newPos+addLen > newSize {
+			return newPos, fmt.Errorf("patch control block is corrupt")
+		}
+
+		for done := int64(0); done < addLen; {
+			chunk := min(addLen-done, bspatchChunkSize)
+
+			d := diffBuf[:chunk]
+			_, err = io.ReadFull(diff, d)
+			if err != nil {
+				return newPos, fmt.Errorf("error reading patch diff block:%w", err)
+			}
+
+			o := oldBuf[:chunk]
+			err = readOld(old, oldSize, oldPos+done, o)
+			if err != nil {
+				return newPos, fmt.Errorf("error reading old file:%w", err)
+			}
+
+			for i := range d {
+				d[i] += o[i]
+			}
+
+			_, err = w.Write(d)
+			if err != nil {
+				return newPos, fmt.Errorf("error writing new file:%w", err)
+			}
+
+			done += chunk
+			newPos += chunk
+		}
+
+		oldPos += addLen
+
+		if newPos+copyLen > newSize {
+			return newPos, fmt.Errorf("patch control block is corrupt")
+		}
+
+		n, err := io.CopyN(w, extra, copyLen)
+		newPos += n
+		if err != nil {
+			return newPos, fmt.Errorf("error reading patch extra block:%w", err)
+		}
+
+		oldPos += seek
+	}
+
+	return newPos, nil
+}
+
+// readOld fills p with the old file contents at the given position, bytes outside of the old file are zero.
+func readOld(old io.ReaderAt, oldSize, pos int64, p []byte) error {
+	clear(p)
+
+	start := max(pos, 0)
+	end := min(pos+int64(len(p)), oldSize)
+	if start >= end {
+		return nil
+	}
+
+	_, err := old.ReadAt(p[start-pos:end-pos], start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// offtin decodes the sign-magnitude encoded integers used by bsdiff.
+func offtin(b []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(b) & 0x7fffffffffffffff)
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBSPatch(t *testing.T) {
+	header := func(ctrlLen, diffLen, newSize int64) []byte {
+		patch := []byte(bsdiffMagic)
+		patch = binary.LittleEndian.AppendUint64(patch, uint64(ctrlLen))
+		patch = binary.LittleEndian.AppendUint64(patch, uint64(diffLen))
+		patch = binary.LittleEndian.AppendUint64(patch, uint64(newSize))
+		return patch
+	}
+
+	tests := []struct {
+		name       string
+		patch      []byte
+		maxNewSize int64
+		wantErr    string
+	}{
+		{
+			name:    "not a bsdiff patch",
+			patch:   []byte("BSDIFF"),
+			wantErr: "patch is not in bsdiff format",
+		},
+		{
+			name:    "blocks exceed the patch",
+			patch:   header(100, 0, 10),
+			wantErr: "patch header is corrupt",
+		},
+		{
+			name:       "new file exceeds the expected size",
+			patch:      header(0, 0, 1<<50),
+			maxNewSize: 330,
+			wantErr:    "patch produces 1125899906842624 bytes but 330 bytes are expected",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := BSPatch(bytes.NewReader(nil), 0, tt.patch, &out, tt.maxNewSize)
+			require.EqualError(t, err, tt.wantErr)
+			assert.Zero(t, n)
+			assert.Zero(t, out.Len())
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloader serves a tls certificate from the given files and reloads it when the files change, such that
+// a rotated certificate is picked up without a restart.
+type CertReloader struct {
+	logger   *slog.Logger
+	certFile string
+	keyFile  string
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// mutex guards the modification times of the loaded files
+	mutex   sync.Mutex
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func NewCertReloader(logger *slog.Logger, certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		logger:   logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.load(certMod, keyMod)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate, it serves the certificate loaded last without
+// touching the files, such that handshakes do not contend on the file system.
+func (r *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Watch checks the files for changes in the given interval until the context is done.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reload()
+		}
+	}
+}
+
+// reload loads the certificate if the files changed, if a changed certificate cannot be loaded (e.g. because only
+// one of the files was rotated yet) the previous certificate is served.
+func (r *CertReloader) reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		r.logger.Warn("unable to check tls certificate for changes, serving previous certificate", "error", err)
+		return
+	}
+
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return
+	}
+
+	err = r.load(certMod, keyMod)
+	if err != nil {
+		r.logger.Warn("unable to reload tls certificate, serving previous certificate", "error", err)
+		return
+	}
+
+	r.logger.Info("reloaded tls certificate", "cert", r.certFile)
+}
+
+func (r *CertReloader) load(certMod, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load tls certificate:%w", err)
+	}
+
+	r.cert.Store(&cert)
+	r.certMod = certMod
+	r.keyMod = keyMod
+
+	return nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to stat tls certificate:%w", err)
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to stat tls key:%w", err)
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
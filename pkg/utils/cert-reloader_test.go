@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCert(t *testing.T, dir, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := path.Join(dir, "tls.crt")
+	keyFile := path.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func commonName(t *testing.T, r *CertReloader) string {
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	writeTestCert(t, dir, "first", now.Add(-time.Minute))
+
+	r, err := NewCertReloader(slog.Default(), path.Join(dir, "tls.crt"), path.Join(dir, "tls.key"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, r))
+
+	// the files are only checked for changes by the reload
+	writeTestCert(t, dir, "rotated", now)
+	assert.Equal(t, "first", commonName(t, r))
+	r.reload()
+	assert.Equal(t, "rotated", commonName(t, r))
+
+	// a broken rotation keeps the previous certificate
+	require.NoError(t, os.WriteFile(path.Join(dir, "tls.key"), []byte("broken"), 0600))
+	require.NoError(t, os.Chtimes(path.Join(dir, "tls.key"), now.Add(time.Minute), now.Add(time.Minute)))
+	r.reload()
+	assert.Equal(t, "rotated", commonName(t, r))
+
+	_, err = NewCertReloader(slog.Default(), path.Join(dir, "missing.crt"), path.Join(dir, "tls.key"))
+	require.Error(t, err)
+}
+
+func TestCertReloader_Watch(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	writeTestCert(t, dir, "first", now.Add(-time.Minute))
+
+	r, err := NewCertReloader(slog.Default(), path.Join(dir, "tls.crt"), path.Join(dir, "tls.key"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	writeTestCert(t, dir, "rotated", now)
+	assert.Eventually(t, func() bool {
+		return commonName(t, r) == "rotated"
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	// nolint
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/spf13/afero"
+)
+
+// FileMD5 returns the hex encoded md5 checksum of the given file.
+func FileMD5(fs afero.Fs, filePath string) (string, error) {
+	return fileChecksum(fs, filePath, md5.New()) // nolint
+}
+
+// FileSHA256 returns the hex encoded sha256 checksum of the given file.
+func FileSHA256(fs afero.Fs, filePath string) (string, error) {
+	return fileChecksum(fs, filePath, sha256.New())
+}
+
+func fileChecksum(fs afero.Fs, filePath string, h hash.Hash) (string, error) {
+	file, err := fs.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -17,5 +17,5 @@ func (c *CronLogger) Info(msg string, keysAndValues ...interface{}) {
 }
 
 func (c *CronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
-	c.l.Error(msg, keysAndValues...)
+	c.l.Error(msg, append([]interface{}{"error", err}, keysAndValues...)...)
 }
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronLogger(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCronLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	c.Info("run", "now", "10:00", "entry", 1)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, "run", got["msg"])
+	assert.Equal(t, "10:00", got["now"])
+	assert.Equal(t, float64(1), got["entry"])
+
+	buf.Reset()
+	c.Error(errors.New("job failed"), "panic", "entry", 2)
+
+	got = nil
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, "ERROR", got["level"])
+	assert.Equal(t, "job failed", got["error"])
+	assert.Equal(t, float64(2), got["entry"])
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// CompressionSuffixes are the file suffixes of compressed artifacts that can be decompressed while serving.
+var CompressionSuffixes = []string{".lz4", ".zst"}
+
+// NewDecompressor returns a reader that decompresses the given reader according to the compression suffix.
+func NewDecompressor(r io.Reader, suffix string) (io.ReadCloser, error) {
+	switch suffix {
+	case ".lz4":
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case ".zst":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create zstd reader:%w", err)
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression suffix %q", suffix)
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// MetadataSuffixes are the file suffixes of small metadata files that are worth compressing while serving.
+var MetadataSuffixes = []string{".md5", ".sha256"}
+
+// IsMetadataFile returns true if the given path is a metadata file like a checksum.
+func IsMetadataFile(p string) bool {
+	for _, suffix := range MetadataSuffixes {
+		if strings.HasSuffix(p, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GzipHandler compresses the response of the given handler if the client accepts gzip. It is meant for small
+// metadata responses only, images are already compressed and must be served as they are.
+func GzipHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// compressing a range of the content would break the offsets the client asked for
+		if !acceptsGzip(r) || r.Header.Get("Range") != "" {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+
+		next(gw, r)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, _, _ = strings.Cut(enc, ";")
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response body, the gzip writer is only created if a body is written
+// such that responses without body like redirects or not modified stay untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if !g.wroteHeader {
+		g.wroteHeader = true
+		if code == http.StatusOK {
+			g.Header().Del("Content-Length")
+			g.Header().Set("Content-Encoding", "gzip")
+			g.gz = gzip.NewWriter(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !g.wroteHeader {
+		// the content type would otherwise be detected from the compressed data
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(data)
+	}
+	return g.gz.Write(data)
+}
+
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		_ = g.gz.Close()
+	}
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NewHTTPTransport returns a transport for the requests to the origins. the caches periodically fetch from a
+// handful of hosts, so a few idle connections per host are kept for reuse and closed after the idle timeout.
+// requests go through the given proxy, the proxy is taken from the environment if it is nil.
+func NewHTTPTransport(proxy *url.URL, maxIdleConnsPerHost int, idleConnTimeout, tlsHandshakeTimeout time.Duration) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	t.IdleConnTimeout = idleConnTimeout
+	t.TLSHandshakeTimeout = tlsHandshakeTimeout
+	return t
+}
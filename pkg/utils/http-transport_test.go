@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	// the stub proxy answers the requests itself instead of forwarding them to the origin
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		_, _ = w.Write([]byte("kernel"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	transport := NewHTTPTransport(proxyURL, 4, 90*time.Second, 10*time.Second)
+	assert.Equal(t, 4, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 10*time.Second, transport.TLSHandshakeTimeout)
+
+	c := &http.Client{Transport: transport}
+
+	resp, err := c.Get("http://images.metal-stack.io/metal-kernel")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "kernel", string(body))
+	assert.Equal(t, []string{"http://images.metal-stack.io/metal-kernel"}, proxied)
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"strings"
+)
+
+// LatestLinkName is the name of the links next to the version directories of an os major.minor, they point to the
+// directory of the newest cached version and therefore change with every new version.
+const LatestLinkName = "latest"
+
+// IsLatestPath returns true if the given slash separated path passes through a latest link.
+func IsLatestPath(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == LatestLinkName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/spf13/afero"
+)
+
+// VerifyLZ4 decodes the given lz4 file without keeping the decompressed output to validate its frame structure.
+func VerifyLZ4(fs afero.Fs, filePath string) error {
+	file, err := fs.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(io.Discard, lz4.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("lz4 stream of %s is corrupt:%w", filePath, err)
+	}
+
+	return nil
+}
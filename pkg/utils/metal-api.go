@@ -14,18 +14,27 @@ import (
 // ubuntu-19.04                 os: ubuntu version: 19.04
 // ubuntu-19.04.20200408        os: ubuntu version: 19.04.20200408
 // ubuntu-small-19.04.20200408  os: ubuntu-small version: 19.04.20200408
+//
+// versions containing dashes, e.g. pre-releases, are found by extending the version with the preceding parts
+// until it parses, ids that parse with the last part as version are therefore parsed as before:
+// ubuntu-20.04.20200408-rc1    os: ubuntu version: 20.04.20200408-rc1
 func GetOsAndSemver(id string) (string, *semver.Version, error) {
 	imageParts := strings.Split(id, "-")
 	if len(imageParts) < 2 {
 		return "", nil, fmt.Errorf("image does not contain a version")
 	}
 
-	parts := len(imageParts) - 1
-	os := strings.Join(imageParts[:parts], "-")
-	version := strings.Join(imageParts[parts:], "")
-	v, err := semver.NewVersion(version)
-	if err != nil {
-		return "", nil, err
+	var err error
+	for parts := len(imageParts) - 1; parts > 0; parts-- {
+		os := strings.Join(imageParts[:parts], "-")
+		version := strings.Join(imageParts[parts:], "-")
+
+		var v *semver.Version
+		v, err = semver.NewVersion(version)
+		if err == nil {
+			return os, v, nil
+		}
 	}
-	return os, v, nil
+
+	return "", nil, err
 }
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOsAndSemver(t *testing.T) {
+	tests := []struct {
+		id          string
+		wantOS      string
+		wantVersion string
+		wantErr     bool
+	}{
+		{
+			id:          "ubuntu-19.04",
+			wantOS:      "ubuntu",
+			wantVersion: "19.4.0",
+		},
+		{
+			id:          "ubuntu-20.04.20200408",
+			wantOS:      "ubuntu",
+			wantVersion: "20.4.20200408",
+		},
+		{
+			id:          "ubuntu-small-20.04.20200408",
+			wantOS:      "ubuntu-small",
+			wantVersion: "20.4.20200408",
+		},
+		{
+			id:          "firewall-ubuntu-2.0.20201025",
+			wantOS:      "firewall-ubuntu",
+			wantVersion: "2.0.20201025",
+		},
+		{
+			id:          "ubuntu-small-hardened-20.04.20200408",
+			wantOS:      "ubuntu-small-hardened",
+			wantVersion: "20.4.20200408",
+		},
+		{
+			id:          "debian-12.0.20231016-rc1",
+			wantOS:      "debian",
+			wantVersion: "12.0.20231016-rc1",
+		},
+		{
+			id:          "ubuntu-22.04.20231016-pre.1",
+			wantOS:      "ubuntu",
+			wantVersion: "22.4.20231016-pre.1",
+		},
+		{
+			id:      "ubuntu",
+			wantErr: true,
+		},
+		{
+			id:      "ubuntu-latest",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.id, func(t *testing.T) {
+			os, v, err := GetOsAndSemver(tt.id)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantOS, os)
+			assert.Equal(t, tt.wantVersion, v.String())
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// OriginProxy streams requests for files missing in the cache from the origin instead of redirecting the client there.
+// it adds headers to the proxied requests, which allows serving files from origins that require authentication.
+type OriginProxy struct {
+	paths []string
+	proxy *httputil.ReverseProxy
+}
+
+// NewOriginProxy returns a proxy to the given origin, the proxied requests are sent through the given transport such
+// that they use the same proxy, timeouts and user agent as the sync. the default transport is used if it is nil.
+func NewOriginProxy(origin *url.URL, paths []string, headers map[string]string, transport http.RoundTripper) *OriginProxy {
+	return &OriginProxy{
+		paths: paths,
+		proxy: &httputil.ReverseProxy{
+			Transport: transport,
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(origin)
+				for k, v := range headers {
+					r.Out.Header.Set(k, v)
+				}
+			},
+		},
+	}
+}
+
+// Matches returns true if misses for the given url path should be proxied.
+func (o *OriginProxy) Matches(urlPath string) bool {
+	for _, p := range o.paths {
+		if strings.HasPrefix(urlPath, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OriginProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.proxy.ServeHTTP(w, r)
+}
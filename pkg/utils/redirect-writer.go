@@ -2,6 +2,7 @@ package utils
 
 import (
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -9,17 +10,21 @@ const (
 	notFoundResp = "404 page not found"
 )
 
-// HTTPRedirectResponseWriter redirects to the HTTPS address of the requested resource on 404.
+// HTTPRedirectResponseWriter redirects to the HTTPS address of the requested resource on 404, or to the
+// resource at the given origin if set.
 type HTTPRedirectResponseWriter struct {
 	http.ResponseWriter
-	status int
-	req    *http.Request
+	status  int
+	written int64
+	req     *http.Request
+	origin  *url.URL
 }
 
-func NewHTTPRedirectResponseWriter(wrap http.ResponseWriter, req *http.Request) *HTTPRedirectResponseWriter {
+func NewHTTPRedirectResponseWriter(wrap http.ResponseWriter, req *http.Request, origin *url.URL) *HTTPRedirectResponseWriter {
 	return &HTTPRedirectResponseWriter{
 		ResponseWriter: wrap,
 		req:            req,
+		origin:         origin,
 	}
 }
 
@@ -31,21 +36,40 @@ func (h *HTTPRedirectResponseWriter) WriteHeader(code int) {
 	}
 
 	h.status = http.StatusTemporaryRedirect
-	h.req.URL.Scheme = "https"
-	h.req.URL.Host = h.req.Host
-	h.ResponseWriter.Header().Add("Location", h.req.URL.String())
+	h.ResponseWriter.Header().Add("Location", h.location())
 	h.ResponseWriter.WriteHeader(http.StatusTemporaryRedirect)
 }
 
+func (h *HTTPRedirectResponseWriter) location() string {
+	if h.origin == nil {
+		h.req.URL.Scheme = "https"
+		h.req.URL.Host = h.req.Host
+		return h.req.URL.String()
+	}
+
+	u := *h.origin
+	u.Path = strings.TrimSuffix(u.Path, "/") + h.req.URL.Path
+	u.RawPath = ""
+	u.RawQuery = h.req.URL.RawQuery
+	return u.String()
+}
+
 func (h *HTTPRedirectResponseWriter) Write(data []byte) (int, error) {
 	resp := string(data)
 	if strings.Contains(resp, notFoundResp) {
 		mod := strings.Replace(resp, notFoundResp, "307 redirect due to cache miss", -1)
 		return h.ResponseWriter.Write([]byte(mod))
 	}
-	return h.ResponseWriter.Write(data)
+	n, err := h.ResponseWriter.Write(data)
+	h.written += int64(n)
+	return n, err
 }
 
 func (h *HTTPRedirectResponseWriter) GetStatus() int {
 	return h.status
 }
+
+// GetWritten returns the amount of body bytes written to the client.
+func (h *HTTPRedirectResponseWriter) GetWritten() int64 {
+	return h.written
+}
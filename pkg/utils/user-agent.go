@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"net/http"
+)
+
+// UserAgentTransport sets the user agent of outgoing requests that do not set one themselves, such that the
+// operators of an origin can identify (and rate-limit) the traffic of the caches.
+type UserAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+// NewUserAgentTransport wraps the given transport, the default transport is used if base is nil.
+func NewUserAgentTransport(base http.RoundTripper, userAgent string) *UserAgentTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &UserAgentTransport{
+		base:      base,
+		userAgent: userAgent,
+	}
+}
+
+func (t *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent == "" || req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// a round tripper must not modify the given request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+
+	return t.base.RoundTrip(req)
+}
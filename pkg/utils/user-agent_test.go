@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserAgentTransport(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		userAgent string
+		header    string
+		want      string
+	}{
+		{
+			name:      "user agent is set",
+			userAgent: "metal-image-cache-sync/v0.1.0",
+			want:      "metal-image-cache-sync/v0.1.0",
+		},
+		{
+			name:      "user agent of the request is kept",
+			userAgent: "metal-image-cache-sync/v0.1.0",
+			header:    "curl/8.0.0",
+			want:      "curl/8.0.0",
+		},
+		{
+			name: "go default without user agent",
+			want: "Go-http-client/1.1",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := &http.Client{Transport: NewUserAgentTransport(nil, tt.userAgent)}
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			require.NoError(t, err)
+			if tt.header != "" {
+				req.Header.Set("User-Agent", tt.header)
+			}
+
+			resp, err := c.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.header, req.Header.Get("User-Agent"), "the request must not be modified")
+		})
+	}
+}